@@ -0,0 +1,279 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/reports"
+)
+
+const (
+	// Prefix all API routes are served under
+	Prefix = "/api/v1/"
+
+	defaultLimit = 100
+	maxLimit     = 1000
+
+	defaultExpirationsDays = 365
+	maxExpirationsDays     = 5 * 365
+)
+
+// page is the envelope of paginated responses
+type page struct {
+	Items      interface{} `json:"items"`
+	Limit      int         `json:"limit"`
+	Offset     int         `json:"offset"`
+	Total      int         `json:"total"`
+	NextOffset *int        `json:"next_offset"`
+}
+
+// errBadRequest wraps errors caused by invalid request parameters
+type errBadRequest struct {
+	error
+}
+
+// parseTime accepts RFC3339 times, or dates
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// parseFilter builds a filter out of the query string
+// from, to: time range, as RFC3339 or date
+// family, region: exact match
+// tag: key=value, can be repeated
+// limit, offset: pagination
+func parseFilter(query url.Values) (*postgres.Filter, error) {
+	filter := &postgres.Filter{
+		Family: query.Get("family"),
+		Region: query.Get("region"),
+		Limit:  defaultLimit,
+		Tags:   map[string]string{},
+	}
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = parseTime(v); err != nil {
+			return nil, errBadRequest{fmt.Errorf("invalid from: %v", err)}
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = parseTime(v); err != nil {
+			return nil, errBadRequest{fmt.Errorf("invalid to: %v", err)}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			return nil, errBadRequest{fmt.Errorf("limit must be between 1 and %d", maxLimit)}
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			return nil, errBadRequest{fmt.Errorf("offset must be a non negative number")}
+		}
+	}
+	for _, tag := range query["tag"] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errBadRequest{fmt.Errorf("invalid tag %q, expected key=value", tag)}
+		}
+		filter.Tags[kv[0]] = kv[1]
+	}
+	return filter, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed writing API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if _, ok := err.(errBadRequest); ok {
+		status = http.StatusBadRequest
+	} else {
+		log.WithError(err).Error("API request failed")
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writePage(w http.ResponseWriter, filter *postgres.Filter, items interface{}, total int) {
+	p := page{Items: items, Limit: filter.Limit, Offset: filter.Offset, Total: total}
+	if next := filter.Offset + filter.Limit; next < total {
+		p.NextOffset = &next
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// listHandler serves a paginated list, select returns the items and the total number of matches
+// it is given the request context, cancelled when the client goes away
+func listHandler(selectFn func(context.Context, *postgres.Filter) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFilter(r.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		items, total, err := selectFn(r.Context(), filter)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writePage(w, filter, items, total)
+	}
+}
+
+// reservationsHandler serves /reservations, and /reservations/{id}/lineage
+func reservationsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix+"reservations"), "/")
+	if path == "" {
+		listHandler(func(ctx context.Context, filter *postgres.Filter) (interface{}, int, error) {
+			return postgres.SelectReservations(ctx, filter)
+		})(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] != "lineage" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	reservationID, err := uuid.Parse(parts[0])
+	if err != nil {
+		writeError(w, errBadRequest{fmt.Errorf("invalid reservation id: %v", err)})
+		return
+	}
+	lineage, err := reports.GetLineage(r.Context(), reservationID)
+	if err == reports.ErrReservationNotFound {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, lineage)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		if err := lineage.WriteDOT(w); err != nil {
+			log.WithError(err).Warn("Failed writing API response")
+		}
+	default:
+		writeError(w, errBadRequest{fmt.Errorf("format must be either json or dot")})
+	}
+}
+
+// expirationsHandler serves upcoming reservations and listing terms expirations, either as an
+// iCalendar feed or as CSV, days sets how far ahead to look
+func expirationsHandler(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days := defaultExpirationsDays
+		if v := r.URL.Query().Get("days"); v != "" {
+			var err error
+			if days, err = strconv.Atoi(v); err != nil || days < 1 || days > maxExpirationsDays {
+				writeError(w, errBadRequest{fmt.Errorf("days must be between 1 and %d", maxExpirationsDays)})
+				return
+			}
+		}
+		expirations, err := reports.GetExpirations(r.Context(), days)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if format == "ics" {
+			w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+			err = reports.WriteExpirationsICS(w, expirations)
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="expirations.csv"`)
+			err = reports.WriteExpirationsCSV(w, expirations)
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed writing API response")
+		}
+	}
+}
+
+// resaleHandler serves the marketplace resale advice, options default to reports.DefaultResaleOptions
+func resaleHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := reports.DefaultResaleOptions
+	var err error
+	if v := query.Get("days"); v != "" {
+		if options.Days, err = strconv.Atoi(v); err != nil {
+			writeError(w, errBadRequest{fmt.Errorf("invalid days: %v", err)})
+			return
+		}
+	}
+	for name, value := range map[string]*float64{
+		"discount":   &options.Discount,
+		"percentile": &options.Percentile,
+		"threshold":  &options.Threshold,
+	} {
+		if v := query.Get(name); v != "" {
+			if *value, err = strconv.ParseFloat(v, 64); err != nil {
+				writeError(w, errBadRequest{fmt.Errorf("invalid %s: %v", name, err)})
+				return
+			}
+		}
+	}
+	if err := options.Validate(); err != nil {
+		writeError(w, errBadRequest{err})
+		return
+	}
+	advice, err := reports.GetResaleAdvice(r.Context(), options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, advice)
+}
+
+// readOnly rejects any method other than GET and HEAD
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the read-only JSON API over the data stored in postgres
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle(Prefix+"instances", listHandler(func(ctx context.Context, filter *postgres.Filter) (interface{}, int, error) {
+		return postgres.SelectInstances(ctx, filter)
+	}))
+	mux.HandleFunc(Prefix+"reservations", reservationsHandler)
+	mux.HandleFunc(Prefix+"reservations/", reservationsHandler)
+	mux.Handle(Prefix+"listings", listHandler(func(ctx context.Context, filter *postgres.Filter) (interface{}, int, error) {
+		return postgres.SelectReservationsListings(ctx, filter)
+	}))
+	mux.Handle(Prefix+"spot-prices", listHandler(func(ctx context.Context, filter *postgres.Filter) (interface{}, int, error) {
+		return postgres.SelectSpotPrices(ctx, filter)
+	}))
+	mux.HandleFunc(Prefix+"resale", resaleHandler)
+	mux.Handle(Prefix+"expirations.ics", expirationsHandler("ics"))
+	mux.Handle(Prefix+"expirations.csv", expirationsHandler("csv"))
+
+	return readOnly(mux)
+}
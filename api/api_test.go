@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+func TestParseFilter(t *testing.T) {
+	query, _ := url.ParseQuery("from=2020-01-01&to=2020-02-01T12:00:00Z&family=m5&region=us-east-1&tag=team=core&tag=env=&limit=10&offset=20")
+	filter, err := parseFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.From.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) || !filter.To.Equal(time.Date(2020, 2, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("time range = %v - %v", filter.From, filter.To)
+	}
+	if filter.Family != "m5" || filter.Region != "us-east-1" || filter.Limit != 10 || filter.Offset != 20 {
+		t.Errorf("filter = %+v", filter)
+	}
+	if len(filter.Tags) != 2 || filter.Tags["team"] != "core" || filter.Tags["env"] != "" {
+		t.Errorf("tags = %v", filter.Tags)
+	}
+
+	filter, err = parseFilter(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Limit != defaultLimit || filter.Offset != 0 || !filter.From.IsZero() {
+		t.Errorf("default filter = %+v", filter)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, tt := range []string{
+		"from=yesterday",
+		"to=2020-13-01",
+		"limit=0",
+		"limit=1001",
+		"limit=ten",
+		"offset=-1",
+		"tag=team",
+		"tag==core",
+	} {
+		query, _ := url.ParseQuery(tt)
+		if _, err := parseFilter(query); err == nil {
+			t.Errorf("parseFilter(%q) succeeded", tt)
+		} else if _, ok := err.(errBadRequest); !ok {
+			t.Errorf("parseFilter(%q) = %v, want a bad request", tt, err)
+		}
+	}
+}
+
+func TestListHandlerPagination(t *testing.T) {
+	handler := listHandler(func(ctx context.Context, filter *postgres.Filter) (interface{}, int, error) {
+		return []int{filter.Offset}, 25, nil
+	})
+	for _, tt := range []struct {
+		query string
+		next  *int
+	}{
+		{"limit=10", intPtr(10)},
+		{"limit=10&offset=10", intPtr(20)},
+		{"limit=10&offset=20", nil},
+		{"limit=25", nil},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.query, w.Code)
+		}
+		var p struct {
+			Total      int  `json:"total"`
+			NextOffset *int `json:"next_offset"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Total != 25 {
+			t.Errorf("%s: total = %d, want 25", tt.query, p.Total)
+		}
+		if (p.NextOffset == nil) != (tt.next == nil) || (p.NextOffset != nil && *p.NextOffset != *tt.next) {
+			t.Errorf("%s: next_offset = %v, want %v", tt.query, p.NextOffset, tt.next)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/?limit=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandlerRejects(t *testing.T) {
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, Prefix + "instances", http.StatusMethodNotAllowed},
+		{http.MethodGet, Prefix + "reservations/not-a-uuid/lineage", http.StatusBadRequest},
+		{http.MethodGet, Prefix + "listings?tag=team", http.StatusBadRequest},
+		{http.MethodGet, Prefix + "spot-prices?tag==core", http.StatusBadRequest},
+		{http.MethodGet, Prefix + "reservations/4c1f4ab4-4f2b-4d7e-9a3e-1b0c7f7b1a9e", http.StatusNotFound},
+		{http.MethodGet, Prefix + "expirations.ics?days=0", http.StatusBadRequest},
+		{http.MethodGet, Prefix + "resale?percentile=high", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: error is not JSON", tt.method, tt.path)
+		}
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,186 @@
+package awsapi
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	requestsLabels = []string{"service", "operation"}
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_aws_requests_total",
+		Help: "Number of AWS API calls, by service, operation and result [success|error], once their retries are over",
+	},
+		append(requestsLabels, "result"))
+
+	attemptDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aws_audit_exporter_aws_request_attempt_duration_seconds",
+		Help:    "Duration of every attempt of AWS API calls",
+		Buckets: prometheus.DefBuckets,
+	},
+		requestsLabels)
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_aws_request_retries_total",
+		Help: "Number of AWS API calls attempts which were retries",
+	},
+		requestsLabels)
+
+	throttles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_aws_request_throttles_total",
+		Help: "Number of AWS API calls attempts which were throttled",
+	},
+		requestsLabels)
+
+	pages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_aws_request_pages_total",
+		Help: "Number of pages returned by paginated AWS API calls, over the paginated calls it is the pages per call",
+	},
+		requestsLabels)
+
+	paginatedCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_aws_paginated_calls_total",
+		Help: "Number of paginated AWS API calls, counted once their first page is returned",
+	},
+		requestsLabels)
+
+	rateLimitWait = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_aws_rate_limit_wait_seconds_total",
+		Help: "Time AWS API calls attempts waited for the client-side rate limit",
+	},
+		requestsLabels)
+)
+
+// RegisterAWSMetrics registers Prometheus metrics
+func RegisterAWSMetrics() {
+	prometheus.Register(requests)
+	prometheus.Register(attemptDuration)
+	prometheus.Register(retries)
+	prometheus.Register(throttles)
+	prometheus.Register(pages)
+	prometheus.Register(paginatedCalls)
+	prometheus.Register(rateLimitWait)
+}
+
+// Instrument adds handlers recording the calls made with handlers, those of a session instrument
+// all the clients created out of it
+func Instrument(handlers *request.Handlers) {
+	handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "awsapi.CompleteAttempt",
+		Fn: func(r *request.Request) {
+			service, operation := r.ClientInfo.ServiceName, r.Operation.Name
+			attemptDuration.WithLabelValues(service, operation).Observe(time.Since(r.AttemptTime).Seconds())
+			if r.RetryCount > 0 {
+				retries.WithLabelValues(service, operation).Inc()
+			}
+			if r.Error != nil && request.IsErrorThrottle(r.Error) {
+				throttles.WithLabelValues(service, operation).Inc()
+			}
+		},
+	})
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "awsapi.Complete",
+		Fn: func(r *request.Request) {
+			service, operation := r.ClientInfo.ServiceName, r.Operation.Name
+			result := "success"
+			if r.Error != nil {
+				result = "error"
+			}
+			requests.WithLabelValues(service, operation, result).Inc()
+			if r.Error == nil && r.Operation.Paginator != nil {
+				pages.WithLabelValues(service, operation).Inc()
+				if firstPage(r) {
+					paginatedCalls.WithLabelValues(service, operation).Inc()
+				}
+			}
+		},
+	})
+}
+
+// firstPage returns whether the request of a paginated operation is for its first page,
+// which is requested without any of the tokens the following pages are chained by
+func firstPage(r *request.Request) bool {
+	for _, token := range r.Operation.InputTokens {
+		values, _ := awsutil.ValuesAtPath(r.Params, token)
+		for _, value := range values {
+			switch v := value.(type) {
+			case *string:
+				if aws.StringValue(v) != "" {
+					return false
+				}
+			case string:
+				if v != "" {
+					return false
+				}
+			default:
+				if value != nil {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// RateLimiter caps the rate of the attempts of AWS API calls, per operation
+type RateLimiter struct {
+	// limits requests per second by operation, the "*" operation applies to all the others
+	limits   map[string]float64
+	mutex    sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewRateLimiter creates a rate limiter, limits are in requests per second, by operation
+// operations without a limit, and without a "*" limit, are not limited
+func NewRateLimiter(limits map[string]float64) *RateLimiter {
+	return &RateLimiter{limits: limits, limiters: map[string]*rate.Limiter{}}
+}
+
+// limiter returns the limiter of an operation, nil when it is not limited
+// operations limited by "*" have a limiter each
+func (l *RateLimiter) limiter(operation string) *rate.Limiter {
+	limit, ok := l.limits[operation]
+	if !ok {
+		if limit, ok = l.limits["*"]; !ok {
+			return nil
+		}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limiter, ok := l.limiters[operation]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(limit), int(math.Max(1, math.Ceil(limit))))
+		l.limiters[operation] = limiter
+	}
+	return limiter
+}
+
+// Limit adds a handler to handlers, waiting for the rate limit before every attempt is signed
+func (l *RateLimiter) Limit(handlers *request.Handlers) {
+	if l == nil || len(l.limits) == 0 {
+		return
+	}
+	handlers.Sign.PushFrontNamed(request.NamedHandler{
+		Name: "awsapi.RateLimit",
+		Fn: func(r *request.Request) {
+			limiter := l.limiter(r.Operation.Name)
+			if limiter == nil {
+				return
+			}
+			start := time.Now()
+			if err := limiter.Wait(r.Context()); err != nil {
+				r.Error = err
+				return
+			}
+			rateLimitWait.WithLabelValues(r.ClientInfo.ServiceName, r.Operation.Name).Add(time.Since(start).Seconds())
+		},
+	})
+}
@@ -0,0 +1,112 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+// newRequest returns a request of an EC2 operation, running handlers
+func newRequest(handlers request.Handlers, operation *request.Operation) *request.Request {
+	return request.New(aws.Config{}, metadata.ClientInfo{ServiceName: "ec2"}, handlers, nil, operation, nil, nil)
+}
+
+func TestRateLimiterLimiter(t *testing.T) {
+	l := NewRateLimiter(map[string]float64{"DescribeInstances": 2.5, "*": 0.5})
+	limiter := l.limiter("DescribeInstances")
+	if limiter == nil || limiter.Limit() != rate.Limit(2.5) || limiter.Burst() != 3 {
+		t.Errorf("DescribeInstances limiter = %v", limiter)
+	}
+	if l.limiter("DescribeInstances") != limiter {
+		t.Error("limiters are not kept")
+	}
+	// operations limited by "*" are limited each by their own
+	volumes, fleets := l.limiter("DescribeVolumes"), l.limiter("DescribeSpotFleetRequests")
+	if volumes == nil || volumes == fleets || volumes.Limit() != rate.Limit(0.5) || volumes.Burst() != 1 {
+		t.Errorf("DescribeVolumes limiter = %v", volumes)
+	}
+
+	if limiter := NewRateLimiter(map[string]float64{"DescribeInstances": 1}).limiter("DescribeVolumes"); limiter != nil {
+		t.Errorf("limiter of an unlimited operation = %v", limiter)
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	var handlers request.Handlers
+	NewRateLimiter(map[string]float64{"DescribeInstances": 1}).Limit(&handlers)
+	if handlers.Sign.Len() != 1 {
+		t.Fatalf("%d sign handlers, want 1", handlers.Sign.Len())
+	}
+
+	// the burst lets the first attempt through, the second waits until its context is done
+	operation := &request.Operation{Name: "DescribeInstances"}
+	r := newRequest(handlers, operation)
+	handlers.Sign.Run(r)
+	if r.Error != nil {
+		t.Fatalf("first attempt: %v", r.Error)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r = newRequest(handlers, operation)
+	r.SetContext(ctx)
+	handlers.Sign.Run(r)
+	if r.Error == nil {
+		t.Error("second attempt was not limited")
+	}
+
+	var none request.Handlers
+	NewRateLimiter(nil).Limit(&none)
+	var nilLimiter *RateLimiter
+	nilLimiter.Limit(&none)
+	if none.Sign.Len() != 0 {
+		t.Error("rate limiter without limits added a handler")
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	var handlers request.Handlers
+	Instrument(&handlers)
+
+	paginated := &request.Operation{Name: "DescribeVolumes",
+		Paginator: &request.Paginator{InputTokens: []string{"NextToken"}, OutputTokens: []string{"NextToken"}}}
+	// a call of two pages, the second one chained by the token of the first
+	for _, token := range []*string{nil, aws.String("page-2")} {
+		r := newRequest(handlers, paginated)
+		r.Params = &ec2.DescribeVolumesInput{NextToken: token}
+		r.AttemptTime = time.Now()
+		handlers.CompleteAttempt.Run(r)
+		handlers.Complete.Run(r)
+	}
+
+	r := newRequest(handlers, paginated)
+	r.Params = &ec2.DescribeVolumesInput{}
+	r.AttemptTime = time.Now()
+	r.RetryCount = 1
+	r.Error = awserr.New("RequestLimitExceeded", "throttled", errors.New("throttled"))
+	handlers.CompleteAttempt.Run(r)
+	handlers.Complete.Run(r)
+
+	for name, test := range map[string]struct {
+		got, want float64
+	}{
+		"successful requests": {testutil.ToFloat64(requests.WithLabelValues("ec2", "DescribeVolumes", "success")), 2},
+		"failed requests":     {testutil.ToFloat64(requests.WithLabelValues("ec2", "DescribeVolumes", "error")), 1},
+		"retries":             {testutil.ToFloat64(retries.WithLabelValues("ec2", "DescribeVolumes")), 1},
+		"throttles":           {testutil.ToFloat64(throttles.WithLabelValues("ec2", "DescribeVolumes")), 1},
+		"pages":               {testutil.ToFloat64(pages.WithLabelValues("ec2", "DescribeVolumes")), 2},
+		"paginated calls":     {testutil.ToFloat64(paginatedCalls.WithLabelValues("ec2", "DescribeVolumes")), 1},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", name, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package billing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	labelsCacheEntries   prometheus.Gauge
+	labelsCacheEvictions prometheus.Counter
+	labelsCacheLookups   *prometheus.CounterVec
+)
+
+// RegisterLabelsCacheMetrics constructs and registers Prometheus metrics
+func RegisterLabelsCacheMetrics() {
+
+	labelsCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aws_audit_exporter_labels_cache_entries",
+		Help: "Number of instances in the instance labels cache",
+	})
+
+	labelsCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_labels_cache_evictions_total",
+		Help: "Number of instances evicted from the instance labels cache",
+	})
+
+	labelsCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_labels_cache_lookups_total",
+		Help: "Number of lookups in the instance labels cache, by result [hit|miss]",
+	},
+		[]string{"result"})
+
+	Registerer.Register(labelsCacheEntries)
+	Registerer.Register(labelsCacheEvictions)
+	Registerer.Register(labelsCacheLookups)
+}
+
+type labelsCacheEntry struct {
+	labels     prometheus.Labels
+	seen       time.Time
+	terminated bool
+}
+
+// LabelsCache holds the tag labels of instances, filled by the instances collector, so that collectors
+// of resources attached to instances label their series with the instance tags. it is safe for concurrent use
+// entries expire TTL after their instance was last seen, or first seen terminated
+type LabelsCache struct {
+	TTL     time.Duration
+	mutex   sync.RWMutex
+	entries map[string]*labelsCacheEntry
+}
+
+// NewLabelsCache creates an empty cache
+func NewLabelsCache(ttl time.Duration) *LabelsCache {
+	return &LabelsCache{TTL: ttl, entries: map[string]*labelsCacheEntry{}}
+}
+
+// Set sets the labels of an instance, a copy of them is kept
+func (c *LabelsCache) Set(instanceID string, labels prometheus.Labels, terminated bool) {
+	copied := prometheus.Labels{}
+	for k, v := range labels {
+		copied[k] = v
+	}
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[instanceID]
+	if ok && entry.terminated && terminated {
+		// terminated instances are kept for TTL since first seen terminated
+		now = entry.seen
+	}
+	c.entries[instanceID] = &labelsCacheEntry{labels: copied, seen: now, terminated: terminated}
+	if labelsCacheEntries != nil {
+		labelsCacheEntries.Set(float64(len(c.entries)))
+	}
+}
+
+// Get returns a copy of the labels of an instance
+func (c *LabelsCache) Get(instanceID string) (prometheus.Labels, bool) {
+	c.mutex.RLock()
+	entry, ok := c.entries[instanceID]
+	c.mutex.RUnlock()
+
+	if labelsCacheLookups != nil {
+		result := "hit"
+		if !ok {
+			result = "miss"
+		}
+		labelsCacheLookups.WithLabelValues(result).Inc()
+	}
+	if !ok {
+		return nil, false
+	}
+	copied := prometheus.Labels{}
+	for k, v := range entry.labels {
+		copied[k] = v
+	}
+	return copied, true
+}
+
+// instanceLabels returns the tag labels of an instance, "unknown" when it is not in the cache
+func (c *LabelsCache) instanceLabels(instanceID string, instanceTags map[string]string) prometheus.Labels {
+	if labels, ok := c.Get(instanceID); ok {
+		return labels
+	}
+	labels := prometheus.Labels{}
+	for _, label := range instanceTags {
+		labels[label] = "unknown"
+	}
+	return labels
+}
+
+// has returns whether an instance is in the cache, without counting as a lookup
+func (c *LabelsCache) has(instanceID string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.entries[instanceID]
+	return ok
+}
+
+// Evict drops the expired entries, returning how many were dropped
+func (c *LabelsCache) Evict() int {
+	expiry := time.Now().Add(-c.TTL)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	evicted := 0
+	for instanceID, entry := range c.entries {
+		if entry.seen.Before(expiry) {
+			delete(c.entries, instanceID)
+			evicted++
+		}
+	}
+	if labelsCacheEntries != nil {
+		labelsCacheEntries.Set(float64(len(c.entries)))
+		labelsCacheEvictions.Add(float64(evicted))
+	}
+	return evicted
+}
+
+// Len returns the number of instances in the cache
+func (c *LabelsCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.entries)
+}
@@ -0,0 +1,107 @@
+package billing
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// age moves the last time an instance was seen back by d
+func age(c *LabelsCache, instanceID string, d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[instanceID].seen = c.entries[instanceID].seen.Add(-d)
+}
+
+func TestLabelsCacheCopies(t *testing.T) {
+	c := NewLabelsCache(time.Hour)
+	labels := prometheus.Labels{"aws_tag_team": "payments"}
+	c.Set("i-1", labels, false)
+	labels["aws_tag_team"] = "search"
+
+	got, ok := c.Get("i-1")
+	if !ok || got["aws_tag_team"] != "payments" {
+		t.Fatalf("Get() = %v, %v, want the labels as set", got, ok)
+	}
+	got["aws_tag_team"] = "billing"
+	if got, _ := c.Get("i-1"); got["aws_tag_team"] != "payments" {
+		t.Errorf("Get() = %v, changed through a previous Get", got)
+	}
+}
+
+func TestLabelsCacheEvict(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterLabelsCacheMetrics()
+	c := NewLabelsCache(time.Hour)
+	c.Set("i-running", nil, false)
+	c.Set("i-stopped", nil, false)
+	c.Set("i-terminated", nil, true)
+
+	// running instances seen again are kept
+	age(c, "i-running", 2*time.Hour)
+	c.Set("i-running", nil, false)
+	age(c, "i-stopped", 2*time.Hour)
+	// terminated instances expire since first seen terminated, however often they are seen
+	age(c, "i-terminated", 2*time.Hour)
+	c.Set("i-terminated", nil, true)
+
+	if evicted := c.Evict(); evicted != 2 {
+		t.Errorf("Evict() = %d, want 2", evicted)
+	}
+	if !c.has("i-running") || c.has("i-stopped") || c.has("i-terminated") || c.Len() != 1 {
+		t.Errorf("running %v, stopped %v, terminated %v, len %d", c.has("i-running"), c.has("i-stopped"), c.has("i-terminated"), c.Len())
+	}
+	if got := testutil.ToFloat64(labelsCacheEntries); got != 1 {
+		t.Errorf("entries = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(labelsCacheEvictions); got != 2 {
+		t.Errorf("evictions = %v, want 2", got)
+	}
+}
+
+func TestLabelsCacheInstanceLabels(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterLabelsCacheMetrics()
+	c := NewLabelsCache(time.Hour)
+	c.Set("i-1", prometheus.Labels{"aws_tag_team": "payments"}, false)
+	instanceTags := map[string]string{"team": "aws_tag_team", "env": "aws_tag_env"}
+
+	if got := c.instanceLabels("i-1", instanceTags); got["aws_tag_team"] != "payments" {
+		t.Errorf("instanceLabels() of a cached instance = %v", got)
+	}
+	got := c.instanceLabels("i-2", instanceTags)
+	if len(got) != 2 || got["aws_tag_team"] != "unknown" || got["aws_tag_env"] != "unknown" {
+		t.Errorf("instanceLabels() of a missing instance = %v", got)
+	}
+	// has is not counted as a lookup
+	c.has("i-1")
+	if hits, misses := testutil.ToFloat64(labelsCacheLookups.WithLabelValues("hit")),
+		testutil.ToFloat64(labelsCacheLookups.WithLabelValues("miss")); hits != 1 || misses != 1 {
+		t.Errorf("lookups = %v hits, %v misses, want 1 and 1", hits, misses)
+	}
+}
+
+func TestLabelsCacheConcurrent(t *testing.T) {
+	c := NewLabelsCache(time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("i-%d", i)
+			for j := 0; j < 100; j++ {
+				c.Set(id, prometheus.Labels{"aws_tag_team": "payments"}, false)
+				c.Get(id)
+				c.Evict()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if c.Len() != 10 {
+		t.Errorf("Len() = %d, want 10", c.Len())
+	}
+}
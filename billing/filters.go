@@ -0,0 +1,147 @@
+package billing
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tagPattern matches tag values, either a glob with * and ? wildcards, as EC2 filters do,
+// or a regular expression between slashes
+type tagPattern struct {
+	value  string
+	regexp *regexp.Regexp
+	isGlob bool
+}
+
+func newTagPattern(value string) (*tagPattern, error) {
+	if len(value) > 1 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+		re, err := regexp.Compile(value[1 : len(value)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag value regexp %s: %v", value, err)
+		}
+		return &tagPattern{value: value, regexp: re}, nil
+	}
+	glob := regexp.QuoteMeta(value)
+	glob = strings.Replace(glob, `\*`, ".*", -1)
+	glob = strings.Replace(glob, `\?`, ".", -1)
+	return &tagPattern{value: value, regexp: regexp.MustCompile("^" + glob + "$"), isGlob: true}, nil
+}
+
+// Filters restrict the resources collected, and written to postgres
+// instances states and VPC ids, along with include tags made of globs only, are filtered by EC2,
+// all the rest is filtered after describing
+type Filters struct {
+	InstanceStates []string
+	VpcIDs         []string
+	// includeTags resources must have all of these tags, with a value matching any of its patterns
+	includeTags map[string][]*tagPattern
+	// excludeTags resources having any of these tags, with a value matching any of its patterns, are left out
+	excludeTags map[string][]*tagPattern
+}
+
+func compileTagPatterns(tags map[string][]string) (map[string][]*tagPattern, error) {
+	patterns := map[string][]*tagPattern{}
+	for key, values := range tags {
+		for _, value := range values {
+			pattern, err := newTagPattern(value)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %v", key, err)
+			}
+			patterns[key] = append(patterns[key], pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// NewFilters compiles the tag patterns of the filters, tag values are globs, or regexps between slashes
+func NewFilters(instanceStates []string, vpcIDs []string,
+	includeTags map[string][]string, excludeTags map[string][]string) (*Filters, error) {
+
+	f := &Filters{InstanceStates: instanceStates, VpcIDs: vpcIDs}
+	var err error
+	if f.includeTags, err = compileTagPatterns(includeTags); err != nil {
+		return nil, err
+	}
+	if f.excludeTags, err = compileTagPatterns(excludeTags); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// IsEmpty returns whether the filters let all resources through
+func (f *Filters) IsEmpty() bool {
+	return f == nil || (len(f.InstanceStates) == 0 && len(f.VpcIDs) == 0 &&
+		len(f.includeTags) == 0 && len(f.excludeTags) == 0)
+}
+
+// instancesFilters returns the filters DescribeInstances applies
+func (f *Filters) instancesFilters() []*ec2.Filter {
+	if f == nil {
+		return nil
+	}
+	var filters []*ec2.Filter
+	if len(f.InstanceStates) > 0 {
+		filters = append(filters, &ec2.Filter{Name: aws.String("instance-state-name"),
+			Values: aws.StringSlice(f.InstanceStates)})
+	}
+	if len(f.VpcIDs) > 0 {
+		filters = append(filters, &ec2.Filter{Name: aws.String("vpc-id"), Values: aws.StringSlice(f.VpcIDs)})
+	}
+	keys := []string{}
+	for key := range f.includeTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := []string{}
+		for _, pattern := range f.includeTags[key] {
+			if !pattern.isGlob {
+				values = nil
+				break
+			}
+			values = append(values, pattern.value)
+		}
+		if len(values) > 0 {
+			filters = append(filters, &ec2.Filter{Name: aws.String("tag:" + key), Values: aws.StringSlice(values)})
+		}
+	}
+	return filters
+}
+
+func matchTag(patterns []*tagPattern, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.regexp.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTags returns whether resources with tags are collected
+func (f *Filters) matchTags(tags []*ec2.Tag) bool {
+	if f == nil {
+		return true
+	}
+	values := map[string]string{}
+	for _, tag := range tags {
+		if tag.Key != nil && tag.Value != nil {
+			values[*tag.Key] = *tag.Value
+		}
+	}
+	for key, patterns := range f.includeTags {
+		if value, ok := values[key]; !ok || !matchTag(patterns, value) {
+			return false
+		}
+	}
+	for key, patterns := range f.excludeTags {
+		if value, ok := values[key]; ok && matchTag(patterns, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package billing
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func ec2Tags(kv ...string) []*ec2.Tag {
+	var tags []*ec2.Tag
+	for i := 0; i < len(kv); i += 2 {
+		tags = append(tags, &ec2.Tag{Key: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+	}
+	return tags
+}
+
+func TestNewFiltersInvalidRegexp(t *testing.T) {
+	if _, err := NewFilters(nil, nil, map[string][]string{"team": {"/pay(/"}}, nil); err == nil {
+		t.Error("NewFilters() succeeded with an invalid include regexp")
+	}
+	if _, err := NewFilters(nil, nil, nil, map[string][]string{"team": {"/[/"}}); err == nil {
+		t.Error("NewFilters() succeeded with an invalid exclude regexp")
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	f, err := NewFilters(nil, nil,
+		map[string][]string{"team": {"pay*", "/^search-(eu|us)$/"}, "env": {"prod?"}},
+		map[string][]string{"lifecycle": {"ephemeral"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tags []*ec2.Tag
+		want bool
+	}{
+		{"glob", ec2Tags("team", "payments", "env", "prod1"), true},
+		{"regexp", ec2Tags("team", "search-eu", "env", "prod1"), true},
+		{"regexp is anchored by itself", ec2Tags("team", "search-eu-2", "env", "prod1"), false},
+		{"glob is anchored", ec2Tags("team", "mypayments", "env", "prod1"), false},
+		{"question mark matches a single character", ec2Tags("team", "payments", "env", "prod12"), false},
+		{"glob metacharacters are literal", ec2Tags("team", "payments", "env", "prod."), true},
+		{"missing included tag", ec2Tags("team", "payments"), false},
+		{"excluded", ec2Tags("team", "payments", "env", "prod1", "lifecycle", "ephemeral"), false},
+		{"other value of excluded tag", ec2Tags("team", "payments", "env", "prod1", "lifecycle", "permanent"), true},
+		{"no tags", nil, false},
+	}
+	for _, test := range tests {
+		if got := f.matchTags(test.tags); got != test.want {
+			t.Errorf("%s: matchTags() = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	var none *Filters
+	if !none.matchTags(nil) {
+		t.Error("nil filters should match all resources")
+	}
+}
+
+func TestFiltersIsEmpty(t *testing.T) {
+	var none *Filters
+	empty, _ := NewFilters(nil, nil, nil, nil)
+	states, _ := NewFilters([]string{"running"}, nil, nil, nil)
+	excluded, _ := NewFilters(nil, nil, nil, map[string][]string{"team": {"search"}})
+	for _, test := range []struct {
+		name    string
+		filters *Filters
+		want    bool
+	}{
+		{"nil", none, true},
+		{"no filters", empty, true},
+		{"instance states", states, false},
+		{"exclude tags", excluded, false},
+	} {
+		if got := test.filters.IsEmpty(); got != test.want {
+			t.Errorf("%s: IsEmpty() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInstancesFilters(t *testing.T) {
+	f, err := NewFilters([]string{"running", "stopped"}, []string{"vpc-1"},
+		map[string][]string{"team": {"pay*", "search"}, "env": {"/^prod$/"}},
+		map[string][]string{"lifecycle": {"ephemeral"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, filter := range f.instancesFilters() {
+		got[*filter.Name] = aws.StringValueSlice(filter.Values)
+	}
+	// tags with a regexp, and excluded tags, are filtered after describing
+	want := map[string][]string{
+		"instance-state-name": {"running", "stopped"},
+		"vpc-id":              {"vpc-1"},
+		"tag:team":            {"pay*", "search"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("instancesFilters() = %v, want %v", got, want)
+	}
+
+	var none *Filters
+	if filters := none.instancesFilters(); filters != nil {
+		t.Errorf("instancesFilters() of nil filters = %v", filters)
+	}
+}
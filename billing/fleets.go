@@ -0,0 +1,170 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	spotFleetsLabels = []string{
+		"allocation_strategy",
+		"fleet_id",
+		"state",
+		"type",
+	}
+
+	spotFleetInstancesLabels = []string{
+		"family",
+		"fleet_id",
+		"instance_type",
+	}
+
+	spotFleetsTargetCapacity    *prometheus.GaugeVec
+	spotFleetsFulfilledCapacity *prometheus.GaugeVec
+	spotFleetInstancesCount     *prometheus.GaugeVec
+)
+
+// RegisterSpotFleetsMetrics constructs and registers Prometheus metrics
+// withAccount labels them with the account, when collecting from accounts
+func RegisterSpotFleetsMetrics(tagList []string, withAccount bool) {
+
+	spotFleetsTargetCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_fleet_target_capacity",
+		Help: "Capacity units requested by spot fleets",
+	},
+		metricLabels(spotFleetsLabels, withAccount, nil))
+
+	spotFleetsFulfilledCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_fleet_fulfilled_capacity",
+		Help: "Capacity units fulfilled by spot fleets",
+	},
+		metricLabels(spotFleetsLabels, withAccount, nil))
+
+	spotFleetInstancesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_fleet_instances_count",
+		Help: "Number of active instances of spot fleets",
+	},
+		metricLabels(spotFleetInstancesLabels, withAccount, tagList))
+
+	Registerer.Register(spotFleetsTargetCapacity)
+	Registerer.Register(spotFleetsFulfilledCapacity)
+	Registerer.Register(spotFleetInstancesCount)
+}
+
+// SpotFleets parameters to be passed from main
+type SpotFleets struct {
+	Svc                 *ec2.EC2
+	InstanceLabelsCache *LabelsCache
+	InstanceTags        map[string]string
+	// Filters when set, only fleets matching by their own tags are collected, and of them only
+	// the instances which are collected
+	Filters *Filters
+	// Account name of the account collected from, empty unless accounts are configured
+	Account string
+}
+
+// ResetSpotFleetsMetrics drops spot fleets metrics, before collecting them again for all targets
+func ResetSpotFleetsMetrics() {
+	spotFleetsTargetCapacity.Reset()
+	spotFleetsFulfilledCapacity.Reset()
+	spotFleetInstancesCount.Reset()
+}
+
+// fleetLabels returns the labels of a spot fleet, and whether it is collected
+func (s *SpotFleets) fleetLabels(f *ec2.SpotFleetRequestConfig) (prometheus.Labels, bool) {
+	if !s.Filters.matchTags(f.Tags) {
+		return nil, false
+	}
+	labels := prometheus.Labels{
+		"fleet_id":            *f.SpotFleetRequestId,
+		"state":               *f.SpotFleetRequestState,
+		"allocation_strategy": "unknown",
+		"type":                "unknown",
+	}
+	setAccount(labels, s.Account)
+	if f.SpotFleetRequestConfig != nil {
+		if f.SpotFleetRequestConfig.AllocationStrategy != nil {
+			labels["allocation_strategy"] = *f.SpotFleetRequestConfig.AllocationStrategy
+		}
+		if f.SpotFleetRequestConfig.Type != nil {
+			labels["type"] = *f.SpotFleetRequestConfig.Type
+		}
+	}
+	return labels, true
+}
+
+// fleetInstanceLabels returns the labels of an instance of a spot fleet, and whether it is collected
+// instances are labeled with their tags out of the cache, like spot requests
+func (s *SpotFleets) fleetInstanceLabels(fleetID string, i *ec2.ActiveInstance) (prometheus.Labels, bool) {
+	if i.InstanceId == nil {
+		return nil, false
+	}
+	if !s.Filters.IsEmpty() && !s.InstanceLabelsCache.has(*i.InstanceId) {
+		return nil, false
+	}
+	labels := s.InstanceLabelsCache.instanceLabels(*i.InstanceId, s.InstanceTags)
+	setAccount(labels, s.Account)
+	labels["fleet_id"] = fleetID
+	labels["instance_type"] = "unknown"
+	labels["family"] = "unknown"
+	if i.InstanceType != nil {
+		labels["instance_type"] = *i.InstanceType
+		labels["family"], _ = getInstanceTypeDetails(*i.InstanceType)
+	}
+	return labels, true
+}
+
+// GetSpotFleetsInfo gets spot fleets information, AWS calls are cancelled along with ctx
+func (s *SpotFleets) GetSpotFleetsInfo(ctx context.Context) error {
+	var fleets []*ec2.SpotFleetRequestConfig
+	err := s.Svc.DescribeSpotFleetRequestsPagesWithContext(ctx, &ec2.DescribeSpotFleetRequestsInput{},
+		func(page *ec2.DescribeSpotFleetRequestsOutput, lastPage bool) bool {
+			fleets = append(fleets, page.SpotFleetRequestConfigs...)
+			return !lastPage
+		})
+	if err != nil {
+		return errors.Wrap(err, "there was an error listing spot fleets")
+	}
+
+	for _, f := range fleets {
+		labels, ok := s.fleetLabels(f)
+		if !ok {
+			continue
+		}
+		if f.SpotFleetRequestConfig != nil {
+			if f.SpotFleetRequestConfig.TargetCapacity != nil {
+				spotFleetsTargetCapacity.With(labels).Set(float64(*f.SpotFleetRequestConfig.TargetCapacity))
+			}
+			if f.SpotFleetRequestConfig.FulfilledCapacity != nil {
+				spotFleetsFulfilledCapacity.With(labels).Set(*f.SpotFleetRequestConfig.FulfilledCapacity)
+			}
+		}
+
+		// only active fleets have instances
+		switch *f.SpotFleetRequestState {
+		case ec2.BatchStateActive, ec2.BatchStateModifying:
+		default:
+			continue
+		}
+		input := &ec2.DescribeSpotFleetInstancesInput{SpotFleetRequestId: f.SpotFleetRequestId}
+		for {
+			resp, err := s.Svc.DescribeSpotFleetInstancesWithContext(ctx, input)
+			if err != nil {
+				return errors.Wrapf(err, "there was an error listing instances of spot fleet %s", *f.SpotFleetRequestId)
+			}
+			for _, i := range resp.ActiveInstances {
+				if ilabels, ok := s.fleetInstanceLabels(*f.SpotFleetRequestId, i); ok {
+					spotFleetInstancesCount.With(ilabels).Inc()
+				}
+			}
+			if resp.NextToken == nil || *resp.NextToken == "" {
+				break
+			}
+			input.NextToken = resp.NextToken
+		}
+	}
+	return nil
+}
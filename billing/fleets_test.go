@@ -0,0 +1,88 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSpotFleetLabels(t *testing.T) {
+	cache := NewLabelsCache(0)
+	cache.Set("i-1", prometheus.Labels{"aws_tag_team": "payments"}, false)
+	filters, err := NewFilters(nil, nil, nil, map[string][]string{"team": {"search"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SpotFleets{
+		InstanceLabelsCache: cache,
+		InstanceTags:        map[string]string{"team": "aws_tag_team"},
+		Filters:             filters,
+	}
+
+	fleet := &ec2.SpotFleetRequestConfig{
+		SpotFleetRequestId:     aws.String("sfr-1"),
+		SpotFleetRequestState:  aws.String(ec2.BatchStateActive),
+		SpotFleetRequestConfig: &ec2.SpotFleetRequestConfigData{AllocationStrategy: aws.String(ec2.AllocationStrategyLowestPrice)},
+	}
+	labels, ok := s.fleetLabels(fleet)
+	if !ok {
+		t.Fatal("fleet without tags should be collected")
+	}
+	if labels["allocation_strategy"] != ec2.AllocationStrategyLowestPrice || labels["type"] != "unknown" {
+		t.Errorf("fleet labels = %v", labels)
+	}
+	fleet.Tags = []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("search")}}
+	if _, ok := s.fleetLabels(fleet); ok {
+		t.Error("fleet excluded by its tags was collected")
+	}
+
+	labels, ok = s.fleetInstanceLabels("sfr-1", &ec2.ActiveInstance{InstanceId: aws.String("i-1"), InstanceType: aws.String("m5.large")})
+	if !ok {
+		t.Fatal("cached instance of the fleet should be collected")
+	}
+	if labels["aws_tag_team"] != "payments" || labels["fleet_id"] != "sfr-1" || labels["family"] != "m5" {
+		t.Errorf("fleet instance labels = %v", labels)
+	}
+	if _, ok := s.fleetInstanceLabels("sfr-1", &ec2.ActiveInstance{InstanceId: aws.String("i-2")}); ok {
+		t.Error("instance left out of the collection was collected")
+	}
+
+	s.Filters = nil
+	labels, ok = s.fleetInstanceLabels("sfr-1", &ec2.ActiveInstance{InstanceId: aws.String("i-2")})
+	if !ok || labels["aws_tag_team"] != "unknown" || labels["instance_type"] != "unknown" {
+		t.Errorf("fleet instance missing from the cache: collected = %v, labels = %v", ok, labels)
+	}
+}
+
+func TestSpotFleetsMetricsAccountLabel(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotFleetsMetrics([]string{"aws_tag_team"}, true)
+	cache := NewLabelsCache(0)
+	cache.Set("i-1", prometheus.Labels{"aws_tag_team": "payments"}, false)
+
+	fleet := &ec2.SpotFleetRequestConfig{
+		SpotFleetRequestId:     aws.String("sfr-1"),
+		SpotFleetRequestState:  aws.String(ec2.BatchStateActive),
+		SpotFleetRequestConfig: &ec2.SpotFleetRequestConfigData{TargetCapacity: aws.Int64(4)},
+	}
+	// the same fleet id and labels in two accounts are two series
+	for _, account := range []string{"production", "staging"} {
+		s := &SpotFleets{InstanceLabelsCache: cache, InstanceTags: map[string]string{"team": "aws_tag_team"}, Account: account}
+		labels, _ := s.fleetLabels(fleet)
+		if labels[AccountLabel] != account {
+			t.Errorf("fleet labels = %v, want account %s", labels, account)
+		}
+		spotFleetsTargetCapacity.With(labels).Set(4)
+		ilabels, _ := s.fleetInstanceLabels("sfr-1", &ec2.ActiveInstance{InstanceId: aws.String("i-1"), InstanceType: aws.String("m5.large")})
+		spotFleetInstancesCount.With(ilabels).Inc()
+	}
+	if n := testutil.CollectAndCount(spotFleetsTargetCapacity); n != 2 {
+		t.Errorf("%d target capacity series, want one per account", n)
+	}
+	if n := testutil.CollectAndCount(spotFleetInstancesCount); n != 2 {
+		t.Errorf("%d fleet instances series, want one per account", n)
+	}
+}
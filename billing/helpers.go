@@ -1,16 +1,43 @@
 package billing
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
+// Registerer billing metrics are registered with
+// a new registry is set on reload, so that metrics can be registered again with a different set of labels
+var Registerer prometheus.Registerer = prometheus.DefaultRegisterer
+
+// AccountLabel labels the metrics with the name of the account they were collected from,
+// when accounts are configured
+const AccountLabel = "account"
+
+// metricLabels returns the label names of a metric: its own labels, the account label when
+// collecting from accounts, and then the tag labels
+func metricLabels(labels []string, withAccount bool, tagList []string) []string {
+	names := append([]string{}, labels...)
+	if withAccount {
+		names = append(names, AccountLabel)
+	}
+	return append(names, tagList...)
+}
+
+// setAccount labels with the account collected from, which is empty unless accounts are configured
+func setAccount(labels prometheus.Labels, account string) {
+	if account != "" {
+		labels[AccountLabel] = account
+	}
+}
+
 // GetProductDescriptions maps program OS input to AWS format
 func GetProductDescriptions(osList string, isVPC bool) ([]*string, error) {
 	pList := []*string{}
@@ -36,22 +63,33 @@ func GetProductDescriptions(osList string, isVPC bool) ([]*string, error) {
 	return pList, nil
 }
 
+// instanceProduct returns the spot product of an instance, the product its spot prices are published for
+// DescribeInstances only tells Windows instances apart, other platforms are taken as Linux/UNIX
+func instanceProduct(ins *ec2.Instance) string {
+	product := "Linux/UNIX"
+	if ins.Platform != nil && *ins.Platform == ec2.PlatformValuesWindows {
+		product = "Windows"
+	}
+	if ins.VpcId != nil {
+		product += " (Amazon VPC)"
+	}
+	return product
+}
+
 // IsClassicLink returns true if VPC Classic Link is enabled
-func IsClassicLink(svc *ec2.EC2) bool {
-	var resp *ec2.DescribeVpcClassicLinkOutput
-	var err error
-	if resp, err = svc.DescribeVpcClassicLink(&ec2.DescribeVpcClassicLinkInput{}); err != nil {
-		fmt.Println("there was an error describing vpc")
-		log.Fatal(err)
+func IsClassicLink(ctx context.Context, svc *ec2.EC2) (bool, error) {
+	resp, err := svc.DescribeVpcClassicLinkWithContext(ctx, &ec2.DescribeVpcClassicLinkInput{})
+	if err != nil {
+		return false, fmt.Errorf("Failed describing VPC classic link: %v", err)
 	}
 
 	for _, r := range resp.Vpcs {
 		if *r.ClassicLinkEnabled == true {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
 
 func getShortenedSpotMessage(message string) string {
@@ -102,8 +140,7 @@ func getInstanceTypeDetails(instanceType string) (string, string) {
 		multiplierString := regexp.MustCompile(`xlarge`).Split(size, 2)[0]
 		multiplier, err := strconv.Atoi(multiplierString)
 		if err != nil {
-			fmt.Println("there was an error in breaking instance type into family and units", err.Error())
-			log.Fatal(err)
+			log.WithField("size", size).WithError(err).Fatal("Failed breaking instance type into family and units")
 		}
 		units = strconv.Itoa(8 * multiplier)
 	}
@@ -111,6 +148,11 @@ func getInstanceTypeDetails(instanceType string) (string, string) {
 	return family, units
 }
 
+// getRegion returns the region of an availability zone
+func getRegion(az string) string {
+	return strings.TrimRight(az, "abcdefghijklmnopqrstuvwxyz")
+}
+
 var cleanre = regexp.MustCompile("[^A-Za-z0-9]")
 
 // Tagname converts to valid Prometheus format
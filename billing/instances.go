@@ -1,8 +1,7 @@
 package billing
 
 import (
-	"fmt"
-	"log"
+	"context"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,47 +28,124 @@ var (
 		"units",
 	}
 
+	// instancesAggregatedLabels labels of the aggregated instances metrics, along with the tags
+	instancesAggregatedLabels = []string{
+		"az",
+		"family",
+		"instance_type",
+		"lifecycle",
+		"region",
+		"state",
+	}
+
+	// instanceInfoLabels identity labels of every instance
+	instanceInfoLabels = []string{
+		"az",
+		"groups",
+		"instance_id",
+		"instance_type",
+		"launch_time",
+		"lifecycle",
+		"owner_id",
+		"requester_id",
+	}
+
 	instancesCount              *prometheus.GaugeVec
 	instancesNormalizationUnits *prometheus.GaugeVec
+	instancesAggregated         *prometheus.GaugeVec
+	instancesAggregatedUnits    *prometheus.GaugeVec
+	instanceInfo                *prometheus.GaugeVec
+
+	// instancesDroppedLabels labels left out of the instances metrics
+	instancesDroppedLabels []string
 )
 
 // RegisterInstancesMetrics constructs and registers Prometheus metrics
-func RegisterInstancesMetrics(tagList []string) {
+// droppedLabels are left out of the instances metrics, which are then aggregated over them,
+// they remain on aws_ec2_instance_info
+// withAccount labels them with the account, when collecting from accounts
+func RegisterInstancesMetrics(tagList []string, droppedLabels []string, withAccount bool) {
+	instancesDroppedLabels = droppedLabels
+	labels := []string{}
+	for _, label := range instancesLabels {
+		dropped := false
+		for _, d := range droppedLabels {
+			dropped = dropped || d == label
+		}
+		if !dropped {
+			labels = append(labels, label)
+		}
+	}
+
 	instancesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_instances_count",
 		Help: "Running EC2 instances count",
 	},
-		append(instancesLabels, tagList...))
+		metricLabels(labels, withAccount, tagList))
 
 	instancesNormalizationUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_instances_normalization_units_total",
 		Help: "Running EC2 instances total normalization units",
 	},
-		append(instancesLabels, tagList...))
+		metricLabels(labels, withAccount, tagList))
+
+	instancesAggregated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_instances",
+		Help: "EC2 instances count, by region, az, family, instance type, lifecycle, state and tags",
+	},
+		metricLabels(instancesAggregatedLabels, withAccount, tagList))
+
+	instancesAggregatedUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_instances_normalization_units",
+		Help: "EC2 instances normalization units, by region, az, family, instance type, lifecycle, state and tags",
+	},
+		metricLabels(instancesAggregatedLabels, withAccount, tagList))
 
-	prometheus.Register(instancesCount)
-	prometheus.Register(instancesNormalizationUnits)
+	instanceInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_instance_info",
+		Help: "EC2 instances identity, always 1",
+	},
+		metricLabels(instanceInfoLabels, withAccount, nil))
+
+	Registerer.Register(instancesCount)
+	Registerer.Register(instancesNormalizationUnits)
+	Registerer.Register(instancesAggregated)
+	Registerer.Register(instancesAggregatedUnits)
+	Registerer.Register(instanceInfo)
 }
 
 // Instances parameters to be passed from main
 type Instances struct {
 	Svc                 *ec2.EC2
-	InstanceLabelsCache *map[string]prometheus.Labels
+	InstanceLabelsCache *LabelsCache
 	InstanceTags        map[string]string
+	// Filters when set, only matching instances are collected
+	Filters *Filters
+	// TagValues when set, normalizes tag labels values
+	TagValues *TagValues
+	// Account name of the account collected from, empty unless accounts are configured
+	Account string
+}
+
+// ResetInstancesMetrics drops instances metrics, before collecting them again for all targets
+func ResetInstancesMetrics() {
+	instancesCount.Reset()
+	instancesNormalizationUnits.Reset()
+	instancesAggregated.Reset()
+	instancesAggregatedUnits.Reset()
+	instanceInfo.Reset()
 }
 
-// GetInstancesInfo gets instances information
-func (s *Instances) GetInstancesInfo() {
+// GetInstancesInfo gets instances information, AWS calls and DB writes are cancelled along with ctx
+func (s *Instances) GetInstancesInfo(ctx context.Context) error {
 
-	resp, err := s.Svc.DescribeInstances(&ec2.DescribeInstancesInput{})
+	resp, err := s.Svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{Filters: s.Filters.instancesFilters()})
 	if err != nil {
-		fmt.Println("There was an error listing instances")
-		log.Fatal(err)
+		return errors.Wrap(err, "there was an error listing instances")
 	}
 
-	instancesCount.Reset()
-	instancesNormalizationUnits.Reset()
 	labels := prometheus.Labels{}
+	setAccount(labels, s.Account)
 	for _, r := range resp.Reservations {
 		groups := []string{}
 		for _, g := range r.Groups {
@@ -83,6 +159,9 @@ func (s *Instances) GetInstancesInfo() {
 			labels["requester_id"] = *r.RequesterId
 		}
 		for _, ins := range r.Instances {
+			if !s.Filters.matchTags(ins.Tags) {
+				continue
+			}
 			labels["az"] = *ins.Placement.AvailabilityZone
 			labels["state"] = *(*ins.State).Name
 			labels["family"], labels["units"] = getInstanceTypeDetails(*ins.InstanceType)
@@ -93,36 +172,72 @@ func (s *Instances) GetInstancesInfo() {
 			if ins.InstanceLifecycle != nil {
 				labels["lifecycle"] = *ins.InstanceLifecycle
 			}
-			// TODO: bring back the mutex
-			(*s.InstanceLabelsCache)[*ins.InstanceId] = prometheus.Labels{}
 			tags := make(map[string]string)
+			tagLabels := prometheus.Labels{}
 			for key, label := range s.InstanceTags {
 				labels[label] = "none"
 				tags[key] = "none"
-				(*s.InstanceLabelsCache)[*ins.InstanceId][label] = "none"
+				tagLabels[label] = "none"
 			}
 			for _, tag := range ins.Tags {
 				label, ok := s.InstanceTags[*tag.Key]
 				if ok {
 					tags[*tag.Key] = *tag.Value
-					labels[label] = *tag.Value
-					(*s.InstanceLabelsCache)[*ins.InstanceId][label] = *tag.Value
+					labels[label] = s.TagValues.normalize(*tag.Key, *tag.Value)
+					tagLabels[label] = labels[label]
 				}
 			}
+			s.InstanceLabelsCache.Set(*ins.InstanceId, tagLabels, labels["state"] == ec2.InstanceStateNameTerminated)
 
-			instancesCount.With(labels).Inc()
+			metricLabels := withoutLabels(labels, instancesDroppedLabels)
+			instancesCount.With(metricLabels).Inc()
+
+			aggregatedLabels := aggregatedInstanceLabels(labels, s.InstanceTags)
+			instancesAggregated.With(aggregatedLabels).Inc()
+			instanceInfo.With(instanceInfoLabelsOf(labels)).Set(1)
 
 			units, err := strconv.ParseFloat(labels["units"], 64)
 			if err != nil {
-				log.Fatal(errors.Wrap(err, "There was an error converting normalization units from string to float64"))
+				return errors.Wrap(err, "There was an error converting normalization units from string to float64")
 			}
 
-			instancesNormalizationUnits.With(labels).Add(units)
+			instancesNormalizationUnits.With(metricLabels).Add(units)
+			instancesAggregatedUnits.With(aggregatedLabels).Add(units)
 
 			// write to db
-			if err := postgres.InsertIntoPGInstances(&labels, tags); err != nil {
-				log.Fatal(errors.Wrapf(err, "There was an error calling insertIntoPGInstances for: %s", labels["instance_id"]))
+			if err := postgres.InsertIntoPGInstances(ctx, &labels, tags, instanceProduct(ins)); err != nil {
+				return errors.Wrapf(err, "There was an error calling insertIntoPGInstances for: %s", labels["instance_id"])
 			}
 		}
 	}
+	return nil
+}
+
+// aggregatedInstanceLabels returns the labels of the aggregated instances metrics out of the labels of an instance
+func aggregatedInstanceLabels(labels prometheus.Labels, instanceTags map[string]string) prometheus.Labels {
+	aggregatedLabels := prometheus.Labels{"region": getRegion(labels["az"])}
+	for _, label := range instancesAggregatedLabels {
+		if label != "region" {
+			aggregatedLabels[label] = labels[label]
+		}
+	}
+	for _, label := range instanceTags {
+		aggregatedLabels[label] = labels[label]
+	}
+	if account, ok := labels[AccountLabel]; ok {
+		aggregatedLabels[AccountLabel] = account
+	}
+	return aggregatedLabels
+}
+
+// instanceInfoLabelsOf returns the labels of aws_ec2_instance_info out of the labels of an instance
+func instanceInfoLabelsOf(labels prometheus.Labels) prometheus.Labels {
+	infoLabels := prometheus.Labels{}
+	for _, label := range instanceInfoLabels {
+		infoLabels[label] = labels[label]
+	}
+	if account, ok := labels[AccountLabel]; ok {
+		infoLabels[AccountLabel] = account
+	}
+	return infoLabels
 }
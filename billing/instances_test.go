@@ -0,0 +1,113 @@
+package billing
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testInstanceLabels labels of an instance, as collected
+func testInstanceLabels() prometheus.Labels {
+	return prometheus.Labels{
+		"az":            "us-east-1a",
+		"family":        "m5",
+		"groups":        "default,web",
+		"instance_id":   "i-1",
+		"instance_type": "m5.large",
+		"launch_time":   "2020-10-01 00:00:00",
+		"lifecycle":     "spot",
+		"owner_id":      "123456789012",
+		"requester_id":  "123456789012",
+		"state":         "running",
+		"units":         "4",
+		"aws_tag_team":  "payments",
+	}
+}
+
+func TestAggregatedInstanceLabels(t *testing.T) {
+	got := aggregatedInstanceLabels(testInstanceLabels(), map[string]string{"team": "aws_tag_team"})
+	want := prometheus.Labels{
+		"az":            "us-east-1a",
+		"family":        "m5",
+		"instance_type": "m5.large",
+		"lifecycle":     "spot",
+		"region":        "us-east-1",
+		"state":         "running",
+		"aws_tag_team":  "payments",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("aggregatedInstanceLabels() = %v, want %v", got, want)
+	}
+}
+
+func TestInstanceInfoLabels(t *testing.T) {
+	got := instanceInfoLabelsOf(testInstanceLabels())
+	if len(got) != len(instanceInfoLabels) || got["instance_id"] != "i-1" || got["launch_time"] != "2020-10-01 00:00:00" {
+		t.Errorf("instanceInfoLabelsOf() = %v", got)
+	}
+	if _, ok := got["aws_tag_team"]; ok {
+		t.Errorf("instanceInfoLabelsOf() = %v, tags belong to the instances metrics", got)
+	}
+}
+
+func TestRegisterInstancesMetricsDroppedLabels(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	dropped := []string{"instance_id", "launch_time"}
+	RegisterInstancesMetrics([]string{"aws_tag_team"}, dropped, false)
+
+	labels := testInstanceLabels()
+	if _, err := instancesCount.GetMetricWith(withoutLabels(labels, dropped)); err != nil {
+		t.Errorf("instances count without the dropped labels: %v", err)
+	}
+	if _, err := instancesCount.GetMetricWith(labels); err == nil {
+		t.Error("instances count accepts the dropped labels")
+	}
+	// dropped labels remain on the info metric
+	if _, err := instanceInfo.GetMetricWith(instanceInfoLabelsOf(labels)); err != nil {
+		t.Errorf("instance info: %v", err)
+	}
+	if _, err := instancesAggregated.GetMetricWith(aggregatedInstanceLabels(labels, map[string]string{"team": "aws_tag_team"})); err != nil {
+		t.Errorf("aggregated instances: %v", err)
+	}
+}
+
+func TestInstanceProduct(t *testing.T) {
+	for _, tt := range []struct {
+		instance ec2.Instance
+		want     string
+	}{
+		{ec2.Instance{}, "Linux/UNIX"},
+		{ec2.Instance{VpcId: aws.String("vpc-1")}, "Linux/UNIX (Amazon VPC)"},
+		{ec2.Instance{Platform: aws.String(ec2.PlatformValuesWindows)}, "Windows"},
+		{ec2.Instance{Platform: aws.String(ec2.PlatformValuesWindows), VpcId: aws.String("vpc-1")}, "Windows (Amazon VPC)"},
+	} {
+		if got := instanceProduct(&tt.instance); got != tt.want {
+			t.Errorf("instanceProduct(%v) = %q, want %q", tt.instance, got, tt.want)
+		}
+	}
+}
+
+func TestInstancesMetricsAccountLabel(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterInstancesMetrics([]string{"aws_tag_team"}, nil, true)
+
+	instanceTags := map[string]string{"team": "aws_tag_team"}
+	for _, account := range []string{"production", "staging"} {
+		labels := testInstanceLabels()
+		setAccount(labels, account)
+		instancesCount.With(labels).Inc()
+		instancesAggregated.With(aggregatedInstanceLabels(labels, instanceTags)).Inc()
+		instanceInfo.With(instanceInfoLabelsOf(labels)).Set(1)
+	}
+	// aggregated instances of two accounts are not summed
+	if n := testutil.CollectAndCount(instancesAggregated); n != 2 {
+		t.Errorf("%d aggregated instances series, want one per account", n)
+	}
+	if n := testutil.CollectAndCount(instanceInfo); n != 2 {
+		t.Errorf("%d instance info series, want one per account", n)
+	}
+}
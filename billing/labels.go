@@ -0,0 +1,114 @@
+package billing
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowValue tag labels take this value once they reach their maximum number of distinct values
+const OverflowValue = "other"
+
+// TagValues normalizes tag values used as metric labels, and caps the number of distinct values of every tag
+// values are case folded first, when CaseFold is set, then replaced by their alias
+// values never seen before are exported as OverflowValue, once a tag has MaxValues distinct values, 0 is no limit
+type TagValues struct {
+	CaseFold  bool
+	MaxValues int
+	// aliases value by tag key and value, case folded when CaseFold is set
+	aliases map[string]map[string]string
+	mutex   sync.Mutex
+	// seen distinct values by tag key, they are kept for the life of the exporter, so values never flap
+	seen map[string]map[string]bool
+}
+
+// NewTagValues creates the normalization of tag values
+// aliases lists the values replaced by every value, by tag key, e.g. environment: production: [Prod, prd]
+func NewTagValues(caseFold bool, maxValues int, aliases map[string]map[string][]string) *TagValues {
+	t := &TagValues{
+		CaseFold:  caseFold,
+		MaxValues: maxValues,
+		aliases:   map[string]map[string]string{},
+		seen:      map[string]map[string]bool{},
+	}
+	for key, values := range aliases {
+		t.aliases[key] = map[string]string{}
+		for value, aliasedValues := range values {
+			for _, aliased := range aliasedValues {
+				if caseFold {
+					aliased = strings.ToLower(aliased)
+				}
+				t.aliases[key][aliased] = value
+			}
+		}
+	}
+	return t
+}
+
+// fold returns a tag value case folded and replaced by its alias, without counting it as a distinct value
+// "none" and "unknown", used when tags are missing, are returned as is
+func (t *TagValues) fold(key string, value string) string {
+	if t == nil || value == "none" || value == "unknown" {
+		return value
+	}
+	if t.CaseFold {
+		value = strings.ToLower(value)
+	}
+	if alias, ok := t.aliases[key][value]; ok {
+		value = alias
+	}
+	return value
+}
+
+// normalize returns the label value of a tag value
+// "none" and "unknown", used when tags are missing, are exported as is
+func (t *TagValues) normalize(key string, value string) string {
+	if t == nil || value == "none" || value == "unknown" {
+		return value
+	}
+	value = t.fold(key, value)
+	if t.MaxValues <= 0 {
+		return value
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.seen[key] == nil {
+		t.seen[key] = map[string]bool{}
+	}
+	if !t.seen[key][value] {
+		if len(t.seen[key]) >= t.MaxValues {
+			return OverflowValue
+		}
+		t.seen[key][value] = true
+	}
+	return value
+}
+
+// tagLabels returns the tag labels of a resource out of its own tags, "none" for missing tags
+func tagLabels(tags []*ec2.Tag, instanceTags map[string]string, tagValues *TagValues) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for _, label := range instanceTags {
+		labels[label] = "none"
+	}
+	for _, tag := range tags {
+		if label, ok := instanceTags[*tag.Key]; ok {
+			labels[label] = tagValues.normalize(*tag.Key, *tag.Value)
+		}
+	}
+	return labels
+}
+
+// withoutLabels returns a copy of labels, without the dropped ones
+func withoutLabels(labels prometheus.Labels, dropped []string) prometheus.Labels {
+	copied := prometheus.Labels{}
+	for k, v := range labels {
+		copied[k] = v
+	}
+	for _, label := range dropped {
+		delete(copied, label)
+	}
+	return copied
+}
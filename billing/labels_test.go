@@ -0,0 +1,90 @@
+package billing
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTagValuesNormalize(t *testing.T) {
+	tagValues := NewTagValues(true, 2, map[string]map[string][]string{
+		"env": {"production": {"Prod", "prd"}},
+	})
+	tests := []struct {
+		key, value, want string
+	}{
+		{"env", "PRD", "production"},
+		{"env", "prod", "production"},
+		{"env", "Staging", "staging"},
+		// the third distinct value overflows, while the ones seen keep their value
+		{"env", "dev", OverflowValue},
+		{"env", "production", "production"},
+		{"env", "STAGING", "staging"},
+		// values are counted by tag
+		{"team", "Payments", "payments"},
+		// missing tags are not counted
+		{"team", "none", "none"},
+		{"team", "unknown", "unknown"},
+		{"team", "search", "search"},
+		{"team", "billing", OverflowValue},
+	}
+	for _, test := range tests {
+		if got := tagValues.normalize(test.key, test.value); got != test.want {
+			t.Errorf("normalize(%s, %s) = %s, want %s", test.key, test.value, got, test.want)
+		}
+	}
+}
+
+func TestTagValuesWithoutCaseFold(t *testing.T) {
+	tagValues := NewTagValues(false, 0, map[string]map[string][]string{
+		"env": {"production": {"prd"}},
+	})
+	for value, want := range map[string]string{"prd": "production", "PRD": "PRD", "Prod": "Prod"} {
+		if got := tagValues.normalize("env", value); got != want {
+			t.Errorf("normalize(env, %s) = %s, want %s", value, got, want)
+		}
+	}
+
+	var none *TagValues
+	if got := none.normalize("env", "Prod"); got != "Prod" {
+		t.Errorf("normalize() without normalization = %s, want Prod", got)
+	}
+}
+
+func TestTagValuesConcurrentCap(t *testing.T) {
+	tagValues := NewTagValues(false, 10, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tagValues.normalize("team", string(rune('a'+i%26)))
+		}(i)
+	}
+	wg.Wait()
+	if got := len(tagValues.seen["team"]); got != 10 {
+		t.Errorf("%d distinct values kept, want 10", got)
+	}
+}
+
+func TestTagLabels(t *testing.T) {
+	instanceTags := map[string]string{"team": "aws_tag_team", "env": "aws_tag_env"}
+	got := tagLabels(ec2Tags("team", "Payments", "owner", "jane"), instanceTags, NewTagValues(true, 0, nil))
+	want := prometheus.Labels{"aws_tag_team": "payments", "aws_tag_env": "none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tagLabels() = %v, want %v", got, want)
+	}
+}
+
+func TestWithoutLabels(t *testing.T) {
+	labels := prometheus.Labels{"instance_id": "i-1", "launch_time": "2020-10-01 00:00:00", "az": "us-east-1a"}
+	got := withoutLabels(labels, []string{"instance_id", "launch_time", "groups"})
+	if !reflect.DeepEqual(got, prometheus.Labels{"az": "us-east-1a"}) {
+		t.Errorf("withoutLabels() = %v", got)
+	}
+	if len(labels) != 3 {
+		t.Errorf("withoutLabels() changed its labels: %v", labels)
+	}
+}
@@ -1,8 +1,8 @@
 package billing
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"sort"
 	"strconv"
 	"strings"
@@ -10,6 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/EladDolev/aws_audit_exporter/postgres"
 )
@@ -61,69 +62,70 @@ var (
 )
 
 // RegisterReservationsMetrics constructs and registers Prometheus metrics
-func RegisterReservationsMetrics() {
+// withAccount labels them with the account, when collecting from accounts
+func RegisterReservationsMetrics(withAccount bool) {
 
 	riEffectiveHourlyPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_effective_unit_price",
 		Help: "The effective price of the reservation per normalization unit",
 	},
-		riLabels)
+		metricLabels(riLabels, withAccount, nil))
 
 	riFixedPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_fixed_unit_price",
 		Help: "The purchase price of the reservation per normalization unit",
 	},
-		riLabels)
+		metricLabels(riLabels, withAccount, nil))
 
 	riHourlyPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_hourly_unit_price",
 		Help: "Hourly reservation reccuring charges per normalization unit",
 	},
-		riLabels)
+		metricLabels(riLabels, withAccount, nil))
 
 	riInstanceCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_count",
 		Help: "Number of reserved instances in this reservation",
 	},
-		riLabels)
+		metricLabels(riLabels, withAccount, nil))
 
 	rilInstanceCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_listing_count",
 		Help: "Number of reserved instances listed on the market for a reservation",
 	},
-		rilLabels)
+		metricLabels(rilLabels, withAccount, nil))
 
 	rilInstancePrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_listing_price",
 		Help: "Current upfront price for which reserved instances are listed on the market",
 	},
-		rilLabels)
+		metricLabels(rilLabels, withAccount, nil))
 
 	riTotalNormalizationUnits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_reserved_instances_normalization_units_total",
 		Help: "Number of total normalization units in this reservation",
 	},
-		riLabels)
+		metricLabels(riLabels, withAccount, nil))
 
-	prometheus.Register(riEffectiveHourlyPrice)
-	prometheus.Register(riFixedPrice)
-	prometheus.Register(riHourlyPrice)
-	prometheus.Register(riInstanceCount)
-	prometheus.Register(rilInstanceCount)
-	prometheus.Register(rilInstancePrice)
-	prometheus.Register(riTotalNormalizationUnits)
+	Registerer.Register(riEffectiveHourlyPrice)
+	Registerer.Register(riFixedPrice)
+	Registerer.Register(riHourlyPrice)
+	Registerer.Register(riInstanceCount)
+	Registerer.Register(rilInstanceCount)
+	Registerer.Register(rilInstancePrice)
+	Registerer.Register(riTotalNormalizationUnits)
 }
 
 // getReservedInstancesListings returns RIs listed on the AWS marketplace
 // gets an RI id as an input to act upon, or nil to return all listings
-func getReservedInstancesListings(svc *ec2.EC2, reservation *ec2.ReservedInstances) ([]*ec2.ReservedInstancesListing, error) {
+func getReservedInstancesListings(ctx context.Context, svc *ec2.EC2, reservation *ec2.ReservedInstances) ([]*ec2.ReservedInstancesListing, error) {
 
 	rilparams := &ec2.DescribeReservedInstancesListingsInput{}
 	// if won't be set, will return all listings
 	if reservation != nil {
 		rilparams.SetReservedInstancesId(*reservation.ReservedInstancesId)
 	}
-	rilresp, err := svc.DescribeReservedInstancesListings(rilparams)
+	rilresp, err := svc.DescribeReservedInstancesListingsWithContext(ctx, rilparams)
 	if err != nil {
 		if strings.Contains(err.Error(), "You cannot list your Reserved Instance") {
 			return nil, nil
@@ -133,24 +135,31 @@ func getReservedInstancesListings(svc *ec2.EC2, reservation *ec2.ReservedInstanc
 	return rilresp.ReservedInstancesListings, nil
 }
 
-// GetReservationsInfo gets RIs information
-func GetReservationsInfo(svc *ec2.EC2) {
-
-	labels := prometheus.Labels{}
-
+// ResetReservationsMetrics drops reservations and listings metrics, before collecting them again for all targets
+func ResetReservationsMetrics() {
 	riEffectiveHourlyPrice.Reset()
 	riFixedPrice.Reset()
 	riHourlyPrice.Reset()
 	riInstanceCount.Reset()
 	riTotalNormalizationUnits.Reset()
+	rilInstanceCount.Reset()
+	rilInstancePrice.Reset()
+}
 
-	resp, err := svc.DescribeReservedInstances(&ec2.DescribeReservedInstancesInput{})
+// GetReservationsInfo gets RIs information, AWS calls and DB writes are cancelled along with ctx
+// account is the name of the account collected from, empty unless accounts are configured
+func GetReservationsInfo(ctx context.Context, svc *ec2.EC2, account string) error {
+
+	labels := prometheus.Labels{}
+
+	resp, err := svc.DescribeReservedInstancesWithContext(ctx, &ec2.DescribeReservedInstancesInput{})
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "there was an error listing instances"))
+		return errors.Wrap(err, "there was an error listing instances")
 	}
 
 	ris := map[string]*ec2.ReservedInstances{}
 	labels = prometheus.Labels{}
+	setAccount(labels, account)
 	reservedInstances := resp.ReservedInstances
 	// oldest reservation in the sysetm will be first to get processed
 	sort.Slice(reservedInstances, func(i, j int) bool {
@@ -182,7 +191,7 @@ func GetReservationsInfo(svc *ec2.EC2) {
 
 		units, err := strconv.ParseFloat(labels["units"], 64)
 		if err != nil {
-			log.Fatal(errors.Wrap(err, "There was an error converting normalization units from string to float64"))
+			return errors.Wrap(err, "There was an error converting normalization units from string to float64")
 		}
 		riTotalNormalizationUnits.With(labels).Add(float64(*r.InstanceCount * int64(units)))
 		// TODO: validate this is hourly !!
@@ -201,39 +210,38 @@ func GetReservationsInfo(svc *ec2.EC2) {
 		// RI that was created from a parent RI that had some of it's instances sold,
 		// will have a ReservedInstancesId pointing to that parent RI, otherwise will point to itself
 		// there can be maximum two different RI ids in the array, one of which always point to itself
-		listings, err := getReservedInstancesListings(svc, r)
+		listings, err := getReservedInstancesListings(ctx, svc, r)
 		if err != nil {
-			log.Fatal(errors.Wrap(err, "there was an error calling getReservedInstancesListings"))
+			return errors.Wrap(err, "there was an error calling getReservedInstancesListings")
 		}
 		// write to db
-		if err := postgres.InsertIntoPGReservations(&labels, RC, FP, effectivePrice, &listings); err != nil {
-			log.Fatal(errors.Wrapf(err, "There was an error calling InsertIntoPGReservations for: %s", labels["ri_id"]))
+		if err := postgres.InsertIntoPGReservations(ctx, &labels, RC, FP, effectivePrice, &listings); err != nil {
+			return errors.Wrapf(err, "There was an error calling InsertIntoPGReservations for: %s", labels["ri_id"])
 		}
 	}
 	// looking for reservations modifications
-	modresp, err := svc.DescribeReservedInstancesModifications(&ec2.DescribeReservedInstancesModificationsInput{})
+	modresp, err := svc.DescribeReservedInstancesModificationsWithContext(ctx, &ec2.DescribeReservedInstancesModificationsInput{})
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "There was an error calling DescribeReservedInstancesModifications"))
+		return errors.Wrap(err, "There was an error calling DescribeReservedInstancesModifications")
 	}
 	modificationEvents := modresp.ReservedInstancesModifications
 	// getting all listings
-	listings, err := getReservedInstancesListings(svc, nil)
+	listings, err := getReservedInstancesListings(ctx, svc, nil)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "there was an error calling getReservedInstancesListings"))
+		return errors.Wrap(err, "there was an error calling getReservedInstancesListings")
 	}
 
 	// write to db
-	if err := postgres.InsertIntoPGReservationsRelations(&modificationEvents, &listings, &reservedInstances); err != nil {
-		log.Fatal(errors.Wrap(err, "There was an error calling InsertIntoPGReservationsRelations"))
+	if err := postgres.InsertIntoPGReservationsRelations(ctx, &modificationEvents, &listings, &reservedInstances); err != nil {
+		return errors.Wrap(err, "There was an error calling InsertIntoPGReservationsRelations")
 	}
 
-	rilInstanceCount.Reset()
-	rilInstancePrice.Reset()
 	labels = prometheus.Labels{}
+	setAccount(labels, account)
 	for _, ril := range listings {
 		r, ok := ris[*ril.ReservedInstancesId]
 		if !ok {
-			log.Println("Reservations listing for unknown reservation")
+			log.WithFields(log.Fields{"region": svc.SigningRegion, "reservation_id": *ril.ReservedInstancesId}).Warn("Reservations listing for unknown reservation")
 			continue
 		}
 		labels["scope"] = *r.Scope
@@ -264,16 +272,17 @@ func GetReservationsInfo(svc *ec2.EC2) {
 				}
 			}
 			// write to db
-			if err := postgres.InsertIntoPGReservationsListings(&labels, uint16(*ic.InstanceCount)); err != nil {
-				log.Fatal(errors.Wrapf(err, "There was an error calling InsertIntoPGReservationsListings for: %s", labels["ril_id"]))
+			if err := postgres.InsertIntoPGReservationsListings(ctx, &labels, uint16(*ic.InstanceCount)); err != nil {
+				return errors.Wrapf(err, "There was an error calling InsertIntoPGReservationsListings for: %s", labels["ril_id"])
 			}
 			if labels["state"] == "sold" {
 				// write to db
-				if err := postgres.InsertIntoPGReservationsListingsSales(&labels,
+				if err := postgres.InsertIntoPGReservationsListingsSales(ctx, &labels,
 					uint16(*ic.InstanceCount), ril.PriceSchedules); err != nil {
-					log.Fatal(errors.Wrapf(err, "There was an error calling InsertIntoPGReservationsListingsSales for:", labels["ril_id"]))
+					return errors.Wrapf(err, "There was an error calling InsertIntoPGReservationsListingsSales for: %s", labels["ril_id"])
 				}
 			}
 		}
 	}
+	return nil
 }
@@ -0,0 +1,217 @@
+package billing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+var (
+	spotSavingsLabels = []string{
+		"az",
+		"family",
+		"instance_id",
+		"instance_type",
+		"product",
+	}
+
+	spotSavingsTotalLabels = []string{
+		"family",
+		"product",
+	}
+
+	spotSavingsHourly *prometheus.GaugeVec
+	spotDiscount      *prometheus.GaugeVec
+	spotSavingsTotal  *prometheus.CounterVec
+
+	// currentSpotPrices holds the current spot prices by account/az/instance_type/product,
+	// as exported by sphPrice. the same az name maps to a different zone in every account
+	currentSpotPrices      = map[string]float64{}
+	currentSpotPricesMutex sync.Mutex
+)
+
+// LoadSpotSavingsTotals returns the savings persisted to postgres, which the savings counter starts off with
+func LoadSpotSavingsTotals() ([]postgres.SpotSavingsTotal, error) {
+	if postgres.DB == nil {
+		return nil, nil
+	}
+	totals, err := postgres.SelectSpotSavingsTotals()
+	if err != nil {
+		return nil, errors.Wrap(err, "There was an error calling SelectSpotSavingsTotals")
+	}
+	return totals, nil
+}
+
+// RegisterSpotSavingsMetrics constructs and registers Prometheus metrics
+// the savings counter starts off with totals, as loaded by LoadSpotSavingsTotals
+// tags persisted are case folded and aliased by tagValues, when set, but don't count against its max values,
+// so that the tag values of running instances aren't exported as "other" because of historical ones
+// withAccount labels them with the account, when collecting from accounts
+func RegisterSpotSavingsMetrics(tagList []string, withAccount bool, instanceTags map[string]string,
+	tagValues *TagValues, totals []postgres.SpotSavingsTotal) {
+
+	spotSavingsHourly = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_savings_hourly_dollars",
+		Help: "hourly savings of active spot instances compared to on-demand, in dollars",
+	},
+		metricLabels(spotSavingsLabels, withAccount, tagList))
+
+	spotDiscount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_discount_percent",
+		Help: "discount of the current spot price of active spot instances off the on-demand price",
+	},
+		metricLabels(spotSavingsLabels, withAccount, tagList))
+
+	spotSavingsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_ec2_spot_savings_dollars_total",
+		Help: "cumulative savings of spot instances compared to on-demand, in dollars",
+	},
+		metricLabels(spotSavingsTotalLabels, withAccount, tagList))
+
+	Registerer.Register(spotSavingsHourly)
+	Registerer.Register(spotDiscount)
+	Registerer.Register(spotSavingsTotal)
+
+	for _, total := range totals {
+		labels := prometheus.Labels{"family": total.Family, "product": total.Product}
+		if withAccount {
+			// savings persisted before accounts were configured are left without an account
+			labels[AccountLabel] = total.Account
+		}
+		for key, label := range instanceTags {
+			labels[label] = "none"
+			if value, ok := total.Tags[key]; ok {
+				labels[label] = tagValues.fold(key, value)
+			}
+		}
+		spotSavingsTotal.With(labels).Add(total.Savings)
+	}
+}
+
+// resetSpotSavingsMetrics drops the savings gauges, which only exist when a price catalog is configured
+func resetSpotSavingsMetrics() {
+	if spotSavingsHourly == nil {
+		return
+	}
+	spotSavingsHourly.Reset()
+	spotDiscount.Reset()
+}
+
+func spotPriceKey(account string, az string, instanceType string, product string) string {
+	return account + "/" + az + "/" + instanceType + "/" + product
+}
+
+// setCurrentSpotPrice records the current spot price in an account
+func setCurrentSpotPrice(account string, az string, instanceType string, product string, price float64) {
+	currentSpotPricesMutex.Lock()
+	defer currentSpotPricesMutex.Unlock()
+	currentSpotPrices[spotPriceKey(account, az, instanceType, product)] = price
+}
+
+// getCurrentSpotPrice returns the current spot price in an account
+// prices are fetched for VPC products on accounts with EC2-Classic, so these are tried as well
+func getCurrentSpotPrice(account string, az string, instanceType string, product string) (float64, bool) {
+	currentSpotPricesMutex.Lock()
+	defer currentSpotPricesMutex.Unlock()
+	if price, ok := currentSpotPrices[spotPriceKey(account, az, instanceType, product)]; ok {
+		return price, true
+	}
+	price, ok := currentSpotPrices[spotPriceKey(account, az, instanceType, product+" (Amazon VPC)")]
+	return price, ok
+}
+
+// SpotSavings parameters to be passed from main
+type SpotSavings struct {
+	Catalog      *pricing.Catalog
+	InstanceTags map[string]string
+	// Account the name of the account collected from, empty unless accounts are configured
+	Account string
+	// lastSeen when each active spot instance was last seen, savings are accumulated from then on
+	lastSeen map[string]time.Time
+}
+
+// KeepLastSeen carries when the active spot instances were last seen by previous over, so that
+// the savings accumulated since are not lost when the collector is replaced, e.g. on reload
+func (s *SpotSavings) KeepLastSeen(previous *SpotSavings) {
+	s.lastSeen = previous.lastSeen
+}
+
+// getSpotSavings compares the current spot price of active spot instances with the on-demand price
+// savings are accumulated since the previous run, and are never negative, as the counter can only go up
+// savings are counted once persisted, those which fail to be are logged and left out of both, and the
+// remaining instances are still accounted for
+func (s *SpotSavings) getSpotSavings(ctx context.Context, requests []*ec2.SpotInstanceRequest,
+	instanceLabelsCache *LabelsCache) error {
+
+	now := time.Now()
+	seen := map[string]time.Time{}
+	failed := 0
+	for _, r := range requests {
+		if r.InstanceId == nil || r.State == nil || *r.State != "active" || r.LaunchedAvailabilityZone == nil ||
+			r.ProductDescription == nil || r.LaunchSpecification == nil || r.LaunchSpecification.InstanceType == nil {
+			continue
+		}
+		labels := prometheus.Labels{
+			"az":            *r.LaunchedAvailabilityZone,
+			"instance_id":   *r.InstanceId,
+			"instance_type": *r.LaunchSpecification.InstanceType,
+			"product":       *r.ProductDescription,
+		}
+		labels["family"], _ = getInstanceTypeDetails(labels["instance_type"])
+		setAccount(labels, s.Account)
+
+		spotPrice, ok := getCurrentSpotPrice(s.Account, labels["az"], labels["instance_type"], labels["product"])
+		if !ok {
+			continue
+		}
+		onDemandPrice, ok := s.Catalog.OnDemandPrice(getRegion(labels["az"]), labels["instance_type"])
+		if !ok || onDemandPrice <= 0 {
+			continue
+		}
+
+		totalLabels := prometheus.Labels{"family": labels["family"], "product": labels["product"]}
+		setAccount(totalLabels, s.Account)
+		tags := map[string]string{}
+		ilabels, _ := instanceLabelsCache.Get(*r.InstanceId)
+		for key, label := range s.InstanceTags {
+			value := "unknown"
+			if v, ok := ilabels[label]; ok {
+				value = v
+			}
+			labels[label] = value
+			totalLabels[label] = value
+			tags[key] = value
+		}
+
+		savings := onDemandPrice - spotPrice
+		spotSavingsHourly.With(labels).Set(savings)
+		spotDiscount.With(labels).Set(savings / onDemandPrice * 100)
+
+		seen[*r.InstanceId] = now
+		last, ok := s.lastSeen[*r.InstanceId]
+		if !ok || savings <= 0 {
+			continue
+		}
+		saved := savings * now.Sub(last).Hours()
+		// write to db
+		if err := postgres.InsertIntoPGSpotSavings(ctx, &labels, tags, saved); err != nil {
+			log.WithField("instance_id", *r.InstanceId).WithError(err).Error("There was an error calling InsertIntoPGSpotSavings")
+			failed++
+			continue
+		}
+		spotSavingsTotal.With(totalLabels).Add(saved)
+	}
+	s.lastSeen = seen
+	if failed > 0 {
+		return errors.Errorf("failed persisting the savings of %d spot instances", failed)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package billing
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/go-pg/pg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+func TestSpotSavingsSeedDoesNotCountTagValues(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	tagValues := NewTagValues(true, 1, nil)
+	totals := []postgres.SpotSavingsTotal{
+		{Family: "m5", Product: "Linux/UNIX", Tags: map[string]string{"team": "Payments"}, Savings: 10},
+		{Family: "m5", Product: "Linux/UNIX", Tags: map[string]string{"team": "search"}, Savings: 5},
+	}
+	RegisterSpotSavingsMetrics([]string{"aws_tag_team"}, false, map[string]string{"team": "aws_tag_team"}, tagValues, totals)
+
+	for team, savings := range map[string]float64{"payments": 10, "search": 5} {
+		labels := prometheus.Labels{"family": "m5", "product": "Linux/UNIX", "aws_tag_team": team}
+		if got := testutil.ToFloat64(spotSavingsTotal.With(labels)); got != savings {
+			t.Errorf("savings of %s = %v, want %v", team, got, savings)
+		}
+	}
+	if got := tagValues.normalize("team", "billing"); got != "billing" {
+		t.Errorf("first value of a running instance = %s, want billing", got)
+	}
+	if got := tagValues.normalize("team", "search"); got != OverflowValue {
+		t.Errorf("second value of a running instance = %s, want %s", got, OverflowValue)
+	}
+}
+
+func TestSpotSavingsSeedByAccount(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	totals := []postgres.SpotSavingsTotal{
+		{Account: "production", Family: "m5", Product: "Linux/UNIX", Savings: 10},
+		{Account: "staging", Family: "m5", Product: "Linux/UNIX", Savings: 5},
+	}
+	RegisterSpotSavingsMetrics(nil, true, nil, nil, totals)
+
+	for account, savings := range map[string]float64{"production": 10, "staging": 5} {
+		labels := prometheus.Labels{"account": account, "family": "m5", "product": "Linux/UNIX"}
+		if got := testutil.ToFloat64(spotSavingsTotal.With(labels)); got != savings {
+			t.Errorf("savings of %s = %v, want %v", account, got, savings)
+		}
+	}
+
+	// without accounts configured, the savings of every account add up
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotSavingsMetrics(nil, false, nil, nil, totals)
+	if got := testutil.ToFloat64(spotSavingsTotal.With(prometheus.Labels{"family": "m5", "product": "Linux/UNIX"})); got != 15 {
+		t.Errorf("savings without accounts = %v, want 15", got)
+	}
+}
+
+func TestSpotSavingsKeepLastSeen(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotSavingsMetrics(nil, false, nil, nil, nil)
+	catalog, err := pricing.ReadCatalog(strings.NewReader("region,instance_type,on_demand\nus-east-1,m5.large,0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCurrentSpotPrice("", "us-east-1a", "m5.large", "Linux/UNIX", 0.04)
+	requests := []*ec2.SpotInstanceRequest{{
+		InstanceId:               aws.String("i-1"),
+		State:                    aws.String("active"),
+		LaunchedAvailabilityZone: aws.String("us-east-1a"),
+		ProductDescription:       aws.String("Linux/UNIX"),
+		LaunchSpecification:      &ec2.LaunchSpecification{InstanceType: aws.String("m5.large")},
+	}}
+
+	// the instance was last seen an hour ago, by the collector replaced on reload
+	previous := &SpotSavings{lastSeen: map[string]time.Time{"i-1": time.Now().Add(-time.Hour)}}
+	s := &SpotSavings{Catalog: catalog}
+	s.KeepLastSeen(previous)
+	if err := s.getSpotSavings(context.Background(), requests, NewLabelsCache(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(spotSavingsTotal); math.Abs(got-0.06) > 0.001 {
+		t.Errorf("savings after reload = %v, want 0.06", got)
+	}
+}
+
+func TestSpotSavingsCountedOncePersisted(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotSavingsMetrics(nil, false, nil, nil, nil)
+	catalog, err := pricing.ReadCatalog(strings.NewReader("region,instance_type,on_demand\nus-east-1,m5.large,0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCurrentSpotPrice("", "us-east-1a", "m5.large", "Linux/UNIX", 0.04)
+	var requests []*ec2.SpotInstanceRequest
+	for _, instanceID := range []string{"i-1", "i-2"} {
+		requests = append(requests, &ec2.SpotInstanceRequest{
+			InstanceId:               aws.String(instanceID),
+			State:                    aws.String("active"),
+			LaunchedAvailabilityZone: aws.String("us-east-1a"),
+			ProductDescription:       aws.String("Linux/UNIX"),
+			LaunchSpecification:      &ec2.LaunchSpecification{InstanceType: aws.String("m5.large")},
+		})
+	}
+
+	// nothing listens there, so that every insert fails
+	postgres.DB = pg.Connect(&pg.Options{Addr: "127.0.0.1:1", DialTimeout: time.Second, MaxRetries: 0})
+	defer func() {
+		postgres.DB.Close()
+		postgres.DB = nil
+	}()
+	hourAgo := time.Now().Add(-time.Hour)
+	s := &SpotSavings{Catalog: catalog, lastSeen: map[string]time.Time{"i-1": hourAgo, "i-2": hourAgo}}
+	if err := s.getSpotSavings(context.Background(), requests, NewLabelsCache(time.Hour)); err == nil ||
+		!strings.Contains(err.Error(), "2 spot instances") {
+		t.Errorf("getSpotSavings() = %v, want both instances failing", err)
+	}
+	if got := testutil.CollectAndCount(spotSavingsTotal); got != 0 {
+		t.Errorf("%d savings series, want none counted before they are persisted", got)
+	}
+	for _, instanceID := range []string{"i-1", "i-2"} {
+		if !s.lastSeen[instanceID].After(hourAgo) {
+			t.Errorf("%s last seen %v, want the current cycle", instanceID, s.lastSeen[instanceID])
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package billing
 
 import (
-	"log"
+	"context"
 	"strconv"
 	"time"
 
@@ -45,76 +45,104 @@ var (
 )
 
 // RegisterSpotsMetrics constructs and registers Prometheus metrics
-func RegisterSpotsMetrics(tagList []string) {
+// withAccount labels them with the account, when collecting from accounts
+func RegisterSpotsMetrics(tagList []string, withAccount bool) {
 
 	siBidPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_spot_request_bid_price_hourly_dollars",
 		Help: "cost of spot instances hourly usage in dollars",
 	},
-		append(siLabels, tagList...))
+		metricLabels(siLabels, withAccount, tagList))
 
 	siBlockHourlyPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_spot_request_actual_block_price_hourly_dollars",
 		Help: "fixed hourly cost of limited duration spot instances in dollars",
 	},
-		append(siLabels, tagList...))
+		metricLabels(siLabels, withAccount, tagList))
 
 	siCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_spot_request_count",
 		Help: "Number of active/fullfilled spot requests",
 	},
-		append(siLabels, tagList...))
+		metricLabels(siLabels, withAccount, tagList))
 
-	prometheus.Register(siBidPrice)
-	prometheus.Register(siBlockHourlyPrice)
-	prometheus.Register(siCount)
+	Registerer.Register(siBidPrice)
+	Registerer.Register(siBlockHourlyPrice)
+	Registerer.Register(siCount)
 }
 
 // RegisterSpotsPricesMetrics constructs and registers Prometheus metrics
-func RegisterSpotsPricesMetrics() {
+// withAccount labels them with the account, when collecting from accounts
+func RegisterSpotsPricesMetrics(withAccount bool) {
 
 	sphPrice = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "aws_ec2_spot_price_per_hour_dollars",
 		Help: "Current market price of a spot instance, per hour,  in dollars",
 	},
-		sphLabels)
+		metricLabels(sphLabels, withAccount, nil))
 
-	prometheus.Register(sphPrice)
+	Registerer.Register(sphPrice)
 }
 
 // Spots parameters to be passed from main
 type Spots struct {
 	Svc                 *ec2.EC2
-	InstanceLabelsCache *map[string]prometheus.Labels
+	InstanceLabelsCache *LabelsCache
 	InstanceTags        map[string]string
+	// Filters when set, only spot requests of collected instances are collected, and requests
+	// without an instance by their own tags
+	Filters *Filters
+	// TagValues when set, normalizes tag labels values of requests without an instance
+	TagValues *TagValues
+	// Savings when set, savings of active spot instances compared to on-demand are exported as well
+	Savings *SpotSavings
+	// Account name of the account collected from, empty unless accounts are configured
+	Account string
 }
 
-// GetSpotsInfo gets spot instances information
-func (s *Spots) GetSpotsInfo() {
-
-	resp, err := s.Svc.DescribeSpotInstanceRequests(&ec2.DescribeSpotInstanceRequestsInput{})
-	if err != nil {
-		log.Fatal(errors.Wrap(err, "there was an error listing spot requests"))
-	}
-
-	labels := prometheus.Labels{}
+// ResetSpotsMetrics drops spot requests and savings gauges, before collecting them again for all targets
+func ResetSpotsMetrics() {
 	siBidPrice.Reset()
 	siBlockHourlyPrice.Reset()
 	siCount.Reset()
+	resetSpotSavingsMetrics()
+}
 
-	for _, r := range resp.SpotInstanceRequests {
-		if r.InstanceId != nil {
-			if ilabels, ok := (*s.InstanceLabelsCache)[*r.InstanceId]; ok {
-				for k, v := range ilabels {
-					labels[k] = v
-				}
-			} else {
-				for _, label := range s.InstanceTags {
-					labels[label] = "unknown"
+// requestTagLabels returns a new set of the tag labels of a spot request, requests with an instance are
+// labeled with the tags of their instance, requests without one with their own tags
+func (s *Spots) requestTagLabels(r *ec2.SpotInstanceRequest) prometheus.Labels {
+	if r.InstanceId != nil {
+		return s.InstanceLabelsCache.instanceLabels(*r.InstanceId, s.InstanceTags)
+	}
+	return tagLabels(r.Tags, s.InstanceTags, s.TagValues)
+}
+
+// GetSpotsInfo gets spot instances information, AWS calls and DB writes are cancelled along with ctx
+func (s *Spots) GetSpotsInfo(ctx context.Context) error {
+
+	resp, err := s.Svc.DescribeSpotInstanceRequestsWithContext(ctx, &ec2.DescribeSpotInstanceRequestsInput{})
+	if err != nil {
+		return errors.Wrap(err, "there was an error listing spot requests")
+	}
+
+	requests := resp.SpotInstanceRequests
+	if !s.Filters.IsEmpty() {
+		requests = []*ec2.SpotInstanceRequest{}
+		for _, r := range resp.SpotInstanceRequests {
+			if r.InstanceId != nil {
+				if !s.InstanceLabelsCache.has(*r.InstanceId) {
+					continue
 				}
+			} else if !s.Filters.matchTags(r.Tags) {
+				continue
 			}
+			requests = append(requests, r)
 		}
+	}
 
+	for _, r := range requests {
+		labels := s.requestTagLabels(r)
+		setAccount(labels, s.Account)
 		labels["az"] = *r.LaunchedAvailabilityZone
 		labels["request_id"] = *r.SpotInstanceRequestId
 		labels["state"] = *r.State
@@ -161,18 +189,26 @@ func (s *Spots) GetSpotsInfo() {
 
 		siCount.With(labels).Inc()
 	}
+
+	if s.Savings != nil {
+		return s.Savings.getSpotSavings(ctx, requests, s.InstanceLabelsCache)
+	}
+	return nil
 }
 
-// GetSpotsCurrentPrices gets spot current prices
-func GetSpotsCurrentPrices(svc *ec2.EC2, pList []*string) {
+// GetSpotsCurrentPrices gets spot current prices, AWS calls and DB writes are cancelled along with ctx
+// account is the name of the account collected from, empty unless accounts are configured
+func GetSpotsCurrentPrices(ctx context.Context, svc *ec2.EC2, pList []*string, account string) error {
 	phParams := &ec2.DescribeSpotPriceHistoryInput{
 		StartTime:           aws.Time(time.Now()),
 		EndTime:             aws.Time(time.Now()),
 		ProductDescriptions: pList,
 	}
-	err := svc.DescribeSpotPriceHistoryPages(phParams,
+	var insertErr error
+	err := svc.DescribeSpotPriceHistoryPagesWithContext(ctx, phParams,
 		func(page *ec2.DescribeSpotPriceHistoryOutput, lastPage bool) bool {
 			spLabels := prometheus.Labels{}
+			setAccount(spLabels, account)
 			for _, sp := range page.SpotPriceHistory {
 				spLabels["az"] = *sp.AvailabilityZone
 				spLabels["product"] = *sp.ProductDescription
@@ -181,9 +217,11 @@ func GetSpotsCurrentPrices(svc *ec2.EC2, pList []*string) {
 				if sp.SpotPrice != nil {
 					if f, err := strconv.ParseFloat(*sp.SpotPrice, 64); err == nil {
 						sphPrice.With(spLabels).Set(f)
+						setCurrentSpotPrice(account, spLabels["az"], spLabels["instance_type"], spLabels["product"], f)
 						// write to db
-						if err = postgres.InsertIntoPGSpotPrices(&spLabels, f); err != nil {
-							log.Fatal(errors.Wrap(err, "There was an error calling insertIntoPGSpotPrices"))
+						if err = postgres.InsertIntoPGSpotPrices(ctx, &spLabels, f); err != nil {
+							insertErr = errors.Wrap(err, "There was an error calling insertIntoPGSpotPrices")
+							return false
 						}
 					}
 				}
@@ -192,6 +230,7 @@ func GetSpotsCurrentPrices(svc *ec2.EC2, pList []*string) {
 		})
 
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "there was an error listing spot requests"))
+		return errors.Wrap(err, "there was an error listing spot prices")
 	}
+	return insertErr
 }
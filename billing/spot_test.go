@@ -0,0 +1,92 @@
+package billing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testSpotRequestLabels labels of a spot request, as collected
+func testSpotRequestLabels() prometheus.Labels {
+	labels := prometheus.Labels{"team": "payments"}
+	for _, label := range siLabels {
+		labels[label] = "x"
+	}
+	return labels
+}
+
+func TestResetSpotsMetricsWithoutSavings(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	spotSavingsHourly, spotDiscount = nil, nil
+	RegisterSpotsMetrics([]string{"team"}, false)
+	siCount.With(testSpotRequestLabels()).Set(1)
+	siBidPrice.With(testSpotRequestLabels()).Set(0.1)
+
+	// savings gauges are only registered along with a price catalog
+	ResetSpotsMetrics()
+	if n := testutil.CollectAndCount(siCount) + testutil.CollectAndCount(siBidPrice); n != 0 {
+		t.Errorf("%d spot requests series left after reset, want none", n)
+	}
+	if spotSavingsHourly != nil || spotDiscount != nil {
+		t.Error("reset registered the savings gauges")
+	}
+}
+
+func TestResetSpotsMetricsWithSavings(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotsMetrics([]string{"team"}, false)
+	RegisterSpotSavingsMetrics([]string{"team"}, false, map[string]string{"team": "team"}, nil, nil)
+	labels := prometheus.Labels{"az": "us-east-1a", "family": "m5", "instance_id": "i-1",
+		"instance_type": "m5.large", "product": "Linux/UNIX", "team": "payments"}
+	spotSavingsHourly.With(labels).Set(0.06)
+	spotDiscount.With(labels).Set(62.5)
+	spotSavingsTotal.With(prometheus.Labels{"family": "m5", "product": "Linux/UNIX", "team": "payments"}).Add(10)
+
+	ResetSpotsMetrics()
+	if n := testutil.CollectAndCount(spotSavingsHourly) + testutil.CollectAndCount(spotDiscount); n != 0 {
+		t.Errorf("%d savings series left after reset, want none", n)
+	}
+	// the cumulative savings survive collection cycles
+	if got := testutil.ToFloat64(spotSavingsTotal); got != 10 {
+		t.Errorf("savings total after reset = %v, want 10", got)
+	}
+}
+
+func TestRequestTagLabels(t *testing.T) {
+	cache := NewLabelsCache(time.Hour)
+	cache.Set("i-1", prometheus.Labels{"aws_tag_team": "payments", "aws_tag_env": "production"}, false)
+	s := &Spots{
+		InstanceLabelsCache: cache,
+		InstanceTags:        map[string]string{"team": "aws_tag_team", "env": "aws_tag_env"},
+		TagValues:           NewTagValues(true, 0, nil),
+	}
+
+	// requests without an instance don't inherit the labels of the request before them
+	for _, test := range []struct {
+		request *ec2.SpotInstanceRequest
+		want    prometheus.Labels
+	}{
+		{&ec2.SpotInstanceRequest{InstanceId: aws.String("i-1")},
+			prometheus.Labels{"aws_tag_team": "payments", "aws_tag_env": "production"}},
+		{&ec2.SpotInstanceRequest{},
+			prometheus.Labels{"aws_tag_team": "none", "aws_tag_env": "none"}},
+		{&ec2.SpotInstanceRequest{Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("Search")}}},
+			prometheus.Labels{"aws_tag_team": "search", "aws_tag_env": "none"}},
+		{&ec2.SpotInstanceRequest{InstanceId: aws.String("i-2")},
+			prometheus.Labels{"aws_tag_team": "unknown", "aws_tag_env": "unknown"}},
+	} {
+		labels := s.requestTagLabels(test.request)
+		if !reflect.DeepEqual(labels, test.want) {
+			t.Errorf("requestTagLabels(%v) = %v, want %v", test.request, labels, test.want)
+		}
+		labels["az"] = "us-east-1a"
+	}
+	if labels, _ := cache.Get("i-1"); len(labels) != 2 {
+		t.Errorf("cached labels = %v, want them left as they are", labels)
+	}
+}
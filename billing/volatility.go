@@ -0,0 +1,183 @@
+package billing
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+var (
+	sphStatsLabels = []string{
+		"az",
+		"family",
+		"instance_type",
+		"product",
+		"window",
+	}
+
+	sphOnDemandLabels = []string{
+		"az",
+		"family",
+		"instance_type",
+		"product",
+	}
+
+	// sphStatsWindows windows rolling statistics are computed over
+	sphStatsWindows = []statsWindow{
+		{"1h", time.Hour},
+		{"24h", 24 * time.Hour},
+		{"7d", 7 * 24 * time.Hour},
+	}
+
+	sphMin           *prometheus.GaugeVec
+	sphMax           *prometheus.GaugeVec
+	sphStddev        *prometheus.GaugeVec
+	sphChanges       *prometheus.GaugeVec
+	sphAnomaly       *prometheus.GaugeVec
+	sphOnDemandRatio *prometheus.GaugeVec
+)
+
+// RegisterSpotsPricesStatsMetrics constructs and registers Prometheus metrics
+// withAccount labels them with the account, when collecting from accounts
+func RegisterSpotsPricesStatsMetrics(withAccount bool) {
+
+	sphMin = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_price_min_per_hour_dollars",
+		Help: "Minimal spot price during the window, per hour, in dollars",
+	},
+		metricLabels(sphStatsLabels, withAccount, nil))
+
+	sphMax = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_price_max_per_hour_dollars",
+		Help: "Maximal spot price during the window, per hour, in dollars",
+	},
+		metricLabels(sphStatsLabels, withAccount, nil))
+
+	sphStddev = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_price_stddev_per_hour_dollars",
+		Help: "Standard deviation of the spot price during the window, per hour, in dollars",
+	},
+		metricLabels(sphStatsLabels, withAccount, nil))
+
+	sphChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_price_changes",
+		Help: "Number of times the spot price changed during the window",
+	},
+		metricLabels(sphStatsLabels, withAccount, nil))
+
+	sphAnomaly = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_price_anomaly",
+		Help: "1 when the current spot price breaches the z-score over the window, 0 otherwise",
+	},
+		metricLabels(sphStatsLabels, withAccount, nil))
+
+	sphOnDemandRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_spot_price_on_demand_ratio",
+		Help: "Current spot price as a fraction of the on-demand price",
+	},
+		metricLabels(sphOnDemandLabels, withAccount, nil))
+
+	Registerer.Register(sphMin)
+	Registerer.Register(sphMax)
+	Registerer.Register(sphStddev)
+	Registerer.Register(sphChanges)
+	Registerer.Register(sphAnomaly)
+	Registerer.Register(sphOnDemandRatio)
+}
+
+// minStatsWindowSamples number of spot prices a window must span for its statistics to be computed
+const minStatsWindowSamples = 4
+
+// statsWindow a window rolling statistics are computed over
+type statsWindow struct {
+	name   string
+	length time.Duration
+}
+
+// SpotsPricesStats parameters to be passed from main
+type SpotsPricesStats struct {
+	// Catalog when set, current prices are exported as a fraction of the on-demand price
+	Catalog *pricing.Catalog
+	// ZScore number of standard deviations away from the mean, above which the current price is an anomaly
+	ZScore float64
+	// Interval spot prices are collected every, windows spanning less than minStatsWindowSamples
+	// prices are left out
+	Interval time.Duration
+}
+
+// windows returns the windows spanning at least minStatsWindowSamples spot prices
+func (s *SpotsPricesStats) windows() []statsWindow {
+	windows := []statsWindow{}
+	for _, window := range sphStatsWindows {
+		if window.length >= minStatsWindowSamples*s.Interval {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// GetSpotsPricesStats computes rolling statistics out of the spot prices stored in postgres
+func (s *SpotsPricesStats) GetSpotsPricesStats(ctx context.Context) error {
+	// exist silently if database was not initialized
+	if postgres.DB == nil {
+		return nil
+	}
+
+	sphMin.Reset()
+	sphMax.Reset()
+	sphStddev.Reset()
+	sphChanges.Reset()
+	sphAnomaly.Reset()
+	sphOnDemandRatio.Reset()
+
+	for _, window := range s.windows() {
+		stats, err := postgres.SelectSpotPriceStats(ctx, time.Now().Add(-window.length))
+		if err != nil {
+			return errors.Wrap(err, "There was an error calling SelectSpotPriceStats")
+		}
+		s.setStats(window.name, stats)
+	}
+	return nil
+}
+
+// setStats exports the statistics of a window, flagging current prices breaching the z-score
+func (s *SpotsPricesStats) setStats(window string, stats []postgres.SpotPriceStats) {
+	for _, stat := range stats {
+		labels := prometheus.Labels{
+			"az":            stat.Az,
+			"family":        stat.Family,
+			"instance_type": stat.InstanceType,
+			"product":       stat.Product,
+			"window":        window,
+		}
+		setAccount(labels, stat.Account)
+		sphMin.With(labels).Set(stat.Min)
+		sphMax.With(labels).Set(stat.Max)
+		sphStddev.With(labels).Set(stat.Stddev)
+		sphChanges.With(labels).Set(float64(stat.Changes))
+
+		current, ok := getCurrentSpotPrice(stat.Account, stat.Az, stat.InstanceType, stat.Product)
+		if !ok {
+			continue
+		}
+		anomaly := 0.0
+		if stat.Stddev > 0 && math.Abs(current-stat.Mean)/stat.Stddev > s.ZScore {
+			anomaly = 1
+		}
+		sphAnomaly.With(labels).Set(anomaly)
+
+		if s.Catalog == nil {
+			continue
+		}
+		if onDemand, ok := s.Catalog.OnDemandPrice(getRegion(stat.Az), stat.InstanceType); ok && onDemand > 0 {
+			delete(labels, "window")
+			sphOnDemandRatio.With(labels).Set(current / onDemand)
+		}
+	}
+}
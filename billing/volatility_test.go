@@ -0,0 +1,121 @@
+package billing
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+func TestSpotsPricesStats(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotsPricesStatsMetrics(false)
+	catalog, err := pricing.ReadCatalog(strings.NewReader("region,instance_type,on_demand\nus-east-1,m5.large,0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// spiking above mean + 2 stddev, stable, and priced for the VPC product only
+	setCurrentSpotPrice("", "us-east-1a", "m5.large", "Linux/UNIX", 0.05)
+	setCurrentSpotPrice("", "us-east-1b", "m5.large", "Linux/UNIX", 0.035)
+	setCurrentSpotPrice("", "us-east-1c", "m5.large", "Windows (Amazon VPC)", 0.08)
+	stats := []postgres.SpotPriceStats{
+		{Az: "us-east-1a", InstanceType: "m5.large", Product: "Linux/UNIX", Family: "m5", Min: 0.03, Max: 0.05, Mean: 0.035, Stddev: 0.005, Changes: 4},
+		{Az: "us-east-1b", InstanceType: "m5.large", Product: "Linux/UNIX", Family: "m5", Min: 0.035, Max: 0.035, Mean: 0.035},
+		{Az: "us-east-1c", InstanceType: "m5.large", Product: "Windows", Family: "m5", Min: 0.07, Max: 0.09, Mean: 0.08, Stddev: 0.01, Changes: 2},
+		{Az: "us-east-1d", InstanceType: "m5.large", Product: "Linux/UNIX", Family: "m5", Min: 0.03, Max: 0.04, Mean: 0.035, Stddev: 0.005},
+	}
+	s := &SpotsPricesStats{Catalog: catalog, ZScore: 2}
+	s.setStats("24h", stats)
+
+	labels := func(az, product string) prometheus.Labels {
+		return prometheus.Labels{"az": az, "family": "m5", "instance_type": "m5.large", "product": product, "window": "24h"}
+	}
+	a := labels("us-east-1a", "Linux/UNIX")
+	if min, max, changes := testutil.ToFloat64(sphMin.With(a)), testutil.ToFloat64(sphMax.With(a)), testutil.ToFloat64(sphChanges.With(a)); min != 0.03 || max != 0.05 || changes != 4 {
+		t.Errorf("stats of us-east-1a = %v, %v, %v", min, max, changes)
+	}
+	for _, test := range []struct {
+		labels  prometheus.Labels
+		anomaly float64
+	}{
+		{a, 1},
+		// no deviation is never an anomaly
+		{labels("us-east-1b", "Linux/UNIX"), 0},
+		{labels("us-east-1c", "Windows"), 0},
+	} {
+		if got := testutil.ToFloat64(sphAnomaly.With(test.labels)); got != test.anomaly {
+			t.Errorf("anomaly of %s = %v, want %v", test.labels["az"], got, test.anomaly)
+		}
+	}
+	// without a current price only the window statistics are exported
+	if got := testutil.CollectAndCount(sphAnomaly); got != 3 {
+		t.Errorf("%d anomaly series, want 3", got)
+	}
+
+	ratio := labels("us-east-1a", "Linux/UNIX")
+	delete(ratio, "window")
+	if got := testutil.ToFloat64(sphOnDemandRatio.With(ratio)); got != 0.5 {
+		t.Errorf("on-demand ratio = %v, want 0.5", got)
+	}
+
+	// without a catalog no ratio is exported
+	sphOnDemandRatio.Reset()
+	(&SpotsPricesStats{ZScore: 2}).setStats("24h", stats)
+	if got := testutil.CollectAndCount(sphOnDemandRatio); got != 0 {
+		t.Errorf("%d on-demand ratio series without a catalog, want 0", got)
+	}
+}
+
+func TestSpotsPricesStatsAccounts(t *testing.T) {
+	Registerer = prometheus.NewRegistry()
+	RegisterSpotsPricesStatsMetrics(true)
+
+	// the same az name is a different zone, priced differently, in every account
+	setCurrentSpotPrice("production", "us-east-1a", "m5.large", "Linux/UNIX", 0.05)
+	setCurrentSpotPrice("staging", "us-east-1a", "m5.large", "Linux/UNIX", 0.035)
+	stats := []postgres.SpotPriceStats{
+		{Account: "production", Az: "us-east-1a", InstanceType: "m5.large", Product: "Linux/UNIX", Family: "m5", Min: 0.03, Max: 0.05, Mean: 0.035, Stddev: 0.005},
+		{Account: "staging", Az: "us-east-1a", InstanceType: "m5.large", Product: "Linux/UNIX", Family: "m5", Min: 0.03, Max: 0.04, Mean: 0.035, Stddev: 0.005},
+	}
+	(&SpotsPricesStats{ZScore: 2}).setStats("24h", stats)
+
+	for account, anomaly := range map[string]float64{"production": 1, "staging": 0} {
+		labels := prometheus.Labels{"account": account, "az": "us-east-1a", "family": "m5",
+			"instance_type": "m5.large", "product": "Linux/UNIX", "window": "24h"}
+		if got := testutil.ToFloat64(sphAnomaly.With(labels)); got != anomaly {
+			t.Errorf("anomaly of %s = %v, want %v", account, got, anomaly)
+		}
+	}
+	if got := testutil.CollectAndCount(sphMax); got != 2 {
+		t.Errorf("%d max series, want one per account", got)
+	}
+}
+
+func TestSpotsPricesStatsWindows(t *testing.T) {
+	for _, tt := range []struct {
+		interval time.Duration
+		want     []string
+	}{
+		{15 * time.Minute, []string{"1h", "24h", "7d"}},
+		{time.Hour, []string{"24h", "7d"}},
+		{6 * time.Hour, []string{"24h", "7d"}},
+		{12 * time.Hour, []string{"7d"}},
+		{3 * 24 * time.Hour, []string{}},
+	} {
+		s := &SpotsPricesStats{Interval: tt.interval}
+		names := []string{}
+		for _, window := range s.windows() {
+			names = append(names, window.name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("windows with a %v interval = %v, want %v", tt.interval, names, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	volumesLabels = []string{
+		"attached",
+		"az",
+		"state",
+		"volume_type",
+	}
+
+	volumesCount           *prometheus.GaugeVec
+	volumesSize            *prometheus.GaugeVec
+	volumesProvisionedIops *prometheus.GaugeVec
+)
+
+// RegisterVolumesMetrics constructs and registers Prometheus metrics
+// withAccount labels them with the account, when collecting from accounts
+func RegisterVolumesMetrics(tagList []string, withAccount bool) {
+
+	volumesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_volumes_count",
+		Help: "Number of EBS volumes",
+	},
+		metricLabels(volumesLabels, withAccount, tagList))
+
+	volumesSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_volumes_size_gibibytes",
+		Help: "Size of EBS volumes, in GiB",
+	},
+		metricLabels(volumesLabels, withAccount, tagList))
+
+	volumesProvisionedIops = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_ec2_volumes_provisioned_iops",
+		Help: "IOPS provisioned for EBS volumes",
+	},
+		metricLabels(volumesLabels, withAccount, tagList))
+
+	Registerer.Register(volumesCount)
+	Registerer.Register(volumesSize)
+	Registerer.Register(volumesProvisionedIops)
+}
+
+// Volumes parameters to be passed from main
+type Volumes struct {
+	Svc                 *ec2.EC2
+	InstanceLabelsCache *LabelsCache
+	InstanceTags        map[string]string
+	// Filters when set, only volumes attached to collected instances are collected, and unattached
+	// volumes by their own tags
+	Filters *Filters
+	// TagValues when set, normalizes tag labels values of unattached volumes
+	TagValues *TagValues
+	// Account name of the account collected from, empty unless accounts are configured
+	Account string
+}
+
+// ResetVolumesMetrics drops volumes metrics, before collecting them again for all targets
+func ResetVolumesMetrics() {
+	volumesCount.Reset()
+	volumesSize.Reset()
+	volumesProvisionedIops.Reset()
+}
+
+// volumeLabels returns the labels of a volume, and whether it is collected
+// attached volumes are labeled with the tags of their instance, unattached ones with their own tags
+func (s *Volumes) volumeLabels(v *ec2.Volume) (prometheus.Labels, bool) {
+	var labels prometheus.Labels
+	if len(v.Attachments) > 0 && v.Attachments[0].InstanceId != nil {
+		instanceID := *v.Attachments[0].InstanceId
+		if !s.Filters.IsEmpty() && !s.InstanceLabelsCache.has(instanceID) {
+			return nil, false
+		}
+		labels = s.InstanceLabelsCache.instanceLabels(instanceID, s.InstanceTags)
+		labels["attached"] = "true"
+	} else {
+		if !s.Filters.matchTags(v.Tags) {
+			return nil, false
+		}
+		labels = tagLabels(v.Tags, s.InstanceTags, s.TagValues)
+		labels["attached"] = "false"
+	}
+	setAccount(labels, s.Account)
+	labels["az"] = *v.AvailabilityZone
+	labels["state"] = *v.State
+	labels["volume_type"] = *v.VolumeType
+	return labels, true
+}
+
+// GetVolumesInfo gets EBS volumes information, AWS calls are cancelled along with ctx
+func (s *Volumes) GetVolumesInfo(ctx context.Context) error {
+	err := s.Svc.DescribeVolumesPagesWithContext(ctx, &ec2.DescribeVolumesInput{},
+		func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, v := range page.Volumes {
+				labels, ok := s.volumeLabels(v)
+				if !ok {
+					continue
+				}
+				volumesCount.With(labels).Inc()
+				if v.Size != nil {
+					volumesSize.With(labels).Add(float64(*v.Size))
+				}
+				if v.Iops != nil {
+					volumesProvisionedIops.With(labels).Add(float64(*v.Iops))
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return errors.Wrap(err, "there was an error listing volumes")
+	}
+	return nil
+}
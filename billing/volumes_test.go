@@ -0,0 +1,73 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testVolume returns an attached volume when instanceID is set, with tags as key, value pairs
+func testVolume(instanceID string, tags ...string) *ec2.Volume {
+	v := &ec2.Volume{
+		AvailabilityZone: aws.String("us-east-1a"),
+		State:            aws.String(ec2.VolumeStateInUse),
+		VolumeType:       aws.String(ec2.VolumeTypeGp2),
+	}
+	if len(instanceID) > 0 {
+		v.Attachments = []*ec2.VolumeAttachment{{InstanceId: aws.String(instanceID)}}
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		v.Tags = append(v.Tags, &ec2.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+	}
+	return v
+}
+
+func TestVolumeLabels(t *testing.T) {
+	cache := NewLabelsCache(0)
+	cache.Set("i-1", prometheus.Labels{"aws_tag_team": "payments"}, false)
+	filters, err := NewFilters(nil, nil, map[string][]string{"team": {"pay*"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filters  *Filters
+		volume   *ec2.Volume
+		expected string
+		attached string
+	}{
+		{"attached to a cached instance", nil, testVolume("i-1", "team", "other"), "payments", "true"},
+		{"attached to an unknown instance", nil, testVolume("i-2"), "unknown", "true"},
+		{"unattached", nil, testVolume("", "team", "Search"), "search", "false"},
+		{"unattached without tags", nil, testVolume(""), "none", "false"},
+		{"filtered attached to a cached instance", filters, testVolume("i-1"), "payments", "true"},
+		{"filtered attached to an instance left out", filters, testVolume("i-2", "team", "payments"), "", ""},
+		{"filtered unattached matching", filters, testVolume("", "team", "payments"), "payments", "false"},
+		{"filtered unattached not matching", filters, testVolume("", "team", "search"), "", ""},
+	}
+	for _, test := range tests {
+		s := &Volumes{
+			InstanceLabelsCache: cache,
+			InstanceTags:        map[string]string{"team": "aws_tag_team"},
+			Filters:             test.filters,
+			TagValues:           NewTagValues(true, 0, nil),
+		}
+		labels, ok := s.volumeLabels(test.volume)
+		if ok != (test.expected != "") {
+			t.Errorf("%s: collected = %v", test.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if labels["aws_tag_team"] != test.expected || labels["attached"] != test.attached {
+			t.Errorf("%s: labels = %v, want aws_tag_team=%s attached=%s", test.name, labels, test.expected, test.attached)
+		}
+		if labels["az"] != "us-east-1a" || labels["volume_type"] != ec2.VolumeTypeGp2 {
+			t.Errorf("%s: labels = %v", test.name, labels)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Collectors names
+const (
+	Instances    = "instances"
+	Reservations = "reservations"
+	SpotPrices   = "spot_prices"
+	SpotRequests = "spot_requests"
+	Volumes      = "volumes"
+	SpotFleets   = "spot_fleets"
+)
+
+// collectors names, in order
+var collectors = []string{Instances, Reservations, SpotPrices, SpotRequests, Volumes, SpotFleets}
+
+var (
+	regionRegexp  = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-[0-9]+$`)
+	roleARNRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/.+$`)
+	vpcIDRegexp   = regexp.MustCompile(`^vpc-[0-9a-f]+$`)
+	// operationRegexp AWS API operation names, e.g. DescribeInstances
+	operationRegexp = regexp.MustCompile(`^([A-Z][A-Za-z0-9]+|\*)$`)
+
+	instanceStates = []string{"pending", "running", "shutting-down", "terminated", "stopping", "stopped"}
+
+	// DroppableLabels instances metrics labels which can be dropped into aws_ec2_instance_info
+	DroppableLabels = []string{"groups", "instance_id", "launch_time", "owner_id", "requester_id"}
+)
+
+// Duration a time.Duration read from a string such as "5m"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration, used by TOML
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// UnmarshalYAML parses a duration
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(text))
+}
+
+// Collector schedule of a collector
+// Enabled defaults to true, except for the collectors DisabledByDefault left out of the config,
+// Timeout bounds every cycle of the collector, its AWS API requests and DB writes, 0 is no timeout
+type Collector struct {
+	Enabled  *bool    `yaml:"enabled" toml:"enabled"`
+	Interval Duration `yaml:"interval" toml:"interval"`
+	Timeout  Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// IsEnabled returns whether the collector should run
+func (c *Collector) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// Account an AWS account collected through an assumed role
+// when no account is configured, the default credentials are used
+type Account struct {
+	Name    string `yaml:"name" toml:"name"`
+	RoleARN string `yaml:"role_arn" toml:"role_arn"`
+}
+
+// Filters restrict the resources collected, tag values are globs with * and ? wildcards,
+// or regular expressions between slashes
+type Filters struct {
+	InstanceStates []string            `yaml:"instance_states" toml:"instance_states"`
+	VpcIDs         []string            `yaml:"vpc_ids" toml:"vpc_ids"`
+	IncludeTags    map[string][]string `yaml:"include_tags" toml:"include_tags"`
+	ExcludeTags    map[string][]string `yaml:"exclude_tags" toml:"exclude_tags"`
+}
+
+// Labels normalizes tag labels values, and controls the cardinality of the instances metrics
+// Aliases lists the values replaced by every value, by tag key. Drop labels are exported on aws_ec2_instance_info only
+type Labels struct {
+	CaseFold  bool                           `yaml:"case_fold" toml:"case_fold"`
+	MaxValues int                            `yaml:"max_values" toml:"max_values"`
+	Aliases   map[string]map[string][]string `yaml:"aliases" toml:"aliases"`
+	Drop      []string                       `yaml:"drop" toml:"drop"`
+}
+
+// OTLP exports the billing metrics to an OpenTelemetry collector, when Endpoint is set
+// Endpoint is host:port with the grpc protocol, and the full url, e.g. http://collector:4318/v1/metrics, with http
+// Insecure disables TLS of grpc, http uses TLS with https urls
+type OTLP struct {
+	Endpoint string            `yaml:"endpoint" toml:"endpoint"`
+	Protocol string            `yaml:"protocol" toml:"protocol"`
+	Insecure bool              `yaml:"insecure" toml:"insecure"`
+	Headers  map[string]string `yaml:"headers" toml:"headers"`
+	Interval Duration          `yaml:"interval" toml:"interval"`
+	Timeout  Duration          `yaml:"timeout" toml:"timeout"`
+}
+
+// OTLP protocols
+const (
+	OTLPGRPC = "grpc"
+	OTLPHTTP = "http"
+)
+
+// Config holds the exporter configuration, read from a YAML or a TOML file
+type Config struct {
+	Addr         string                `yaml:"addr" toml:"addr"`
+	DBURL        string                `yaml:"db_url" toml:"db_url"`
+	PriceCatalog string                `yaml:"price_catalog" toml:"price_catalog"`
+	Regions      []string              `yaml:"regions" toml:"regions"`
+	Accounts     []Account             `yaml:"accounts" toml:"accounts"`
+	InstanceTags []string              `yaml:"instance_tags" toml:"instance_tags"`
+	SpotOS       []string              `yaml:"spot_os" toml:"spot_os"`
+	Collectors   map[string]*Collector `yaml:"collectors" toml:"collectors"`
+	Filters      Filters               `yaml:"filters" toml:"filters"`
+	Labels       Labels                `yaml:"labels" toml:"labels"`
+	// LabelsCacheTTL instances tag labels are kept this long after their instance was last seen
+	LabelsCacheTTL Duration `yaml:"labels_cache_ttl" toml:"labels_cache_ttl"`
+	OTLP           OTLP     `yaml:"otlp" toml:"otlp"`
+	// APIRateLimits AWS API requests per second by operation, per account and region, "*" limits every other operation
+	APIRateLimits map[string]float64 `yaml:"api_rate_limits" toml:"api_rate_limits"`
+}
+
+// defaults used unless set otherwise
+const (
+	DefaultLabelsCacheTTL = time.Hour
+	DefaultOTLPInterval   = time.Minute
+	DefaultOTLPTimeout    = 10 * time.Second
+)
+
+// DefaultIntervals collectors intervals when not configured
+// collectors without a default run every --duration
+var DefaultIntervals = map[string]time.Duration{
+	SpotPrices: time.Hour,
+}
+
+// DisabledByDefault collectors which only run when configured, as they need more IAM permissions
+var DisabledByDefault = map[string]bool{
+	Volumes:    true,
+	SpotFleets: true,
+}
+
+// Load reads the configuration file, TOML files are expected to have a .toml extension,
+// anything else is read as YAML. unknown keys are rejected
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading config: %v", err)
+	}
+	config := &Config{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		metadata, err := toml.DecodeReader(bytes.NewReader(data), config)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing config %s: %v", path, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("Failed parsing config %s: unknown key %s", path, undecoded[0])
+		}
+	} else if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("Failed parsing config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// SetDefaults adds collectors missing from the configuration, and sets intervals left empty
+// duration is the interval of collectors with no default interval, overriding the configured one when override is set
+// the labels cache TTL defaults to DefaultLabelsCacheTTL, or to the instances interval when longer
+func (c *Config) SetDefaults(duration time.Duration, override bool) {
+	if len(c.OTLP.Endpoint) > 0 {
+		if c.OTLP.Protocol == "" {
+			c.OTLP.Protocol = OTLPGRPC
+		}
+		if c.OTLP.Interval.Duration == 0 {
+			c.OTLP.Interval.Duration = DefaultOTLPInterval
+		}
+		if c.OTLP.Timeout.Duration == 0 {
+			c.OTLP.Timeout.Duration = DefaultOTLPTimeout
+		}
+	}
+	if c.Collectors == nil {
+		c.Collectors = map[string]*Collector{}
+	}
+	for _, name := range collectors {
+		// a collector key left without settings is decoded as nil, and is enabled
+		collector, ok := c.Collectors[name]
+		if !ok || collector == nil {
+			collector = &Collector{}
+			if !ok && DisabledByDefault[name] {
+				disabled := false
+				collector.Enabled = &disabled
+			}
+			c.Collectors[name] = collector
+		}
+		interval, hasDefault := DefaultIntervals[name]
+		switch {
+		case override && !hasDefault:
+			collector.Interval.Duration = duration
+		case collector.Interval.Duration != 0:
+		case hasDefault:
+			collector.Interval.Duration = interval
+		default:
+			collector.Interval.Duration = duration
+		}
+	}
+	if c.LabelsCacheTTL.Duration == 0 {
+		c.LabelsCacheTTL.Duration = DefaultLabelsCacheTTL
+		if interval := c.Collectors[Instances].Interval.Duration; interval > c.LabelsCacheTTL.Duration {
+			c.LabelsCacheTTL.Duration = interval
+		}
+	}
+}
+
+// Validate checks the configuration, returning all the problems found
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Addr == "" {
+		problems = append(problems, "addr: must not be empty")
+	}
+	if len(c.Regions) == 0 {
+		problems = append(problems, "regions: at least one region is required")
+	}
+	for i, region := range c.Regions {
+		if !regionRegexp.MatchString(region) {
+			problems = append(problems, fmt.Sprintf("regions[%d]: %q is not a valid region, e.g. us-east-1", i, region))
+		}
+	}
+	accounts := map[string]bool{}
+	for i, account := range c.Accounts {
+		if account.Name == "" {
+			problems = append(problems, fmt.Sprintf("accounts[%d].name: must not be empty", i))
+		} else if accounts[account.Name] {
+			problems = append(problems, fmt.Sprintf("accounts[%d].name: %q appears more than once", i, account.Name))
+		}
+		accounts[account.Name] = true
+		if !roleARNRegexp.MatchString(account.RoleARN) {
+			problems = append(problems, fmt.Sprintf("accounts[%d].role_arn: %q is not a valid IAM role ARN", i, account.RoleARN))
+		}
+	}
+	for i, os := range c.SpotOS {
+		switch os {
+		case "Linux", "SUSE", "RHEL", "Windows":
+		default:
+			problems = append(problems, fmt.Sprintf("spot_os[%d]: %q is not supported, expected one of Linux, SUSE, RHEL, Windows", i, os))
+		}
+	}
+	tags := map[string]bool{}
+	for i, tag := range c.InstanceTags {
+		if strings.TrimSpace(tag) == "" {
+			problems = append(problems, fmt.Sprintf("instance_tags[%d]: must not be empty", i))
+		} else if tags[tag] {
+			problems = append(problems, fmt.Sprintf("instance_tags[%d]: %q appears more than once", i, tag))
+		}
+		tags[tag] = true
+	}
+
+	if c.LabelsCacheTTL.Duration < 0 {
+		problems = append(problems, "labels_cache_ttl: must not be negative")
+	} else if c.Collectors[Instances] != nil && c.LabelsCacheTTL.Duration < c.Collectors[Instances].Interval.Duration {
+		problems = append(problems, "labels_cache_ttl: must not be shorter than the instances interval")
+	}
+	problems = append(problems, c.Filters.validate()...)
+	problems = append(problems, c.Labels.validate(tags)...)
+	problems = append(problems, c.OTLP.validate()...)
+	var operations []string
+	for operation := range c.APIRateLimits {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		if !operationRegexp.MatchString(operation) {
+			problems = append(problems, fmt.Sprintf("api_rate_limits.%s: not an AWS API operation, e.g. DescribeInstances, or *", operation))
+		}
+		if c.APIRateLimits[operation] <= 0 {
+			problems = append(problems, fmt.Sprintf("api_rate_limits.%s: must be positive", operation))
+		}
+	}
+
+	var names []string
+	for name := range c.Collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		collector := c.Collectors[name]
+		switch name {
+		case Instances, Reservations, SpotPrices, SpotRequests, Volumes, SpotFleets:
+		default:
+			problems = append(problems, fmt.Sprintf("collectors.%s: unknown collector, expected one of %s",
+				name, strings.Join(collectors, ", ")))
+			continue
+		}
+		if collector == nil {
+			continue
+		}
+		if collector.Interval.Duration <= 0 {
+			problems = append(problems, fmt.Sprintf("collectors.%s.interval: must be positive", name))
+		}
+		if collector.Timeout.Duration < 0 {
+			problems = append(problems, fmt.Sprintf("collectors.%s.timeout: must not be negative", name))
+		} else if collector.Timeout.Duration > collector.Interval.Duration {
+			problems = append(problems, fmt.Sprintf("collectors.%s.timeout: must not exceed the interval", name))
+		}
+	}
+	if c.Collectors[Instances] != nil && !c.Collectors[Instances].IsEnabled() {
+		// resources attached to instances are labeled and filtered out of the instances collection
+		for _, name := range []string{SpotRequests, Volumes, SpotFleets} {
+			if c.Collectors[name] == nil || !c.Collectors[name].IsEnabled() {
+				continue
+			}
+			resources := strings.Replace(name, "_", " ", -1)
+			if len(c.InstanceTags) > 0 {
+				problems = append(problems, fmt.Sprintf("collectors.%s: tag labels of %s are taken from instances, which is disabled", name, resources))
+			}
+			if len(c.Filters.InstanceStates)+len(c.Filters.VpcIDs)+len(c.Filters.IncludeTags)+len(c.Filters.ExcludeTags) > 0 {
+				problems = append(problems, fmt.Sprintf("collectors.%s: %s are filtered by their instances, which is disabled", name, resources))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validate returns the problems found in the filters
+func (f *Filters) validate() []string {
+	var problems []string
+	for i, state := range f.InstanceStates {
+		valid := false
+		for _, s := range instanceStates {
+			valid = valid || s == state
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("filters.instance_states[%d]: %q is not an instance state, expected one of %s",
+				i, state, strings.Join(instanceStates, ", ")))
+		}
+	}
+	for i, vpcID := range f.VpcIDs {
+		if !vpcIDRegexp.MatchString(vpcID) {
+			problems = append(problems, fmt.Sprintf("filters.vpc_ids[%d]: %q is not a valid VPC id", i, vpcID))
+		}
+	}
+	for name, tags := range map[string]map[string][]string{"include_tags": f.IncludeTags, "exclude_tags": f.ExcludeTags} {
+		var keys []string
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if len(tags[key]) == 0 {
+				problems = append(problems, fmt.Sprintf("filters.%s.%s: at least one value is required", name, key))
+			}
+			for i, value := range tags[key] {
+				if len(value) > 1 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+					if _, err := regexp.Compile(value[1 : len(value)-1]); err != nil {
+						problems = append(problems, fmt.Sprintf("filters.%s.%s[%d]: %v", name, key, i, err))
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// validate returns the problems found in the labels, tags are the instance tags exported as labels
+func (l *Labels) validate(tags map[string]bool) []string {
+	var problems []string
+	if l.MaxValues < 0 {
+		problems = append(problems, "labels.max_values: must not be negative")
+	}
+	for i, label := range l.Drop {
+		valid := false
+		for _, d := range DroppableLabels {
+			valid = valid || d == label
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("labels.drop[%d]: %q can not be dropped, expected one of %s",
+				i, label, strings.Join(DroppableLabels, ", ")))
+		}
+	}
+	var keys []string
+	for key := range l.Aliases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !tags[key] {
+			problems = append(problems, fmt.Sprintf("labels.aliases.%s: not one of instance_tags", key))
+		}
+		aliased := map[string]string{}
+		var values []string
+		for value := range l.Aliases[key] {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			for _, a := range l.Aliases[key][value] {
+				if l.CaseFold {
+					a = strings.ToLower(a)
+				}
+				if other, ok := aliased[a]; ok && other != value {
+					problems = append(problems, fmt.Sprintf("labels.aliases.%s: %q is an alias of both %q and %q",
+						key, a, other, value))
+				}
+				aliased[a] = value
+			}
+		}
+	}
+	return problems
+}
+
+// validate returns the problems found in the OTLP export, which is off when the endpoint is empty
+func (o *OTLP) validate() []string {
+	if o.Endpoint == "" {
+		return nil
+	}
+	var problems []string
+	switch o.Protocol {
+	case OTLPGRPC:
+		if _, _, err := net.SplitHostPort(o.Endpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("otlp.endpoint: %q is not host:port", o.Endpoint))
+		}
+	case OTLPHTTP:
+		if u, err := url.Parse(o.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("otlp.endpoint: %q is not an http or https url", o.Endpoint))
+		}
+		if o.Insecure {
+			problems = append(problems, "otlp.insecure: applies to grpc only, use an http url instead")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("otlp.protocol: %q is not supported, expected one of %s, %s",
+			o.Protocol, OTLPGRPC, OTLPHTTP))
+	}
+	if o.Interval.Duration <= 0 {
+		problems = append(problems, "otlp.interval: must be positive")
+	}
+	if o.Timeout.Duration < 0 {
+		problems = append(problems, "otlp.timeout: must not be negative")
+	} else if o.Timeout.Duration > o.Interval.Duration {
+		problems = append(problems, "otlp.timeout: must not exceed the interval")
+	}
+	return problems
+}
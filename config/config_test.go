@@ -0,0 +1,191 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load writes data into a config file named name, and loads it
+func load(t *testing.T, name string, data string) *Config {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestSetDefaultsCollectorWithoutSettings(t *testing.T) {
+	cfg := load(t, "config.yaml", "addr: \":9190\"\nregions: [us-east-1]\ncollectors:\n  instances:\n")
+	cfg.SetDefaults(4*time.Minute, false)
+	if cfg.Collectors[Instances] == nil {
+		t.Fatal("instances collector was left nil")
+	}
+	if got := cfg.Collectors[Instances].Interval.Duration; got != 4*time.Minute {
+		t.Errorf("instances interval = %s, want 4m", got)
+	}
+	if !cfg.Collectors[Instances].IsEnabled() {
+		t.Error("instances collector without settings should be enabled")
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	cfg := load(t, "config.toml", "addr = \":9190\"\nregions = [\"us-east-1\"]\n\n[collectors.instances]\ninterval = \"10m\"\n")
+	if cfg.Addr != ":9190" || len(cfg.Regions) != 1 || cfg.Collectors[Instances].Interval.Duration != 10*time.Minute {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	for name, data := range map[string]string{
+		"config.yaml": "addr: \":9190\"\nregion: us-east-1\n",
+		"config.toml": "addr = \":9190\"\nregion = \"us-east-1\"\n",
+	} {
+		dir, err := ioutil.TempDir("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "region") {
+			t.Errorf("Load(%s) = %v, want the unknown key", name, err)
+		}
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	cfg := load(t, "config.yaml", `addr: ""
+regions: [us-east-1, useast]
+accounts:
+  - name: production
+    role_arn: arn:aws:iam::123456789012:role/audit
+  - name: production
+    role_arn: audit
+spot_os: [Linux, BSD]
+instance_tags: [team, team, " "]
+api_rate_limits:
+  DescribeInstances: 0
+  describe: 1
+collectors:
+  instances:
+    interval: 1m
+    timeout: 2m
+  reservations:
+    interval: -1m
+  spot_price:
+`)
+	cfg.SetDefaults(4*time.Minute, false)
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() succeeded")
+	}
+	for _, problem := range []string{
+		"addr: must not be empty",
+		`regions[1]: "useast" is not a valid region`,
+		`accounts[1].name: "production" appears more than once`,
+		`accounts[1].role_arn: "audit" is not a valid IAM role ARN`,
+		`spot_os[1]: "BSD" is not supported`,
+		`instance_tags[1]: "team" appears more than once`,
+		"instance_tags[2]: must not be empty",
+		"api_rate_limits.DescribeInstances: must be positive",
+		"api_rate_limits.describe: not an AWS API operation",
+		"collectors.instances.timeout: must not exceed the interval",
+		"collectors.reservations.interval: must be positive",
+		"collectors.spot_price: unknown collector",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Validate() = %v, missing %q", err, problem)
+		}
+	}
+	if strings.Contains(err.Error(), "accounts[0]") || strings.Contains(err.Error(), "regions[0]") {
+		t.Errorf("Validate() = %v, reports valid settings", err)
+	}
+}
+
+func TestSetDefaultsIntervals(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		duration    time.Duration
+		override    bool
+		instances   time.Duration
+		spotPrices  time.Duration
+		labelsTTL   time.Duration
+		expectValid bool
+	}{
+		{"defaults", "", 4 * time.Minute, false, 4 * time.Minute, time.Hour, time.Hour, true},
+		{"short duration", "", 5 * time.Second, true, 5 * time.Second, time.Hour, time.Hour, true},
+		{"duration longer than the default TTL", "", 2 * time.Hour, true, 2 * time.Hour, time.Hour, 2 * time.Hour, true},
+		{"configured interval", "collectors:\n  instances:\n    interval: 10m\n", 4 * time.Minute, false,
+			10 * time.Minute, time.Hour, time.Hour, true},
+		{"explicit duration overrides configured interval", "collectors:\n  instances:\n    interval: 10m\n", time.Minute, true,
+			time.Minute, time.Hour, time.Hour, true},
+		{"configured spot prices interval is kept", "collectors:\n  spot_prices:\n    interval: 30m\n", time.Minute, true,
+			time.Minute, 30 * time.Minute, time.Hour, true},
+		{"explicit TTL shorter than the instances interval", "labels_cache_ttl: 5m\n", 10 * time.Minute, false,
+			10 * time.Minute, time.Hour, 5 * time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := load(t, "config.yaml", "addr: \":9190\"\nregions: [us-east-1]\n"+test.config)
+			cfg.SetDefaults(test.duration, test.override)
+			if got := cfg.Collectors[Instances].Interval.Duration; got != test.instances {
+				t.Errorf("instances interval = %s, want %s", got, test.instances)
+			}
+			if got := cfg.Collectors[SpotPrices].Interval.Duration; got != test.spotPrices {
+				t.Errorf("spot_prices interval = %s, want %s", got, test.spotPrices)
+			}
+			if got := cfg.LabelsCacheTTL.Duration; got != test.labelsTTL {
+				t.Errorf("labels_cache_ttl = %s, want %s", got, test.labelsTTL)
+			}
+			if err := cfg.Validate(); (err == nil) != test.expectValid {
+				t.Errorf("Validate() = %v, want valid %v", err, test.expectValid)
+			}
+		})
+	}
+}
+
+func TestSetDefaultsDisabledByDefault(t *testing.T) {
+	cfg := load(t, "config.yaml", "addr: \":9190\"\nregions: [us-east-1]\ncollectors:\n  volumes:\n")
+	cfg.SetDefaults(4*time.Minute, false)
+	if !cfg.Collectors[Volumes].IsEnabled() {
+		t.Error("volumes collector configured without settings should be enabled")
+	}
+	if cfg.Collectors[SpotFleets].IsEnabled() {
+		t.Error("spot_fleets collector left out of the config should be disabled")
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateCollectorsNeedingInstances(t *testing.T) {
+	cfg := load(t, "config.yaml", "addr: \":9190\"\nregions: [us-east-1]\ninstance_tags: [team]\n"+
+		"collectors:\n  instances:\n    enabled: false\n  spot_requests:\n    enabled: false\n  volumes:\n")
+	cfg.SetDefaults(4*time.Minute, false)
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "collectors.volumes: tag labels of volumes are taken from instances") {
+		t.Errorf("Validate() = %v, want volumes depending on instances", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "collectors.spot_requests") {
+		t.Errorf("Validate() = %v, disabled spot requests should not depend on instances", err)
+	}
+}
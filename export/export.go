@@ -0,0 +1,275 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// export formats
+const (
+	CSV     = "csv"
+	Parquet = "parquet"
+)
+
+// dateLayout of the date partitions
+const dateLayout = "2006-01-02"
+
+// csvTimestampLayout timestamps in CSV files, UTC, as Athena parses them
+const csvTimestampLayout = "2006-01-02 15:04:05.000"
+
+// Options of an export
+// snapshot tables are exported whole, partitioned by Date, rows of event tables with their event column
+// within [From, To), partitioned by their event date. when UpdatedSince is set, as done right after a live
+// collection, only the partitions of event tables holding rows updated since are exported, whole
+type Options struct {
+	Dir          string
+	Formats      []string
+	Tables       []string
+	Date         time.Time
+	From         time.Time
+	To           time.Time
+	UpdatedSince time.Time
+}
+
+// Validate checks the formats and tables
+func (o *Options) Validate() error {
+	if o.Dir == "" {
+		return fmt.Errorf("must supply a directory to export to")
+	}
+	if len(o.Formats) == 0 {
+		return fmt.Errorf("must supply at least one format")
+	}
+	for _, format := range o.Formats {
+		if format != CSV && format != Parquet {
+			return fmt.Errorf("unknown format %s, expected one of %s, %s", format, CSV, Parquet)
+		}
+	}
+	for _, name := range o.Tables {
+		if _, ok := tables[name]; !ok {
+			return fmt.Errorf("unknown table %s, expected one of %s", name, strings.Join(Tables, ", "))
+		}
+	}
+	if o.UpdatedSince.IsZero() && !o.From.Before(o.To) {
+		return fmt.Errorf("from must be before to")
+	}
+	return nil
+}
+
+// Export writes the tables into Dir, as <format>/<table>/dt=<YYYY-MM-DD>/<table>.<format>, returning the files written
+// files of a partition exported again are replaced
+func Export(options Options) ([]string, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	names := options.Tables
+	if len(names) == 0 {
+		names = Tables
+	}
+	var files []string
+	for _, name := range names {
+		t := tables[name]
+		var rows []row
+		var err error
+		switch {
+		case t.eventColumn == "":
+			rows, err = t.load("", time.Time{}, time.Time{})
+		case !options.UpdatedSince.IsZero():
+			rows, err = t.loadUpdatedPartitions(options.UpdatedSince)
+		default:
+			rows, err = t.load(t.eventColumn, options.From, options.To)
+		}
+		if err != nil {
+			return files, fmt.Errorf("Failed reading %s: %v", name, err)
+		}
+
+		partitions := map[string][]row{}
+		if t.eventColumn == "" {
+			// snapshots are written even when empty
+			partitions[options.Date.UTC().Format(dateLayout)] = nil
+		}
+		for _, r := range rows {
+			date := options.Date
+			if t.eventColumn != "" {
+				date = r.date
+			}
+			partitions[date.UTC().Format(dateLayout)] = append(partitions[date.UTC().Format(dateLayout)], r)
+		}
+		var dates []string
+		for date := range partitions {
+			dates = append(dates, date)
+		}
+		sort.Strings(dates)
+
+		for _, date := range dates {
+			for _, format := range options.Formats {
+				path := filepath.Join(options.Dir, format, name, "dt="+date, name+"."+format)
+				if err := writeFile(path, format, t.columns, partitions[date]); err != nil {
+					return files, err
+				}
+				files = append(files, path)
+			}
+		}
+	}
+	return files, nil
+}
+
+// loadUpdatedPartitions returns the rows of the date partitions holding rows updated since, whole,
+// so that partitions written again keep the rows exported before
+func (t *table) loadUpdatedPartitions(since time.Time) ([]row, error) {
+	updated, err := t.load("updated_at", since, time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	days := map[time.Time]bool{}
+	for _, r := range updated {
+		date := r.date.UTC()
+		days[time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)] = true
+	}
+	var rows []row
+	for day := range days {
+		partition, err := t.load(t.eventColumn, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, partition...)
+	}
+	return rows, nil
+}
+
+// writeFile writes rows into a temporary file, renamed to path once complete
+func writeFile(path string, format string, columns []column, rows []row) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Failed creating %s: %v", filepath.Dir(path), err)
+	}
+	tmp := path + ".tmp"
+	var err error
+	if format == Parquet {
+		err = writeParquet(tmp, columns, rows)
+	} else {
+		err = writeCSV(tmp, columns, rows)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed writing %s: %v", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// csvValue formats a value of a CSV column
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(csvTimestampLayout)
+	}
+	return fmt.Sprint(value)
+}
+
+// writeCSV writes rows as CSV, with a header line
+func writeCSV(path string, columns []column, rows []row) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	header := []string{}
+	for _, c := range columns {
+		header = append(header, c.name)
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		record := []string{}
+		for _, value := range r.values {
+			record = append(record, csvValue(value))
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// parquetSchema returns the parquet-go metadata of the columns, all of them are optional
+func parquetSchema(columns []column) []string {
+	var schema []string
+	for _, c := range columns {
+		switch c.kind {
+		case typeString:
+			schema = append(schema, "name="+c.name+", type=UTF8")
+		case typeInt64:
+			schema = append(schema, "name="+c.name+", type=INT64")
+		case typeDouble:
+			schema = append(schema, "name="+c.name+", type=DOUBLE")
+		case typeBool:
+			schema = append(schema, "name="+c.name+", type=BOOLEAN")
+		case typeTimestamp:
+			schema = append(schema, "name="+c.name+", type=TIMESTAMP_MILLIS")
+		}
+	}
+	return schema
+}
+
+// parquetValue converts a value to its parquet type, timestamps to milliseconds and zero times to null
+func parquetValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		if t.IsZero() {
+			return nil
+		}
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	return value
+}
+
+// writeParquet writes rows as parquet, compressed with snappy
+func writeParquet(path string, columns []column, rows []row) error {
+	f, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := writer.NewCSVWriter(parquetSchema(columns), f, 1)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		record := make([]interface{}, len(r.values))
+		for i, value := range r.values {
+			record[i] = parquetValue(value)
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := w.WriteStop(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,102 @@
+package export
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeEvent a row of the fake events table
+type fakeEvent struct {
+	id        string
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+// fakeEventsTable replaces the spot_prices table with events read out of events, for the test
+func fakeEventsTable(t *testing.T, events *[]fakeEvent) {
+	original := tables["spot_prices"]
+	t.Cleanup(func() { tables["spot_prices"] = original })
+	tables["spot_prices"] = &table{
+		name:        "spot_prices",
+		columns:     []column{{"id", typeString}, {"created_at", typeTimestamp}, {"updated_at", typeTimestamp}},
+		eventColumn: "created_at",
+		load: func(column string, from time.Time, to time.Time) ([]row, error) {
+			var rows []row
+			for _, e := range *events {
+				value := e.createdAt
+				if column == "updated_at" {
+					value = e.updatedAt
+				}
+				if column != "" && (value.Before(from) || !value.Before(to)) {
+					continue
+				}
+				rows = append(rows, row{date: e.createdAt, values: []interface{}{e.id, e.createdAt, e.updatedAt}})
+			}
+			return rows, nil
+		},
+	}
+}
+
+// readIDs returns the sorted ids of a CSV file
+func readIDs(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, record := range records[1:] {
+		ids = append(ids, record[0])
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLiveExportKeepsPartitionRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	events := []fakeEvent{
+		{"a", day.Add(time.Hour), day.Add(time.Hour)},
+		{"b", day.Add(2 * time.Hour), day.Add(2 * time.Hour)},
+		{"c", day.AddDate(0, 0, 1).Add(time.Hour), day.AddDate(0, 0, 1).Add(time.Hour)},
+	}
+	fakeEventsTable(t, &events)
+
+	if _, err := Export(Options{Dir: dir, Formats: []string{CSV}, Tables: []string{"spot_prices"},
+		From: day, To: day.AddDate(0, 0, 2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a live collection adds a row to the first day only
+	since := time.Now()
+	events = append(events, fakeEvent{"d", day.Add(3 * time.Hour), since.Add(time.Second)})
+	files, err := Export(Options{Dir: dir, Formats: []string{CSV}, Tables: []string{"spot_prices"}, UpdatedSince: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := filepath.Join(dir, CSV, "spot_prices", "dt=2020-10-01", "spot_prices.csv")
+	if len(files) != 1 || files[0] != first {
+		t.Errorf("live export wrote %v, want only %s", files, first)
+	}
+	if got := readIDs(t, first); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "d" {
+		t.Errorf("first day partition holds %v, want [a b d]", got)
+	}
+	second := filepath.Join(dir, CSV, "spot_prices", "dt=2020-10-02", "spot_prices.csv")
+	if got := readIDs(t, second); len(got) != 1 || got[0] != "c" {
+		t.Errorf("second day partition holds %v, want [c]", got)
+	}
+}
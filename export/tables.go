@@ -0,0 +1,240 @@
+package export
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// column types
+const (
+	typeString    = "string"
+	typeInt64     = "int64"
+	typeDouble    = "double"
+	typeBool      = "bool"
+	typeTimestamp = "timestamp"
+)
+
+// column of an exported table
+type column struct {
+	name string
+	kind string
+}
+
+// row of an exported table, its values in the order of the table columns
+// date is the date partition of rows of event tables
+type row struct {
+	date   time.Time
+	values []interface{}
+}
+
+// table an exported table
+// snapshot tables are exported whole, partitioned by the export date, while rows of
+// event tables are selected and partitioned by their eventColumn
+type table struct {
+	name        string
+	columns     []column
+	eventColumn string
+	// load returns the rows with column within [from, to), all the rows when column is empty
+	load func(column string, from time.Time, to time.Time) ([]row, error)
+}
+
+// dollars converts prices stored in billionths of dollars
+func dollars(price uint64) float64 {
+	return float64(price) / 1000000000
+}
+
+// tagsJSON encodes tags as a JSON object
+func tagsJSON(tags map[string]string) string {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	encoded, _ := json.Marshal(tags)
+	return string(encoded)
+}
+
+// Tables names of the tables exported, in the order they are exported
+var Tables = []string{"instances", "reservations", "reservations_listings", "spot_prices", "reservations_sell_events"}
+
+var tables = map[string]*table{
+	"instances": {
+		name: "instances",
+		columns: []column{
+			{"instance_id", typeString},
+			{"az", typeString},
+			{"family", typeString},
+			{"instance_type", typeString},
+			{"lifecycle", typeString},
+			{"state", typeString},
+			{"units", typeDouble},
+			{"owner_id", typeInt64},
+			{"requester_id", typeInt64},
+			{"groups", typeString},
+			{"tags", typeString},
+			{"launch_time", typeTimestamp},
+			{"created_at", typeTimestamp},
+			{"updated_at", typeTimestamp},
+		},
+		load: func(column string, from time.Time, to time.Time) ([]row, error) {
+			instances := []models.Instances{}
+			if err := postgres.SelectRange(&instances, column, from, to); err != nil {
+				return nil, err
+			}
+			var rows []row
+			for _, i := range instances {
+				rows = append(rows, row{values: []interface{}{
+					i.InstanceID, i.Az, i.Family, i.InstanceType, i.Lifecycle, i.State, float64(i.Units),
+					int64(i.OwnerID), int64(i.RequesterID), i.Groups, tagsJSON(i.Tags),
+					i.LaunchTime, i.CreatedAt, i.UpdatedAt,
+				}})
+			}
+			return rows, nil
+		},
+	},
+	"reservations": {
+		name: "reservations",
+		columns: []column{
+			{"reservation_id", typeString},
+			{"az", typeString},
+			{"region", typeString},
+			{"family", typeString},
+			{"instance_type", typeString},
+			{"product", typeString},
+			{"scope", typeString},
+			{"tenancy", typeString},
+			{"offer_class", typeString},
+			{"offer_type", typeString},
+			{"state", typeString},
+			{"count", typeInt64},
+			{"units", typeDouble},
+			{"duration", typeInt64},
+			{"upfront_price", typeDouble},
+			{"recurring_charges", typeDouble},
+			{"effective_price", typeDouble},
+			{"canceled", typeBool},
+			{"converted", typeBool},
+			{"sold", typeBool},
+			{"sell_splitted", typeBool},
+			{"listed_on", typeString},
+			{"start_date", typeTimestamp},
+			{"end_date", typeTimestamp},
+			{"original_end_date", typeTimestamp},
+			{"created_at", typeTimestamp},
+			{"updated_at", typeTimestamp},
+		},
+		load: func(column string, from time.Time, to time.Time) ([]row, error) {
+			reservations := []models.Reservations{}
+			if err := postgres.SelectRange(&reservations, column, from, to); err != nil {
+				return nil, err
+			}
+			var rows []row
+			for _, r := range reservations {
+				listedOn := []string{}
+				for _, listingID := range r.ListedOn {
+					listedOn = append(listedOn, listingID.String())
+				}
+				rows = append(rows, row{values: []interface{}{
+					r.ReservationID.String(), r.Az, r.Region, r.Family, r.InstanceType, r.Product, r.Scope,
+					r.Tenancy, r.OfferClass, r.OfferType, r.State, int64(r.Count), float64(r.Units),
+					int64(r.Duration), dollars(r.UpfrontPrice), dollars(r.RecurringCharges),
+					dollars(r.EffectivePrice), r.Canceled, r.Converted, r.Sold, r.SellSplitted,
+					strings.Join(listedOn, ","), r.StartDate, r.EndDate, r.OriginalEndDate, r.CreatedAt, r.UpdatedAt,
+				}})
+			}
+			return rows, nil
+		},
+	},
+	"reservations_listings": {
+		name: "reservations_listings",
+		columns: []column{
+			{"listing_id", typeString},
+			{"state", typeString},
+			{"status", typeString},
+			{"status_message", typeString},
+			{"az", typeString},
+			{"region", typeString},
+			{"family", typeString},
+			{"instance_type", typeString},
+			{"product", typeString},
+			{"scope", typeString},
+			{"count", typeInt64},
+			{"units", typeDouble},
+			{"published_date", typeTimestamp},
+			{"created_at", typeTimestamp},
+			{"updated_at", typeTimestamp},
+		},
+		load: func(column string, from time.Time, to time.Time) ([]row, error) {
+			listings := []models.ReservationsListings{}
+			if err := postgres.SelectRange(&listings, column, from, to); err != nil {
+				return nil, err
+			}
+			var rows []row
+			for _, l := range listings {
+				rows = append(rows, row{values: []interface{}{
+					l.ListingID.String(), l.State, l.Status, l.StatusMessage, l.Az, l.Region, l.Family,
+					l.InstanceType, l.Product, l.Scope, int64(l.Count), float64(l.Units),
+					l.PublishedDate, l.CreatedAt, l.UpdatedAt,
+				}})
+			}
+			return rows, nil
+		},
+	},
+	"spot_prices": {
+		name: "spot_prices",
+		columns: []column{
+			{"az", typeString},
+			{"family", typeString},
+			{"instance_type", typeString},
+			{"product", typeString},
+			{"units", typeDouble},
+			{"recurring_charges", typeDouble},
+			{"account", typeString},
+			{"created_at", typeTimestamp},
+			{"updated_at", typeTimestamp},
+		},
+		eventColumn: "created_at",
+		load: func(column string, from time.Time, to time.Time) ([]row, error) {
+			prices := []models.SpotPrices{}
+			if err := postgres.SelectRange(&prices, column, from, to); err != nil {
+				return nil, err
+			}
+			var rows []row
+			for _, p := range prices {
+				rows = append(rows, row{date: p.CreatedAt, values: []interface{}{
+					p.Az, p.Family, p.InstanceType, p.Product, float64(p.Units), dollars(p.RecurringCharges), p.Account,
+					p.CreatedAt, p.UpdatedAt,
+				}})
+			}
+			return rows, nil
+		},
+	},
+	"reservations_sell_events": {
+		name: "reservations_sell_events",
+		columns: []column{
+			{"reservation_id", typeString},
+			{"listing_id", typeString},
+			{"units_sold", typeInt64},
+			{"sold_date", typeTimestamp},
+			{"created_at", typeTimestamp},
+			{"updated_at", typeTimestamp},
+		},
+		eventColumn: "sold_date",
+		load: func(column string, from time.Time, to time.Time) ([]row, error) {
+			events := []models.ReservationsSellEvents{}
+			if err := postgres.SelectRange(&events, column, from, to); err != nil {
+				return nil, err
+			}
+			var rows []row
+			for _, e := range events {
+				rows = append(rows, row{date: e.SoldDate, values: []interface{}{
+					e.ReservationID.String(), e.ListingID.String(), int64(e.UnitsSold),
+					e.SoldDate, e.CreatedAt, e.UpdatedAt,
+				}})
+			}
+			return rows, nil
+		},
+	},
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/awsapi"
+	"github.com/EladDolev/aws_audit_exporter/billing"
+	"github.com/EladDolev/aws_audit_exporter/config"
+	"github.com/EladDolev/aws_audit_exporter/otlp"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+// target an account and region collected from, with an ec2 client per collector
+type target struct {
+	account string
+	region  string
+	svc     map[string]*ec2.EC2
+	// pList will hold the list of OS (products) for which spot prices should be fetched
+	pList []*string
+}
+
+// newTargets creates an ec2 client per account, region and collector
+func newTargets(ctx context.Context, sess *session.Session, cfg *config.Config) ([]*target, error) {
+	accounts := cfg.Accounts
+	if len(accounts) == 0 {
+		accounts = []config.Account{{}}
+	}
+	var targets []*target
+	for _, account := range accounts {
+		for _, region := range cfg.Regions {
+			t := &target{account: account.Name, region: region, svc: map[string]*ec2.EC2{}}
+			// API quotas are per account and region, shared by the collectors
+			limiter := awsapi.NewRateLimiter(cfg.APIRateLimits)
+			for name := range cfg.Collectors {
+				awsConfig := &aws.Config{Region: aws.String(region)}
+				if len(account.RoleARN) > 0 {
+					awsConfig.Credentials = stscreds.NewCredentials(sess, account.RoleARN)
+				}
+				t.svc[name] = ec2.New(sess, awsConfig)
+				limiter.Limit(&t.svc[name].Handlers)
+			}
+			isClassicLink, err := billing.IsClassicLink(ctx, t.svc[config.SpotPrices])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", t, err)
+			}
+			if t.pList, err = billing.GetProductDescriptions(strings.Join(cfg.SpotOS, ","), isClassicLink); err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// String returns the account and region of the target
+func (t *target) String() string {
+	if t.account != "" {
+		return t.account + "/" + t.region
+	}
+	return t.region
+}
+
+// logger returns the logger of a cycle, with the account and region of the target
+func (t *target) logger(cycle *log.Entry) *log.Entry {
+	fields := log.Fields{"region": t.region}
+	if t.account != "" {
+		fields["account"] = t.account
+	}
+	return cycle.WithFields(fields)
+}
+
+// collectTargets runs collect against every target, logging the failures along with the target
+func collectTargets(targets []*target, cycle *log.Entry, collect func(t *target) error) []error {
+	var errs []error
+	for _, t := range targets {
+		if err := collect(t); err != nil {
+			t.logger(cycle).WithError(err).Error("collection failed")
+			errs = append(errs, fmt.Errorf("%s: %v", t, err))
+		}
+	}
+	return errs
+}
+
+// collector collects all the targets, every interval
+// collect logs with the logger of its cycle, made of the collector name and a cycle id, and stops
+// calling AWS and writing to the DB once ctx is cancelled, or once timeout is over, 0 is no timeout
+type collector struct {
+	name     string
+	interval time.Duration
+	timeout  time.Duration
+	collect  func(ctx context.Context, cycle *log.Entry) error
+}
+
+// cycleLogger returns the logger of a new cycle of a collector
+func cycleLogger(name string) *log.Entry {
+	return log.WithFields(log.Fields{"collector": name, "cycle": uuid.New().String()})
+}
+
+// exporter runs the collectors of a configuration on their schedules, until stopped
+// its metrics are registered with a registry of its own, which is dropped along with it on reload
+type exporter struct {
+	registry   *prometheus.Registry
+	collectors []collector
+	// statuses of the collectors, by name
+	statuses map[string]*collectorStatus
+	// savings of the spot requests collector, by target, when a price catalog is configured
+	savings map[string]*billing.SpotSavings
+	// otlp exports the metrics every otlpInterval, when configured
+	otlp         *otlp.Exporter
+	otlpInterval time.Duration
+	// stop stops scheduling, while cancel cancels the cycles in flight, through ctx
+	stop   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// joinErrors returns an error made of all errors, nil when there are none
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+// run runs a cycle of a collector, recording its outcome in the collector status
+func (e *exporter) run(c collector) error {
+	cycle := cycleLogger(c.name)
+	status := e.statuses[c.name]
+	start := time.Now()
+	status.start(start)
+	cycle.Debug("collector cycle started")
+	ctx := e.ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(e.ctx, c.timeout)
+		defer cancel()
+	}
+	err := c.collect(ctx, cycle)
+	status.finish(start, err)
+	if err != nil {
+		cycle.WithField("duration", time.Since(start).String()).WithError(err).Warn("collector cycle failed")
+	} else {
+		cycle.WithField("duration", time.Since(start).String()).Debug("collector cycle finished")
+	}
+	return err
+}
+
+// schedule runs a collector every interval, in the background, until the exporter is stopped
+// failures are logged, and the collector runs again on its next interval
+func (e *exporter) schedule(c collector) {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for {
+			e.run(c)
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(c.interval):
+			}
+		}
+	}()
+}
+
+// Start starts the schedules of the collectors, and of the OTLP export
+func (e *exporter) Start() {
+	for _, c := range e.collectors {
+		e.schedule(c)
+	}
+	if e.otlp != nil {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			for {
+				select {
+				case <-e.stop:
+					return
+				case <-time.After(e.otlpInterval):
+				}
+				if err := e.otlp.Export(e.registry); err != nil {
+					log.WithError(err).Error("OTLP export failed")
+				}
+			}
+		}()
+	}
+}
+
+// CollectOnce runs every collector once, one after the other, returning the failures of all of them
+func (e *exporter) CollectOnce() error {
+	var errs []error
+	for _, c := range e.collectors {
+		if err := e.run(c); err != nil {
+			errs = append(errs, fmt.Errorf("collector %s failed: %v", c.name, err))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Shutdown stops scheduling collectors, and waits for the cycles in flight to finish
+// once ctx is done, the cycles in flight are cancelled, their transactions rolled back, and ctx error is returned
+func (e *exporter) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("cancelling collector cycles in flight")
+		e.cancel()
+		<-done
+		err = ctx.Err()
+	}
+	e.cancel()
+	if e.otlp != nil {
+		if err := e.otlp.Close(); err != nil {
+			log.WithError(err).Warn("Failed closing OTLP exporter")
+		}
+	}
+	return err
+}
+
+// Stop stops scheduling collectors, and waits for the cycles in flight to finish, however long they take
+func (e *exporter) Stop() {
+	e.Shutdown(context.Background())
+}
+
+// keepStatuses carries the statuses of the collectors of a stopped exporter over, so that a reload
+// does not make the exporter unready until its collectors succeed again
+func (e *exporter) keepStatuses(previous *exporter) {
+	for _, c := range e.collectors {
+		if status, ok := previous.statuses[c.name]; ok {
+			status.setInterval(c.interval)
+			e.statuses[c.name] = status
+		}
+	}
+}
+
+// keepSavings carries when the spot instances were last seen by a stopped exporter over, so that
+// the savings accumulated since its last cycle are counted by the first cycle after a reload
+func (e *exporter) keepSavings(previous *exporter) {
+	for t, savings := range e.savings {
+		if last, ok := previous.savings[t]; ok {
+			savings.KeepLastSeen(last)
+		}
+	}
+}
+
+// startExporter creates the exporter and starts its schedules
+func startExporter(ctx context.Context, cfg *config.Config, spotAnomalyZScore float64) (*exporter, error) {
+	e, err := newExporter(ctx, cfg, spotAnomalyZScore)
+	if err != nil {
+		return nil, err
+	}
+	e.Start()
+	return e, nil
+}
+
+// newExporter prepares the exporter of a configuration, and builds it
+// the cycles are cancelled along with ctx, or by Shutdown
+func newExporter(ctx context.Context, cfg *config.Config, spotAnomalyZScore float64) (*exporter, error) {
+	setup, err := prepareExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return setup.build(ctx, spotAnomalyZScore), nil
+}
+
+// exporterSetup everything an exporter is made of which may fail to be created, AWS clients included
+// it is prepared while the running exporter keeps running, so that a reload failing leaves it be
+type exporterSetup struct {
+	cfg           *config.Config
+	instanceTags  map[string]string
+	tagl          []string
+	targets       []*target
+	catalog       *pricing.Catalog
+	filters       *billing.Filters
+	tagValues     *billing.TagValues
+	savingsTotals []postgres.SpotSavingsTotal
+	otlp          *otlp.Exporter
+}
+
+// prepareExporter creates the AWS clients, and loads what the collectors of cfg need
+func prepareExporter(ctx context.Context, cfg *config.Config) (*exporterSetup, error) {
+	// We have to construct the set of tags for this based on the config,
+	// so it is created on every start
+	instanceTags := map[string]string{}
+	tagl := []string{}
+	for _, tstr := range cfg.InstanceTags {
+		ctag := billing.Tagname(tstr)
+		instanceTags[tstr] = ctag
+		tagl = append(tagl, ctag)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	awsapi.Instrument(&sess.Handlers)
+	targets, err := newTargets(ctx, sess, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog *pricing.Catalog
+	if len(cfg.PriceCatalog) > 0 {
+		if catalog, err = pricing.LoadCatalog(cfg.PriceCatalog); err != nil {
+			return nil, err
+		}
+	}
+
+	filters, err := billing.NewFilters(cfg.Filters.InstanceStates, cfg.Filters.VpcIDs,
+		cfg.Filters.IncludeTags, cfg.Filters.ExcludeTags)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := &exporterSetup{
+		cfg:          cfg,
+		instanceTags: instanceTags,
+		tagl:         tagl,
+		targets:      targets,
+		catalog:      catalog,
+		filters:      filters,
+		tagValues:    billing.NewTagValues(cfg.Labels.CaseFold, cfg.Labels.MaxValues, cfg.Labels.Aliases),
+	}
+	if err := setup.loadSavingsTotals(); err != nil {
+		return nil, err
+	}
+
+	// created last, as it is not closed when failing
+	if len(cfg.OTLP.Endpoint) > 0 {
+		tagKeys := map[string]string{}
+		for tag, label := range instanceTags {
+			tagKeys[label] = tag
+		}
+		if setup.otlp, err = otlp.New(otlp.Options{
+			Endpoint: cfg.OTLP.Endpoint,
+			Protocol: cfg.OTLP.Protocol,
+			Insecure: cfg.OTLP.Insecure,
+			Headers:  cfg.OTLP.Headers,
+			Timeout:  cfg.OTLP.Timeout.Duration,
+			TagKeys:  tagKeys,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return setup, nil
+}
+
+// loadSpotSavingsTotals loads the savings persisted to postgres, replaced by tests
+var loadSpotSavingsTotals = billing.LoadSpotSavingsTotals
+
+// loadSavingsTotals loads the savings the savings counter starts off with, when savings are exported
+func (s *exporterSetup) loadSavingsTotals() error {
+	if c := s.cfg.Collectors[config.SpotRequests]; !c.IsEnabled() || s.catalog == nil {
+		return nil
+	}
+	totals, err := loadSpotSavingsTotals()
+	if err != nil {
+		return err
+	}
+	s.savingsTotals = totals
+	return nil
+}
+
+// build registers the metrics of the enabled collectors, with a registry of the exporter, it can not fail,
+// so that it is done once the running exporter is stopped on reload
+// collectors run in order: instances fill the labels cache and spot prices are current for the spot requests
+func (s *exporterSetup) build(ctx context.Context, spotAnomalyZScore float64) *exporter {
+	cfg, instanceTags, tagl, targets := s.cfg, s.instanceTags, s.tagl, s.targets
+	catalog, filters, tagValues := s.catalog, s.filters, s.tagValues
+
+	// We'll cache the instance tag labels so that we can use them to separate
+	// out spot instance spend
+	instanceLabelsCache := billing.NewLabelsCache(cfg.LabelsCacheTTL.Duration)
+
+	e := &exporter{registry: prometheus.NewRegistry(), stop: make(chan struct{}), otlp: s.otlp,
+		savings: map[string]*billing.SpotSavings{}}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	billing.Registerer = e.registry
+	if e.otlp != nil {
+		e.otlpInterval = cfg.OTLP.Interval.Duration
+	}
+
+	// spot requests, volumes and spot fleets are labeled out of the cache, which is filled by the first
+	// instances collection
+	instancesCollected := make(chan struct{})
+	var instancesOnce sync.Once
+
+	// metrics of every account are told apart by the account label
+	withAccount := len(cfg.Accounts) > 0
+
+	if c := cfg.Collectors[config.Instances]; c.IsEnabled() {
+		billing.RegisterInstancesMetrics(tagl, cfg.Labels.Drop, withAccount)
+		billing.RegisterLabelsCacheMetrics()
+		instances := map[*target]*billing.Instances{}
+		for _, t := range targets {
+			instances[t] = &billing.Instances{
+				Svc:                 t.svc[config.Instances],
+				InstanceLabelsCache: instanceLabelsCache,
+				InstanceTags:        instanceTags,
+				Filters:             filters,
+				TagValues:           tagValues,
+				Account:             t.account,
+			}
+		}
+		e.collectors = append(e.collectors, collector{config.Instances, c.Interval.Duration, c.Timeout.Duration, func(ctx context.Context, cycle *log.Entry) error {
+			defer instancesOnce.Do(func() { close(instancesCollected) })
+			billing.ResetInstancesMetrics()
+			errs := collectTargets(targets, cycle, func(t *target) error {
+				return instances[t].GetInstancesInfo(ctx)
+			})
+			if evicted := instanceLabelsCache.Evict(); evicted > 0 {
+				cycle.WithField("evicted", evicted).Debug("instance labels evicted")
+			}
+			return joinErrors(errs)
+		}})
+	} else {
+		close(instancesCollected)
+	}
+
+	if c := cfg.Collectors[config.Reservations]; c.IsEnabled() {
+		billing.RegisterReservationsMetrics(withAccount)
+		e.collectors = append(e.collectors, collector{config.Reservations, c.Interval.Duration, c.Timeout.Duration, func(ctx context.Context, cycle *log.Entry) error {
+			billing.ResetReservationsMetrics()
+			return joinErrors(collectTargets(targets, cycle, func(t *target) error {
+				return billing.GetReservationsInfo(ctx, t.svc[config.Reservations], t.account)
+			}))
+		}})
+	}
+
+	if c := cfg.Collectors[config.SpotPrices]; c.IsEnabled() {
+		billing.RegisterSpotsPricesMetrics(withAccount)
+		stats := &billing.SpotsPricesStats{
+			Catalog:  catalog,
+			ZScore:   spotAnomalyZScore,
+			Interval: c.Interval.Duration,
+		}
+		if len(cfg.DBURL) > 0 {
+			billing.RegisterSpotsPricesStatsMetrics(withAccount)
+		}
+		e.collectors = append(e.collectors, collector{config.SpotPrices, c.Interval.Duration, c.Timeout.Duration, func(ctx context.Context, cycle *log.Entry) error {
+			errs := collectTargets(targets, cycle, func(t *target) error {
+				return billing.GetSpotsCurrentPrices(ctx, t.svc[config.SpotPrices], t.pList, t.account)
+			})
+			if err := stats.GetSpotsPricesStats(ctx); err != nil {
+				errs = append(errs, err)
+			}
+			return joinErrors(errs)
+		}})
+	}
+
+	if c := cfg.Collectors[config.SpotRequests]; c.IsEnabled() {
+		billing.RegisterSpotsMetrics(tagl, withAccount)
+		if catalog != nil {
+			billing.RegisterSpotSavingsMetrics(tagl, withAccount, instanceTags, tagValues, s.savingsTotals)
+		}
+		spots := map[*target]*billing.Spots{}
+		for _, t := range targets {
+			s := &billing.Spots{
+				Svc:                 t.svc[config.SpotRequests],
+				InstanceLabelsCache: instanceLabelsCache,
+				InstanceTags:        instanceTags,
+				Filters:             filters,
+				TagValues:           tagValues,
+				Account:             t.account,
+			}
+			if catalog != nil {
+				s.Savings = &billing.SpotSavings{
+					Catalog:      catalog,
+					InstanceTags: instanceTags,
+					Account:      t.account,
+				}
+				e.savings[t.String()] = s.Savings
+			}
+			spots[t] = s
+		}
+		e.collectors = append(e.collectors, collector{config.SpotRequests, c.Interval.Duration, c.Timeout.Duration, func(ctx context.Context, cycle *log.Entry) error {
+			select {
+			case <-instancesCollected:
+			case <-e.stop:
+				return nil
+			}
+			billing.ResetSpotsMetrics()
+			return joinErrors(collectTargets(targets, cycle, func(t *target) error {
+				return spots[t].GetSpotsInfo(ctx)
+			}))
+		}})
+	}
+
+	if c := cfg.Collectors[config.Volumes]; c.IsEnabled() {
+		billing.RegisterVolumesMetrics(tagl, withAccount)
+		volumes := map[*target]*billing.Volumes{}
+		for _, t := range targets {
+			volumes[t] = &billing.Volumes{
+				Svc:                 t.svc[config.Volumes],
+				InstanceLabelsCache: instanceLabelsCache,
+				InstanceTags:        instanceTags,
+				Filters:             filters,
+				TagValues:           tagValues,
+				Account:             t.account,
+			}
+		}
+		e.collectors = append(e.collectors, collector{config.Volumes, c.Interval.Duration, c.Timeout.Duration, func(ctx context.Context, cycle *log.Entry) error {
+			select {
+			case <-instancesCollected:
+			case <-e.stop:
+				return nil
+			}
+			billing.ResetVolumesMetrics()
+			return joinErrors(collectTargets(targets, cycle, func(t *target) error {
+				return volumes[t].GetVolumesInfo(ctx)
+			}))
+		}})
+	}
+
+	if c := cfg.Collectors[config.SpotFleets]; c.IsEnabled() {
+		billing.RegisterSpotFleetsMetrics(tagl, withAccount)
+		fleets := map[*target]*billing.SpotFleets{}
+		for _, t := range targets {
+			fleets[t] = &billing.SpotFleets{
+				Svc:                 t.svc[config.SpotFleets],
+				InstanceLabelsCache: instanceLabelsCache,
+				InstanceTags:        instanceTags,
+				Filters:             filters,
+				Account:             t.account,
+			}
+		}
+		e.collectors = append(e.collectors, collector{config.SpotFleets, c.Interval.Duration, c.Timeout.Duration, func(ctx context.Context, cycle *log.Entry) error {
+			select {
+			case <-instancesCollected:
+			case <-e.stop:
+				return nil
+			}
+			billing.ResetSpotFleetsMetrics()
+			return joinErrors(collectTargets(targets, cycle, func(t *target) error {
+				return fleets[t].GetSpotFleetsInfo(ctx)
+			}))
+		}})
+	}
+
+	e.statuses = map[string]*collectorStatus{}
+	for _, c := range e.collectors {
+		e.statuses[c.name] = newCollectorStatus(c)
+	}
+
+	return e
+}
+
+// reloader restarts the exporter with the configuration loaded again, the HTTP server and the
+// postgres connection are kept, so addr and db_url changes require a restart
+type reloader struct {
+	// mutex serializes reloads
+	mutex   sync.Mutex
+	load    func() (*config.Config, error)
+	zScore  float64
+	started time.Time
+	// stopTimeout the cycles in flight are given to finish on reload before being cancelled
+	stopTimeout time.Duration
+	// exporter and its cfg are guarded by exporterMutex, so that scrapes are served throughout a reload
+	exporter *exporter
+	cfg      *config.Config
+	// shutdown is set once the exporter is shut down, no reloads happen from then on
+	shutdown      bool
+	exporterMutex sync.RWMutex
+}
+
+// Gather gathers the metrics of the running exporter
+func (r *reloader) Gather() ([]*dto.MetricFamily, error) {
+	e, _ := r.current()
+	return e.registry.Gather()
+}
+
+// current returns the running exporter and its configuration
+func (r *reloader) current() (*exporter, *config.Config) {
+	r.exporterMutex.RLock()
+	defer r.exporterMutex.RUnlock()
+	return r.exporter, r.cfg
+}
+
+func (r *reloader) setExporter(e *exporter, cfg *config.Config) {
+	r.exporterMutex.Lock()
+	defer r.exporterMutex.Unlock()
+	r.exporter, r.cfg = e, cfg
+}
+
+// Reload loads the configuration and restarts the exporter with it
+// the running exporter is kept when the configuration is invalid. its cycles in flight are cancelled
+// past stopTimeout, the exporter is restarted all the same, and the cancellation is returned
+func (r *reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.shutdown {
+		return fmt.Errorf("shutting down")
+	}
+
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+	if cfg.Addr != r.cfg.Addr || cfg.DBURL != r.cfg.DBURL {
+		log.Warn("addr and db_url changes take effect on restart only")
+		cfg.Addr, cfg.DBURL = r.cfg.Addr, r.cfg.DBURL
+	}
+	// everything which may fail is prepared while the running exporter keeps running
+	setup, err := prepareExporter(context.Background(), cfg)
+	if err != nil {
+		log.WithError(err).Error("Failed preparing exporter with the reloaded config, keeping the running one")
+		return err
+	}
+	// the running exporter is stopped before the new one registers its metrics, so that collections never overlap
+	ctx, cancel := context.WithTimeout(context.Background(), r.stopTimeout)
+	defer cancel()
+	stopErr := r.exporter.Shutdown(ctx)
+	// the savings the running exporter persisted until it stopped are loaded again, the totals loaded
+	// while preparing are kept when failing, as the running exporter is stopped already
+	if err := setup.loadSavingsTotals(); err != nil {
+		log.WithError(err).Warn("Failed loading spot savings totals again, the savings of the last cycles are left out")
+	}
+	exporter := setup.build(context.Background(), r.zScore)
+	exporter.keepStatuses(r.exporter)
+	exporter.keepSavings(r.exporter)
+	exporter.Start()
+	r.setExporter(exporter, cfg)
+	if stopErr != nil {
+		return fmt.Errorf("config reloaded, but collector cycles in flight were cancelled after %v: %v",
+			r.stopTimeout, stopErr)
+	}
+	log.Info("config reloaded")
+	return nil
+}
+
+// Shutdown shuts the running exporter down, see exporter.Shutdown
+func (r *reloader) Shutdown(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.exporterMutex.Lock()
+	r.shutdown = true
+	r.exporterMutex.Unlock()
+	return r.exporter.Shutdown(ctx)
+}
+
+// ServeHTTP reloads on POST /-/reload
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "config reloaded")
+}
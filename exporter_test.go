@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/billing"
+	"github.com/EladDolev/aws_audit_exporter/config"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// newTestExporter creates an exporter with a single collector running collect
+func newTestExporter(collect func(ctx context.Context, cycle *log.Entry) error) *exporter {
+	e := &exporter{stop: make(chan struct{})}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.collectors = []collector{{config.Instances, time.Hour, 0, collect}}
+	e.statuses = map[string]*collectorStatus{config.Instances: newCollectorStatus(e.collectors[0])}
+	return e
+}
+
+func TestReloadKeepsRunningExporterOnFailure(t *testing.T) {
+	running := newTestExporter(func(ctx context.Context, cycle *log.Entry) error { return nil })
+	running.Start()
+	defer running.Stop()
+
+	cfg := &config.Config{Addr: ":9190", PriceCatalog: "/nonexistent/catalog.csv"}
+	cfg.SetDefaults(time.Minute, false)
+	r := &reloader{
+		load:     func() (*config.Config, error) { return cfg, nil },
+		cfg:      &config.Config{Addr: ":9190"},
+		exporter: running,
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload succeeded with a missing price catalog")
+	}
+	if e, _ := r.current(); e != running {
+		t.Error("running exporter was replaced")
+	}
+	select {
+	case <-running.stop:
+		t.Error("running exporter was stopped")
+	default:
+	}
+}
+
+func TestReloadLoadsSavingsTotalsOnceStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	catalog := filepath.Join(dir, "catalog.csv")
+	if err := ioutil.WriteFile(catalog, []byte("region,instance_type,on_demand\nus-east-1,m5.large,0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	running := newTestExporter(func(ctx context.Context, cycle *log.Entry) error { return nil })
+	running.Start()
+	var loadedOnceStopped bool
+	loadSpotSavingsTotals = func() ([]postgres.SpotSavingsTotal, error) {
+		select {
+		case <-running.stop:
+			loadedOnceStopped = true
+		default:
+			loadedOnceStopped = false
+		}
+		return nil, nil
+	}
+	defer func() { loadSpotSavingsTotals = billing.LoadSpotSavingsTotals }()
+
+	cfg := &config.Config{Addr: ":9190", PriceCatalog: catalog}
+	cfg.SetDefaults(time.Minute, false)
+	r := &reloader{
+		load:        func() (*config.Config, error) { return cfg, nil },
+		cfg:         &config.Config{Addr: ":9190"},
+		exporter:    running,
+		stopTimeout: time.Second,
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Shutdown(context.Background())
+	if !loadedOnceStopped {
+		t.Error("savings totals were last loaded before the running exporter stopped")
+	}
+}
+
+func TestShutdownCancelsCyclesPastDeadline(t *testing.T) {
+	e := newTestExporter(func(ctx context.Context, cycle *log.Entry) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	e.Start()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if state := e.statuses[config.Instances].get(); state.LastError != context.Canceled.Error() {
+		t.Errorf("cycle ended with %q, want %q", state.LastError, context.Canceled.Error())
+	}
+}
+
+func TestRunCancelsCyclesPastTimeout(t *testing.T) {
+	e := newTestExporter(func(ctx context.Context, cycle *log.Entry) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer e.cancel()
+	e.collectors[0].timeout = 10 * time.Millisecond
+	if err := e.run(e.collectors[0]); err != context.DeadlineExceeded {
+		t.Errorf("run returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// log formats
+const (
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+// configureLogging sets the level and format of the logs, written to stderr
+// --debug is kept as a shorthand of --log-level debug
+func configureLogging(level string, format string, debug bool) error {
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q, expected one of debug, info, warn, error", level)
+	}
+	if debug {
+		logLevel = log.DebugLevel
+	}
+	switch format {
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	case logFormatLogfmt:
+		log.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return fmt.Errorf("invalid log format %q, expected one of %s, %s", format, logFormatLogfmt, logFormatJSON)
+	}
+	log.SetLevel(logLevel)
+	log.SetOutput(os.Stderr)
+	return nil
+}
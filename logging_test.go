@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	defer configureLogging("info", logFormatLogfmt, false)
+
+	for _, test := range []struct {
+		level, format string
+		debug         bool
+		want          log.Level
+	}{
+		{"warn", logFormatJSON, false, log.WarnLevel},
+		{"error", logFormatLogfmt, true, log.DebugLevel},
+	} {
+		if err := configureLogging(test.level, test.format, test.debug); err != nil {
+			t.Fatal(err)
+		}
+		if got := log.GetLevel(); got != test.want {
+			t.Errorf("level %s, debug %v = %s, want %s", test.level, test.debug, got, test.want)
+		}
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.TextFormatter); !ok {
+		t.Errorf("logfmt formatter = %T", log.StandardLogger().Formatter)
+	}
+
+	if err := configureLogging("verbose", logFormatLogfmt, false); err == nil {
+		t.Error("configureLogging() succeeded with an invalid level")
+	}
+	if err := configureLogging("info", "text", false); err == nil {
+		t.Error("configureLogging() succeeded with an invalid format")
+	}
+}
@@ -15,47 +15,54 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 
-	"github.com/EladDolev/aws_audit_exporter/billing"
-	"github.com/EladDolev/aws_audit_exporter/debug"
+	"github.com/EladDolev/aws_audit_exporter/api"
+	"github.com/EladDolev/aws_audit_exporter/awsapi"
+	"github.com/EladDolev/aws_audit_exporter/config"
+	"github.com/EladDolev/aws_audit_exporter/export"
 	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+	"github.com/EladDolev/aws_audit_exporter/pusher"
+	"github.com/EladDolev/aws_audit_exporter/reports"
 	"github.com/EladDolev/aws_audit_exporter/sqlmigrations"
 )
 
+// options holds the global flags as set on the command line or in the environment, commands read
+// the configuration resolved out of them and the config file instead
 type options struct {
-	addr         string
-	dbURL        string
-	duration     time.Duration
-	instanceTags string
-	region       string
-	spotOS       string
+	addr               string
+	config             string
+	dbURL              string
+	debug              bool
+	duration           time.Duration
+	instanceTags       string
+	logFormat          string
+	logLevel           string
+	partitionsAhead    int
+	priceCatalog       string
+	region             string
+	retention          time.Duration
+	retentionRollup    bool
+	shutdownTimeout    time.Duration
+	spotAnomalyZScore  float64
+	spotOS             string
+	webEnableLifecycle bool
 }
 
-// We have to construct the set of tags for this based on the program
-// args, so it is created in main
-var instanceTags = map[string]string{}
-var tagl = []string{}
-
-// We'll cache the instance tag labels so that we can use them to separate
-// out spot instance spend
-var instanceLabelsCache = map[string]prometheus.Labels{}
-
-// will hold the list of OS (products) for which spot prices should be fetched
-var pList []*string
-
 // maintainSchema maintains the schema by running migrations
 func maintainSchema() error {
 	// runs init if gopg_migrations table does not exists
@@ -75,8 +82,122 @@ func maintainSchema() error {
 	return sqlmigrations.RunMigrations("")
 }
 
+// requirePostgres connects to postgres, for commands which only work against the database
+func requirePostgres(dbURL string) error {
+	if len(dbURL) == 0 {
+		return fmt.Errorf("must supply dbURL")
+	}
+	return postgres.ConnectPostgres(dbURL)
+}
+
+// loadConfig builds the configuration out of the config file when given, with flags and env set
+// explicitly taking precedence over it. an explicit --duration sets the interval of all the collectors
+// without a default interval of their own
+func loadConfig(c *cli.Context, options *options) (*config.Config, error) {
+	cfg := &config.Config{}
+	if len(options.config) > 0 {
+		var err error
+		if cfg, err = config.Load(options.config); err != nil {
+			return nil, err
+		}
+	}
+	override := func(flag string, file bool) bool {
+		return c.GlobalIsSet(flag) || !file
+	}
+	if override("addr", cfg.Addr != "") {
+		cfg.Addr = options.addr
+	}
+	if override("db-url", cfg.DBURL != "") {
+		cfg.DBURL = options.dbURL
+	}
+	if override("price-catalog", cfg.PriceCatalog != "") {
+		cfg.PriceCatalog = options.priceCatalog
+	}
+	if override("region", len(cfg.Regions) > 0) {
+		cfg.Regions = strings.Split(options.region, ",")
+	}
+	if override("instance-tags", len(cfg.InstanceTags) > 0) {
+		cfg.InstanceTags = nil
+		if len(options.instanceTags) > 0 {
+			cfg.InstanceTags = strings.Split(options.instanceTags, ",")
+		}
+	}
+	if override("spot-os", len(cfg.SpotOS) > 0) {
+		cfg.SpotOS = strings.Split(options.spotOS, ",")
+	}
+	cfg.SetDefaults(options.duration, c.GlobalIsSet("duration"))
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// pushCollectOnce pushes the metrics of a single collection, along with its outcome and time,
+// to a Pushgateway and/or a remote write endpoint. the AWS API calls and enum metrics of the
+// default registry are pushed along with them
+func pushCollectOnce(registry *prometheus.Registry, pushGateway string, remoteWrite string,
+	job string, grouping map[string]string, success bool) error {
+
+	outcome := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aws_audit_exporter_collect_once_success",
+		Help: "Whether all the collectors of the last collect-once run succeeded",
+	})
+	if success {
+		outcome.Set(1)
+	}
+	timestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aws_audit_exporter_collect_once_timestamp_seconds",
+		Help: "Unix time of the last collect-once run",
+	})
+	timestamp.SetToCurrentTime()
+	registry.MustRegister(outcome, timestamp)
+
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	if len(pushGateway) > 0 {
+		if err := pusher.Pushgateway(pushGateway, job, grouping, gatherers); err != nil {
+			return err
+		}
+	}
+	if len(remoteWrite) > 0 {
+		if err := pusher.RemoteWrite(remoteWrite, job, grouping, gatherers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signalContext returns a context cancelled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.WithField("signal", sig.String()).Info("shutting down")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// loadPriceCatalog loads the price catalog given to a command, or the global one
+func loadPriceCatalog(path string, globalPath string) (*pricing.Catalog, error) {
+	if len(path) == 0 {
+		path = globalPath
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("must supply a price catalog")
+	}
+	return pricing.LoadCatalog(path)
+}
+
 func main() {
 	options := &options{}
+	// cfg is resolved by app.Before, and read by the commands
+	var cfg *config.Config
 	app := cli.NewApp()
 
 	app.Name = "Prometheus AWS audit exporter"
@@ -88,7 +209,7 @@ func main() {
 		{
 			Name:            "migrate",
 			Usage:           "runs migrations on postgres database",
-			Description:     "https://github.com/go-pg/migrations#run-migrations",
+			Description:     "https://github.com/go-pg/migrations#run-migrations\n   \"status\" reports drift between the live schema and the models",
 			UsageText:       "./aws_audit_exporter migrate [args]",
 			SkipFlagParsing: false,
 			HideHelp:        false,
@@ -96,28 +217,481 @@ func main() {
 			HelpName:        "migrate",
 			Action: func(c *cli.Context) error {
 
-				if len(options.dbURL) == 0 {
-					log.Fatal("must supply dbURL")
+				if len(cfg.DBURL) == 0 {
 					return fmt.Errorf("must supply dbURL")
 				}
 
-				if err := postgres.ConnectPostgres(options.dbURL); err != nil {
-					log.Fatal(err)
-					return err
+				if err := postgres.ConnectPostgres(cfg.DBURL); err != nil {
+					return fmt.Errorf("Failed connecting to postgres: %v", err)
 				}
 				defer postgres.DB.Close()
 
 				if err := sqlmigrations.RunMigrations(
 					strings.Join(c.Args(), " ")); err != nil {
-					log.Fatal(err)
-					return err
+					return fmt.Errorf("Failed running migrations: %v", err)
 				}
 				return nil
 			},
 		},
+		{
+			Name:      "lineage",
+			Usage:     "prints the ancestors and descendants of a reserved instance",
+			UsageText: "./aws_audit_exporter lineage [--format json|dot] <reservation id>",
+			HelpName:  "lineage",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "json",
+					Usage: "output format [json|dot]",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				reservationID, err := uuid.Parse(c.Args().First())
+				if err != nil {
+					return fmt.Errorf("must supply a valid reservation id: %v", err)
+				}
+				if err := requirePostgres(cfg.DBURL); err != nil {
+					return err
+				}
+				defer postgres.DB.Close()
+
+				lineage, err := reports.GetLineage(context.Background(), reservationID)
+				if err != nil {
+					return err
+				}
+				return lineage.Write(os.Stdout, c.String("format"))
+			},
+		},
+		{
+			Name:      "recommend",
+			Usage:     "proposes reserved instances purchases out of the usage history stored in postgres",
+			UsageText: "./aws_audit_exporter recommend --price-catalog <file> [options]",
+			HelpName:  "recommend",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "class",
+					Usage: "only consider offerings of class [standard|convertible]",
+				},
+				cli.IntFlag{
+					Name:  "days",
+					Value: 30,
+					Usage: "days of usage history to compute the baseline from",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "markdown",
+					Usage: "output format [csv|json|markdown]",
+				},
+				cli.DurationFlag{
+					Name:  "horizon",
+					Value: 90 * 24 * time.Hour,
+					Usage: "reservations expiring within horizon are not counted as coverage",
+				},
+				cli.StringFlag{
+					Name:  "payment",
+					Usage: "only consider offerings with payment option [no|partial|all]",
+				},
+				cli.Float64Flag{
+					Name:  "percentile",
+					Value: 10,
+					Usage: "percentile of hourly usage taken as the steady-state baseline",
+				},
+				cli.StringFlag{
+					Name:   "price-catalog",
+					Usage:  "CSV file of on-demand and reserved instances prices",
+					EnvVar: "PRICE_CATALOG",
+				},
+				cli.StringFlag{
+					Name:  "term",
+					Usage: "only consider offerings of term [1yr|3yr]",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.Int("days") < 1 {
+					return fmt.Errorf("days must be positive")
+				}
+				if p := c.Float64("percentile"); p <= 0 || p > 100 {
+					return fmt.Errorf("percentile must be between 0 and 100")
+				}
+				catalog, err := loadPriceCatalog(c.String("price-catalog"), cfg.PriceCatalog)
+				if err != nil {
+					return err
+				}
+				if err := requirePostgres(cfg.DBURL); err != nil {
+					return err
+				}
+				defer postgres.DB.Close()
+
+				recommendations, err := reports.GetRecommendations(context.Background(), reports.RecommendOptions{
+					Days:       c.Int("days"),
+					Percentile: c.Float64("percentile"),
+					Horizon:    c.Duration("horizon"),
+					Class:      c.String("class"),
+					Term:       c.String("term"),
+					Payment:    c.String("payment"),
+				}, catalog)
+				if err != nil {
+					return err
+				}
+				return recommendations.Write(os.Stdout, c.String("format"))
+			},
+		},
+		{
+			Name:      "collect-once",
+			Usage:     "runs every enabled collector once, pushes the metrics and exits, failing when any collector failed",
+			UsageText: "./aws_audit_exporter collect-once (--push-gateway <url> | --remote-write <url> | --config <file with otlp>) [options]",
+			HelpName:  "collect-once",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "instance",
+					Usage: "instance label, part of the grouping key along with job",
+				},
+				cli.StringFlag{
+					Name:  "job",
+					Value: "aws_audit_exporter",
+					Usage: "job label, and the grouping key of the metrics pushed",
+				},
+				cli.StringFlag{
+					Name:   "push-gateway",
+					Usage:  "Pushgateway url to push the metrics to",
+					EnvVar: "PUSH_GATEWAY",
+				},
+				cli.StringFlag{
+					Name:   "remote-write",
+					Usage:  "Prometheus remote write url to send the metrics to",
+					EnvVar: "REMOTE_WRITE",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				if c.String("push-gateway") == "" && c.String("remote-write") == "" && cfg.OTLP.Endpoint == "" {
+					return fmt.Errorf("must supply either push-gateway, remote-write or an otlp endpoint in the config")
+				}
+				grouping := map[string]string{}
+				if instance := c.String("instance"); instance != "" {
+					grouping["instance"] = instance
+				}
+				// a signal cancels the collection, rolling back the transactions in flight
+				ctx, cancel := signalContext()
+				defer cancel()
+				if len(cfg.DBURL) > 0 {
+					if err := postgres.ConnectPostgres(cfg.DBURL); err != nil {
+						return err
+					}
+					defer postgres.DB.Close()
+					if err := maintainSchema(); err != nil {
+						return err
+					}
+					// spot_prices has no default partition, and between runs nothing else creates the partitions
+					if err := postgres.MaintainPartitions(ctx, options.partitionsAhead,
+						options.retention, options.retentionRollup); err != nil {
+						return fmt.Errorf("Failed maintaining partitions: %v", err)
+					}
+					postgres.RegisterEnumsMetrics()
+				}
+				awsapi.RegisterAWSMetrics()
+				exporter, err := newExporter(ctx, cfg, options.spotAnomalyZScore)
+				if err != nil {
+					return err
+				}
+				collectErr := exporter.CollectOnce()
+				if collectErr != nil {
+					log.WithError(collectErr).Error("collect-once failed")
+				}
+				if err := pushCollectOnce(exporter.registry, c.String("push-gateway"), c.String("remote-write"),
+					c.String("job"), grouping, collectErr == nil); err != nil {
+					return err
+				}
+				if exporter.otlp != nil {
+					defer exporter.otlp.Close()
+					if err := exporter.otlp.Export(exporter.registry); err != nil {
+						return err
+					}
+				}
+				return collectErr
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "writes the tables stored in postgres as CSV and Parquet files, partitioned by table and date",
+			UsageText: "./aws_audit_exporter export --dir <directory> [options]",
+			HelpName:  "export",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dir",
+					Usage: "directory to write the files into, as <format>/<table>/dt=<YYYY-MM-DD>/<table>.<format>",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "csv,parquet",
+					Usage: "comma separated formats [csv|parquet]",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "first day of the events exported, as YYYY-MM-DD, defaults to yesterday",
+				},
+				cli.BoolFlag{
+					Name:  "live",
+					Usage: "runs every enabled collector once first, then exports the snapshots and the event partitions it wrote to, whole",
+				},
+				cli.StringFlag{
+					Name:  "tables",
+					Usage: "comma separated tables to export, defaults to " + strings.Join(export.Tables, ","),
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "day following the last day of the events exported, as YYYY-MM-DD, defaults to today",
+				},
+			},
+			Action: func(c *cli.Context) error {
+
+				today := time.Now().UTC().Truncate(24 * time.Hour)
+				exportOptions := export.Options{
+					Dir:     c.String("dir"),
+					Formats: strings.Split(c.String("format"), ","),
+					Date:    today,
+					From:    today.AddDate(0, 0, -1),
+					To:      today,
+				}
+				if tables := c.String("tables"); tables != "" {
+					exportOptions.Tables = strings.Split(tables, ",")
+				}
+				for flag, date := range map[string]*time.Time{"from": &exportOptions.From, "to": &exportOptions.To} {
+					if v := c.String(flag); v != "" {
+						var err error
+						if *date, err = time.Parse("2006-01-02", v); err != nil {
+							return fmt.Errorf("invalid %s %q, expected YYYY-MM-DD", flag, v)
+						}
+					}
+				}
+				if c.Bool("live") {
+					exportOptions.UpdatedSince = time.Now()
+				}
+				if err := exportOptions.Validate(); err != nil {
+					return err
+				}
+
+				if err := requirePostgres(cfg.DBURL); err != nil {
+					return err
+				}
+				defer postgres.DB.Close()
+
+				// rows of a live collection are written to postgres first, then exported out of it
+				var collectErr error
+				if c.Bool("live") {
+					ctx, cancel := signalContext()
+					defer cancel()
+					if err := maintainSchema(); err != nil {
+						return err
+					}
+					if err := postgres.MaintainPartitions(ctx, options.partitionsAhead,
+						options.retention, options.retentionRollup); err != nil {
+						return fmt.Errorf("Failed maintaining partitions: %v", err)
+					}
+					exporter, err := newExporter(ctx, cfg, options.spotAnomalyZScore)
+					if err != nil {
+						return err
+					}
+					if collectErr = exporter.CollectOnce(); collectErr != nil {
+						log.WithError(collectErr).Error("live collection failed")
+					}
+				}
+
+				files, err := export.Export(exportOptions)
+				for _, file := range files {
+					fmt.Println(file)
+				}
+				if err != nil {
+					return err
+				}
+				return collectErr
+			},
+		},
+		{
+			Name:      "report",
+			Usage:     "reports over the data stored in postgres, runs offline",
+			UsageText: "./aws_audit_exporter report <report> [args]",
+			HelpName:  "report",
+			Subcommands: []cli.Command{
+				{
+					Name:      "chargeback",
+					Usage:     "prints the cost of a calendar month by the values of an instance tag",
+					UsageText: "./aws_audit_exporter report chargeback --tag <key> --price-catalog <file> [--month YYYY-MM] [--format csv|json|markdown]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "format",
+							Value: "csv",
+							Usage: "output format [csv|json|markdown]",
+						},
+						cli.StringFlag{
+							Name:  "month",
+							Usage: "calendar month to report, as YYYY-MM, defaults to the previous month",
+						},
+						cli.StringFlag{
+							Name:   "price-catalog",
+							Usage:  "CSV file of on-demand hourly prices, with region,instance_type,on_demand columns",
+							EnvVar: "PRICE_CATALOG",
+						},
+						cli.StringFlag{
+							Name:  "tag",
+							Usage: "instance tag key to split the cost by",
+						},
+					},
+					Action: func(c *cli.Context) error {
+
+						now := time.Now().UTC()
+						month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+						if v := c.String("month"); v != "" {
+							var err error
+							if month, err = time.Parse("2006-01", v); err != nil {
+								return fmt.Errorf("invalid month %q, expected YYYY-MM", v)
+							}
+						}
+						if c.String("tag") == "" {
+							return fmt.Errorf("must supply a tag")
+						}
+						catalog, err := loadPriceCatalog(c.String("price-catalog"), cfg.PriceCatalog)
+						if err != nil {
+							return err
+						}
+						if err := requirePostgres(cfg.DBURL); err != nil {
+							return err
+						}
+						defer postgres.DB.Close()
+
+						chargeback, err := reports.GetChargeback(context.Background(), month, c.String("tag"), catalog)
+						if err != nil {
+							return err
+						}
+						return chargeback.Write(os.Stdout, c.String("format"))
+					},
+				},
+				{
+					Name:      "resale",
+					Usage:     "suggests underutilized standard reservations to list on the marketplace, along with price schedules",
+					UsageText: "./aws_audit_exporter report resale [options]",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "days",
+							Value: reports.DefaultResaleOptions.Days,
+							Usage: "days of usage history to compute utilization from",
+						},
+						cli.Float64Flag{
+							Name:  "discount",
+							Value: reports.DefaultResaleOptions.Discount,
+							Usage: "discount off the remaining value of listed reservations, between 0 and 1",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Value: "markdown",
+							Usage: "output format [json|markdown]",
+						},
+						cli.Float64Flag{
+							Name:  "percentile",
+							Value: reports.DefaultResaleOptions.Percentile,
+							Usage: "percentile of hourly usage to keep reserved",
+						},
+						cli.Float64Flag{
+							Name:  "threshold",
+							Value: reports.DefaultResaleOptions.Threshold,
+							Usage: "utilization below which reservations are considered for resale, between 0 and 1",
+						},
+					},
+					Action: func(c *cli.Context) error {
+
+						resaleOptions := reports.ResaleOptions{
+							Days:       c.Int("days"),
+							Discount:   c.Float64("discount"),
+							Percentile: c.Float64("percentile"),
+							Threshold:  c.Float64("threshold"),
+						}
+						if err := resaleOptions.Validate(); err != nil {
+							return err
+						}
+						if err := requirePostgres(cfg.DBURL); err != nil {
+							return err
+						}
+						defer postgres.DB.Close()
+
+						advice, err := reports.GetResaleAdvice(context.Background(), resaleOptions)
+						if err != nil {
+							return err
+						}
+						return advice.Write(os.Stdout, c.String("format"))
+					},
+				},
+				{
+					Name:      "exchange",
+					Usage:     "plans exchanging convertible reservations into families with uncovered usage",
+					UsageText: "./aws_audit_exporter report exchange --price-catalog <file> [options]",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "days",
+							Value: 7,
+							Usage: "days of usage history to compute the current usage from",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Value: "markdown",
+							Usage: "output format [json|markdown]",
+						},
+						cli.Float64Flag{
+							Name:  "percentile",
+							Value: 50,
+							Usage: "percentile of hourly usage taken as the current usage",
+						},
+						cli.StringFlag{
+							Name:   "price-catalog",
+							Usage:  "CSV file of convertible reservations prices",
+							EnvVar: "PRICE_CATALOG",
+						},
+					},
+					Action: func(c *cli.Context) error {
+
+						if c.Int("days") < 1 {
+							return fmt.Errorf("days must be positive")
+						}
+						if p := c.Float64("percentile"); p <= 0 || p > 100 {
+							return fmt.Errorf("percentile must be between 0 and 100")
+						}
+						catalog, err := loadPriceCatalog(c.String("price-catalog"), cfg.PriceCatalog)
+						if err != nil {
+							return err
+						}
+						if err := requirePostgres(cfg.DBURL); err != nil {
+							return err
+						}
+						defer postgres.DB.Close()
+
+						plan, err := reports.GetExchangePlan(context.Background(), reports.ExchangeOptions{
+							Days:       c.Int("days"),
+							Percentile: c.Float64("percentile"),
+						}, catalog)
+						if err != nil {
+							return err
+						}
+						return plan.Write(os.Stdout, c.String("format"))
+					},
+				},
+			},
+		},
 	}
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:        "config",
+			Usage:       "YAML or TOML (.toml) config file, flags and env set explicitly take precedence over it",
+			EnvVar:      "CONFIG",
+			Destination: &options.config,
+		},
+		cli.BoolFlag{
+			Name:        "add-unknown-enum-values",
+			Usage:       "add values unknown to database enum types with ALTER TYPE, instead of storing them as \"other\"",
+			EnvVar:      "ADD_UNKNOWN_ENUM_VALUES",
+			Destination: &postgres.AddUnknownEnumValues,
+		},
 		cli.StringFlag{
 			Name:        "addr",
 			Value:       ":9190",
@@ -127,9 +701,9 @@ func main() {
 		},
 		cli.BoolFlag{
 			Name:        "debug",
-			Usage:       "Whether to print debug logs and SQL statements",
+			Usage:       "Whether to print debug logs, along with queries durations, same as --log-level debug",
 			EnvVar:      "DEBUG",
-			Destination: &debug.Enabled,
+			Destination: &options.debug,
 		},
 		cli.StringFlag{
 			Name:        "db-url",
@@ -144,19 +718,72 @@ func main() {
 			EnvVar:      "DURATION",
 			Destination: &options.duration,
 		},
+		cli.StringFlag{
+			Name:        "log-format",
+			Value:       logFormatLogfmt,
+			Usage:       "format of the logs [logfmt|json]",
+			EnvVar:      "LOG_FORMAT",
+			Destination: &options.logFormat,
+		},
+		cli.StringFlag{
+			Name:        "log-level",
+			Value:       "info",
+			Usage:       "lowest level of the logs printed [debug|info|warn|error]",
+			EnvVar:      "LOG_LEVEL",
+			Destination: &options.logLevel,
+		},
 		cli.StringFlag{
 			Name:        "instance-tags",
 			Usage:       "comma seperated list of tag keys to use as metric labels",
 			EnvVar:      "INSTANCE_TAGS",
 			Destination: &options.instanceTags,
 		},
+		cli.IntFlag{
+			Name:        "partitions-ahead",
+			Value:       3,
+			Usage:       "number of future monthly partitions to keep created for partitioned tables",
+			EnvVar:      "PARTITIONS_AHEAD",
+			Destination: &options.partitionsAhead,
+		},
+		cli.StringFlag{
+			Name:        "price-catalog",
+			Usage:       "CSV file of on-demand hourly prices, exports spot savings when set",
+			EnvVar:      "PRICE_CATALOG",
+			Destination: &options.priceCatalog,
+		},
 		cli.StringFlag{
 			Name:        "region",
 			Value:       "us-east-1",
-			Usage:       "the region to query",
+			Usage:       "comma seperated list of regions to query",
 			EnvVar:      "REGION",
 			Destination: &options.region,
 		},
+		cli.DurationFlag{
+			Name:        "retention",
+			Usage:       "drop partitions of spot_prices and instances_uptime older than this (0 keeps data forever)",
+			EnvVar:      "RETENTION",
+			Destination: &options.retention,
+		},
+		cli.BoolFlag{
+			Name:        "retention-rollup",
+			Usage:       "roll up expired spot_prices partitions into daily min/avg/max rows before dropping them",
+			EnvVar:      "RETENTION_ROLLUP",
+			Destination: &options.retentionRollup,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-timeout",
+			Value:       30 * time.Second,
+			Usage:       "time the collector cycles in flight, and HTTP requests, are given to finish on SIGTERM before being cancelled",
+			EnvVar:      "SHUTDOWN_TIMEOUT",
+			Destination: &options.shutdownTimeout,
+		},
+		cli.Float64Flag{
+			Name:        "spot-anomaly-zscore",
+			Value:       3,
+			Usage:       "number of standard deviations from the mean spot price, above which the current price is flagged as an anomaly",
+			EnvVar:      "SPOT_ANOMALY_ZSCORE",
+			Destination: &options.spotAnomalyZScore,
+		},
 		cli.StringFlag{
 			Name:        "spot-os",
 			Value:       "Linux",
@@ -164,76 +791,122 @@ func main() {
 			EnvVar:      "SPOT_OS",
 			Destination: &options.spotOS,
 		},
+		cli.BoolFlag{
+			Name:        "web.enable-lifecycle",
+			Usage:       "enable config reloads through POST /-/reload",
+			EnvVar:      "WEB_ENABLE_LIFECYCLE",
+			Destination: &options.webEnableLifecycle,
+		},
 	}
 
-	app.Action = func(c *cli.Context) error {
-
-		if len(options.instanceTags) > 0 {
-			for _, tstr := range strings.Split(options.instanceTags, ",") {
-				ctag := billing.Tagname(tstr)
-				instanceTags[tstr] = ctag
-				tagl = append(tagl, ctag)
-			}
-		}
-
-		sess, err := session.NewSession()
-		if err != nil {
-			return fmt.Errorf("failed to create session: %v", err)
+	app.Before = func(c *cli.Context) error {
+		if err := configureLogging(options.logLevel, options.logFormat, options.debug); err != nil {
+			return err
 		}
+		var err error
+		cfg, err = loadConfig(c, options)
+		return err
+	}
 
-		svc := ec2.New(sess, &aws.Config{Region: aws.String(options.region)})
+	app.Action = func(c *cli.Context) error {
 
-		if pList, err = billing.GetProductDescriptions(options.spotOS, billing.IsClassicLink(svc)); err != nil {
-			return err
-		}
+		// SIGTERM and SIGINT stop scheduling, the cycles in flight and the HTTP requests are given
+		// shutdown-timeout to finish, and postgres is closed last
+		ctx, cancel := signalContext()
+		defer cancel()
 
-		if len(options.dbURL) > 0 {
-			if err := postgres.ConnectPostgres(options.dbURL); err != nil {
-				log.Fatal(err)
-				return err
+		if len(cfg.DBURL) > 0 {
+			if err := postgres.ConnectPostgres(cfg.DBURL); err != nil {
+				return fmt.Errorf("Failed connecting to postgres: %v", err)
 			}
 			defer postgres.DB.Close()
 			if err := maintainSchema(); err != nil {
 				return err
 			}
-		}
+			postgres.RegisterEnumsMetrics()
 
-		go func() {
-			billing.RegisterSpotsPricesMetrics()
-			for {
-				billing.GetSpotsCurrentPrices(svc, pList)
-				<-time.After(time.Hour)
+			// spot_prices has no default partition, the partition of the current month must
+			// exist before the first spot prices are written
+			if err := postgres.MaintainPartitions(ctx, options.partitionsAhead,
+				options.retention, options.retentionRollup); err != nil {
+				return fmt.Errorf("Failed maintaining partitions: %v", err)
 			}
-		}()
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(24 * time.Hour):
+					}
+					if err := postgres.MaintainPartitions(ctx, options.partitionsAhead,
+						options.retention, options.retentionRollup); err != nil {
+						log.WithError(err).Error("Failed maintaining partitions")
+					}
+				}
+			}()
+		}
 
+		awsapi.RegisterAWSMetrics()
+		// the cycles are cancelled by the reloader shutdown only, once its timeout is over
+		exporter, err := startExporter(context.Background(), cfg, options.spotAnomalyZScore)
+		if err != nil {
+			return err
+		}
+		reloader := &reloader{
+			load:        func() (*config.Config, error) { return loadConfig(c, options) },
+			cfg:         cfg,
+			exporter:    exporter,
+			zScore:      options.spotAnomalyZScore,
+			started:     time.Now(),
+			stopTimeout: options.shutdownTimeout,
+		}
+
+		// SIGHUP reloads the config, as does POST /-/reload when web.enable-lifecycle is set
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 		go func() {
-			instances := &billing.Instances{
-				Svc:                 svc,
-				InstanceLabelsCache: &instanceLabelsCache,
-				InstanceTags:        instanceTags,
-			}
-			spots := &billing.Spots{
-				Svc:                 svc,
-				InstanceLabelsCache: &instanceLabelsCache,
-				InstanceTags:        instanceTags,
+			for range hup {
+				if err := reloader.Reload(); err != nil {
+					log.WithError(err).Error("Failed reloading config")
+				}
 			}
+		}()
 
-			billing.RegisterInstancesMetrics(tagl)
-			billing.RegisterReservationsMetrics()
-			billing.RegisterSpotsMetrics(tagl)
-
-			for {
-				instances.GetInstancesInfo()
-				go billing.GetReservationsInfo(svc)
-				go spots.GetSpotsInfo()
-				<-time.After(options.duration)
-			}
+		// collectors metrics are gathered from the registry of the running exporter
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, reloader}
+		http.Handle("/metrics", promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})))
+		if options.webEnableLifecycle {
+			http.Handle("/-/reload", reloader)
+		}
+		http.HandleFunc("/healthz", reloader.healthz)
+		http.HandleFunc("/readyz", reloader.readyz)
+		http.HandleFunc("/status", reloader.status)
+		if len(cfg.DBURL) > 0 {
+			http.Handle(api.Prefix, api.Handler())
+		}
 
+		server := &http.Server{Addr: cfg.Addr}
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- server.ListenAndServe()
 		}()
+		select {
+		case err := <-serverErr:
+			return err
+		case <-ctx.Done():
+		}
 
-		http.Handle("/metrics", promhttp.Handler())
-
-		return http.ListenAndServe(options.addr, nil)
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), options.shutdownTimeout)
+		defer cancelShutdown()
+		if err := reloader.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Warn("collector cycles cancelled before finishing")
+		}
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Warn("Failed shutting down HTTP server")
+		}
+		log.Info("shut down")
+		return nil
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli"
+)
+
+func TestPushCollectOnceIncludesDefaultRegistry(t *testing.T) {
+	// stands for the AWS API calls and enum metrics, registered with the default registry
+	calls := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_default_registry_calls_total"})
+	calls.Inc()
+	prometheus.MustRegister(calls)
+	defer prometheus.Unregister(calls)
+
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	if err := pushCollectOnce(prometheus.NewRegistry(), server.URL, "", "aws_audit_exporter", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test_default_registry_calls_total", "aws_audit_exporter_collect_once_success"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("%s was not pushed", name)
+		}
+	}
+}
+
+func TestLoadConfigFallsBackToFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	options := &options{
+		addr:         ":9190",
+		config:       path,
+		duration:     4 * time.Minute,
+		priceCatalog: "flag.csv",
+		region:       "us-east-1",
+		spotOS:       "Linux",
+	}
+	c := cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil)
+
+	if err := ioutil.WriteFile(path, []byte("addr: \":9100\"\nprice_catalog: file.csv\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(c, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":9100" || cfg.PriceCatalog != "file.csv" {
+		t.Errorf("addr, price catalog = %q, %q, want the ones of the file", cfg.Addr, cfg.PriceCatalog)
+	}
+
+	// settings removed from the file on reload fall back to the flags
+	if err := ioutil.WriteFile(path, []byte("regions: [eu-west-1]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = loadConfig(c, options); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":9190" || cfg.PriceCatalog != "flag.csv" {
+		t.Errorf("addr, price catalog = %q, %q, want the ones of the flags", cfg.Addr, cfg.PriceCatalog)
+	}
+}
@@ -14,22 +14,24 @@ type BillingTable interface {
 	GetTableForeignKeys() *map[string]string
 }
 
-// Enums a map for enums used in database
-// used in createEnums(migrations.DB) and destroyEnums(migrations.DB) functions
+// Enums a map for enums used in database, as the models expect them to be
+// used for reporting schema drift, changes to the enums themselves are made by migrations
+// every enum has an "other" value, for values AWS returns which are unknown to it
 // TODO: use enums in go
 var Enums = map[string][]string{
-	"instance_lifecycle":         []string{"normal", "spot"},
-	"instance_state":             []string{"pending", "running", "shutting-down", "rebooting", "terminated", "stopping", "stopped"},
-	"reservation_listing_state":  []string{"available", "cancelled", "pending", "sold"},
-	"reservation_listing_status": []string{"active", "cancelled", "closed", "pending"},
-	"reservation_offer_class":    []string{"convertible", "scheduled", "standard"},
-	"reservation_offer_type":     []string{"All Upfront", "No Upfront", "Partial Upfront"},
-	"reservation_scope":          []string{"Availability Zone", "Region"},
-	"reservation_state":          []string{"active", "payment-failed", "payment-pending", "retired"},
-	"reservation_tenancy":        []string{"dedicated", "default"},
+	"instance_lifecycle":         []string{"normal", "spot", "scheduled", "capacity-block", "other"},
+	"instance_state":             []string{"pending", "running", "shutting-down", "rebooting", "terminated", "stopping", "stopped", "other"},
+	"reservation_listing_state":  []string{"available", "cancelled", "pending", "sold", "other"},
+	"reservation_listing_status": []string{"active", "cancelled", "closed", "pending", "other"},
+	"reservation_offer_class":    []string{"convertible", "scheduled", "standard", "other"},
+	"reservation_offer_type":     []string{"All Upfront", "No Upfront", "Partial Upfront", "other"},
+	"reservation_relation_event": []string{"modification", "sell-split", "other"},
+	"reservation_scope":          []string{"Availability Zone", "Region", "other"},
+	"reservation_state":          []string{"active", "payment-failed", "payment-pending", "retired", "other"},
+	"reservation_tenancy":        []string{"dedicated", "default", "other"},
 	"spot_product": []string{"Linux/UNIX", "Linux/UNIX (Amazon VPC)", "Windows",
 		"Windows (Amazon VPC)", "SUSE Linux", "SUSE Linux (Amazon VPC)",
-		"Red Hat Enterprise Linux", "Red Hat Enterprise Linux (Amazon VPC)"},
+		"Red Hat Enterprise Linux", "Red Hat Enterprise Linux (Amazon VPC)", "other"},
 }
 
 // -------------------------------------------------------------
@@ -56,20 +58,21 @@ var instancesForeignKeys = map[string]string{}
 
 // Instances hold information about ec2 instances
 type Instances struct {
-	InstanceID   string    `sql:"type:varchar(25),pk"`
-	Az           string    `sql:"type:varchar(15),notnull"`
-	CreatedAt    time.Time `sql:"default:now(),notnull"`
-	Family       string    `sql:"type:varchar(4),notnull"`
-	InstanceType string    `sql:"type:varchar(13),notnull"`
-	LaunchTime   time.Time `sql:",notnull"`
-	Lifecycle    string    `sql:"type:instance_lifecycle,notnull"`
-	OwnerID      uint64    `sql:",notnull"`
-	RequesterID  uint64    `sql:",notnull"`
-	State        string    `sql:"type:instance_state,notnull"`
-	Units        float32   `sql:",notnull"`
-	UpdatedAt    time.Time `sql:"default:now(),notnull"`
-	Groups       string
-	Tags         map[string]string `sql:",hstore"`
+	InstanceID   string            `sql:"type:varchar(25),pk" json:"instance_id"`
+	Az           string            `sql:"type:varchar(15),notnull" json:"az"`
+	CreatedAt    time.Time         `sql:"default:now(),notnull" json:"created_at"`
+	Family       string            `sql:"type:varchar(4),notnull" json:"family"`
+	InstanceType string            `sql:"type:varchar(13),notnull" json:"instance_type"`
+	LaunchTime   time.Time         `sql:",notnull" json:"launch_time"`
+	Lifecycle    string            `sql:"type:instance_lifecycle,notnull" json:"lifecycle"`
+	OwnerID      uint64            `sql:",notnull" json:"owner_id"`
+	Product      string            `sql:"type:spot_product" json:"product"`
+	RequesterID  uint64            `sql:",notnull" json:"requester_id"`
+	State        string            `sql:"type:instance_state,notnull" json:"state"`
+	Units        float32           `sql:",notnull" json:"units"`
+	UpdatedAt    time.Time         `sql:"default:now(),notnull" json:"updated_at"`
+	Groups       string            `json:"groups"`
+	Tags         map[string]string `sql:",hstore" json:"tags"`
 }
 
 // GetTableName returns table name
@@ -113,12 +116,12 @@ var instancesUptimeForeignKeys = map[string]string{
 
 // InstancesUptime holds information about instance state changes over time
 type InstancesUptime struct {
-	InstanceID string    `sql:"type:varchar(25),pk"`
-	LaunchTime time.Time `sql:",notnull,pk"`
-	State      string    `sql:"type:instance_state,pk"`
-	TableName  struct{}  `sql:"instances_uptime"`
-	CreatedAt  time.Time `sql:"default:now(),notnull"`
-	UpdatedAt  time.Time `sql:"default:now(),notnull"`
+	InstanceID string    `sql:"type:varchar(25),pk" json:"instance_id"`
+	LaunchTime time.Time `sql:",notnull,pk" json:"launch_time"`
+	State      string    `sql:"type:instance_state,pk" json:"state"`
+	TableName  struct{}  `sql:"instances_uptime" json:"-"`
+	CreatedAt  time.Time `sql:"default:now(),notnull" json:"created_at"`
+	UpdatedAt  time.Time `sql:"default:now(),notnull" json:"updated_at"`
 }
 
 // GetTableName returns table name
@@ -171,33 +174,33 @@ var reservationsForeignKeys = map[string]string{}
 
 // Reservations holds information for reserved instances
 type Reservations struct {
-	ReservationID    uuid.UUID   `sql:"type:uuid,pk"`
-	Az               string      `sql:"type:varchar(15)"`
-	Canceled         bool        `sql:"default:false,notnull"`
-	Converted        bool        `sql:"default:false,notnull"`
-	Count            uint16      `sql:",notnull"`
-	CreatedAt        time.Time   `sql:"default:now(),notnull"`
-	Duration         int32       `sql:",notnull"`
-	EffectivePrice   uint64      `sql:",notnull"`
-	EndDate          time.Time   `sql:",notnull"`
-	Family           string      `sql:"type:varchar(4),notnull"`
-	InstanceType     string      `sql:"type:varchar(13),notnull"`
-	ListedOn         []uuid.UUID `sql:"type:uuid[],array"`
-	OfferClass       string      `sql:"type:reservation_offer_class,notnull"`
-	OfferType        string      `sql:"type:reservation_offer_type,notnull"`
-	OriginalEndDate  time.Time   `sql:",notnull"`
-	Product          string      `sql:"type:varchar(37),notnull"`
-	RecurringCharges uint64      `sql:",notnull"`
-	Region           string      `sql:"type:varchar(14),notnull"`
-	Scope            string      `sql:"type:reservation_scope,notnull"`
-	SellSplitted     bool        `sql:"default:false,notnull"`
-	Sold             bool        `sql:"default:false,notnull"`
-	StartDate        time.Time   `sql:",notnull"`
-	State            string      `sql:"type:reservation_state,notnull"`
-	Tenancy          string      `sql:"type:reservation_tenancy,notnull"`
-	Units            float32     `sql:",notnull"`
-	UpdatedAt        time.Time   `sql:"default:now(),notnull"`
-	UpfrontPrice     uint64      `sql:",notnull"`
+	ReservationID    uuid.UUID   `sql:"type:uuid,pk" json:"reservation_id"`
+	Az               string      `sql:"type:varchar(15)" json:"az"`
+	Canceled         bool        `sql:"default:false,notnull" json:"canceled"`
+	Converted        bool        `sql:"default:false,notnull" json:"converted"`
+	Count            uint16      `sql:",notnull" json:"count"`
+	CreatedAt        time.Time   `sql:"default:now(),notnull" json:"created_at"`
+	Duration         int32       `sql:",notnull" json:"duration"`
+	EffectivePrice   uint64      `sql:",notnull" json:"effective_price"`
+	EndDate          time.Time   `sql:",notnull" json:"end_date"`
+	Family           string      `sql:"type:varchar(4),notnull" json:"family"`
+	InstanceType     string      `sql:"type:varchar(13),notnull" json:"instance_type"`
+	ListedOn         []uuid.UUID `sql:"type:uuid[],array" json:"listed_on"`
+	OfferClass       string      `sql:"type:reservation_offer_class,notnull" json:"offer_class"`
+	OfferType        string      `sql:"type:reservation_offer_type,notnull" json:"offer_type"`
+	OriginalEndDate  time.Time   `sql:",notnull" json:"original_end_date"`
+	Product          string      `sql:"type:varchar(37),notnull" json:"product"`
+	RecurringCharges uint64      `sql:",notnull" json:"recurring_charges"`
+	Region           string      `sql:"type:varchar(14),notnull" json:"region"`
+	Scope            string      `sql:"type:reservation_scope,notnull" json:"scope"`
+	SellSplitted     bool        `sql:"default:false,notnull" json:"sell_splitted"`
+	Sold             bool        `sql:"default:false,notnull" json:"sold"`
+	StartDate        time.Time   `sql:",notnull" json:"start_date"`
+	State            string      `sql:"type:reservation_state,notnull" json:"state"`
+	Tenancy          string      `sql:"type:reservation_tenancy,notnull" json:"tenancy"`
+	Units            float32     `sql:",notnull" json:"units"`
+	UpdatedAt        time.Time   `sql:"default:now(),notnull" json:"updated_at"`
+	UpfrontPrice     uint64      `sql:",notnull" json:"upfront_price"`
 }
 
 // GetTableName returns table name
@@ -234,11 +237,13 @@ var reservationsRelationsForeignKeys = map[string]string{
 }
 
 // ReservationsRelations hold relations between reservations
+// Event is the event that created the child reservation out of its parent
 type ReservationsRelations struct {
-	ParentID      uuid.UUID `sql:"type:uuid,pk"`
-	ReservationID uuid.UUID `sql:"type:uuid,pk"`
-	CreatedAt     time.Time `sql:"default:now(),notnull"`
-	UpdatedAt     time.Time `sql:"default:now(),notnull"`
+	ParentID      uuid.UUID `sql:"type:uuid,pk" json:"parent_id"`
+	ReservationID uuid.UUID `sql:"type:uuid,pk" json:"reservation_id"`
+	CreatedAt     time.Time `sql:"default:now(),notnull" json:"created_at"`
+	Event         string    `sql:"type:reservation_relation_event,default:'other',notnull" json:"event"`
+	UpdatedAt     time.Time `sql:"default:now(),notnull" json:"updated_at"`
 }
 
 // GetTableName returns table name
@@ -285,21 +290,21 @@ var reservationsListingsForeignKeys = map[string]string{}
 
 // ReservationsListings holds historical and current reservations listings in the AWS marketplace
 type ReservationsListings struct {
-	ListingID     uuid.UUID `sql:"type:uuid,pk"`
-	State         string    `sql:"type:reservation_listing_state,pk"`
-	Az            string    `sql:"type:varchar(15)"`
-	Count         uint16    `sql:",notnull"`
-	CreatedAt     time.Time `sql:"default:now(),notnull"`
-	Family        string    `sql:"type:varchar(4),notnull"`
-	InstanceType  string    `sql:"type:varchar(13),notnull"`
-	Product       string    `sql:"type:varchar(37),notnull"`
-	PublishedDate time.Time `sql:",notnull"`
-	Region        string    `sql:"type:varchar(14),notnull"`
-	Scope         string    `sql:"type:reservation_scope,notnull"`
-	Status        string    `sql:"type:reservation_listing_status,notnull"`
-	StatusMessage string
-	Units         float32   `sql:",notnull"`
-	UpdatedAt     time.Time `sql:"default:now(),notnull"`
+	ListingID     uuid.UUID `sql:"type:uuid,pk" json:"listing_id"`
+	State         string    `sql:"type:reservation_listing_state,pk" json:"state"`
+	Az            string    `sql:"type:varchar(15)" json:"az"`
+	Count         uint16    `sql:",notnull" json:"count"`
+	CreatedAt     time.Time `sql:"default:now(),notnull" json:"created_at"`
+	Family        string    `sql:"type:varchar(4),notnull" json:"family"`
+	InstanceType  string    `sql:"type:varchar(13),notnull" json:"instance_type"`
+	Product       string    `sql:"type:varchar(37),notnull" json:"product"`
+	PublishedDate time.Time `sql:",notnull" json:"published_date"`
+	Region        string    `sql:"type:varchar(14),notnull" json:"region"`
+	Scope         string    `sql:"type:reservation_scope,notnull" json:"scope"`
+	Status        string    `sql:"type:reservation_listing_status,notnull" json:"status"`
+	StatusMessage string    `json:"status_message"`
+	Units         float32   `sql:",notnull" json:"units"`
+	UpdatedAt     time.Time `sql:"default:now(),notnull" json:"updated_at"`
 }
 
 // GetTableName returns table name
@@ -342,12 +347,12 @@ var reservationsListingTermsForeignKeys = map[string]string{}
 
 // ReservationsListingsTerms holds listing terms history
 type ReservationsListingsTerms struct {
-	ListingID    uuid.UUID `sql:"type:uuid,pk"`
-	StartDate    time.Time `sql:",pk"`
-	CreatedAt    time.Time `sql:"default:now(),notnull"`
-	EndDate      time.Time `sql:",notnull"`
-	UpdatedAt    time.Time `sql:"default:now(),notnull"`
-	UpfrontPrice uint64    `sql:",notnull"`
+	ListingID    uuid.UUID `sql:"type:uuid,pk" json:"listing_id"`
+	StartDate    time.Time `sql:",pk" json:"start_date"`
+	CreatedAt    time.Time `sql:"default:now(),notnull" json:"created_at"`
+	EndDate      time.Time `sql:",notnull" json:"end_date"`
+	UpdatedAt    time.Time `sql:"default:now(),notnull" json:"updated_at"`
+	UpfrontPrice uint64    `sql:",notnull" json:"upfront_price"`
 }
 
 // GetTableName returns table name
@@ -392,12 +397,12 @@ var reservationsSellEventsForeignKeys = map[string]string{
 
 // ReservationsSellEvents holds dates and numbers of sold RIs
 type ReservationsSellEvents struct {
-	ReservationID uuid.UUID `sql:"type:uuid,pk"`
-	CreatedAt     time.Time `sql:"default:now(),notnull"`
-	ListingID     uuid.UUID `sql:"type:uuid"`
-	SoldDate      time.Time `sql:",notnull"`
-	UnitsSold     uint16    `sql:",notnull"`
-	UpdatedAt     time.Time `sql:"default:now(),notnull"`
+	ReservationID uuid.UUID `sql:"type:uuid,pk" json:"reservation_id"`
+	CreatedAt     time.Time `sql:"default:now(),notnull" json:"created_at"`
+	ListingID     uuid.UUID `sql:"type:uuid" json:"listing_id"`
+	SoldDate      time.Time `sql:",notnull" json:"sold_date"`
+	UnitsSold     uint16    `sql:",notnull" json:"units_sold"`
+	UpdatedAt     time.Time `sql:"default:now(),notnull" json:"updated_at"`
 }
 
 // GetTableName returns table name
@@ -438,15 +443,16 @@ var spotPricesForeignKeys = map[string]string{}
 
 // SpotPrices holds historical spots prices
 type SpotPrices struct {
-	Az               string    `sql:"type:varchar(15),pk"`
-	CreatedAt        time.Time `sql:"default:now(),pk"`
-	InstanceType     string    `sql:"type:varchar(13),pk"`
-	Product          string    `sql:"type:spot_product,pk"`
-	TableName        struct{}  `sql:"spot_prices"`
-	Family           string    `sql:"type:varchar(4),notnull"`
-	RecurringCharges uint64    `sql:",notnull"`
-	UpdatedAt        time.Time `sql:"default:now(),notnull"`
-	Units            float32   `sql:",notnull"`
+	Az               string    `sql:"type:varchar(15),pk" json:"az"`
+	CreatedAt        time.Time `sql:"default:now(),pk" json:"created_at"`
+	InstanceType     string    `sql:"type:varchar(13),pk" json:"instance_type"`
+	Product          string    `sql:"type:spot_product,pk" json:"product"`
+	TableName        struct{}  `sql:"spot_prices" json:"-"`
+	Family           string    `sql:"type:varchar(4),notnull" json:"family"`
+	RecurringCharges uint64    `sql:",notnull" json:"recurring_charges"`
+	UpdatedAt        time.Time `sql:"default:now(),notnull" json:"updated_at"`
+	Units            float32   `sql:",notnull" json:"units"`
+	Account          string    `sql:"type:varchar(64),notnull,default:''" json:"account"`
 }
 
 // GetTableName returns table name
@@ -468,3 +474,111 @@ func (s *SpotPrices) GetTableChecks() *map[string]string {
 func (s *SpotPrices) GetTableForeignKeys() *map[string]string {
 	return &spotPricesForeignKeys
 }
+
+// -------------------------------------------------------------
+// ------------------ spot_prices_daily table ------------------
+// -------------------------------------------------------------
+
+var spotPricesDailyIndexes = map[string]string{
+	"day":           "(day)",
+	"instance_type": "(instance_type)",
+}
+
+var spotPricesDailyChecks = map[string]string{
+	"charges": `min_recurring_charges <= avg_recurring_charges
+			    AND avg_recurring_charges <= max_recurring_charges`,
+	"samples":           "samples > 0",
+	"type_match_family": `substring(instance_type from '(.+)\..+') = family`,
+}
+
+var spotPricesDailyForeignKeys = map[string]string{}
+
+// SpotPricesDaily holds daily aggregations of spot prices which passed retention
+type SpotPricesDaily struct {
+	Az                  string    `sql:"type:varchar(15),pk" json:"az"`
+	Day                 time.Time `sql:"type:date,pk" json:"day"`
+	InstanceType        string    `sql:"type:varchar(13),pk" json:"instance_type"`
+	Product             string    `sql:"type:spot_product,pk" json:"product"`
+	TableName           struct{}  `sql:"spot_prices_daily" json:"-"`
+	AvgRecurringCharges uint64    `sql:",notnull" json:"avg_recurring_charges"`
+	CreatedAt           time.Time `sql:"default:now(),notnull" json:"created_at"`
+	Family              string    `sql:"type:varchar(4),notnull" json:"family"`
+	MaxRecurringCharges uint64    `sql:",notnull" json:"max_recurring_charges"`
+	MinRecurringCharges uint64    `sql:",notnull" json:"min_recurring_charges"`
+	Samples             uint32    `sql:",notnull" json:"samples"`
+	Units               float32   `sql:",notnull" json:"units"`
+	UpdatedAt           time.Time `sql:"default:now(),notnull" json:"updated_at"`
+	Account             string    `sql:"type:varchar(64),pk,default:''" json:"account"`
+}
+
+// GetTableName returns table name
+func (s *SpotPricesDaily) GetTableName() string {
+	return "spot_prices_daily"
+}
+
+// GetTableIndexes returns table indexes
+func (s *SpotPricesDaily) GetTableIndexes() *map[string]string {
+	return &spotPricesDailyIndexes
+}
+
+// GetTableChecks returns table check constraints
+func (s *SpotPricesDaily) GetTableChecks() *map[string]string {
+	return &spotPricesDailyChecks
+}
+
+// GetTableForeignKeys returns table foreign keys constraints
+func (s *SpotPricesDaily) GetTableForeignKeys() *map[string]string {
+	return &spotPricesDailyForeignKeys
+}
+
+// -------------------------------------------------------------
+// -------------------- spot_savings table ---------------------
+// -------------------------------------------------------------
+
+var spotSavingsIndexes = map[string]string{
+	"family":        "(family)",
+	"instance_type": "(instance_type)",
+}
+
+var spotSavingsChecks = map[string]string{
+	"times":             "updated_at >= created_at",
+	"type_match_family": `substring(instance_type from '(.+)\..+') = family`,
+}
+
+var spotSavingsForeignKeys = map[string]string{}
+
+// SpotSavings holds the cumulative savings of spot instances, compared to on-demand
+// Tags holds the label values the savings were exported with, normalized by the labels settings, rather
+// than the raw instance tags, so that the savings counter resumes from them with the same labels
+type SpotSavings struct {
+	InstanceID   string            `sql:"type:varchar(25),pk" json:"instance_id"`
+	Az           string            `sql:"type:varchar(15),notnull" json:"az"`
+	CreatedAt    time.Time         `sql:"default:now(),notnull" json:"created_at"`
+	Family       string            `sql:"type:varchar(4),notnull" json:"family"`
+	InstanceType string            `sql:"type:varchar(13),notnull" json:"instance_type"`
+	Product      string            `sql:"type:spot_product,notnull" json:"product"`
+	Savings      uint64            `sql:",notnull" json:"savings"`
+	Tags         map[string]string `sql:",hstore" json:"tags"`
+	UpdatedAt    time.Time         `sql:"default:now(),notnull" json:"updated_at"`
+	Account      string            `sql:"type:varchar(64),notnull,default:''" json:"account"`
+}
+
+// GetTableName returns table name
+func (s *SpotSavings) GetTableName() string {
+	return "spot_savings"
+}
+
+// GetTableIndexes returns table indexes
+func (s *SpotSavings) GetTableIndexes() *map[string]string {
+	return &spotSavingsIndexes
+}
+
+// GetTableChecks returns table check constraints
+func (s *SpotSavings) GetTableChecks() *map[string]string {
+	return &spotSavingsChecks
+}
+
+// GetTableForeignKeys returns table foreign keys constraints
+func (s *SpotSavings) GetTableForeignKeys() *map[string]string {
+	return &spotSavingsForeignKeys
+}
@@ -0,0 +1,358 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Prefix only the metric families with this prefix, the billing metrics, are exported
+const Prefix = "aws_ec2_"
+
+// serviceName the service.name resource attribute
+const serviceName = "aws_audit_exporter"
+
+// attributes OTel attribute names of labels, by label name. account, owner_id and region are resource attributes
+var attributes = map[string]string{
+	"az":            "cloud.availability_zone",
+	"instance_id":   "host.id",
+	"instance_type": "host.type",
+}
+
+// resource labels turned into resource attributes
+// owner_id remains a data point attribute when the account label is set
+var resourceLabels = map[string]string{
+	"account":  "aws.account.name",
+	"owner_id": "cloud.account.id",
+	"region":   "cloud.region",
+}
+
+// Options of the export
+// TagKeys holds the tag keys of tag labels, by label name, e.g. aws_tag_cost_center: CostCenter
+type Options struct {
+	Endpoint string
+	Protocol string
+	Insecure bool
+	Headers  map[string]string
+	Timeout  time.Duration
+	TagKeys  map[string]string
+}
+
+// Exporter sends the billing metrics gathered to an OpenTelemetry collector over OTLP/gRPC or OTLP/HTTP
+type Exporter struct {
+	options Options
+	// start start time of the cumulative metrics
+	start  time.Time
+	conn   *grpc.ClientConn
+	client collectorpb.MetricsServiceClient
+	http   *http.Client
+}
+
+// New creates an exporter, grpc connections are established lazily, on the first export
+func New(options Options) (*Exporter, error) {
+	e := &Exporter{options: options, start: time.Now()}
+	switch options.Protocol {
+	case "grpc":
+		creds := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+		if options.Insecure {
+			creds = grpc.WithInsecure()
+		}
+		conn, err := grpc.Dial(options.Endpoint, creds)
+		if err != nil {
+			return nil, fmt.Errorf("Failed connecting to %s: %v", options.Endpoint, err)
+		}
+		e.conn = conn
+		e.client = collectorpb.NewMetricsServiceClient(conn)
+	case "http":
+		e.http = &http.Client{Timeout: options.Timeout}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %s", options.Protocol)
+	}
+	return e, nil
+}
+
+// Close closes the grpc connection
+func (e *Exporter) Close() error {
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+// Export sends the billing metrics gathered
+func (e *Exporter) Export(gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("Failed gathering metrics: %v", err)
+	}
+	request := e.toRequest(families, time.Now())
+	if len(request.ResourceMetrics) == 0 {
+		return nil
+	}
+	if e.client != nil {
+		return e.exportGRPC(request)
+	}
+	return e.exportHTTP(request)
+}
+
+func (e *Exporter) exportGRPC(request *collectorpb.ExportMetricsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
+	defer cancel()
+	if len(e.options.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.options.Headers))
+	}
+	if _, err := e.client.Export(ctx, request); err != nil {
+		return fmt.Errorf("Failed exporting to %s: %v", e.options.Endpoint, err)
+	}
+	return nil
+}
+
+func (e *Exporter) exportHTTP(request *collectorpb.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("Failed encoding OTLP request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.options.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed creating OTLP request: %v", err)
+	}
+	for name, value := range e.options.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", serviceName)
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed exporting to %s: %v", e.options.Endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Failed exporting to %s: %s %s", e.options.Endpoint, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// attributeName returns the OTel attribute name of a label
+// tag labels become aws.tag.<tag key>, using the original tag key when known
+func (e *Exporter) attributeName(label string) string {
+	if name, ok := attributes[label]; ok {
+		return name
+	}
+	if strings.HasPrefix(label, "aws_tag_") {
+		if key, ok := e.options.TagKeys[label]; ok {
+			return "aws.tag." + key
+		}
+		return "aws.tag." + strings.TrimPrefix(label, "aws_tag_")
+	}
+	return label
+}
+
+func keyValue(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// resourceKey resource attributes of a metric, the region is taken from the az when missing
+// metrics are labeled with the account they were collected from when accounts are configured, otherwise
+// only instances are labeled with the account id of their owner
+func resourceKey(metric *dto.Metric) (account string, accountID string, region string) {
+	for _, l := range metric.Label {
+		switch l.GetName() {
+		case "account":
+			account = l.GetValue()
+		case "owner_id":
+			accountID = l.GetValue()
+		case "region":
+			region = l.GetValue()
+		}
+	}
+	// instances of an account may be owned by another one, they remain in the resource of the account
+	if account != "" {
+		accountID = ""
+	}
+	if region == "" {
+		for _, l := range metric.Label {
+			if l.GetName() == "az" {
+				region = strings.TrimRight(l.GetValue(), "abcdefghijklmnopqrstuvwxyz")
+			}
+		}
+	}
+	return account, accountID, region
+}
+
+// pointAttributes attributes of a data point, all the labels which are not resource attributes
+func (e *Exporter) pointAttributes(metric *dto.Metric, accountID string) []*commonpb.KeyValue {
+	var kvs []*commonpb.KeyValue
+	for _, l := range metric.Label {
+		if _, ok := resourceLabels[l.GetName()]; ok && (l.GetName() != "owner_id" || accountID != "") {
+			continue
+		}
+		kvs = append(kvs, keyValue(e.attributeName(l.GetName()), l.GetValue()))
+	}
+	return kvs
+}
+
+// toRequest converts the billing metric families, grouping data points by account and region
+// gauges and untyped become gauges, counters monotonic cumulative sums, histograms and summaries remain so
+func (e *Exporter) toRequest(families []*dto.MetricFamily, now time.Time) *collectorpb.ExportMetricsServiceRequest {
+	type key struct{ account, accountID, region string }
+	metrics := map[key]map[string]*metricspb.Metric{}
+	start, timestamp := uint64(e.start.UnixNano()), uint64(now.UnixNano())
+
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), Prefix) {
+			continue
+		}
+		for _, m := range family.Metric {
+			account, accountID, region := resourceKey(m)
+			k := key{account, accountID, region}
+			if metrics[k] == nil {
+				metrics[k] = map[string]*metricspb.Metric{}
+			}
+			metric, ok := metrics[k][family.GetName()]
+			if !ok {
+				metric = &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+				switch family.GetType() {
+				case dto.MetricType_COUNTER:
+					metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+						AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+						IsMonotonic:            true,
+					}}
+				case dto.MetricType_HISTOGRAM:
+					metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+						AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					}}
+				case dto.MetricType_SUMMARY:
+					metric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}
+				default:
+					metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+				}
+				metrics[k][family.GetName()] = metric
+			}
+
+			attributes := e.pointAttributes(m, accountID)
+			switch data := metric.Data.(type) {
+			case *metricspb.Metric_Gauge:
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				data.Gauge.DataPoints = append(data.Gauge.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:   attributes,
+					TimeUnixNano: timestamp,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				})
+			case *metricspb.Metric_Sum:
+				data.Sum.DataPoints = append(data.Sum.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: start,
+					TimeUnixNano:      timestamp,
+					Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()},
+				})
+			case *metricspb.Metric_Histogram:
+				histogram := m.GetHistogram()
+				point := &metricspb.HistogramDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: start,
+					TimeUnixNano:      timestamp,
+					Count:             histogram.GetSampleCount(),
+					Sum:               histogram.GetSampleSum(),
+				}
+				// prometheus buckets are cumulative, OTLP ones are not, and hold an implicit +Inf bucket
+				var previous uint64
+				for _, b := range histogram.Bucket {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						break
+					}
+					point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-previous)
+					previous = b.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, histogram.GetSampleCount()-previous)
+				data.Histogram.DataPoints = append(data.Histogram.DataPoints, point)
+			case *metricspb.Metric_Summary:
+				summary := m.GetSummary()
+				point := &metricspb.SummaryDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: start,
+					TimeUnixNano:      timestamp,
+					Count:             summary.GetSampleCount(),
+					Sum:               summary.GetSampleSum(),
+				}
+				for _, q := range summary.Quantile {
+					point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					})
+				}
+				data.Summary.DataPoints = append(data.Summary.DataPoints, point)
+			}
+		}
+	}
+
+	// sorted, so that requests are stable
+	var keys []key
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].account != keys[j].account {
+			return keys[i].account < keys[j].account
+		}
+		if keys[i].accountID != keys[j].accountID {
+			return keys[i].accountID < keys[j].accountID
+		}
+		return keys[i].region < keys[j].region
+	})
+	request := &collectorpb.ExportMetricsServiceRequest{}
+	for _, k := range keys {
+		resource := &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			keyValue("cloud.provider", "aws"),
+			keyValue("service.name", serviceName),
+		}}
+		if k.account != "" {
+			resource.Attributes = append(resource.Attributes, keyValue(resourceLabels["account"], k.account))
+		}
+		if k.accountID != "" {
+			resource.Attributes = append(resource.Attributes, keyValue(resourceLabels["owner_id"], k.accountID))
+		}
+		if k.region != "" {
+			resource.Attributes = append(resource.Attributes, keyValue(resourceLabels["region"], k.region))
+		}
+		var names []string
+		for name := range metrics[k] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		library := &metricspb.InstrumentationLibraryMetrics{
+			InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: serviceName},
+		}
+		for _, name := range names {
+			library.Metrics = append(library.Metrics, metrics[k][name])
+		}
+		request.ResourceMetrics = append(request.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource:                      resource,
+			InstrumentationLibraryMetrics: []*metricspb.InstrumentationLibraryMetrics{library},
+		})
+	}
+	return request
+}
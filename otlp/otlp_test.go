@@ -0,0 +1,219 @@
+package otlp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// testGatherer returns a registry with billing metrics of two accounts, and a metric of the exporter itself
+func testGatherer() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "aws_ec2_instances_count", Help: "instances"},
+		[]string{"owner_id", "az", "instance_id", "aws_tag_cost_center"})
+	gauge.WithLabelValues("111111111111", "us-east-1a", "i-1", "rnd").Set(1)
+	gauge.WithLabelValues("222222222222", "eu-west-1b", "i-2", "ops").Set(2)
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "aws_ec2_spot_savings_dollars_total", Help: "savings"},
+		[]string{"owner_id", "region"})
+	counter.WithLabelValues("111111111111", "us-east-1").Add(3)
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "aws_ec2_api_duration_seconds", Help: "duration",
+		Buckets: []float64{0.1, 1, 10}}, []string{"owner_id", "region"})
+	for _, v := range []float64{0.05, 0.5, 0.7, 5, 20} {
+		histogram.WithLabelValues("111111111111", "us-east-1").Observe(v)
+	}
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "aws_audit_exporter_labels_cache_entries", Help: "entries"})
+	registry.MustRegister(gauge, counter, histogram, other)
+	return registry
+}
+
+// attributesOf returns attributes as a map
+func attributesOf(kvs []*commonpb.KeyValue) map[string]string {
+	attributes := map[string]string{}
+	for _, kv := range kvs {
+		attributes[kv.Key] = kv.Value.GetStringValue()
+	}
+	return attributes
+}
+
+func TestToRequest(t *testing.T) {
+	e := &Exporter{options: Options{TagKeys: map[string]string{"aws_tag_cost_center": "CostCenter"}}, start: time.Unix(100, 0)}
+	families, err := testGatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := e.toRequest(families, time.Unix(200, 0))
+
+	if len(request.ResourceMetrics) != 2 {
+		t.Fatalf("%d resources, want one per account and region", len(request.ResourceMetrics))
+	}
+	resource := attributesOf(request.ResourceMetrics[0].Resource.Attributes)
+	want := map[string]string{"cloud.provider": "aws", "service.name": serviceName,
+		"cloud.account.id": "111111111111", "cloud.region": "us-east-1"}
+	if !reflect.DeepEqual(resource, want) {
+		t.Errorf("resource = %v, want %v", resource, want)
+	}
+	if region := attributesOf(request.ResourceMetrics[1].Resource.Attributes)["cloud.region"]; region != "eu-west-1" {
+		t.Errorf("region of the second resource = %s, want eu-west-1 out of the az", region)
+	}
+
+	metrics := map[string]*metricspb.Metric{}
+	for _, metric := range request.ResourceMetrics[0].InstrumentationLibraryMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+	if len(metrics) != 3 {
+		t.Errorf("metrics = %v, want the billing metrics only", metrics)
+	}
+
+	gauge := metrics["aws_ec2_instances_count"].GetGauge()
+	if gauge == nil || len(gauge.DataPoints) != 1 || gauge.DataPoints[0].GetAsDouble() != 1 || gauge.DataPoints[0].TimeUnixNano != 200e9 {
+		t.Fatalf("instances count = %v", metrics["aws_ec2_instances_count"])
+	}
+	attributes := attributesOf(gauge.DataPoints[0].Attributes)
+	want = map[string]string{"cloud.availability_zone": "us-east-1a", "host.id": "i-1", "aws.tag.CostCenter": "rnd"}
+	if !reflect.DeepEqual(attributes, want) {
+		t.Errorf("point attributes = %v, want %v", attributes, want)
+	}
+
+	sum := metrics["aws_ec2_spot_savings_dollars_total"].GetSum()
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE ||
+		sum.DataPoints[0].GetAsDouble() != 3 || sum.DataPoints[0].StartTimeUnixNano != 100e9 {
+		t.Errorf("savings = %v, want a cumulative monotonic sum", metrics["aws_ec2_spot_savings_dollars_total"])
+	}
+
+	histogram := metrics["aws_ec2_api_duration_seconds"].GetHistogram()
+	if histogram == nil || len(histogram.DataPoints) != 1 {
+		t.Fatalf("duration = %v", metrics["aws_ec2_api_duration_seconds"])
+	}
+	point := histogram.DataPoints[0]
+	if point.Count != 5 || point.Sum != 26.25 {
+		t.Errorf("histogram count %d, sum %v, want 5 and 26.25", point.Count, point.Sum)
+	}
+	// cumulative buckets of 1, 3, 4 out of 5 become 1, 2, 1, and 1 in the implicit +Inf bucket
+	if !reflect.DeepEqual(point.ExplicitBounds, []float64{0.1, 1, 10}) || !reflect.DeepEqual(point.BucketCounts, []uint64{1, 2, 1, 1}) {
+		t.Errorf("histogram bounds %v, counts %v, want [0.1 1 10] and [1 2 1 1]", point.ExplicitBounds, point.BucketCounts)
+	}
+}
+
+func TestToRequestReservation(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	reservations := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "aws_ec2_reserved_instances_fixed_unit_price", Help: "price"},
+		[]string{"account", "az", "region", "ri_id"})
+	reservations.WithLabelValues("production", "none", "us-east-1", "ri-1").Set(100)
+	reservations.WithLabelValues("staging", "none", "us-east-1", "ri-1").Set(200)
+	instances := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "aws_ec2_instances_count", Help: "instances"},
+		[]string{"account", "owner_id", "az", "instance_id"})
+	instances.WithLabelValues("production", "111111111111", "us-east-1a", "i-1").Set(1)
+	registry.MustRegister(reservations, instances)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Exporter{start: time.Unix(100, 0)}
+	request := e.toRequest(families, time.Unix(200, 0))
+	if len(request.ResourceMetrics) != 2 {
+		t.Fatalf("%d resources, want one per account", len(request.ResourceMetrics))
+	}
+	for i, account := range []string{"production", "staging"} {
+		resource := attributesOf(request.ResourceMetrics[i].Resource.Attributes)
+		want := map[string]string{"cloud.provider": "aws", "service.name": serviceName,
+			"aws.account.name": account, "cloud.region": "us-east-1"}
+		if !reflect.DeepEqual(resource, want) {
+			t.Errorf("resource of %s = %v, want %v", account, resource, want)
+		}
+	}
+
+	// instances of the account share its resource, along with their owner
+	metrics := map[string]*metricspb.Metric{}
+	for _, metric := range request.ResourceMetrics[0].InstrumentationLibraryMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+	gauge := metrics["aws_ec2_reserved_instances_fixed_unit_price"].GetGauge()
+	if gauge == nil || len(gauge.DataPoints) != 1 || gauge.DataPoints[0].GetAsDouble() != 100 {
+		t.Fatalf("reservations of production = %v", metrics["aws_ec2_reserved_instances_fixed_unit_price"])
+	}
+	if attributes := attributesOf(gauge.DataPoints[0].Attributes); !reflect.DeepEqual(attributes,
+		map[string]string{"cloud.availability_zone": "none", "ri_id": "ri-1"}) {
+		t.Errorf("reservation point attributes = %v", attributes)
+	}
+	gauge = metrics["aws_ec2_instances_count"].GetGauge()
+	if gauge == nil || len(gauge.DataPoints) != 1 {
+		t.Fatalf("instances of production = %v", metrics["aws_ec2_instances_count"])
+	}
+	if owner := attributesOf(gauge.DataPoints[0].Attributes)["owner_id"]; owner != "111111111111" {
+		t.Errorf("owner_id point attribute = %q, want the owner of the instance", owner)
+	}
+}
+
+func TestAttributeName(t *testing.T) {
+	e := &Exporter{options: Options{TagKeys: map[string]string{"aws_tag_cost_center": "CostCenter"}}}
+	for label, want := range map[string]string{
+		"instance_type":       "host.type",
+		"aws_tag_cost_center": "aws.tag.CostCenter",
+		"aws_tag_team":        "aws.tag.team",
+		"lifecycle":           "lifecycle",
+	} {
+		if got := e.attributeName(label); got != want {
+			t.Errorf("attributeName(%s) = %s, want %s", label, got, want)
+		}
+	}
+}
+
+func TestExportHTTP(t *testing.T) {
+	var request collectorpb.ExportMetricsServiceRequest
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &request); err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	e, err := New(Options{Endpoint: server.URL, Protocol: "http", Headers: map[string]string{"Authorization": "Bearer token"}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Export(testGatherer()); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/x-protobuf" || header.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers = %v", header)
+	}
+	if len(request.ResourceMetrics) != 2 {
+		t.Errorf("%d resources exported, want 2", len(request.ResourceMetrics))
+	}
+}
+
+func TestExportHTTPFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	e, err := New(Options{Endpoint: server.URL, Protocol: "http", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(testGatherer()); err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("Export() = %v, want the status and body of the response", err)
+	}
+}
+
+func TestNewUnknownProtocol(t *testing.T) {
+	if _, err := New(Options{Endpoint: "localhost:4317", Protocol: "udp"}); err == nil {
+		t.Error("New() succeeded with an unknown protocol")
+	}
+}
@@ -0,0 +1,127 @@
+package postgres
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-pg/pg"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+)
+
+// EnumOtherValue is the value used for values unknown to an enum, when not adding them
+const EnumOtherValue = "other"
+
+// AddUnknownEnumValues when true, values AWS returns which are unknown to an enum type
+// are added to it with ALTER TYPE, otherwise they are stored as EnumOtherValue
+var AddUnknownEnumValues bool
+
+var (
+	enumsMutex sync.Mutex
+	// enumValues holds known values per enum type, loaded from the database on first use
+	enumValues map[string]map[string]bool
+	// enumOtherReported unknown values already logged, to log each of them once
+	enumOtherReported = map[string]bool{}
+
+	enumUnknownValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_audit_exporter_enum_unknown_values_total",
+		Help: "Number of values returned by AWS which were unknown to a database enum type",
+	},
+		[]string{"action", "enum"})
+)
+
+type enumValue struct {
+	TypeName string
+	Value    string
+}
+
+// RegisterEnumsMetrics registers Prometheus metrics
+func RegisterEnumsMetrics() {
+	prometheus.Register(enumUnknownValues)
+}
+
+// loadEnums fetches the values of the enum types used by the models
+// must be called while holding enumsMutex
+func loadEnums() error {
+	var values []enumValue
+	if _, err := DB.Query(&values, `SELECT t.typname AS type_name, e.enumlabel AS value
+		FROM pg_type t JOIN pg_enum e ON e.enumtypid = t.oid`); err != nil {
+		return err
+	}
+	enumValues = map[string]map[string]bool{}
+	for name := range models.Enums {
+		enumValues[name] = map[string]bool{}
+	}
+	for _, value := range values {
+		if _, ok := enumValues[value.TypeName]; ok {
+			enumValues[value.TypeName][value.Value] = true
+		}
+	}
+	return nil
+}
+
+// addEnumValue adds a value to an enum type
+// ALTER TYPE ... ADD VALUE can not run inside a transaction block, so it runs on its own
+// a variable for tests to run without a database
+var addEnumValue = func(enum string, value string) error {
+	_, err := DB.Exec("ALTER TYPE ? ADD VALUE IF NOT EXISTS ?", pg.F(enum), value)
+	return err
+}
+
+// EnumValue returns value when it is known to the enum type, otherwise either adds it
+// to the enum type or returns EnumOtherValue, according to AddUnknownEnumValues
+func EnumValue(enum string, value string) (string, error) {
+	enumsMutex.Lock()
+	defer enumsMutex.Unlock()
+
+	if enumValues == nil {
+		if err := loadEnums(); err != nil {
+			return "", fmt.Errorf("Failed loading enum values: %v", err)
+		}
+	}
+	known, ok := enumValues[enum]
+	if !ok {
+		return "", fmt.Errorf("unknown enum type %s", enum)
+	}
+	if known[value] {
+		return value, nil
+	}
+
+	if AddUnknownEnumValues {
+		log.WithFields(log.Fields{"enum": enum, "value": value}).Info("adding value to enum")
+		if err := addEnumValue(enum, value); err != nil {
+			return "", fmt.Errorf("Failed adding value %q to enum %s: %v", value, enum, err)
+		}
+		enumUnknownValues.WithLabelValues("added", enum).Inc()
+		known[value] = true
+		return value, nil
+	}
+	if !enumOtherReported[enum+"/"+value] {
+		log.WithFields(log.Fields{"enum": enum, "value": value}).Warnf("value unknown to enum, storing it as %q", EnumOtherValue)
+		enumOtherReported[enum+"/"+value] = true
+	}
+	enumUnknownValues.WithLabelValues(EnumOtherValue, enum).Inc()
+	return EnumOtherValue, nil
+}
+
+// enumColumns maps columns to the enum type they hold
+type enumColumns map[string]string
+
+// enumFields replaces values of enum columns in values with their EnumValue
+// returns a copy, values is left untouched for the caller to keep using as metric labels
+func enumFields(values map[string]string, columns enumColumns) (map[string]string, error) {
+	result := make(map[string]string, len(values))
+	for k, v := range values {
+		result[k] = v
+	}
+	for column, enum := range columns {
+		value, err := EnumValue(enum, values[column])
+		if err != nil {
+			return nil, err
+		}
+		result[column] = value
+	}
+	return result, nil
+}
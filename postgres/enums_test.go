@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withEnums preloads the enum values cache, so that EnumValue never loads them from the database,
+// and records the values added to enum types instead of running ALTER TYPE
+func withEnums(t *testing.T, add bool) *[]string {
+	var added []string
+	previousAdd, previousAddUnknown := addEnumValue, AddUnknownEnumValues
+	enumValues = map[string]map[string]bool{
+		"instance_state": {"running": true, "stopped": true},
+	}
+	enumOtherReported = map[string]bool{}
+	enumUnknownValues.Reset()
+	AddUnknownEnumValues = add
+	addEnumValue = func(enum string, value string) error {
+		added = append(added, enum+"/"+value)
+		return nil
+	}
+	t.Cleanup(func() {
+		enumValues = nil
+		addEnumValue, AddUnknownEnumValues = previousAdd, previousAddUnknown
+	})
+	return &added
+}
+
+func TestEnumValueFallsBackToOther(t *testing.T) {
+	added := withEnums(t, false)
+
+	for _, value := range []string{"running", "hibernating", "hibernating"} {
+		want := value
+		if value == "hibernating" {
+			want = EnumOtherValue
+		}
+		got, err := EnumValue("instance_state", value)
+		if err != nil || got != want {
+			t.Errorf("EnumValue(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if len(*added) != 0 {
+		t.Errorf("added %v to enum types, want none", *added)
+	}
+	if !enumOtherReported["instance_state/hibernating"] {
+		t.Error("unknown value was not reported")
+	}
+	if v := testutil.ToFloat64(enumUnknownValues.WithLabelValues(EnumOtherValue, "instance_state")); v != 2 {
+		t.Errorf("other counter = %v, want 2", v)
+	}
+	if _, err := EnumValue("no_such_enum", "running"); err == nil {
+		t.Error("expected an error for an unknown enum type")
+	}
+}
+
+func TestEnumValueAddsUnknownValuesOnce(t *testing.T) {
+	added := withEnums(t, true)
+
+	for i := 0; i < 2; i++ {
+		got, err := EnumValue("instance_state", "hibernating")
+		if err != nil || got != "hibernating" {
+			t.Errorf("EnumValue = %q, %v, want hibernating", got, err)
+		}
+	}
+	// the added value is cached, ALTER TYPE runs once
+	if len(*added) != 1 || (*added)[0] != "instance_state/hibernating" {
+		t.Errorf("added %v, want instance_state/hibernating once", *added)
+	}
+	if !enumValues["instance_state"]["hibernating"] {
+		t.Error("added value is missing from the cache")
+	}
+	if v := testutil.ToFloat64(enumUnknownValues.WithLabelValues("added", "instance_state")); v != 1 {
+		t.Errorf("added counter = %v, want 1", v)
+	}
+}
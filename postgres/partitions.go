@@ -0,0 +1,204 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	log "github.com/sirupsen/logrus"
+)
+
+// PartitionedTables maps tables partitioned by month to their partition key column
+var PartitionedTables = map[string]string{
+	"instances_uptime": "launch_time",
+	"spot_prices":      "created_at",
+}
+
+// Executor is satisfied by *pg.DB, *pg.Tx and migrations.DB
+type Executor interface {
+	Exec(query interface{}, params ...interface{}) (orm.Result, error)
+	Query(model, query interface{}, params ...interface{}) (orm.Result, error)
+}
+
+var partitionNameRe = regexp.MustCompile(`_y(\d{4})m(\d{2})$`)
+
+// monthStart returns the first instant of the month t is in, in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// partitionName returns the name of the partition of table holding month
+func partitionName(table string, month time.Time) string {
+	return fmt.Sprintf("%s_y%04dm%02d", table, month.Year(), int(month.Month()))
+}
+
+// partitionMonth parses the month out of a partition name
+// returns false for partitions which are not monthly, like the default one
+func partitionMonth(partition string) (time.Time, bool) {
+	match := partitionNameRe.FindStringSubmatch(partition)
+	if match == nil {
+		return time.Time{}, false
+	}
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC), true
+}
+
+// CreateMonthlyPartitions makes sure table has a partition for every month starting
+// with the month of "from", and up to "ahead" months after the current month
+func CreateMonthlyPartitions(db Executor, table string, from time.Time, ahead int) error {
+	last := monthStart(time.Now()).AddDate(0, ahead, 0)
+	for month := monthStart(from); !month.After(last); month = month.AddDate(0, 1, 0) {
+		sqlStatement := fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			partitionName(table, month), table,
+			month.Format(time.RFC3339), month.AddDate(0, 1, 0).Format(time.RFC3339))
+		if _, err := db.Exec(sqlStatement); err != nil {
+			return fmt.Errorf("Failed creating partition %s: %v", partitionName(table, month), err)
+		}
+	}
+	return nil
+}
+
+// listPartitions returns the names of all partitions attached to table
+func listPartitions(db Executor, table string) ([]string, error) {
+	var partitions []string
+	_, err := db.Query(&partitions, `SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = ?
+		ORDER BY c.relname`, table)
+	return partitions, err
+}
+
+// defaultPartition returns the name of the DEFAULT partition of table, holding the rows
+// no monthly partition covers, like instances launched before the oldest partition
+func defaultPartition(table string) string {
+	return table + "_default"
+}
+
+// expiredPartitions returns the monthly partitions whose whole month is older than cutoff
+func expiredPartitions(partitions []string, cutoff time.Time) []string {
+	var expired []string
+	for _, partition := range partitions {
+		month, ok := partitionMonth(partition)
+		if !ok || month.AddDate(0, 1, 0).After(cutoff) {
+			continue
+		}
+		expired = append(expired, partition)
+	}
+	return expired
+}
+
+// rollupSpotPricesSQL returns the statement aggregating the rows of a spot_prices partition
+// created before the cutoff it is given as parameter into daily min/avg/max rows
+func rollupSpotPricesSQL(partition string) string {
+	return fmt.Sprintf(`INSERT INTO spot_prices_daily (account, az, day, instance_type, product,
+			family, units, min_recurring_charges, avg_recurring_charges, max_recurring_charges, samples)
+		SELECT account, az, date_trunc('day', created_at AT TIME ZONE 'UTC')::date, instance_type, product,
+			family, units, min(recurring_charges), avg(recurring_charges)::bigint,
+			max(recurring_charges), count(*)
+		FROM %s
+		WHERE created_at < ?
+		GROUP BY 1, 2, 3, 4, 5, 6, 7
+		ON CONFLICT (account, az, day, instance_type, product) DO UPDATE SET
+			min_recurring_charges = EXCLUDED.min_recurring_charges,
+			avg_recurring_charges = EXCLUDED.avg_recurring_charges,
+			max_recurring_charges = EXCLUDED.max_recurring_charges,
+			samples = EXCLUDED.samples,
+			updated_at = now()`, partition)
+}
+
+// expiredRowsSQL returns the statement deleting the rows of a partition of table older than
+// the cutoff it is given as parameter. instances_uptime rows expire once their instance
+// was not seen since cutoff, spot_prices rows once they were created before it
+func expiredRowsSQL(table string, partition string) string {
+	column := "created_at"
+	if table == "instances_uptime" {
+		column = "updated_at"
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s < ?", partition, column)
+}
+
+// expirePartition drops a monthly partition that is entirely older than cutoff
+// spot_prices rows are rolled up into spot_prices_daily first when rollup is set
+// instances_uptime partitions holding instances seen after cutoff are kept, and only
+// their expired rows are deleted, as dropping them would have the rows of the running
+// instances re-inserted into the default partition. expired rows of the default
+// partition are deleted the same way
+// the transaction is rolled back when ctx is cancelled
+func expirePartition(ctx context.Context, table string, partition string, cutoff time.Time, rollup bool) error {
+	return DB.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+		if table == "spot_prices" && rollup {
+			if _, err := tx.Exec(rollupSpotPricesSQL(partition), cutoff); err != nil {
+				return fmt.Errorf("Failed rolling up %s: %v", partition, err)
+			}
+		}
+		keep := partition == defaultPartition(table)
+		if !keep && table == "instances_uptime" {
+			var lastSeen time.Time
+			if _, err := tx.QueryOne(pg.Scan(&lastSeen), fmt.Sprintf(
+				"SELECT coalesce(max(updated_at), 'epoch') FROM %s", partition)); err != nil {
+				return err
+			}
+			keep = lastSeen.After(cutoff)
+		}
+		if keep {
+			res, err := tx.Exec(expiredRowsSQL(table, partition), cutoff)
+			if err != nil {
+				return err
+			}
+			if res.RowsAffected() > 0 {
+				log.WithFields(log.Fields{"partition": partition, "rows": res.RowsAffected()}).
+					Info("deleted expired rows")
+			}
+			return nil
+		}
+		log.WithField("partition", partition).Info("dropping expired partition")
+		_, err := tx.Exec(fmt.Sprintf("DROP TABLE %s", partition))
+		return err
+	})
+}
+
+// MaintainPartitions creates partitions "ahead" months in advance, and expires partitions
+// whose whole range is older than retention, along with the expired rows of default
+// partitions. a zero retention keeps data forever
+// queries are cancelled along with ctx
+func MaintainPartitions(ctx context.Context, ahead int, retention time.Duration, rollup bool) error {
+	// exist silently if database was not initialized
+	if DB == nil {
+		return nil
+	}
+
+	db := DB.WithContext(ctx)
+	cutoff := time.Now().Add(-retention)
+	for table := range PartitionedTables {
+		if err := CreateMonthlyPartitions(db, table, time.Now(), ahead); err != nil {
+			return err
+		}
+		if retention == 0 {
+			continue
+		}
+		partitions, err := listPartitions(db, table)
+		if err != nil {
+			return fmt.Errorf("Failed listing partitions of %s: %v", table, err)
+		}
+		expired := expiredPartitions(partitions, cutoff)
+		for _, partition := range partitions {
+			if partition == defaultPartition(table) {
+				expired = append(expired, partition)
+			}
+		}
+		for _, partition := range expired {
+			if err := expirePartition(ctx, table, partition, cutoff, rollup); err != nil {
+				return fmt.Errorf("Failed expiring partition %s: %v", partition, err)
+			}
+		}
+	}
+	return nil
+}
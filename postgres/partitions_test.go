@@ -0,0 +1,136 @@
+package postgres
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/orm"
+)
+
+func TestMonthStart(t *testing.T) {
+	east := time.FixedZone("UTC+3", 3*60*60)
+	for _, tc := range []struct {
+		t    time.Time
+		want time.Time
+	}{
+		{time.Date(2020, 8, 17, 13, 4, 5, 6, time.UTC), time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)},
+		// still the last day of the previous month in UTC
+		{time.Date(2020, 9, 1, 1, 0, 0, 0, east), time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2020, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := monthStart(tc.t); !got.Equal(tc.want) || got.Location() != time.UTC {
+			t.Errorf("monthStart(%v) = %v, want %v", tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestPartitionName(t *testing.T) {
+	month := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	name := partitionName("spot_prices", month)
+	if name != "spot_prices_y2020m03" {
+		t.Errorf("partitionName = %q, want spot_prices_y2020m03", name)
+	}
+	parsed, ok := partitionMonth(name)
+	if !ok || !parsed.Equal(month) {
+		t.Errorf("partitionMonth(%q) = %v, %v, want %v", name, parsed, ok, month)
+	}
+	for _, partition := range []string{defaultPartition("instances_uptime"), "spot_prices_y2020m3", "spot_prices"} {
+		if _, ok := partitionMonth(partition); ok {
+			t.Errorf("partitionMonth(%q) parsed a month, want none", partition)
+		}
+	}
+}
+
+// recordingExecutor records the statements it is given, instead of executing them
+type recordingExecutor struct {
+	statements []string
+}
+
+func (e *recordingExecutor) Exec(query interface{}, params ...interface{}) (orm.Result, error) {
+	e.statements = append(e.statements, fmt.Sprint(query))
+	return nil, nil
+}
+
+func (e *recordingExecutor) Query(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	e.statements = append(e.statements, fmt.Sprint(query))
+	return nil, nil
+}
+
+func TestCreateMonthlyPartitions(t *testing.T) {
+	db := &recordingExecutor{}
+	current := monthStart(time.Now())
+	if err := CreateMonthlyPartitions(db, "spot_prices", current.AddDate(0, -2, 10), 1); err != nil {
+		t.Fatal(err)
+	}
+	// two months back, the current month and one month ahead
+	if len(db.statements) != 4 {
+		t.Fatalf("got %d statements, want 4: %v", len(db.statements), db.statements)
+	}
+	first := current.AddDate(0, -2, 0)
+	want := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF spot_prices FOR VALUES FROM ('%s') TO ('%s')",
+		partitionName("spot_prices", first), first.Format(time.RFC3339), first.AddDate(0, 1, 0).Format(time.RFC3339))
+	if db.statements[0] != want {
+		t.Errorf("first statement = %q, want %q", db.statements[0], want)
+	}
+	if last := partitionName("spot_prices", current.AddDate(0, 1, 0)); !strings.Contains(db.statements[3], last) {
+		t.Errorf("last statement = %q, want partition %s", db.statements[3], last)
+	}
+}
+
+func TestExpiredPartitions(t *testing.T) {
+	partitions := []string{
+		"instances_uptime_default",
+		"instances_uptime_y2020m01",
+		"instances_uptime_y2020m02",
+		"instances_uptime_y2020m03",
+		"instances_uptime_y2020m04",
+	}
+	for _, tc := range []struct {
+		cutoff time.Time
+		want   []string
+	}{
+		// march still holds rows newer than the cutoff
+		{time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC),
+			[]string{"instances_uptime_y2020m01", "instances_uptime_y2020m02"}},
+		// the whole of march is older than a cutoff at the start of april
+		{time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC),
+			[]string{"instances_uptime_y2020m01", "instances_uptime_y2020m02", "instances_uptime_y2020m03"}},
+		{time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC), nil},
+	} {
+		if got := expiredPartitions(partitions, tc.cutoff); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expiredPartitions(%v) = %v, want %v", tc.cutoff, got, tc.want)
+		}
+	}
+}
+
+func TestRollupSpotPricesSQL(t *testing.T) {
+	sql := rollupSpotPricesSQL("spot_prices_y2020m03")
+	for _, want := range []string{
+		"INSERT INTO spot_prices_daily",
+		"FROM spot_prices_y2020m03\n",
+		"WHERE created_at < ?",
+		"min(recurring_charges), avg(recurring_charges)::bigint,\n\t\t\tmax(recurring_charges), count(*)",
+		"SELECT account, az, date_trunc('day', created_at AT TIME ZONE 'UTC')::date",
+		"GROUP BY 1, 2, 3, 4, 5, 6, 7",
+		"ON CONFLICT (account, az, day, instance_type, product) DO UPDATE",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("rollup statement is missing %q:\n%s", want, sql)
+		}
+	}
+}
+
+func TestExpiredRowsSQL(t *testing.T) {
+	if sql := expiredRowsSQL("instances_uptime", "instances_uptime_default"); sql !=
+		"DELETE FROM instances_uptime_default WHERE updated_at < ?" {
+		t.Errorf("instances_uptime statement = %q", sql)
+	}
+	if sql := expiredRowsSQL("spot_prices", "spot_prices_y2020m03"); sql !=
+		"DELETE FROM spot_prices_y2020m03 WHERE created_at < ?" {
+		t.Errorf("spot_prices statement = %q", sql)
+	}
+}
@@ -1,6 +1,7 @@
 package postgres
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -8,30 +9,43 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 	"github.com/thoas/go-funk"
 
-	"github.com/EladDolev/aws_audit_exporter/debug"
 	"github.com/EladDolev/aws_audit_exporter/models"
 )
 
 // DB global variable for postgres connection
 var DB *pg.DB
 
+// dbLogger logs the duration and error of every query at debug level
 type dbLogger struct{}
 
+// queryStartKey key of the query start time in the query event data
+type queryStartKey struct{}
+
 func (d dbLogger) BeforeQuery(q *pg.QueryEvent) {
-	//func (d dbLogger) BeforeQuery(c context.Context, q *pg.QueryEvent) (context.Context, error) {
-	debug.Println(q.FormattedQuery())
-	//return c, nil
+	q.Data[queryStartKey{}] = time.Now()
 }
 
-func (d dbLogger) AfterQuery(q *pg.QueryEvent) {}
-
-//func (d dbLogger) AfterQuery(c context.Context, q *pg.QueryEvent) (context.Context, error) {
-//	return c, nil
-//}
+func (d dbLogger) AfterQuery(q *pg.QueryEvent) {
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	entry := log.WithField("attempt", q.Attempt)
+	if start, ok := q.Data[queryStartKey{}].(time.Time); ok {
+		entry = entry.WithField("duration", time.Since(start).String())
+	}
+	if q.Error != nil {
+		entry = entry.WithError(q.Error)
+	} else if q.Result != nil {
+		entry = entry.WithField("rows", q.Result.RowsAffected())
+	}
+	entry.Debug("query")
+}
 
 // ConnectPostgres initialize connection to postgresql server, and runs migrations
 func ConnectPostgres(dbURL string) error {
@@ -49,8 +63,16 @@ func ConnectPostgres(dbURL string) error {
 	return nil
 }
 
-// upsert takes a model, and performs simple upsert
-func upsert(model interface{}, onConflictTuple *[]string, columnsToUpdate *[]string) error {
+// Ping checks the database is reachable, failing when it does not answer within timeout
+func Ping(timeout time.Duration) error {
+	if _, err := DB.WithTimeout(timeout).Exec("SELECT 1"); err != nil {
+		return fmt.Errorf("Failed reaching postgres: %v", err)
+	}
+	return nil
+}
+
+// upsert takes a model, and performs simple upsert, with db or within a transaction
+func upsert(db orm.DB, model interface{}, onConflictTuple *[]string, columnsToUpdate *[]string) error {
 
 	onConflict := fmt.Sprintf("(%s)", strings.Join(*onConflictTuple, ",")) + " DO UPDATE"
 
@@ -60,7 +82,7 @@ func upsert(model interface{}, onConflictTuple *[]string, columnsToUpdate *[]str
 	}
 	setStatement = setStatement[:len(setStatement)-2]
 
-	_, err := DB.Model(model).OnConflict(onConflict).Set(setStatement).Insert()
+	_, err := db.Model(model).OnConflict(onConflict).Set(setStatement).Insert()
 	return err
 }
 
@@ -85,7 +107,8 @@ func parseDate(dateString string) time.Time {
 }
 
 // InsertIntoPGInstances responsible for updating instances information
-func InsertIntoPGInstances(values *prometheus.Labels, tags map[string]string) error {
+// product is the spot product of the instance platform, stored as "other" when spot prices are not published for it
+func InsertIntoPGInstances(ctx context.Context, values *prometheus.Labels, tags map[string]string, product string) error {
 	// exist silently if database was not initialized
 	if DB == nil {
 		return nil
@@ -99,6 +122,16 @@ func InsertIntoPGInstances(values *prometheus.Labels, tags map[string]string) er
 	if err != nil {
 		return fmt.Errorf("Failed parsing requesterID: %v", err)
 	}
+	fields, err := enumFields(*values, enumColumns{
+		"lifecycle": "instance_lifecycle",
+		"state":     "instance_state",
+	})
+	if err != nil {
+		return err
+	}
+	if product, err = EnumValue("spot_product", product); err != nil {
+		return err
+	}
 
 	instance := models.Instances{
 		InstanceID:   (*values)["instance_id"],
@@ -107,54 +140,90 @@ func InsertIntoPGInstances(values *prometheus.Labels, tags map[string]string) er
 		Groups:       (*values)["groups"],
 		InstanceType: (*values)["instance_type"],
 		LaunchTime:   parseDate((*values)["launch_time"]),
-		Lifecycle:    (*values)["lifecycle"],
+		Lifecycle:    fields["lifecycle"],
 		OwnerID:      uint64(ownerID),
+		Product:      product,
 		RequesterID:  uint64(requesterID),
 		Tags:         tags,
 		Units:        parseUnits((*values)["units"]),
-		State:        (*values)["state"],
+		State:        fields["state"],
 	}
 
 	instanceUpTime := models.InstancesUptime{
 		InstanceID: (*values)["instance_id"],
 		LaunchTime: parseDate((*values)["launch_time"]),
-		State:      (*values)["state"],
+		State:      fields["state"],
 	}
 
-	return DB.RunInTransaction(func(tx *pg.Tx) error {
-		if err := upsert(&([]models.Instances{instance}), &[]string{"instance_id"},
-			&[]string{"az", "family", "groups", "instance_type",
+	return DB.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+		if err := upsert(tx, &([]models.Instances{instance}), &[]string{"instance_id"},
+			&[]string{"az", "family", "groups", "instance_type", "product",
 				"tags", "units", "state", "updated_at"}); err != nil {
 			return err
 		}
 
-		return upsert(&instanceUpTime, &[]string{"instance_id",
+		return upsert(tx, &instanceUpTime, &[]string{"instance_id",
 			"launch_time", "state"}, &[]string{"updated_at"})
 	})
 }
 
 // InsertIntoPGSpotPrices responsible for updating spots price information
-func InsertIntoPGSpotPrices(values *prometheus.Labels, RC float64) error {
+func InsertIntoPGSpotPrices(ctx context.Context, values *prometheus.Labels, RC float64) error {
 	// exist silently if database was not initialized
 	if DB == nil {
 		return nil
 	}
 
+	product, err := EnumValue("spot_product", (*values)["product"])
+	if err != nil {
+		return err
+	}
+
 	spot := models.SpotPrices{
 		Az:               (*values)["az"],
 		Family:           (*values)["family"],
 		InstanceType:     (*values)["instance_type"],
-		Product:          (*values)["product"],
+		Product:          product,
 		RecurringCharges: uint64(RC * 1000000000),
 		Units:            parseUnits((*values)["units"]),
+		Account:          (*values)["account"],
 	}
-	_, err := DB.Model(&spot).Insert()
+	_, err = DB.WithContext(ctx).Model(&spot).Insert()
+	return err
+}
+
+// InsertIntoPGSpotSavings responsible for accumulating spot instances savings
+// savings are in dollars, and are added to the savings already recorded for the instance
+func InsertIntoPGSpotSavings(ctx context.Context, values *prometheus.Labels, tags map[string]string, savings float64) error {
+	// exist silently if database was not initialized
+	if DB == nil {
+		return nil
+	}
+
+	product, err := EnumValue("spot_product", (*values)["product"])
+	if err != nil {
+		return err
+	}
+
+	spotSavings := models.SpotSavings{
+		InstanceID:   (*values)["instance_id"],
+		Az:           (*values)["az"],
+		Family:       (*values)["family"],
+		InstanceType: (*values)["instance_type"],
+		Product:      product,
+		Savings:      uint64(savings * 1000000000),
+		Tags:         tags,
+		Account:      (*values)["account"],
+	}
+	_, err = DB.WithContext(ctx).Model(&spotSavings).OnConflict("(instance_id) DO UPDATE").
+		Set("savings = spot_savings.savings + EXCLUDED.savings, tags = EXCLUDED.tags, updated_at = now()").
+		Insert()
 	return err
 }
 
 // InsertIntoPGReservationsRelations responsible for updating reservations relations information.
 // also sets "converted" and "canceled" statuses, and original expiration (end) date
-func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesModification,
+func InsertIntoPGReservationsRelations(ctx context.Context, modifications *[]*ec2.ReservedInstancesModification,
 	listings *[]*ec2.ReservedInstancesListing, reservedInstances *[]*ec2.ReservedInstances) error {
 	// exist silently if database was not initialized or there are no modifications
 	if DB == nil || modifications == nil || len(*modifications) == 0 {
@@ -169,7 +238,7 @@ func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesMo
 		reservationUUID, _ := uuid.Parse(*r.ReservedInstancesId)
 		return reservationUUID, false
 	}).(map[uuid.UUID]bool)
-	return DB.RunInTransaction(func(tx *pg.Tx) error {
+	return DB.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
 		// taking care of midifications
 		for _, modification := range *modifications {
 			if *modification.Status != "fulfilled" {
@@ -188,6 +257,9 @@ func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesMo
 					relation := models.ReservationsRelations{
 						ParentID:      parentUUID,
 						ReservationID: childUUID,
+						// exchanges of convertible reservations aren't listed as modifications,
+						// so all of them are modifications, whatever the offer class
+						Event: "modification",
 					}
 					relations = append(relations, relation)
 				}
@@ -205,7 +277,7 @@ func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesMo
 				continue
 			}
 			var listedReservations []models.Reservations
-			if err = DB.Model(&listedReservations).Where(
+			if err = tx.Model(&listedReservations).Where(
 				"? = ANY (listed_on)", listing.ReservedInstancesListingId).Order("start_date").Select(); err != nil {
 				return fmt.Errorf("Failed fetching reservations for listing %s: %s",
 					*listing.ReservedInstancesListingId, err.Error())
@@ -216,11 +288,12 @@ func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesMo
 				relation := models.ReservationsRelations{
 					ParentID:      listedReservations[i].ReservationID,
 					ReservationID: listedReservations[i+1].ReservationID,
+					Event:         "sell-split",
 				}
 				relations = append(relations, relation)
 			}
 		}
-		if err = upsert(&relations, &[]string{"parent_id", "reservation_id"}, &[]string{"updated_at"}); err != nil {
+		if err = upsert(tx, &relations, &[]string{"parent_id", "reservation_id"}, &[]string{"event", "updated_at"}); err != nil {
 			return fmt.Errorf("Failed updating reservations relations: %s", err.Error())
 		}
 		// updating reservations "converted" and "canceled" statuses and original expiration (end) date
@@ -230,7 +303,7 @@ func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesMo
 			reservationUUID, _ := uuid.Parse(*r.ReservedInstancesId)
 			reservation := models.Reservations{ReservationID: reservationUUID}
 			reservation.UpdatedAt = time.Now()
-			reservation.OriginalEndDate, err = getOriginalReservationExpirationDate(r)
+			reservation.OriginalEndDate, err = getOriginalReservationExpirationDate(tx, r)
 			if err != nil {
 				return fmt.Errorf("Failed calling getOriginalReservationExpirationDate for %s: %s",
 					reservationUUID, err.Error())
@@ -244,14 +317,14 @@ func InsertIntoPGReservationsRelations(modifications *[]*ec2.ReservedInstancesMo
 			}
 			reservations = append(reservations, reservation)
 		}
-		_, err = DB.Model(&reservations).Column("canceled").Column("converted").Column(
+		_, err = tx.Model(&reservations).Column("canceled").Column("converted").Column(
 			"original_end_date").Column("updated_at").WherePK().Update()
 		return err
 	})
 }
 
 // InsertIntoPGReservations responsible for updating reservations information
-func InsertIntoPGReservations(values *prometheus.Labels, RC float64, FP float64, EP float64,
+func InsertIntoPGReservations(ctx context.Context, values *prometheus.Labels, RC float64, FP float64, EP float64,
 	listings *[]*ec2.ReservedInstancesListing) error {
 	// exist silently if database was not initialized
 	if DB == nil {
@@ -270,6 +343,16 @@ func InsertIntoPGReservations(values *prometheus.Labels, RC float64, FP float64,
 	if err != nil {
 		return fmt.Errorf("Failed parsing reservationID: %v", err)
 	}
+	fields, err := enumFields(*values, enumColumns{
+		"offer_class": "reservation_offer_class",
+		"offer_type":  "reservation_offer_type",
+		"scope":       "reservation_scope",
+		"state":       "reservation_state",
+		"tenancy":     "reservation_tenancy",
+	})
+	if err != nil {
+		return err
+	}
 	var listingsUUIDs []uuid.UUID
 	for _, listing := range *listings {
 		listingUUID, err := uuid.Parse(*listing.ReservedInstancesListingId)
@@ -290,27 +373,27 @@ func InsertIntoPGReservations(values *prometheus.Labels, RC float64, FP float64,
 		Family:           (*values)["family"],
 		InstanceType:     (*values)["instance_type"],
 		ListedOn:         listingsUUIDs,
-		OfferClass:       (*values)["offer_class"],
-		OfferType:        (*values)["offer_type"],
+		OfferClass:       fields["offer_class"],
+		OfferType:        fields["offer_type"],
 		OriginalEndDate:  endDate,
 		Product:          (*values)["product"],
 		RecurringCharges: uint64(RC * 1000000000),
 		Region:           (*values)["region"],
 		ReservationID:    reservationID,
-		Scope:            (*values)["scope"],
+		Scope:            fields["scope"],
 		StartDate:        parseDate((*values)["start_date"]),
-		State:            (*values)["state"],
-		Tenancy:          (*values)["tenancy"],
+		State:            fields["state"],
+		Tenancy:          fields["tenancy"],
 		Units:            parseUnits((*values)["units"]),
 		UpfrontPrice:     uint64(FP * 1000000000),
 	}
 
-	return upsert(&reservation, &[]string{"reservation_id"},
+	return upsert(DB.WithContext(ctx), &reservation, &[]string{"reservation_id"},
 		&[]string{"end_date", "listed_on", "state", "updated_at"})
 }
 
 // InsertIntoPGReservationsListings responsible for updating reservations listings table
-func InsertIntoPGReservationsListings(values *prometheus.Labels, count uint16) error {
+func InsertIntoPGReservationsListings(ctx context.Context, values *prometheus.Labels, count uint16) error {
 	// exist silently if database was not initialized
 	if DB == nil {
 		return nil
@@ -320,6 +403,14 @@ func InsertIntoPGReservationsListings(values *prometheus.Labels, count uint16) e
 	if err != nil {
 		return fmt.Errorf("Failed parsing reservationListingID: %v", err)
 	}
+	fields, err := enumFields(*values, enumColumns{
+		"scope":  "reservation_scope",
+		"state":  "reservation_listing_state",
+		"status": "reservation_listing_status",
+	})
+	if err != nil {
+		return err
+	}
 
 	reservationListing := models.ReservationsListings{
 		Az:            (*values)["az"],
@@ -330,20 +421,20 @@ func InsertIntoPGReservationsListings(values *prometheus.Labels, count uint16) e
 		PublishedDate: parseDate((*values)["created_date"]),
 		Region:        (*values)["region"],
 		ListingID:     listingID,
-		Scope:         (*values)["scope"],
-		State:         (*values)["state"],
-		Status:        (*values)["status"],
+		Scope:         fields["scope"],
+		State:         fields["state"],
+		Status:        fields["status"],
 		StatusMessage: (*values)["status_message"],
 		Units:         parseUnits((*values)["units"]),
 	}
 
-	return upsert(&reservationListing, &[]string{"listing_id", "state"},
+	return upsert(DB.WithContext(ctx), &reservationListing, &[]string{"listing_id", "state"},
 		&[]string{"count", "status", "status_message", "updated_at"})
 }
 
 // getOriginalReservationExpirationDate returns original reservation expiration date
 // might not be accurate for historical data, but should be accurate for new one
-func getOriginalReservationExpirationDate(r *ec2.ReservedInstances) (time.Time, error) {
+func getOriginalReservationExpirationDate(db orm.DB, r *ec2.ReservedInstances) (time.Time, error) {
 	// all members in the dinesty share the same duration
 	duration, err := time.ParseDuration(fmt.Sprintf("%ds", *r.Duration))
 	if err != nil {
@@ -363,7 +454,7 @@ func getOriginalReservationExpirationDate(r *ec2.ReservedInstances) (time.Time,
 			return time.Time{}, fmt.Errorf("Too many iterations for finding oldest parent")
 		}
 		temp := models.Reservations{}
-		err = DB.Model(&temp).Join(
+		err = db.Model(&temp).Join(
 			"JOIN reservations_relations r ON reservations.reservation_id = r.parent_id").Where(
 			"r.reservation_id = ?", oldestParent.ReservationID).Order("start_date").Limit(1).Select()
 		if err != nil {
@@ -386,7 +477,7 @@ func getOriginalReservationExpirationDate(r *ec2.ReservedInstances) (time.Time,
 			return time.Time{}, fmt.Errorf("Too many iterations for finding youngest descendant")
 		}
 		temp := models.Reservations{}
-		err = DB.Model(&temp).Join(
+		err = db.Model(&temp).Join(
 			"JOIN reservations_relations r ON reservations.reservation_id = r.reservation_id").Where(
 			"r.parent_id = ?", youngestDescendnt.ReservationID).Order("start_date ASC").Limit(1).Select()
 		if err != nil {
@@ -408,7 +499,7 @@ func getOriginalReservationExpirationDate(r *ec2.ReservedInstances) (time.Time,
 
 // InsertIntoPGReservationsListingsSales responsible for updating sales information
 // writes to reservations_listings_terms and reservations_sell_events tables
-func InsertIntoPGReservationsListingsSales(values *prometheus.Labels, totalUnitsSold uint16,
+func InsertIntoPGReservationsListingsSales(ctx context.Context, values *prometheus.Labels, totalUnitsSold uint16,
 	priceSchedules []*ec2.PriceSchedule) error {
 	// exist silently if database was not initialized
 	if DB == nil {
@@ -423,8 +514,9 @@ func InsertIntoPGReservationsListingsSales(values *prometheus.Labels, totalUnits
 	if err != nil {
 		return fmt.Errorf("Failed parsing ListedRIID: %v", err)
 	}
+	db := DB.WithContext(ctx)
 	var listedRI models.Reservations
-	if err = DB.Model(&listedRI).Where("reservation_id = ?", listedRIID).Select(); err != nil {
+	if err = db.Model(&listedRI).Where("reservation_id = ?", listedRIID).Select(); err != nil {
 		return fmt.Errorf("Failed fetching listed reservation %s: %s", listedRIID, err.Error())
 	}
 	listedReservationOriginalExpirationDate := listedRI.OriginalEndDate
@@ -436,7 +528,7 @@ func InsertIntoPGReservationsListingsSales(values *prometheus.Labels, totalUnits
 	var reservations []models.Reservations
 	if totalUnitsSold > 0 {
 		var reservationsInListing []models.Reservations
-		numResults, err := DB.Model(&reservationsInListing).Where("? = ANY (listed_on)", listingID).Where(
+		numResults, err := db.Model(&reservationsInListing).Where("? = ANY (listed_on)", listingID).Where(
 			"start_date >= ?", listedReservationStartDate).Order("end_date").SelectAndCount()
 		if err != nil {
 			return fmt.Errorf("Failed getting reservations that belongs to this listing: %s", err.Error())
@@ -492,7 +584,7 @@ func InsertIntoPGReservationsListingsSales(values *prometheus.Labels, totalUnits
 	listingPublishDate := parseDate((*values)["created_date"])
 	listingTotalTerms := int64(len(priceSchedules))
 
-	return DB.RunInTransaction(func(tx *pg.Tx) error {
+	return db.RunInTransaction(func(tx *pg.Tx) error {
 		for _, priceSchedule := range priceSchedules {
 			hoursTillExpiration := *priceSchedule.Term * 24 * 365 / 12
 			duration, _ := time.ParseDuration(fmt.Sprintf("%dh", hoursTillExpiration))
@@ -508,17 +600,17 @@ func InsertIntoPGReservationsListingsSales(values *prometheus.Labels, totalUnits
 				EndDate:      termEndDate,
 				UpfrontPrice: uint64(*priceSchedule.Price * 1000000000),
 			}
-			if err = upsert(&listingPrices, &[]string{"listing_id", "start_date"},
+			if err = upsert(tx, &listingPrices, &[]string{"listing_id", "start_date"},
 				&[]string{"updated_at"}); err != nil {
 				return err
 			}
 		}
 		if totalUnitsSold > 0 {
-			if _, err := DB.Model(&reservations).Column("sell_splitted").Column(
+			if _, err := tx.Model(&reservations).Column("sell_splitted").Column(
 				"sold").Column("updated_at").WherePK().Update(); err != nil {
 				return err
 			}
-			return upsert(&sellEvents, &[]string{"reservation_id"}, &[]string{"updated_at"})
+			return upsert(tx, &sellEvents, &[]string{"reservation_id"}, &[]string{"updated_at"})
 		}
 		return nil
 	})
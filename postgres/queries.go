@@ -0,0 +1,467 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/google/uuid"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+)
+
+// Filter narrows down rows read from the database
+// zero values are not filtered on
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Family string
+	Region string
+	Tags   map[string]string
+	Limit  int
+	Offset int
+}
+
+// ReservationsListingWithTerms a marketplace listing along with its price terms
+type ReservationsListingWithTerms struct {
+	models.ReservationsListings
+	Terms []models.ReservationsListingsTerms `json:"terms"`
+}
+
+// applyCommonFilter filters by family and region, and paginates
+// regionColumn may be "az", in which case region is matched as the az prefix
+func applyCommonFilter(q *orm.Query, filter *Filter, regionColumn string) *orm.Query {
+	if filter.Family != "" {
+		q = q.Where("family = ?", filter.Family)
+	}
+	if filter.Region != "" {
+		if regionColumn == "az" {
+			q = q.Where("az LIKE ?", filter.Region+"%")
+		} else {
+			q = q.Where("? = ?", pg.F(regionColumn), filter.Region)
+		}
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+	return q.Offset(filter.Offset)
+}
+
+// applyTimeRange keeps rows whose [startColumn, endColumn] overlaps the filter time range
+func applyTimeRange(q *orm.Query, filter *Filter, startColumn string, endColumn string) *orm.Query {
+	if !filter.From.IsZero() {
+		q = q.Where("? >= ?", pg.F(endColumn), filter.From)
+	}
+	if !filter.To.IsZero() {
+		q = q.Where("? <= ?", pg.F(startColumn), filter.To)
+	}
+	return q
+}
+
+// tagsCondition returns the condition matching the tags of the instances aliased alias, and its params
+// in the order of the sorted tag keys
+func tagsCondition(alias string, tags map[string]string) (string, []interface{}) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	conditions := []string{"TRUE"}
+	params := []interface{}{}
+	for _, key := range keys {
+		conditions = append(conditions, alias+".tags -> ? = ?")
+		params = append(params, key, tags[key])
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// coveredInstancesCondition the condition matching the on-demand instances reservation r may cover:
+// of its family, in its region, or availability zone when zonal, and seen during its term
+const coveredInstancesCondition = `i.lifecycle = 'normal' AND i.family = r.family
+	AND i.az LIKE r.region || '%' AND coalesce(nullif(r.az, ''), i.az) = i.az
+	AND i.launch_time <= r.end_date AND i.updated_at >= r.start_date`
+
+// SelectInstances returns instances seen during the time range, and total number of matches
+// the queries of the Select functions serving the API are cancelled along with ctx
+func SelectInstances(ctx context.Context, filter *Filter) ([]models.Instances, int, error) {
+	instances := []models.Instances{}
+	q := DB.WithContext(ctx).Model(&instances).Order("launch_time", "instance_id")
+	q = applyTimeRange(q, filter, "launch_time", "updated_at")
+	if len(filter.Tags) > 0 {
+		condition, params := tagsCondition("?TableAlias", filter.Tags)
+		q = q.Where(condition, params...)
+	}
+	total, err := applyCommonFilter(q, filter, "az").SelectAndCount()
+	return instances, total, err
+}
+
+// SelectReservations returns reservations active during the time range, and total number of matches
+// reservations are filtered by tags through the instances they may cover
+func SelectReservations(ctx context.Context, filter *Filter) ([]models.Reservations, int, error) {
+	reservations := []models.Reservations{}
+	q := DB.WithContext(ctx).Model(&reservations).Order("start_date", "reservation_id")
+	q = applyTimeRange(q, filter, "start_date", "end_date")
+	if len(filter.Tags) > 0 {
+		condition, params := tagsCondition("i", filter.Tags)
+		q = q.Where(`EXISTS (SELECT 1 FROM reservations r JOIN instances i ON `+coveredInstancesCondition+`
+			WHERE r.reservation_id = ?TableAlias.reservation_id AND `+condition+`)`, params...)
+	}
+	total, err := applyCommonFilter(q, filter, "region").SelectAndCount()
+	return reservations, total, err
+}
+
+// SelectReservationsListings returns marketplace listings seen during the time range along with
+// their terms, and total number of matches
+// listings are filtered by tags through the instances the reservations listed may cover
+func SelectReservationsListings(ctx context.Context, filter *Filter) ([]ReservationsListingWithTerms, int, error) {
+	listings := []models.ReservationsListings{}
+	q := DB.WithContext(ctx).Model(&listings).Order("published_date", "listing_id", "state")
+	q = applyTimeRange(q, filter, "published_date", "updated_at")
+	if len(filter.Tags) > 0 {
+		condition, params := tagsCondition("i", filter.Tags)
+		q = q.Where(`EXISTS (SELECT 1 FROM reservations r JOIN instances i ON `+coveredInstancesCondition+`
+			WHERE ?TableAlias.listing_id = ANY(r.listed_on) AND `+condition+`)`, params...)
+	}
+	total, err := applyCommonFilter(q, filter, "region").SelectAndCount()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]ReservationsListingWithTerms, len(listings))
+	if len(listings) == 0 {
+		return results, total, nil
+	}
+	var listingIDs []uuid.UUID
+	for _, listing := range listings {
+		listingIDs = append(listingIDs, listing.ListingID)
+	}
+	var terms []models.ReservationsListingsTerms
+	if err := DB.WithContext(ctx).Model(&terms).WhereIn("listing_id IN (?)", listingIDs).
+		Order("start_date").Select(); err != nil {
+		return nil, 0, fmt.Errorf("Failed fetching listings terms: %v", err)
+	}
+	for i, listing := range listings {
+		results[i].ReservationsListings = listing
+		results[i].Terms = []models.ReservationsListingsTerms{}
+		for _, term := range terms {
+			if term.ListingID == listing.ListingID {
+				results[i].Terms = append(results[i].Terms, term)
+			}
+		}
+	}
+	return results, total, nil
+}
+
+// SelectSpotPrices returns spot prices recorded during the time range, and total number of matches
+// spot prices are filtered by tags through the spot instances which ran in their pool
+func SelectSpotPrices(ctx context.Context, filter *Filter) ([]models.SpotPrices, int, error) {
+	prices := []models.SpotPrices{}
+	q := DB.WithContext(ctx).Model(&prices).Order("created_at", "az", "instance_type", "product")
+	q = applyTimeRange(q, filter, "created_at", "created_at")
+	if len(filter.Tags) > 0 {
+		condition, params := tagsCondition("i", filter.Tags)
+		q = q.Where(`EXISTS (SELECT 1 FROM instances i WHERE i.lifecycle = 'spot' AND i.az = ?TableAlias.az
+			AND i.instance_type = ?TableAlias.instance_type AND i.product = ?TableAlias.product
+			AND `+condition+`)`, params...)
+	}
+	total, err := applyCommonFilter(q, filter, "az").SelectAndCount()
+	return prices, total, err
+}
+
+// SelectReservationsLineage returns the relations leading to reservationID from its ancestors,
+// and from it to its descendants, along with the reservations themselves and their sell events
+// the queries of the Select functions serving the reports are cancelled along with ctx as well
+func SelectReservationsLineage(ctx context.Context, reservationID uuid.UUID) ([]models.Reservations,
+	[]models.ReservationsRelations, []models.ReservationsSellEvents, error) {
+	db := DB.WithContext(ctx)
+	relations := []models.ReservationsRelations{}
+	if _, err := db.Query(&relations, `WITH RECURSIVE
+		ancestors AS (
+				SELECT * FROM reservations_relations WHERE reservation_id = ?0
+			UNION
+				SELECT r.* FROM reservations_relations r JOIN ancestors a ON r.reservation_id = a.parent_id
+		),
+		descendants AS (
+				SELECT * FROM reservations_relations WHERE parent_id = ?0
+			UNION
+				SELECT r.* FROM reservations_relations r JOIN descendants d ON r.parent_id = d.reservation_id
+		)
+		SELECT * FROM ancestors UNION SELECT * FROM descendants
+		ORDER BY created_at, parent_id, reservation_id`, reservationID); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed fetching reservations relations: %v", err)
+	}
+
+	reservationIDs := []uuid.UUID{reservationID}
+	for _, relation := range relations {
+		reservationIDs = append(reservationIDs, relation.ParentID, relation.ReservationID)
+	}
+	reservations := []models.Reservations{}
+	if err := db.Model(&reservations).WhereIn("reservation_id IN (?)", reservationIDs).
+		Order("start_date", "reservation_id").Select(); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed fetching reservations: %v", err)
+	}
+	sellEvents := []models.ReservationsSellEvents{}
+	if err := db.Model(&sellEvents).WhereIn("reservation_id IN (?)", reservationIDs).
+		Order("sold_date").Select(); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed fetching sell events: %v", err)
+	}
+	return reservations, relations, sellEvents, nil
+}
+
+// Expiration holds the number of instances, and normalization units expiring on a date
+// Kind is either "reservation", for reservations retiring, or "listing-term", for marketplace
+// listings moving to their next price term
+type Expiration struct {
+	Kind   string    `json:"kind"`
+	Date   time.Time `json:"date"`
+	Family string    `json:"family"`
+	Region string    `json:"region"`
+	Count  int       `json:"count"`
+	Units  float64   `json:"units"`
+}
+
+// SelectExpirations returns active reservations and listing terms expiring between from and to,
+// grouped by day, family and region
+func SelectExpirations(ctx context.Context, from time.Time, to time.Time) ([]Expiration, error) {
+	expirations := []Expiration{}
+	_, err := DB.WithContext(ctx).Query(&expirations, `SELECT 'reservation' AS kind,
+			date_trunc('day', end_date AT TIME ZONE 'UTC') AS date, family, region,
+			sum(count) AS count, sum(count * units) AS units
+		FROM reservations
+		WHERE state = 'active' AND end_date BETWEEN ?0 AND ?1
+		GROUP BY 2, 3, 4
+	UNION ALL
+		SELECT 'listing-term' AS kind,
+			date_trunc('day', t.end_date AT TIME ZONE 'UTC') AS date, l.family, l.region,
+			sum(l.count) AS count, sum(l.count * l.units) AS units
+		FROM reservations_listings_terms t
+		JOIN reservations_listings l ON l.listing_id = t.listing_id
+		WHERE l.state = 'available' AND l.status = 'active' AND t.end_date BETWEEN ?0 AND ?1
+		GROUP BY 2, 3, 4
+	ORDER BY date, kind, family, region`, from, to)
+	return expirations, err
+}
+
+// InstanceUsage the hours an instance was running during a time range
+type InstanceUsage struct {
+	InstanceID   string
+	Az           string
+	Family       string
+	InstanceType string
+	Lifecycle    string
+	// Product empty for instances stored before their product was recorded
+	Product string
+	Units   float64
+	Tags    map[string]string `sql:",hstore"`
+	Hours   float64
+}
+
+// ReservedUsage the normalization unit hours reserved in a region for a family during a time range,
+// and what they cost
+type ReservedUsage struct {
+	Region    string
+	Family    string
+	UnitHours float64
+	Cost      float64
+}
+
+// RunningHours the hours instances of a type and lifecycle were running in an availability zone during a time range
+type RunningHours struct {
+	Az           string
+	Family       string
+	InstanceType string
+	Lifecycle    string
+	// Product empty for instances stored before their product was recorded
+	Product string
+	Units   float64
+	Hours   float64
+}
+
+// SpotPriceAverage the average hourly spot price of an instance type and product in an availability zone
+type SpotPriceAverage struct {
+	Account      string
+	Az           string
+	InstanceType string
+	Product      string
+	Price        float64
+}
+
+// SelectInstancesUsage returns the hours each instance was running between from and to
+// based on the first and last time an instance was seen running
+func SelectInstancesUsage(ctx context.Context, from time.Time, to time.Time) ([]InstanceUsage, error) {
+	usage := []InstanceUsage{}
+	_, err := DB.WithContext(ctx).Query(&usage, `SELECT i.instance_id, i.az, i.family, i.instance_type, i.lifecycle,
+			coalesce(i.product::text, '') AS product, i.units, i.tags,
+			sum(extract(epoch FROM least(u.updated_at, ?1) - greatest(u.created_at, ?0)) / 3600) AS hours
+		FROM instances_uptime u
+		JOIN instances i ON i.instance_id = u.instance_id
+		WHERE u.state = 'running' AND u.updated_at > ?0 AND u.created_at < ?1
+		GROUP BY i.instance_id
+		ORDER BY i.instance_id`, from, to)
+	return usage, err
+}
+
+// SelectRunningHours returns the hours instances were running between from and to, summed over all the
+// instances_uptime rows by availability zone, instance type, lifecycle and product
+func SelectRunningHours(ctx context.Context, from time.Time, to time.Time) ([]RunningHours, error) {
+	hours := []RunningHours{}
+	_, err := DB.WithContext(ctx).Query(&hours, `SELECT i.az, i.family, i.instance_type, i.lifecycle,
+			coalesce(i.product::text, '') AS product, i.units,
+			sum(extract(epoch FROM least(u.updated_at, ?1) - greatest(u.created_at, ?0)) / 3600) AS hours
+		FROM instances_uptime u
+		JOIN instances i ON i.instance_id = u.instance_id
+		WHERE u.state = 'running' AND u.updated_at > ?0 AND u.created_at < ?1
+		GROUP BY 1, 2, 3, 4, 5, 6`, from, to)
+	return hours, err
+}
+
+// SelectReservedCost returns the cost of all the reservations between from and to, in dollars
+func SelectReservedCost(ctx context.Context, from time.Time, to time.Time) (float64, error) {
+	var cost float64
+	_, err := DB.WithContext(ctx).QueryOne(pg.Scan(&cost), `SELECT coalesce(sum(count * effective_price *
+			extract(epoch FROM least(end_date, ?1) - greatest(start_date, ?0)) / 3600), 0) / 1e9
+		FROM reservations
+		WHERE state NOT IN ('payment-pending', 'payment-failed')
+			AND end_date > ?0 AND start_date < ?1`, from, to)
+	return cost, err
+}
+
+// SelectReservedUsage returns the normalization unit hours reserved between from and to
+// and their cost, by region and family
+func SelectReservedUsage(ctx context.Context, from time.Time, to time.Time) ([]ReservedUsage, error) {
+	usage := []ReservedUsage{}
+	_, err := DB.WithContext(ctx).Query(&usage, `SELECT region, family,
+			sum(count * units * hours) AS unit_hours,
+			sum(count * hours * effective_price) / 1e9 AS cost
+		FROM (
+			SELECT region, family, count, units, effective_price,
+				extract(epoch FROM least(end_date, ?1) - greatest(start_date, ?0)) / 3600 AS hours
+			FROM reservations
+			WHERE state NOT IN ('payment-pending', 'payment-failed')
+				AND end_date > ?0 AND start_date < ?1
+		) r
+		GROUP BY region, family
+		ORDER BY region, family`, from, to)
+	return usage, err
+}
+
+// SelectSpotPriceAverages returns the average spot price of each instance type, product and availability
+// zone of every account between from and to, out of both the recent prices and the daily rollups
+func SelectSpotPriceAverages(ctx context.Context, from time.Time, to time.Time) ([]SpotPriceAverage, error) {
+	averages := []SpotPriceAverage{}
+	_, err := DB.WithContext(ctx).Query(&averages, `SELECT account, az, instance_type, product,
+			sum(price * samples) / sum(samples) / 1e9 AS price
+		FROM (
+				SELECT account, az, instance_type, product, recurring_charges AS price, 1 AS samples
+				FROM spot_prices
+				WHERE created_at >= ?0 AND created_at < ?1
+			UNION ALL
+				SELECT account, az, instance_type, product, avg_recurring_charges AS price, samples
+				FROM spot_prices_daily
+				WHERE day >= ?0::date AND day < ?1::date
+		) p
+		GROUP BY account, az, instance_type, product`, from, to)
+	return averages, err
+}
+
+// HourlyUsage the normalization units of on-demand instances running in a region for a family on an hour
+type HourlyUsage struct {
+	Hour   time.Time
+	Region string
+	Family string
+	Units  float64
+}
+
+// SelectHourlyUsage returns the normalization units of on-demand instances running every hour between
+// from and to, by region and family. hours no instance was running on are missing
+func SelectHourlyUsage(ctx context.Context, from time.Time, to time.Time) ([]HourlyUsage, error) {
+	usage := []HourlyUsage{}
+	_, err := DB.WithContext(ctx).Query(&usage, `SELECT h AS hour, rtrim(i.az, 'abcdefghijklmnopqrstuvwxyz') AS region,
+			i.family, sum(i.units) AS units
+		FROM generate_series(date_trunc('hour', ?0::timestamptz), ?1, interval '1 hour') h
+		JOIN instances_uptime u ON u.state = 'running' AND u.created_at <= h AND u.updated_at >= h
+		JOIN instances i ON i.instance_id = u.instance_id AND i.lifecycle = 'normal'
+		GROUP BY 1, 2, 3
+		ORDER BY 1, 2, 3`, from, to)
+	return usage, err
+}
+
+// SelectActiveReservations returns reservations currently active
+func SelectActiveReservations(ctx context.Context) ([]models.Reservations, error) {
+	reservations := []models.Reservations{}
+	err := DB.WithContext(ctx).Model(&reservations).Where("state = 'active'").
+		Order("region", "family", "end_date").Select()
+	return reservations, err
+}
+
+// SelectActiveListings returns marketplace listings currently active
+func SelectActiveListings(ctx context.Context) ([]models.ReservationsListings, error) {
+	listings := []models.ReservationsListings{}
+	err := DB.WithContext(ctx).Model(&listings).Where("status = 'active'").Order("published_date").Select()
+	return listings, err
+}
+
+// SpotSavingsTotal the cumulative savings of spot instances sharing a family, product and tags, in dollars
+type SpotSavingsTotal struct {
+	Account string
+	Family  string
+	Product string
+	Tags    map[string]string `sql:",hstore"`
+	Savings float64
+}
+
+// SelectSpotSavingsTotals returns the cumulative savings of spot instances, by account, family, product and tags
+func SelectSpotSavingsTotals() ([]SpotSavingsTotal, error) {
+	totals := []SpotSavingsTotal{}
+	_, err := DB.Query(&totals, `SELECT account, family, product, tags, sum(savings) / 1e9 AS savings
+		FROM spot_savings
+		GROUP BY account, family, product, tags`)
+	return totals, err
+}
+
+// SpotPriceStats statistics of the spot prices of a pool, in dollars
+type SpotPriceStats struct {
+	Account      string
+	Az           string
+	InstanceType string
+	Product      string
+	Family       string
+	Min          float64
+	Max          float64
+	Mean         float64
+	Stddev       float64
+	Changes      int
+}
+
+// SelectSpotPriceStats returns statistics of the spot prices recorded since, per pool of every account
+// changes counts the times the price changed since
+func SelectSpotPriceStats(ctx context.Context, since time.Time) ([]SpotPriceStats, error) {
+	stats := []SpotPriceStats{}
+	_, err := DB.WithContext(ctx).Query(&stats, `SELECT account, az, instance_type, product, family,
+			min(recurring_charges) / 1e9 AS min, max(recurring_charges) / 1e9 AS max,
+			avg(recurring_charges) / 1e9 AS mean, coalesce(stddev_pop(recurring_charges), 0) / 1e9 AS stddev,
+			count(*) FILTER (WHERE previous IS NOT NULL AND previous <> recurring_charges) AS changes
+		FROM (
+			SELECT account, az, instance_type, product, family, recurring_charges,
+				lag(recurring_charges) OVER (PARTITION BY account, az, instance_type, product
+					ORDER BY created_at) AS previous
+			FROM spot_prices
+			WHERE created_at >= ?
+		) p
+		GROUP BY account, az, instance_type, product, family`, since)
+	return stats, err
+}
+
+// SelectRange selects the rows of a table into model, a pointer to a slice of its model,
+// with column within [from, to). all the rows are selected when column is empty
+func SelectRange(model interface{}, column string, from time.Time, to time.Time) error {
+	q := DB.Model(model)
+	if column != "" {
+		q = q.Where("? >= ?", pg.F(column), from).Where("? < ?", pg.F(column), to).Order(column)
+	}
+	return q.Select()
+}
@@ -0,0 +1,20 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagsCondition(t *testing.T) {
+	condition, params := tagsCondition("i", map[string]string{"team": "core", "env": ""})
+	if condition != "TRUE AND i.tags -> ? = ? AND i.tags -> ? = ?" {
+		t.Errorf("condition = %q", condition)
+	}
+	if want := []interface{}{"env", "", "team", "core"}; !reflect.DeepEqual(params, want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+
+	if condition, params := tagsCondition("i", nil); condition != "TRUE" || len(params) != 0 {
+		t.Errorf("condition without tags = %q, %v", condition, params)
+	}
+}
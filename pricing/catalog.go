@@ -0,0 +1,160 @@
+package pricing
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// OnDemand the catalog column holding on-demand hourly prices
+const OnDemand = "on_demand"
+
+// Catalog holds hourly prices per region and instance type, in dollars
+// loaded from a CSV file, so reports can run offline
+// the header must hold region, instance_type and on_demand columns, any other column is
+// a named price, e.g:
+//
+//	region,instance_type,on_demand
+//	us-east-1,m5.large,0.096
+type Catalog struct {
+	// prices maps region/instance_type to prices by column
+	prices map[string]map[string]float64
+}
+
+func catalogKey(region string, instanceType string) string {
+	return region + "/" + instanceType
+}
+
+// LoadCatalog reads a price catalog from a CSV file
+func LoadCatalog(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening price catalog: %v", err)
+	}
+	defer f.Close()
+	catalog, err := ReadCatalog(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading price catalog %s: %v", path, err)
+	}
+	return catalog, nil
+}
+
+// ReadCatalog reads a price catalog in CSV
+func ReadCatalog(r io.Reader) (*Catalog, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"region", "instance_type", OnDemand} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing %s column", required)
+		}
+	}
+
+	catalog := &Catalog{prices: map[string]map[string]float64{}}
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		prices := map[string]float64{}
+		for name, i := range columns {
+			if name == "region" || name == "instance_type" || record[i] == "" {
+				continue
+			}
+			price, err := strconv.ParseFloat(record[i], 64)
+			if err != nil || price < 0 {
+				return nil, fmt.Errorf("record %d: invalid %s price %q", n, name, record[i])
+			}
+			prices[name] = price
+		}
+		catalog.prices[catalogKey(record[columns["region"]], record[columns["instance_type"]])] = prices
+	}
+	return catalog, nil
+}
+
+// Price returns the hourly price in column for an instance type in a region
+func (c *Catalog) Price(column string, region string, instanceType string) (float64, bool) {
+	price, ok := c.prices[catalogKey(region, instanceType)][column]
+	return price, ok
+}
+
+// OnDemandPrice returns the on-demand hourly price for an instance type in a region
+func (c *Catalog) OnDemandPrice(region string, instanceType string) (float64, bool) {
+	return c.Price(OnDemand, region, instanceType)
+}
+
+// Reserved instances offering classes, terms and payment options, as used in catalog columns
+var (
+	OfferClasses   = []string{"standard", "convertible"}
+	Terms          = []string{"1yr", "3yr"}
+	PaymentOptions = []string{"no", "partial", "all"}
+)
+
+// ReservedOffer a reserved instances offering
+// its prices are held in the <class>_<term>_<payment>_upfront and <class>_<term>_<payment>_hourly
+// columns of the catalog, e.g. convertible_3yr_partial_upfront, a missing column is a zero price
+type ReservedOffer struct {
+	Class   string `json:"class"`
+	Term    string `json:"term"`
+	Payment string `json:"payment"`
+}
+
+func (o ReservedOffer) String() string {
+	return o.Class + "_" + o.Term + "_" + o.Payment
+}
+
+// TermHours returns the number of hours in the offering term
+func (o ReservedOffer) TermHours() float64 {
+	if o.Term == "3yr" {
+		return 3 * 365 * 24
+	}
+	return 365 * 24
+}
+
+// ReservedOffers returns all the offerings, matching class, term and payment when not empty
+func ReservedOffers(class string, term string, payment string) []ReservedOffer {
+	var offers []ReservedOffer
+	for _, c := range OfferClasses {
+		for _, t := range Terms {
+			for _, p := range PaymentOptions {
+				if (class == "" || class == c) && (term == "" || term == t) && (payment == "" || payment == p) {
+					offers = append(offers, ReservedOffer{Class: c, Term: t, Payment: p})
+				}
+			}
+		}
+	}
+	return offers
+}
+
+// ReservedPrice returns the upfront and hourly prices of an offering for an instance type in a region
+// ok is false when the catalog holds neither of them
+func (c *Catalog) ReservedPrice(offer ReservedOffer, region string, instanceType string) (upfront float64,
+	hourly float64, ok bool) {
+	upfront, upfrontOK := c.Price(offer.String()+"_upfront", region, instanceType)
+	hourly, hourlyOK := c.Price(offer.String()+"_hourly", region, instanceType)
+	return upfront, hourly, upfrontOK || hourlyOK
+}
+
+// OfferOf returns the offering of a reservation, out of its class, offering type
+// (e.g. "Partial Upfront") and duration in seconds
+func OfferOf(class string, offerType string, durationSeconds int32) ReservedOffer {
+	offer := ReservedOffer{Class: class, Term: "1yr"}
+	if durationSeconds > 2*365*24*3600 {
+		offer.Term = "3yr"
+	}
+	offer.Payment = strings.ToLower(strings.SplitN(offerType, " ", 2)[0])
+	return offer
+}
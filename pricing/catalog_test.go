@@ -0,0 +1,96 @@
+package pricing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadCatalog(t *testing.T) {
+	catalog, err := ReadCatalog(strings.NewReader(`# prices of 2020-10
+instance_type, region, on_demand, spot
+m5.large, us-east-1, 0.096, 0.035
+m5.xlarge, us-east-1, 0.192,
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price, ok := catalog.OnDemandPrice("us-east-1", "m5.large"); !ok || price != 0.096 {
+		t.Errorf("on-demand price of m5.large = %v, %v, want 0.096", price, ok)
+	}
+	if price, ok := catalog.Price("spot", "us-east-1", "m5.large"); !ok || price != 0.035 {
+		t.Errorf("spot price of m5.large = %v, %v, want 0.035", price, ok)
+	}
+	if _, ok := catalog.Price("spot", "us-east-1", "m5.xlarge"); ok {
+		t.Error("empty price of m5.xlarge should be missing")
+	}
+	if _, ok := catalog.OnDemandPrice("eu-west-1", "m5.large"); ok {
+		t.Error("price of a region missing from the catalog should be missing")
+	}
+}
+
+func TestReadCatalogErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		catalog string
+		err     string
+	}{
+		{"empty", "", "missing header"},
+		{"missing column", "region,instance_type\nus-east-1,m5.large\n", "missing on_demand column"},
+		{"invalid price", "region,instance_type,on_demand\nus-east-1,m5.large,cheap\n", `record 1: invalid on_demand price "cheap"`},
+		{"negative price", "region,instance_type,on_demand\nus-east-1,m5.large,-1\n", `record 1: invalid on_demand price "-1"`},
+	}
+	for _, test := range tests {
+		if _, err := ReadCatalog(strings.NewReader(test.catalog)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: ReadCatalog() = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReservedOffers(t *testing.T) {
+	if got := len(ReservedOffers("", "", "")); got != 12 {
+		t.Errorf("%d offers, want 12", got)
+	}
+	offers := ReservedOffers("convertible", "3yr", "")
+	if len(offers) != 3 || offers[0].String() != "convertible_3yr_no" || offers[0].TermHours() != 3*365*24 {
+		t.Errorf("convertible 3yr offers = %v", offers)
+	}
+}
+
+func TestReservedPrice(t *testing.T) {
+	catalog, err := ReadCatalog(strings.NewReader(`region,instance_type,on_demand,standard_1yr_partial_upfront,standard_1yr_partial_hourly,standard_1yr_all_upfront
+us-east-1,m5.large,0.096,250,0.03,500
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upfront, hourly, ok := catalog.ReservedPrice(ReservedOffer{"standard", "1yr", "partial"}, "us-east-1", "m5.large")
+	if !ok || upfront != 250 || hourly != 0.03 {
+		t.Errorf("partial upfront = %v, %v, %v, want 250, 0.03", upfront, hourly, ok)
+	}
+	// a missing hourly column is a zero price
+	upfront, hourly, ok = catalog.ReservedPrice(ReservedOffer{"standard", "1yr", "all"}, "us-east-1", "m5.large")
+	if !ok || upfront != 500 || hourly != 0 {
+		t.Errorf("all upfront = %v, %v, %v, want 500, 0", upfront, hourly, ok)
+	}
+	if _, _, ok := catalog.ReservedPrice(ReservedOffer{"convertible", "1yr", "no"}, "us-east-1", "m5.large"); ok {
+		t.Error("offer missing from the catalog should not be priced")
+	}
+}
+
+func TestOfferOf(t *testing.T) {
+	tests := []struct {
+		class     string
+		offerType string
+		duration  int32
+		expected  string
+	}{
+		{"convertible", "No Upfront", 3 * 365 * 24 * 3600, "convertible_3yr_no"},
+		{"standard", "Partial Upfront", 365 * 24 * 3600, "standard_1yr_partial"},
+		{"standard", "All Upfront", 365 * 24 * 3600, "standard_1yr_all"},
+	}
+	for _, test := range tests {
+		if got := OfferOf(test.class, test.offerType, test.duration).String(); got != test.expected {
+			t.Errorf("OfferOf(%s, %s, %d) = %s, want %s", test.class, test.offerType, test.duration, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package pusher
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Timeout of every push
+const Timeout = 30 * time.Second
+
+var client = &http.Client{Timeout: Timeout}
+
+// Pushgateway pushes the metrics gathered to a Pushgateway, replacing the metrics of the same grouping key
+// job and grouping make up the grouping key, e.g. grouping of {"instance": "production"}
+func Pushgateway(url string, job string, grouping map[string]string, gatherer prometheus.Gatherer) error {
+	pusher := push.New(url, job).Gatherer(gatherer).Client(client)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if err := pusher.Push(); err != nil {
+		return fmt.Errorf("Failed pushing to %s: %v", url, err)
+	}
+	return nil
+}
+
+// series a time series of the remote write protocol
+type series struct {
+	labels []*dto.LabelPair
+	value  float64
+}
+
+// newSeries returns the series of a metric, labeled with the metric name, its labels and extra labels
+// extra labels take precedence over the labels of the metric
+func newSeries(name string, metric *dto.Metric, extra map[string]string, value float64) series {
+	labels := map[string]string{"__name__": name}
+	for _, l := range metric.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	s := series{value: value}
+	for k, v := range labels {
+		k, v := k, v
+		s.labels = append(s.labels, &dto.LabelPair{Name: &k, Value: &v})
+	}
+	// remote write requires labels sorted by name
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].GetName() < s.labels[j].GetName() })
+	return s
+}
+
+// toSeries flattens metric families into series, summaries and histograms into their
+// _sum, _count and quantile or bucket series, as Prometheus does when scraping
+func toSeries(families []*dto.MetricFamily, grouping map[string]string) []series {
+	var all []series
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				all = append(all, newSeries(name, m, grouping, m.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				all = append(all, newSeries(name, m, grouping, m.GetGauge().GetValue()))
+			case dto.MetricType_UNTYPED:
+				all = append(all, newSeries(name, m, grouping, m.GetUntyped().GetValue()))
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				all = append(all, newSeries(name+"_sum", m, grouping, summary.GetSampleSum()))
+				all = append(all, newSeries(name+"_count", m, grouping, float64(summary.GetSampleCount())))
+				for _, q := range summary.Quantile {
+					labels := map[string]string{"quantile": strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)}
+					for k, v := range grouping {
+						labels[k] = v
+					}
+					all = append(all, newSeries(name, m, labels, q.GetValue()))
+				}
+			case dto.MetricType_HISTOGRAM:
+				histogram := m.GetHistogram()
+				all = append(all, newSeries(name+"_sum", m, grouping, histogram.GetSampleSum()))
+				all = append(all, newSeries(name+"_count", m, grouping, float64(histogram.GetSampleCount())))
+				buckets := append([]*dto.Bucket{}, histogram.Bucket...)
+				if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+					buckets = append(buckets, &dto.Bucket{
+						UpperBound:      proto64(math.Inf(1)),
+						CumulativeCount: proto64u(histogram.GetSampleCount()),
+					})
+				}
+				for _, b := range buckets {
+					labels := map[string]string{"le": strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)}
+					for k, v := range grouping {
+						labels[k] = v
+					}
+					all = append(all, newSeries(name+"_bucket", m, labels, float64(b.GetCumulativeCount())))
+				}
+			}
+		}
+	}
+	return all
+}
+
+func proto64(v float64) *float64 { return &v }
+
+func proto64u(v uint64) *uint64 { return &v }
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(all []series, timestamp int64) []byte {
+	var request []byte
+	for _, s := range all {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.GetName())
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.GetValue())
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+	return request
+}
+
+// RemoteWrite sends the metrics gathered to a Prometheus remote write endpoint, as a single sample
+// per series, stamped with the current time. the job label and grouping are added to every series
+func RemoteWrite(url string, job string, grouping map[string]string, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("Failed gathering metrics: %v", err)
+	}
+	labels := map[string]string{"job": job}
+	for k, v := range grouping {
+		labels[k] = v
+	}
+	request := encodeWriteRequest(toSeries(families, labels), time.Now().UnixNano()/int64(time.Millisecond))
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, request)))
+	if err != nil {
+		return fmt.Errorf("Failed creating remote write request: %v", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "aws_audit_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed remote writing to %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Failed remote writing to %s: %s %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
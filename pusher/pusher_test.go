@@ -0,0 +1,238 @@
+package pusher
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries a time series decoded out of a remote write request
+type decodedSeries struct {
+	labels     [][2]string
+	values     []float64
+	timestamps []int64
+}
+
+// name returns the __name__ label of the series
+func (s decodedSeries) name() string {
+	for _, l := range s.labels {
+		if l[0] == "__name__" {
+			return l[1]
+		}
+	}
+	return ""
+}
+
+// label returns the value of the label name of the series
+func (s decodedSeries) label(name string) string {
+	for _, l := range s.labels {
+		if l[0] == name {
+			return l[1]
+		}
+	}
+	return ""
+}
+
+// fields calls field with the number, type and value of every field of a protobuf message
+func fields(t *testing.T, b []byte, field func(num protowire.Number, typ protowire.Type, value []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(m))
+		}
+		field(num, typ, b[:m])
+		b = b[m:]
+	}
+}
+
+// decodeWriteRequest decodes a snappy compressed prometheus.WriteRequest
+func decodeWriteRequest(t *testing.T, body []byte) []decodedSeries {
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("body is not snappy compressed: %v", err)
+	}
+	var all []decodedSeries
+	fields(t, request, func(num protowire.Number, typ protowire.Type, value []byte) {
+		if num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected WriteRequest field %d", num)
+		}
+		ts, _ := protowire.ConsumeBytes(value)
+		var s decodedSeries
+		fields(t, ts, func(num protowire.Number, typ protowire.Type, value []byte) {
+			message, _ := protowire.ConsumeBytes(value)
+			switch num {
+			case 1:
+				var label [2]string
+				fields(t, message, func(num protowire.Number, typ protowire.Type, value []byte) {
+					v, _ := protowire.ConsumeString(value)
+					label[num-1] = v
+				})
+				s.labels = append(s.labels, label)
+			case 2:
+				fields(t, message, func(num protowire.Number, typ protowire.Type, value []byte) {
+					switch num {
+					case 1:
+						v, _ := protowire.ConsumeFixed64(value)
+						s.values = append(s.values, math.Float64frombits(v))
+					case 2:
+						v, _ := protowire.ConsumeVarint(value)
+						s.timestamps = append(s.timestamps, int64(v))
+					}
+				})
+			default:
+				t.Fatalf("unexpected TimeSeries field %d", num)
+			}
+		})
+		all = append(all, s)
+	})
+	return all
+}
+
+// testGatherer returns a registry with a gauge, a counter and a histogram
+func testGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "gauge"}, []string{"zone", "az"})
+	gauge.WithLabelValues("b", "us-east-1a").Set(3)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "counter"})
+	counter.Add(5)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "histogram", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+	registry.MustRegister(gauge, counter, histogram)
+	return registry
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := RemoteWrite(server.URL, "audit", map[string]string{"instance": "production"}, testGatherer()); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if header.Get("Content-Encoding") != "snappy" || header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	values := map[string]float64{}
+	for _, s := range decodeWriteRequest(t, body) {
+		for i := 1; i < len(s.labels); i++ {
+			if s.labels[i-1][0] >= s.labels[i][0] {
+				t.Errorf("labels of %s are not sorted: %v", s.name(), s.labels)
+			}
+		}
+		if s.label("job") != "audit" || s.label("instance") != "production" {
+			t.Errorf("series %s is missing the job and grouping labels: %v", s.name(), s.labels)
+		}
+		if len(s.values) != 1 || len(s.timestamps) != 1 {
+			t.Fatalf("series %s has %d values and %d timestamps, want a single sample", s.name(), len(s.values), len(s.timestamps))
+		}
+		if s.timestamps[0] < before || s.timestamps[0] > after {
+			t.Errorf("series %s is stamped %d, want between %d and %d", s.name(), s.timestamps[0], before, after)
+		}
+		key := s.name()
+		if le := s.label("le"); le != "" {
+			key += "{le=" + le + "}"
+		}
+		values[key] = s.values[0]
+	}
+
+	expected := map[string]float64{
+		"test_gauge":                   3,
+		"test_total":                   5,
+		"test_seconds_sum":             2.5,
+		"test_seconds_count":           2,
+		"test_seconds_bucket{le=1}":    1,
+		"test_seconds_bucket{le=+Inf}": 2,
+	}
+	if len(values) != len(expected) {
+		t.Errorf("got series %v, want %v", values, expected)
+	}
+	for key, value := range expected {
+		if got, ok := values[key]; !ok || got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestRemoteWriteFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := RemoteWrite(server.URL, "audit", nil, testGatherer())
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "out of order sample") {
+		t.Errorf("RemoteWrite() = %v, want the status and body of the response", err)
+	}
+}
+
+func TestPushgateway(t *testing.T) {
+	var method, path string
+	families := map[string]*dto.MetricFamily{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				if err != io.EOF {
+					t.Errorf("invalid body: %v", err)
+				}
+				break
+			}
+			families[family.GetName()] = family
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	if err := Pushgateway(server.URL, "audit", map[string]string{"instance": "production"}, testGatherer()); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/audit/instance/production" {
+		t.Errorf("pushed with %s %s, want PUT /metrics/job/audit/instance/production", method, path)
+	}
+	gauge, ok := families["test_gauge"]
+	if !ok || len(gauge.Metric) != 1 || gauge.Metric[0].GetGauge().GetValue() != 3 {
+		t.Errorf("test_gauge = %v", gauge)
+	}
+	if histogram, ok := families["test_seconds"]; !ok || histogram.Metric[0].GetHistogram().GetSampleCount() != 2 {
+		t.Errorf("test_seconds = %v", histogram)
+	}
+}
+
+func TestPushgatewayFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pushed metrics are invalid", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := Pushgateway(server.URL, "audit", nil, testGatherer())
+	if err == nil || !strings.Contains(err.Error(), "pushed metrics are invalid") {
+		t.Errorf("Pushgateway() = %v, want the body of the response", err)
+	}
+}
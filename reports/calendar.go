@@ -0,0 +1,103 @@
+package reports
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// icsLineLength maximal length of an iCalendar content line in octets, longer lines are folded
+const icsLineLength = 75
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// GetExpirations returns reservations and listing terms expiring within the next days
+// its query is cancelled along with ctx
+func GetExpirations(ctx context.Context, days int) ([]postgres.Expiration, error) {
+	now := time.Now().UTC()
+	return postgres.SelectExpirations(ctx, now, now.AddDate(0, 0, days))
+}
+
+// expirationSummary a short description of an expiration, used as the event title
+func expirationSummary(e *postgres.Expiration) string {
+	what := "RIs expire"
+	if e.Kind == "listing-term" {
+		what = "listed RIs price term ends"
+	}
+	return fmt.Sprintf("%s %s: %d instances, %s units in %s",
+		e.Family, what, e.Count, strconv.FormatFloat(e.Units, 'f', -1, 64), e.Region)
+}
+
+// writeICSLine writes a content line, folding it as required by RFC 5545
+// continuation lines start with a space, which counts toward their length
+func writeICSLine(b *strings.Builder, line string) {
+	limit := icsLineLength
+	for len(line) > limit {
+		cut := limit
+		// do not split multi-byte characters
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = icsLineLength - 1
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// WriteExpirationsICS writes expirations as an iCalendar feed, an all day event per expiration
+func WriteExpirationsICS(w io.Writer, expirations []postgres.Expiration) error {
+	var b strings.Builder
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//aws_audit_exporter//RI expirations//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:Reserved instances expirations")
+	for i := range expirations {
+		e := &expirations[i]
+		day := e.Date.UTC()
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, fmt.Sprintf("UID:%s-%s-%s-%s@aws_audit_exporter",
+			e.Kind, day.Format("20060102"), e.Family, e.Region))
+		writeICSLine(&b, "DTSTAMP:"+stamp)
+		writeICSLine(&b, "DTSTART;VALUE=DATE:"+day.Format("20060102"))
+		writeICSLine(&b, "DTEND;VALUE=DATE:"+day.AddDate(0, 0, 1).Format("20060102"))
+		writeICSLine(&b, "SUMMARY:"+icsEscaper.Replace(expirationSummary(e)))
+		writeICSLine(&b, "CATEGORIES:"+icsEscaper.Replace(e.Kind))
+		writeICSLine(&b, "TRANSP:TRANSPARENT")
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteExpirationsCSV writes expirations as CSV, with a header line
+func WriteExpirationsCSV(w io.Writer, expirations []postgres.Expiration) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"kind", "date", "family", "region", "count", "units"}); err != nil {
+		return err
+	}
+	for _, e := range expirations {
+		if err := writer.Write([]string{
+			e.Kind,
+			e.Date.UTC().Format("2006-01-02"),
+			e.Family,
+			e.Region,
+			strconv.Itoa(e.Count),
+			strconv.FormatFloat(e.Units, 'f', -1, 64),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,93 @@
+package reports
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+func TestWriteICSLineFolds(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		// ascii lines are folded at exactly the maximal length
+		ascii bool
+	}{
+		{"SUMMARY:" + strings.Repeat("é", 60), false},
+		{"SUMMARY:" + strings.Repeat("x", 200), true},
+	} {
+		line := tt.line
+		var b strings.Builder
+		writeICSLine(&b, line)
+
+		lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+		if len(lines) < 2 {
+			t.Fatalf("line of %d bytes was not folded: %q", len(line), b.String())
+		}
+		unfolded := lines[0]
+		for i, l := range lines {
+			if len(l) > icsLineLength {
+				t.Errorf("folded line is %d bytes long, more than %d: %q", len(l), icsLineLength, l)
+			}
+			if tt.ascii && i < len(lines)-1 && len(l) != icsLineLength {
+				t.Errorf("folded line is %d bytes long, want %d: %q", len(l), icsLineLength, l)
+			}
+			if !utf8.ValidString(l) {
+				t.Errorf("folded line splits a multi-byte character: %q", l)
+			}
+			if i == 0 {
+				continue
+			}
+			if !strings.HasPrefix(l, " ") {
+				t.Errorf("continuation line does not start with a space: %q", l)
+			}
+			unfolded += strings.TrimPrefix(l, " ")
+		}
+		if unfolded != line {
+			t.Errorf("unfolded line = %q, want %q", unfolded, line)
+		}
+	}
+}
+
+func TestWriteExpirationsICS(t *testing.T) {
+	expirations := []postgres.Expiration{
+		{Kind: "reservation", Date: time.Date(2020, 11, 3, 0, 0, 0, 0, time.UTC), Family: "m5", Region: "us-east-1", Count: 2, Units: 8},
+		{Kind: "listing-term", Date: time.Date(2020, 11, 4, 0, 0, 0, 0, time.UTC), Family: "c5", Region: "eu-west-1", Count: 1, Units: 0.5},
+	}
+	var b bytes.Buffer
+	if err := WriteExpirationsICS(&b, expirations); err != nil {
+		t.Fatal(err)
+	}
+	ics := b.String()
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:reservation-20201103-m5-us-east-1@aws_audit_exporter\r\n",
+		"DTSTART;VALUE=DATE:20201103\r\nDTEND;VALUE=DATE:20201104\r\n",
+		`SUMMARY:m5 RIs expire: 2 instances\, 8 units in us-east-1` + "\r\n",
+		`SUMMARY:c5 listed RIs price term ends: 1 instances\, 0.5 units in eu-west-1` + "\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(ics, expected) {
+			t.Errorf("feed is missing %q:\n%s", expected, ics)
+		}
+	}
+	if got := strings.Count(ics, "BEGIN:VEVENT"); got != len(expirations) {
+		t.Errorf("feed holds %d events, want %d", got, len(expirations))
+	}
+}
+
+func TestWriteExpirationsCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteExpirationsCSV(&b, []postgres.Expiration{
+		{Kind: "reservation", Date: time.Date(2020, 11, 3, 0, 0, 0, 0, time.UTC), Family: "m5", Region: "us-east-1", Count: 2, Units: 8},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "kind,date,family,region,count,units\nreservation,2020-11-03,m5,us-east-1,2,8\n"
+	if b.String() != expected {
+		t.Errorf("CSV = %q, want %q", b.String(), expected)
+	}
+}
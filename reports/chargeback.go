@@ -0,0 +1,306 @@
+package reports
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+// UntaggedBucket the bucket of instances missing the chargeback tag
+const UntaggedBucket = "untagged"
+
+// ChargebackLine the cost of the instances sharing a tag value
+type ChargebackLine struct {
+	TagValue     string  `json:"tag_value"`
+	Instances    int     `json:"instances"`
+	Hours        float64 `json:"hours"`
+	OnDemandCost float64 `json:"on_demand_cost"`
+	ReservedCost float64 `json:"reserved_cost"`
+	SpotCost     float64 `json:"spot_cost"`
+	Cost         float64 `json:"cost"`
+}
+
+// Chargeback the cost of a calendar month split by the values of an instance tag
+// Total is the sum of the lines and the unused reservations, and is reconciled against
+// ExpectedTotal, which is computed on its own out of the cost of all the reservations of the month
+// and the running hours of all the instances, priced by instance type rather than by instance
+type Chargeback struct {
+	Month              string           `json:"month"`
+	Tag                string           `json:"tag"`
+	Lines              []ChargebackLine `json:"lines"`
+	UnusedReservedCost float64          `json:"unused_reserved_cost"`
+	UnpricedHours      float64          `json:"unpriced_hours"`
+	Total              float64          `json:"total"`
+	ExpectedTotal      float64          `json:"expected_total"`
+	Difference         float64          `json:"difference"`
+}
+
+// regionOf returns the region of an availability zone
+func regionOf(az string) string {
+	return strings.TrimRight(az, "abcdefghijklmnopqrstuvwxyz")
+}
+
+// tagValue returns the value instance is charged back to
+// instances missing the tag are stored with "none" as its value
+func tagValue(tags map[string]string, tag string) string {
+	if value := tags[tag]; value != "" && value != "none" {
+		return value
+	}
+	return UntaggedBucket
+}
+
+// GetChargeback splits the cost of month between the values of tag
+// reservations are applied per region and family, in normalization units, to on-demand instances
+// spot instances are charged the average spot price of their product, and the on-demand price when missing
+// its queries are cancelled along with ctx
+func GetChargeback(ctx context.Context, month time.Time, tag string, catalog *pricing.Catalog) (*Chargeback, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	instances, err := postgres.SelectInstancesUsage(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching instances usage: %v", err)
+	}
+	reserved, err := postgres.SelectReservedUsage(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching reservations usage: %v", err)
+	}
+	spotPrices, err := postgres.SelectSpotPriceAverages(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching spot prices: %v", err)
+	}
+	reservedCost, err := postgres.SelectReservedCost(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching reservations cost: %v", err)
+	}
+	running, err := postgres.SelectRunningHours(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching running hours: %v", err)
+	}
+	report := chargeback(from.Format("2006-01"), tag, instances, reserved, spotPrices, catalog)
+	report.reconcile(reservedCost, running, reserved, spotPrices, catalog)
+	return report, nil
+}
+
+// spotPricesByPool maps the average spot prices by az/instance_type/product
+// instances don't record the account they run in, so pools of the same name in several accounts are
+// priced the mean of their averages
+func spotPricesByPool(spotPrices []postgres.SpotPriceAverage) map[string]float64 {
+	spot, accounts := map[string]float64{}, map[string]int{}
+	for _, p := range spotPrices {
+		pool := p.Az + "/" + p.InstanceType + "/" + p.Product
+		spot[pool] += p.Price
+		accounts[pool]++
+	}
+	for pool, n := range accounts {
+		spot[pool] /= float64(n)
+	}
+	return spot
+}
+
+// reservedCoverage returns the share of the on-demand unit hours covered by reservations, and the cost
+// of a reserved unit hour, by region/family
+func reservedCoverage(onDemandUnitHours map[string]float64, reserved []postgres.ReservedUsage) (
+	coverage map[string]float64, rate map[string]float64) {
+
+	coverage, rate = map[string]float64{}, map[string]float64{}
+	for _, r := range reserved {
+		key := r.Region + "/" + r.Family
+		if r.UnitHours <= 0 {
+			continue
+		}
+		rate[key] = r.Cost / r.UnitHours
+		if onDemandUnitHours[key] > 0 {
+			coverage[key] = math.Min(r.UnitHours, onDemandUnitHours[key]) / onDemandUnitHours[key]
+		}
+	}
+	return coverage, rate
+}
+
+// reconcile sets the expected total, and its difference with the total of the lines, out of the cost of
+// all the reservations and the running hours of all the instances, by instance type. the hours not covered
+// by reservations are priced on-demand, and spot hours at the spot price. hours missing a price are left
+// out of both totals, while reservations missing normalization units are left out of the lines only
+func (c *Chargeback) reconcile(reservedCost float64, running []postgres.RunningHours,
+	reserved []postgres.ReservedUsage, spotPrices []postgres.SpotPriceAverage, catalog *pricing.Catalog) {
+
+	spot := spotPricesByPool(spotPrices)
+	onDemandUnitHours := map[string]float64{}
+	for _, r := range running {
+		if r.Lifecycle == "normal" {
+			onDemandUnitHours[regionOf(r.Az)+"/"+r.Family] += r.Units * r.Hours
+		}
+	}
+	coverage, _ := reservedCoverage(onDemandUnitHours, reserved)
+
+	c.ExpectedTotal = reservedCost
+	for _, r := range running {
+		region := regionOf(r.Az)
+		price, priced := catalog.OnDemandPrice(region, r.InstanceType)
+		hours := r.Hours
+		if r.Lifecycle == "spot" {
+			if spotPrice, ok := spot[r.Az+"/"+r.InstanceType+"/"+r.Product]; ok {
+				price, priced = spotPrice, true
+			}
+		} else if r.Lifecycle == "normal" {
+			hours *= 1 - coverage[region+"/"+r.Family]
+		}
+		if priced {
+			c.ExpectedTotal += hours * price
+		}
+	}
+	c.Difference = c.Total - c.ExpectedTotal
+}
+
+// chargeback splits the cost of the instances usage of a month between the values of tag
+func chargeback(month string, tag string, instances []postgres.InstanceUsage, reserved []postgres.ReservedUsage,
+	spotPrices []postgres.SpotPriceAverage, catalog *pricing.Catalog) *Chargeback {
+
+	spot := spotPricesByPool(spotPrices)
+	// on-demand unit hours per region and family, to compute the reservations coverage
+	onDemandUnitHours := map[string]float64{}
+	for _, i := range instances {
+		if i.Lifecycle == "normal" {
+			onDemandUnitHours[regionOf(i.Az)+"/"+i.Family] += i.Units * i.Hours
+		}
+	}
+	coverage, reservedRate := reservedCoverage(onDemandUnitHours, reserved)
+
+	report := &Chargeback{Month: month, Tag: tag, Lines: []ChargebackLine{}}
+	for _, r := range reserved {
+		key := r.Region + "/" + r.Family
+		if r.UnitHours <= 0 {
+			continue
+		}
+		used := math.Min(r.UnitHours, onDemandUnitHours[key])
+		report.UnusedReservedCost += (r.UnitHours - used) * reservedRate[key]
+	}
+
+	lines := map[string]*ChargebackLine{}
+	for _, i := range instances {
+		value := tagValue(i.Tags, tag)
+		line, ok := lines[value]
+		if !ok {
+			line = &ChargebackLine{TagValue: value}
+			lines[value] = line
+		}
+		line.Instances++
+		line.Hours += i.Hours
+
+		region := regionOf(i.Az)
+		onDemand, priced := catalog.OnDemandPrice(region, i.InstanceType)
+		if i.Lifecycle == "spot" {
+			if price, ok := spot[i.Az+"/"+i.InstanceType+"/"+i.Product]; ok {
+				onDemand, priced = price, true
+			}
+			if !priced {
+				report.UnpricedHours += i.Hours
+				continue
+			}
+			line.SpotCost += i.Hours * onDemand
+			continue
+		}
+
+		key := region + "/" + i.Family
+		covered := 0.0
+		if i.Lifecycle == "normal" {
+			covered = coverage[key]
+		}
+		line.ReservedCost += i.Hours * i.Units * covered * reservedRate[key]
+		if covered < 1 {
+			if !priced {
+				report.UnpricedHours += i.Hours * (1 - covered)
+				continue
+			}
+			line.OnDemandCost += i.Hours * (1 - covered) * onDemand
+		}
+	}
+
+	for _, line := range lines {
+		line.Cost = line.OnDemandCost + line.ReservedCost + line.SpotCost
+		report.Total += line.Cost
+		report.Lines = append(report.Lines, *line)
+	}
+	report.Total += report.UnusedReservedCost
+	sort.Slice(report.Lines, func(i, j int) bool {
+		if report.Lines[i].Cost != report.Lines[j].Cost {
+			return report.Lines[i].Cost > report.Lines[j].Cost
+		}
+		return report.Lines[i].TagValue < report.Lines[j].TagValue
+	})
+	return report
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 2, 64)
+}
+
+// WriteCSV writes the chargeback as CSV, the unused reservations and the total are the last lines
+func (c *Chargeback) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"month", "tag", "tag_value", "instances", "hours",
+		"on_demand_cost", "reserved_cost", "spot_cost", "cost"})
+	for _, l := range c.Lines {
+		writer.Write([]string{c.Month, c.Tag, l.TagValue, strconv.Itoa(l.Instances),
+			strconv.FormatFloat(l.Hours, 'f', 1, 64), formatCost(l.OnDemandCost),
+			formatCost(l.ReservedCost), formatCost(l.SpotCost), formatCost(l.Cost)})
+	}
+	writer.Write([]string{c.Month, c.Tag, "(unused reservations)", "", "",
+		"", formatCost(c.UnusedReservedCost), "", formatCost(c.UnusedReservedCost)})
+	writer.Write([]string{c.Month, c.Tag, "(total)", "", "", "", "", "", formatCost(c.Total)})
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJSON writes the chargeback as JSON
+func (c *Chargeback) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(c)
+}
+
+// WriteMarkdown writes the chargeback as a Markdown table, followed by the reconciliation
+func (c *Chargeback) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Chargeback for %s by tag `%s`\n\n", c.Month, c.Tag)
+	b.WriteString("| Tag value | Instances | Hours | On-demand | Reserved | Spot | Cost |\n")
+	b.WriteString("|---|---:|---:|---:|---:|---:|---:|\n")
+	for _, l := range c.Lines {
+		fmt.Fprintf(&b, "| %s | %d | %.1f | %s | %s | %s | %s |\n",
+			strings.Replace(l.TagValue, "|", `\|`, -1), l.Instances, l.Hours, formatCost(l.OnDemandCost),
+			formatCost(l.ReservedCost), formatCost(l.SpotCost), formatCost(l.Cost))
+	}
+	fmt.Fprintf(&b, "| *unused reservations* | | | | %s | | %s |\n",
+		formatCost(c.UnusedReservedCost), formatCost(c.UnusedReservedCost))
+	fmt.Fprintf(&b, "| **total** | | | | | | **%s** |\n\n", formatCost(c.Total))
+	b.WriteString("## Reconciliation\n\n")
+	fmt.Fprintf(&b, "- Total of lines: %s\n", formatCost(c.Total))
+	fmt.Fprintf(&b, "- Reservations, and running hours by instance type: %s\n", formatCost(c.ExpectedTotal))
+	fmt.Fprintf(&b, "- Difference: %s\n", formatCost(c.Difference))
+	fmt.Fprintf(&b, "- Unpriced hours: %.1f\n", c.UnpricedHours)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write writes the chargeback in format, either "csv", "json" or "markdown"
+func (c *Chargeback) Write(w io.Writer, format string) error {
+	switch format {
+	case "csv":
+		return c.WriteCSV(w)
+	case "json":
+		return c.WriteJSON(w)
+	case "markdown", "md":
+		return c.WriteMarkdown(w)
+	}
+	return fmt.Errorf("unsupported chargeback format %q, expected csv, json or markdown", format)
+}
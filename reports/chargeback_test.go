@@ -0,0 +1,152 @@
+package reports
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+// testCatalog returns a catalog of on-demand prices in us-east-1
+func testCatalog(t *testing.T) *pricing.Catalog {
+	catalog, err := pricing.ReadCatalog(strings.NewReader(`region,instance_type,on_demand
+us-east-1,m5.large,0.1
+us-east-1,m5.xlarge,0.2
+us-east-1,c5.large,0.08
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func closeTo(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestChargeback(t *testing.T) {
+	instances := []postgres.InstanceUsage{
+		{InstanceID: "i-1", Az: "us-east-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal",
+			Units: 4, Hours: 100, Tags: map[string]string{"team": "a"}},
+		{InstanceID: "i-2", Az: "us-east-1b", Family: "m5", InstanceType: "m5.xlarge", Lifecycle: "normal",
+			Units: 8, Hours: 100, Tags: map[string]string{"team": "b"}},
+		{InstanceID: "i-3", Az: "us-east-1a", Family: "c5", InstanceType: "c5.large", Lifecycle: "spot",
+			Product: "Linux/UNIX (Amazon VPC)", Units: 4, Hours: 10, Tags: map[string]string{"team": "none"}},
+		{InstanceID: "i-4", Az: "us-east-1a", Family: "r5", InstanceType: "r5.large", Lifecycle: "normal",
+			Units: 4, Hours: 5, Tags: map[string]string{"team": "a"}},
+	}
+	// half of the m5 usage is reserved, the c5 reservation is unused
+	reserved := []postgres.ReservedUsage{
+		{Region: "us-east-1", Family: "m5", UnitHours: 600, Cost: 30},
+		{Region: "us-east-1", Family: "c5", UnitHours: 100, Cost: 5},
+	}
+	// spot instances are charged the price of their own product
+	spotPrices := []postgres.SpotPriceAverage{
+		{Az: "us-east-1a", InstanceType: "c5.large", Product: "Linux/UNIX (Amazon VPC)", Price: 0.03},
+		{Az: "us-east-1a", InstanceType: "c5.large", Product: "Windows (Amazon VPC)", Price: 0.12},
+	}
+
+	report := chargeback("2020-10", "team", instances, reserved, spotPrices, testCatalog(t))
+
+	expected := []ChargebackLine{
+		{TagValue: "b", Instances: 1, Hours: 100, OnDemandCost: 10, ReservedCost: 20, Cost: 30},
+		{TagValue: "a", Instances: 2, Hours: 105, OnDemandCost: 5, ReservedCost: 10, Cost: 15},
+		{TagValue: UntaggedBucket, Instances: 1, Hours: 10, SpotCost: 0.3, Cost: 0.3},
+	}
+	if len(report.Lines) != len(expected) {
+		t.Fatalf("lines = %+v, want %+v", report.Lines, expected)
+	}
+	for i, line := range report.Lines {
+		e := expected[i]
+		if line.TagValue != e.TagValue || line.Instances != e.Instances || !closeTo(line.Hours, e.Hours) ||
+			!closeTo(line.OnDemandCost, e.OnDemandCost) || !closeTo(line.ReservedCost, e.ReservedCost) ||
+			!closeTo(line.SpotCost, e.SpotCost) || !closeTo(line.Cost, e.Cost) {
+			t.Errorf("line %d = %+v, want %+v", i, line, e)
+		}
+	}
+	if !closeTo(report.UnusedReservedCost, 5) {
+		t.Errorf("unused reserved cost = %v, want 5", report.UnusedReservedCost)
+	}
+	if !closeTo(report.UnpricedHours, 5) {
+		t.Errorf("unpriced hours = %v, want 5", report.UnpricedHours)
+	}
+	if !closeTo(report.Total, 50.3) {
+		t.Errorf("total = %v, want 50.3", report.Total)
+	}
+
+	// the same hours, summed by instance type, and the cost of all the reservations
+	running := []postgres.RunningHours{
+		{Az: "us-east-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal", Units: 4, Hours: 100},
+		{Az: "us-east-1b", Family: "m5", InstanceType: "m5.xlarge", Lifecycle: "normal", Units: 8, Hours: 100},
+		{Az: "us-east-1a", Family: "c5", InstanceType: "c5.large", Lifecycle: "spot",
+			Product: "Linux/UNIX (Amazon VPC)", Units: 4, Hours: 10},
+		{Az: "us-east-1a", Family: "r5", InstanceType: "r5.large", Lifecycle: "normal", Units: 4, Hours: 5},
+	}
+	report.reconcile(35, running, reserved, spotPrices, testCatalog(t))
+	if !closeTo(report.ExpectedTotal, 50.3) || !closeTo(report.Difference, 0) {
+		t.Errorf("expected total = %v, difference = %v, want 50.3 reconciled", report.ExpectedTotal, report.Difference)
+	}
+}
+
+func TestChargebackReconcileDifference(t *testing.T) {
+	instances := []postgres.InstanceUsage{
+		{InstanceID: "i-1", Az: "us-east-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal",
+			Units: 4, Hours: 100, Tags: map[string]string{"team": "a"}},
+	}
+	// the r5 reservation is missing its normalization units, so no line is charged for it
+	reserved := []postgres.ReservedUsage{
+		{Region: "us-east-1", Family: "m5", UnitHours: 200, Cost: 10},
+		{Region: "us-east-1", Family: "r5", UnitHours: 0, Cost: 7},
+	}
+	// a c5 instance ran during the month, but the instances usage of the lines missed it
+	running := []postgres.RunningHours{
+		{Az: "us-east-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal", Units: 4, Hours: 100},
+		{Az: "us-east-1a", Family: "c5", InstanceType: "c5.large", Lifecycle: "normal", Units: 4, Hours: 50},
+		{Az: "us-east-1a", Family: "r5", InstanceType: "r5.large", Lifecycle: "normal", Units: 4, Hours: 20},
+	}
+
+	report := chargeback("2020-10", "team", instances, reserved, nil, testCatalog(t))
+	report.reconcile(17, running, reserved, nil, testCatalog(t))
+	// half of m5 is reserved: 10 reserved, 5 on-demand, while the unpriced r5 hours count in neither total
+	if !closeTo(report.Total, 15) {
+		t.Errorf("total = %v, want 15", report.Total)
+	}
+	// 17 of reservations, 5 of uncovered m5 and 4 of c5 hours
+	if !closeTo(report.ExpectedTotal, 26) || !closeTo(report.Difference, -11) {
+		t.Errorf("expected total = %v, difference = %v, want 26 and -11", report.ExpectedTotal, report.Difference)
+	}
+}
+
+func TestSpotPricesByPoolAcrossAccounts(t *testing.T) {
+	spot := spotPricesByPool([]postgres.SpotPriceAverage{
+		{Account: "production", Az: "us-east-1a", InstanceType: "c5.large", Product: "Linux/UNIX", Price: 0.02},
+		{Account: "staging", Az: "us-east-1a", InstanceType: "c5.large", Product: "Linux/UNIX", Price: 0.04},
+		{Account: "staging", Az: "us-east-1b", InstanceType: "c5.large", Product: "Linux/UNIX", Price: 0.05},
+	})
+	if got := spot["us-east-1a/c5.large/Linux/UNIX"]; math.Abs(got-0.03) > 1e-9 {
+		t.Errorf("us-east-1a price = %v, want the mean over accounts 0.03", got)
+	}
+	if got := spot["us-east-1b/c5.large/Linux/UNIX"]; got != 0.05 {
+		t.Errorf("us-east-1b price = %v, want 0.05", got)
+	}
+}
+
+func TestChargebackWriteCSV(t *testing.T) {
+	report := &Chargeback{Month: "2020-10", Tag: "team", Total: 12.5, UnusedReservedCost: 2.5,
+		Lines: []ChargebackLine{{TagValue: "a", Instances: 1, Hours: 10, OnDemandCost: 10, Cost: 10}}}
+	var b bytes.Buffer
+	if err := report.Write(&b, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `month,tag,tag_value,instances,hours,on_demand_cost,reserved_cost,spot_cost,cost
+2020-10,team,a,1,10.0,10.00,0.00,0.00,10.00
+2020-10,team,(unused reservations),,,,2.50,,2.50
+2020-10,team,(total),,,,,,12.50
+`
+	if b.String() != expected {
+		t.Errorf("CSV = %q, want %q", b.String(), expected)
+	}
+}
@@ -0,0 +1,281 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+// ExchangeOptions parameters of the exchange planner
+type ExchangeOptions struct {
+	// Days of usage history the current usage is computed from
+	Days int
+	// Percentile of the hourly usage taken as the current usage
+	Percentile float64
+}
+
+// ExchangeSource a convertible reservation given up in an exchange
+// Split is set when only some of its instances are exchanged, requiring to split it first
+// Value is the remaining upfront price, prorated to the hours left, and the remaining recurring charges
+type ExchangeSource struct {
+	ReservationID uuid.UUID `json:"reservation_id"`
+	Family        string    `json:"family"`
+	InstanceType  string    `json:"instance_type"`
+	Count         int       `json:"count"`
+	Split         bool      `json:"split"`
+	EndDate       time.Time `json:"end_date"`
+	HoursLeft     float64   `json:"hours_left"`
+	Value         float64   `json:"value"`
+}
+
+// Exchange convertible reservations of over-reserved families, exchanged into a family with uncovered demand
+// the target reservations end on the end date of the source ending last, and are worth at least as much
+// as the sources. TrueUp is paid on top of the sources value. values are in dollars
+type Exchange struct {
+	Region             string                `json:"region"`
+	TargetFamily       string                `json:"target_family"`
+	TargetInstanceType string                `json:"target_instance_type"`
+	TargetCount        int                   `json:"target_count"`
+	Offer              pricing.ReservedOffer `json:"offer"`
+	EndDate            time.Time             `json:"end_date"`
+	TargetUnitValue    float64               `json:"target_unit_value"`
+	SourcesValue       float64               `json:"sources_value"`
+	TargetValue        float64               `json:"target_value"`
+	TrueUp             float64               `json:"true_up"`
+	Sources            []ExchangeSource      `json:"sources"`
+}
+
+// ExchangePlan exchanges proposed out of the usage between From and To
+// Unpriced lists region/instance_type with uncovered demand but no convertible prices in the catalog
+type ExchangePlan struct {
+	From       time.Time  `json:"from"`
+	To         time.Time  `json:"to"`
+	Percentile float64    `json:"percentile"`
+	Exchanges  []Exchange `json:"exchanges"`
+	Unpriced   []string   `json:"unpriced"`
+}
+
+// reservationValue returns the value left of a single instance of a reservation
+func reservationValue(r *models.Reservations, hoursLeft float64) float64 {
+	termHours := float64(r.Duration) / 3600
+	return float64(r.UpfrontPrice)/1e9*hoursLeft/termHours + float64(r.RecurringCharges)/1e9*hoursLeft
+}
+
+// GetExchangePlan proposes exchanging convertible reservations of families reserved above their usage,
+// into families of the same region with usage not covered by reservations
+// families with the largest uncovered usage are planned first, taking the sources ending last first
+// targets are the instance type of the family which ran the most, of the term and payment option
+// of the first source, and are priced against the catalog
+func GetExchangePlan(ctx context.Context, options ExchangeOptions, catalog *pricing.Catalog) (*ExchangePlan, error) {
+	now := time.Now().UTC()
+	to := now.Truncate(time.Hour)
+	from := to.AddDate(0, 0, -options.Days)
+
+	usage, err := hourlyUsage(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	types, err := topInstanceTypes(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := postgres.SelectActiveReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching reservations: %v", err)
+	}
+
+	plan := &ExchangePlan{From: from, To: to, Percentile: options.Percentile}
+	plan.Exchanges, plan.Unpriced = planExchanges(options, usage, types, reservations, now, catalog)
+	return plan, nil
+}
+
+// planExchanges returns the exchanges of the convertible reservations out of the usage, and the
+// region/instance_type lacking prices
+func planExchanges(options ExchangeOptions, usage map[string][]float64, types *instanceTypes,
+	reservations []models.Reservations, now time.Time, catalog *pricing.Catalog) ([]Exchange, []string) {
+
+	reserved := map[string]float64{}
+	for _, r := range reservations {
+		reserved[usageKey(r.Region, r.Family)] += float64(r.Count) * float64(r.Units)
+	}
+	// units reserved above usage, and usage above units reserved, by region/family
+	surplus := map[string]float64{}
+	deficit := map[string]float64{}
+	var targets []string
+	for key, units := range reserved {
+		if baseline := percentile(usage[key], options.Percentile); units > baseline {
+			surplus[key] = units - baseline
+		}
+	}
+	for key, values := range usage {
+		if baseline := percentile(values, options.Percentile); baseline > reserved[key] {
+			deficit[key] = baseline - reserved[key]
+			targets = append(targets, key)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if deficit[targets[i]] != deficit[targets[j]] {
+			return deficit[targets[i]] > deficit[targets[j]]
+		}
+		return targets[i] < targets[j]
+	})
+
+	// convertible reservations, ending last first, and their instances left to exchange
+	var sources []*models.Reservations
+	left := map[uuid.UUID]int{}
+	for i := range reservations {
+		r := &reservations[i]
+		if r.OfferClass == "convertible" && r.Units > 0 && r.Duration > 0 && r.EndDate.After(now) {
+			sources = append(sources, r)
+			left[r.ReservationID] = int(r.Count)
+		}
+	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].EndDate.After(sources[j].EndDate)
+	})
+
+	exchanges, unpriced := []Exchange{}, []string{}
+	for _, target := range targets {
+		parts := strings.SplitN(target, "/", 2)
+		region, family := parts[0], parts[1]
+		targetType := types.top[target]
+		targetUnits := types.units[targetType]
+		if targetType == "" || targetUnits <= 0 {
+			continue
+		}
+
+		var exchange *Exchange
+		for _, r := range sources {
+			sourceKey := usageKey(r.Region, r.Family)
+			if r.Region != region || r.Family == family || left[r.ReservationID] == 0 ||
+				surplus[sourceKey] < float64(r.Units) || deficit[target] <= 0 {
+				continue
+			}
+			if exchange == nil {
+				offer := pricing.OfferOf(r.OfferClass, r.OfferType, r.Duration)
+				upfront, hourly, ok := catalog.ReservedPrice(offer, region, targetType)
+				if !ok {
+					unpriced = append(unpriced, region+"/"+targetType)
+					break
+				}
+				// the target ends along with the first source, which is the one ending last
+				hoursLeft := r.EndDate.Sub(now).Hours()
+				exchange = &Exchange{
+					Region:             region,
+					TargetFamily:       family,
+					TargetInstanceType: targetType,
+					Offer:              offer,
+					EndDate:            r.EndDate,
+					TargetUnitValue:    (upfront + hourly*offer.TermHours()) * hoursLeft / offer.TermHours(),
+					Sources:            []ExchangeSource{},
+				}
+				if exchange.TargetUnitValue <= 0 {
+					exchange = nil
+					break
+				}
+			} else if pricing.OfferOf(r.OfferClass, r.OfferType, r.Duration).Term != exchange.Offer.Term {
+				continue
+			}
+
+			hoursLeft := r.EndDate.Sub(now).Hours()
+			value := reservationValue(r, hoursLeft)
+			// instances needed to cover the deficit, bounded by the surplus and the instances left
+			count := left[r.ReservationID]
+			if byUnits := int(math.Floor(surplus[sourceKey] / float64(r.Units))); byUnits < count {
+				count = byUnits
+			}
+			if value > 0 {
+				needed := int(math.Ceil(deficit[target] / targetUnits * exchange.TargetUnitValue / value))
+				if needed < count {
+					count = needed
+				}
+			}
+			if count < 1 {
+				continue
+			}
+
+			exchange.Sources = append(exchange.Sources, ExchangeSource{
+				ReservationID: r.ReservationID,
+				Family:        r.Family,
+				InstanceType:  r.InstanceType,
+				Count:         count,
+				Split:         count < int(r.Count),
+				EndDate:       r.EndDate,
+				HoursLeft:     hoursLeft,
+				Value:         value * float64(count),
+			})
+			exchange.SourcesValue += value * float64(count)
+			left[r.ReservationID] -= count
+			surplus[sourceKey] -= float64(count) * float64(r.Units)
+			deficit[target] -= value * float64(count) / exchange.TargetUnitValue * targetUnits
+		}
+		if exchange == nil || len(exchange.Sources) == 0 {
+			continue
+		}
+		// the target must be worth at least as much as the sources
+		exchange.TargetCount = int(math.Ceil(exchange.SourcesValue / exchange.TargetUnitValue))
+		if exchange.TargetCount < 1 {
+			exchange.TargetCount = 1
+		}
+		exchange.TargetValue = float64(exchange.TargetCount) * exchange.TargetUnitValue
+		exchange.TrueUp = exchange.TargetValue - exchange.SourcesValue
+		exchanges = append(exchanges, *exchange)
+	}
+	sort.Strings(unpriced)
+	return exchanges, unpriced
+}
+
+// WriteJSON writes the plan as JSON
+func (p *ExchangePlan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// WriteMarkdown writes the plan as Markdown, a section per exchange along with its value maths
+func (p *ExchangePlan) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Convertible reservations exchange plan\n\nUsage is the p%s of hourly usage between %s and %s\n",
+		formatUnits(p.Percentile), p.From.Format("2006-01-02"), p.To.Format("2006-01-02"))
+	for _, e := range p.Exchanges {
+		fmt.Fprintf(&b, "\n## %s: %d x %s, %s %s %s upfront, ending %s\n\n", e.Region, e.TargetCount,
+			e.TargetInstanceType, e.Offer.Class, e.Offer.Term, e.Offer.Payment, e.EndDate.Format("2006-01-02"))
+		b.WriteString("| Source reservation | Instance type | Count | Split | Hours left | Value |\n")
+		b.WriteString("|---|---|---:|---|---:|---:|\n")
+		for _, s := range e.Sources {
+			fmt.Fprintf(&b, "| %s | %s | %d | %t | %.0f | %s |\n", s.ReservationID, s.InstanceType, s.Count,
+				s.Split, s.HoursLeft, formatCost(s.Value))
+		}
+		fmt.Fprintf(&b, "\n- Sources value: %s\n", formatCost(e.SourcesValue))
+		fmt.Fprintf(&b, "- Target value: %d x %s = %s\n", e.TargetCount, formatCost(e.TargetUnitValue),
+			formatCost(e.TargetValue))
+		fmt.Fprintf(&b, "- True-up: %s\n", formatCost(e.TrueUp))
+	}
+	if len(p.Unpriced) > 0 {
+		fmt.Fprintf(&b, "\nMissing from the price catalog: %s\n", strings.Join(p.Unpriced, ", "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write writes the plan in format, either "json" or "markdown"
+func (p *ExchangePlan) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		return p.WriteJSON(w)
+	case "markdown", "md":
+		return p.WriteMarkdown(w)
+	}
+	return fmt.Errorf("unsupported exchange plan format %q, expected json or markdown", format)
+}
@@ -0,0 +1,68 @@
+package reports
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+func TestPlanExchanges(t *testing.T) {
+	catalog, err := pricing.ReadCatalog(strings.NewReader(`region,instance_type,on_demand,convertible_3yr_no_hourly
+us-east-1,m5.large,0.2,0.1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	threeYears := int32(3 * 365 * 24 * 3600)
+	convertible := func(region string, count uint16) models.Reservations {
+		return models.Reservations{ReservationID: uuid.New(), Region: region, Family: "c5", InstanceType: "c5.large",
+			OfferClass: "convertible", OfferType: "No Upfront", Count: count, Units: 4, Duration: threeYears,
+			RecurringCharges: 0.05e9, EndDate: now.Add(1000 * time.Hour)}
+	}
+	source := convertible("us-east-1", 6)
+	reservations := []models.Reservations{source, convertible("eu-west-1", 2)}
+	// c5 reservations are unused, m5 and r5 usage is on-demand
+	usage := map[string][]float64{"us-east-1/m5": {8, 8}, "eu-west-1/r5": {4, 4}}
+	types := instanceTypesOf([]postgres.InstanceUsage{
+		{Az: "us-east-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal", Units: 4, Hours: 2},
+		{Az: "eu-west-1a", Family: "r5", InstanceType: "r5.large", Lifecycle: "normal", Units: 4, Hours: 2},
+	})
+
+	exchanges, unpriced := planExchanges(ExchangeOptions{Percentile: 50}, usage, types, reservations, now, catalog)
+
+	if len(unpriced) != 1 || unpriced[0] != "eu-west-1/r5.large" {
+		t.Errorf("unpriced = %v, want [eu-west-1/r5.large]", unpriced)
+	}
+	if len(exchanges) != 1 {
+		t.Fatalf("exchanges = %+v, want one into m5", exchanges)
+	}
+	e := exchanges[0]
+	if e.TargetFamily != "m5" || e.TargetInstanceType != "m5.large" || e.Offer.String() != "convertible_3yr_no" ||
+		!e.EndDate.Equal(source.EndDate) {
+		t.Errorf("exchange = %+v, want m5.large convertible_3yr_no ending with the source", e)
+	}
+	// every source instance is worth 50$, every target 100$, 2 targets cover the 8 units used
+	if len(e.Sources) != 1 || e.Sources[0].ReservationID != source.ReservationID || e.Sources[0].Count != 4 ||
+		!e.Sources[0].Split || !closeTo(e.Sources[0].Value, 200) {
+		t.Errorf("sources = %+v, want 4 of the 6 instances of the source, worth 200", e.Sources)
+	}
+	if !closeTo(e.TargetUnitValue, 100) || e.TargetCount != 2 || !closeTo(e.TargetValue, 200) || !closeTo(e.TrueUp, 0) {
+		t.Errorf("target unit value %v, count %d, value %v, true up %v, want 100, 2, 200 and 0",
+			e.TargetUnitValue, e.TargetCount, e.TargetValue, e.TrueUp)
+	}
+}
+
+func TestReservationValue(t *testing.T) {
+	r := &models.Reservations{Duration: 365 * 24 * 3600, UpfrontPrice: 876e9, RecurringCharges: 0.01e9}
+	// half the upfront price, and the recurring charges of the hours left
+	if got := reservationValue(r, 365*12); !closeTo(got, 438+43.8) {
+		t.Errorf("value = %v, want %v", got, 438+43.8)
+	}
+}
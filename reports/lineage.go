@@ -0,0 +1,175 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// LineageNode a reservation in the lineage
+type LineageNode struct {
+	ReservationID   uuid.UUID  `json:"reservation_id"`
+	Canceled        bool       `json:"canceled"`
+	Converted       bool       `json:"converted"`
+	Count           uint16     `json:"count"`
+	EndDate         time.Time  `json:"end_date"`
+	InstanceType    string     `json:"instance_type"`
+	OfferClass      string     `json:"offer_class"`
+	OriginalEndDate time.Time  `json:"original_end_date"`
+	SellSplitted    bool       `json:"sell_splitted"`
+	Sold            bool       `json:"sold"`
+	SoldDate        *time.Time `json:"sold_date,omitempty"`
+	StartDate       time.Time  `json:"start_date"`
+	State           string     `json:"state"`
+	Units           float32    `json:"units"`
+	UnitsSold       uint16     `json:"units_sold"`
+}
+
+// LineageEdge the event that created a child reservation out of its parent
+// Date is the date the child reservation started on
+type LineageEdge struct {
+	ParentID      uuid.UUID `json:"parent_id"`
+	ReservationID uuid.UUID `json:"reservation_id"`
+	Date          time.Time `json:"date"`
+	Event         string    `json:"event"`
+}
+
+// Lineage the ancestors and descendants of a reservation
+type Lineage struct {
+	ReservationID uuid.UUID     `json:"reservation_id"`
+	Nodes         []LineageNode `json:"nodes"`
+	Edges         []LineageEdge `json:"edges"`
+}
+
+// ErrReservationNotFound returned when the reservation is not in the database
+var ErrReservationNotFound = fmt.Errorf("reservation not found")
+
+// GetLineage builds the lineage of a reservation out of the reservations relations
+// its queries are cancelled along with ctx
+func GetLineage(ctx context.Context, reservationID uuid.UUID) (*Lineage, error) {
+	reservations, relations, sellEvents, err := postgres.SelectReservationsLineage(ctx, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(reservations) == 0 {
+		return nil, ErrReservationNotFound
+	}
+
+	lineage := &Lineage{ReservationID: reservationID}
+	startDates := map[uuid.UUID]time.Time{}
+	for _, r := range reservations {
+		startDates[r.ReservationID] = r.StartDate
+		node := LineageNode{
+			ReservationID:   r.ReservationID,
+			Canceled:        r.Canceled,
+			Converted:       r.Converted,
+			Count:           r.Count,
+			EndDate:         r.EndDate,
+			InstanceType:    r.InstanceType,
+			OfferClass:      r.OfferClass,
+			OriginalEndDate: r.OriginalEndDate,
+			SellSplitted:    r.SellSplitted,
+			Sold:            r.Sold,
+			StartDate:       r.StartDate,
+			State:           r.State,
+			Units:           r.Units,
+		}
+		for _, event := range sellEvents {
+			if event.ReservationID == r.ReservationID {
+				soldDate := event.SoldDate
+				node.SoldDate = &soldDate
+				node.UnitsSold = event.UnitsSold
+			}
+		}
+		lineage.Nodes = append(lineage.Nodes, node)
+	}
+	for _, relation := range relations {
+		lineage.Edges = append(lineage.Edges, LineageEdge{
+			ParentID:      relation.ParentID,
+			ReservationID: relation.ReservationID,
+			Date:          startDates[relation.ReservationID],
+			Event:         relation.Event,
+		})
+	}
+	if lineage.Edges == nil {
+		lineage.Edges = []LineageEdge{}
+	}
+	return lineage, nil
+}
+
+// WriteJSON writes the lineage as JSON
+func (l *Lineage) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(l)
+}
+
+// nodeFlags returns the lifecycle flags set on a node
+func (n *LineageNode) nodeFlags() []string {
+	var flags []string
+	for flag, set := range map[string]bool{
+		"canceled":      n.Canceled,
+		"converted":     n.Converted,
+		"sell_splitted": n.SellSplitted,
+		"sold":          n.Sold,
+	} {
+		if set {
+			flags = append(flags, flag)
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// WriteDOT writes the lineage as a Graphviz DOT digraph
+// the reservation the lineage was built for is highlighted
+func (l *Lineage) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph lineage {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+	for _, n := range l.Nodes {
+		label := []string{
+			n.ReservationID.String(),
+			fmt.Sprintf("%s x%d (%s, %s)", n.InstanceType, n.Count, n.OfferClass, n.State),
+			fmt.Sprintf("%s - %s", n.StartDate.Format("2006-01-02"), n.EndDate.Format("2006-01-02")),
+		}
+		if n.SoldDate != nil {
+			label = append(label, fmt.Sprintf("sold %d on %s", n.UnitsSold, n.SoldDate.Format("2006-01-02")))
+		}
+		if flags := n.nodeFlags(); len(flags) > 0 {
+			label = append(label, strings.Join(flags, ", "))
+		}
+		style := ""
+		if n.ReservationID == l.ReservationID {
+			style = ", style=bold"
+		}
+		fmt.Fprintf(&b, "  %q [label=%q%s];\n", n.ReservationID.String(), strings.Join(label, "\n"), style)
+	}
+	for _, e := range l.Edges {
+		fmt.Fprintf(&b, "  %q -> %q [label=%q];\n", e.ParentID.String(), e.ReservationID.String(),
+			fmt.Sprintf("%s\n%s", e.Event, e.Date.Format("2006-01-02")))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write writes the lineage in format, either "json" or "dot"
+func (l *Lineage) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		return l.WriteJSON(w)
+	case "dot":
+		return l.WriteDOT(w)
+	}
+	return fmt.Errorf("unsupported lineage format %q, expected json or dot", format)
+}
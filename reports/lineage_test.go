@@ -0,0 +1,49 @@
+package reports
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLineageWriteDOT(t *testing.T) {
+	parent, child := uuid.New(), uuid.New()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sold := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	lineage := &Lineage{
+		ReservationID: child,
+		Nodes: []LineageNode{
+			{ReservationID: parent, InstanceType: "m5.large", Count: 2, OfferClass: "standard", State: "retired",
+				StartDate: start, EndDate: start.AddDate(1, 0, 0), Converted: true, Canceled: true},
+			{ReservationID: child, InstanceType: "m5.xlarge", Count: 1, OfferClass: "standard", State: "active",
+				StartDate: start.AddDate(0, 3, 0), EndDate: start.AddDate(1, 0, 0), SoldDate: &sold, UnitsSold: 8, Sold: true},
+		},
+		Edges: []LineageEdge{{ParentID: parent, ReservationID: child, Date: start.AddDate(0, 3, 0), Event: "modification"}},
+	}
+	var b bytes.Buffer
+	if err := lineage.Write(&b, "dot"); err != nil {
+		t.Fatal(err)
+	}
+	dot := b.String()
+	for _, expected := range []string{
+		`"` + parent.String() + `" [label="` + parent.String() + `\nm5.large x2 (standard, retired)\n2020-01-01 - 2021-01-01\ncanceled, converted"];`,
+		`"` + child.String() + `" [label="` + child.String() + `\nm5.xlarge x1 (standard, active)\n2020-04-01 - 2021-01-01\nsold 8 on 2020-06-01\nsold", style=bold];`,
+		`"` + parent.String() + `" -> "` + child.String() + `" [label="modification\n2020-04-01"];`,
+	} {
+		if !strings.Contains(dot, expected) {
+			t.Errorf("DOT is missing %s:\n%s", expected, dot)
+		}
+	}
+	if !strings.HasPrefix(dot, "digraph lineage {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("DOT is not a digraph:\n%s", dot)
+	}
+}
+
+func TestLineageWriteUnsupportedFormat(t *testing.T) {
+	if err := (&Lineage{}).Write(&bytes.Buffer{}, "svg"); err == nil {
+		t.Error("writing svg should fail")
+	}
+}
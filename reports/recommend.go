@@ -0,0 +1,228 @@
+package reports
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+// RecommendOptions parameters of the purchase recommendations
+type RecommendOptions struct {
+	// Days of usage history the baseline is computed from
+	Days int
+	// Percentile of the hourly usage taken as the steady-state baseline
+	Percentile float64
+	// Horizon reservations expiring within it are not counted as coverage
+	Horizon time.Duration
+	// Class, Term and Payment restrict the offerings considered, when not empty
+	Class   string
+	Term    string
+	Payment string
+}
+
+// Recommendation a proposed reserved instances purchase for a region and family
+// units are normalization units, prices and savings are in dollars
+type Recommendation struct {
+	Region          string                `json:"region"`
+	Family          string                `json:"family"`
+	BaselineUnits   float64               `json:"baseline_units"`
+	ReservedUnits   float64               `json:"reserved_units"`
+	ExpiringUnits   float64               `json:"expiring_units"`
+	GapUnits        float64               `json:"gap_units"`
+	InstanceType    string                `json:"instance_type"`
+	Count           int                   `json:"count"`
+	Offer           pricing.ReservedOffer `json:"offer"`
+	Upfront         float64               `json:"upfront"`
+	Hourly          float64               `json:"hourly"`
+	OnDemandHourly  float64               `json:"on_demand_hourly"`
+	MonthlySavings  float64               `json:"monthly_savings"`
+	TermSavings     float64               `json:"term_savings"`
+	BreakEvenMonths float64               `json:"break_even_months"`
+}
+
+// Recommendations reserved instances purchases proposed out of the usage between From and To
+// Unpriced lists region/instance_type with a gap but no prices in the catalog
+type Recommendations struct {
+	From            time.Time        `json:"from"`
+	To              time.Time        `json:"to"`
+	Percentile      float64          `json:"percentile"`
+	Recommendations []Recommendation `json:"recommendations"`
+	Unpriced        []string         `json:"unpriced"`
+}
+
+// GetRecommendations proposes reserved instances purchases covering the steady-state usage
+// of on-demand instances, which is not covered by reservations lasting past the horizon
+// purchases are proposed for the instance type of the family which ran the most, with the offering
+// saving the most per month
+func GetRecommendations(ctx context.Context, options RecommendOptions, catalog *pricing.Catalog) (*Recommendations, error) {
+	to := time.Now().UTC().Truncate(time.Hour)
+	from := to.AddDate(0, 0, -options.Days)
+
+	usage, err := hourlyUsage(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	types, err := topInstanceTypes(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := postgres.SelectActiveReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching reservations: %v", err)
+	}
+
+	report := &Recommendations{From: from, To: to, Percentile: options.Percentile}
+	report.Recommendations, report.Unpriced = recommend(options, usage, types, reservations,
+		time.Now().Add(options.Horizon), catalog)
+	return report, nil
+}
+
+// recommend returns the purchases covering the usage not covered by reservations lasting past horizon,
+// and the region/instance_type lacking prices
+func recommend(options RecommendOptions, usage map[string][]float64, types *instanceTypes,
+	reservations []models.Reservations, horizon time.Time, catalog *pricing.Catalog) ([]Recommendation, []string) {
+
+	reserved := map[string]float64{}
+	expiring := map[string]float64{}
+	for _, r := range reservations {
+		key := usageKey(r.Region, r.Family)
+		units := float64(r.Count) * float64(r.Units)
+		reserved[key] += units
+		if r.EndDate.Before(horizon) {
+			expiring[key] += units
+		}
+	}
+
+	recommendations, unpriced := []Recommendation{}, []string{}
+	for key, values := range usage {
+		parts := strings.SplitN(key, "/", 2)
+		r := Recommendation{
+			Region:        parts[0],
+			Family:        parts[1],
+			BaselineUnits: percentile(values, options.Percentile),
+			ReservedUnits: reserved[key],
+			ExpiringUnits: expiring[key],
+		}
+		r.GapUnits = r.BaselineUnits - (r.ReservedUnits - r.ExpiringUnits)
+		r.InstanceType = types.top[key]
+		if r.InstanceType == "" || types.units[r.InstanceType] <= 0 {
+			continue
+		}
+		if r.Count = int(math.Floor(r.GapUnits / types.units[r.InstanceType])); r.Count < 1 {
+			continue
+		}
+
+		onDemand, ok := catalog.OnDemandPrice(r.Region, r.InstanceType)
+		if !ok {
+			unpriced = append(unpriced, r.Region+"/"+r.InstanceType)
+			continue
+		}
+		r.OnDemandHourly = onDemand
+		priced := false
+		for _, offer := range pricing.ReservedOffers(options.Class, options.Term, options.Payment) {
+			upfront, hourlyPrice, ok := catalog.ReservedPrice(offer, r.Region, r.InstanceType)
+			if !ok {
+				continue
+			}
+			priced = true
+			saving := onDemand - hourlyPrice - upfront/offer.TermHours()
+			if saving <= 0 || saving*hoursPerMonth*float64(r.Count) <= r.MonthlySavings {
+				continue
+			}
+			r.Offer = offer
+			r.Upfront = upfront * float64(r.Count)
+			r.Hourly = hourlyPrice * float64(r.Count)
+			r.MonthlySavings = saving * hoursPerMonth * float64(r.Count)
+			r.TermSavings = saving * offer.TermHours() * float64(r.Count)
+			r.BreakEvenMonths = upfront / ((onDemand - hourlyPrice) * hoursPerMonth)
+		}
+		if !priced {
+			unpriced = append(unpriced, r.Region+"/"+r.InstanceType)
+			continue
+		}
+		if r.MonthlySavings > 0 {
+			recommendations = append(recommendations, r)
+		}
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		return recommendations[i].MonthlySavings > recommendations[j].MonthlySavings
+	})
+	sort.Strings(unpriced)
+	return recommendations, unpriced
+}
+
+func formatUnits(units float64) string {
+	return strconv.FormatFloat(units, 'f', -1, 64)
+}
+
+// WriteCSV writes the recommendations as CSV
+func (r *Recommendations) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"region", "family", "baseline_units", "reserved_units", "expiring_units",
+		"gap_units", "instance_type", "count", "class", "term", "payment", "upfront", "hourly",
+		"on_demand_hourly", "monthly_savings", "term_savings", "break_even_months"})
+	for _, rec := range r.Recommendations {
+		writer.Write([]string{rec.Region, rec.Family, formatUnits(rec.BaselineUnits),
+			formatUnits(rec.ReservedUnits), formatUnits(rec.ExpiringUnits), formatUnits(rec.GapUnits),
+			rec.InstanceType, strconv.Itoa(rec.Count), rec.Offer.Class, rec.Offer.Term, rec.Offer.Payment,
+			formatCost(rec.Upfront), strconv.FormatFloat(rec.Hourly, 'f', 4, 64),
+			strconv.FormatFloat(rec.OnDemandHourly, 'f', 4, 64), formatCost(rec.MonthlySavings),
+			formatCost(rec.TermSavings), strconv.FormatFloat(rec.BreakEvenMonths, 'f', 1, 64)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJSON writes the recommendations as JSON
+func (r *Recommendations) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteMarkdown writes the recommendations as a Markdown table
+func (r *Recommendations) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Reserved instances recommendations\n\nBaseline is the p%s of hourly usage between %s and %s\n\n",
+		formatUnits(r.Percentile), r.From.Format("2006-01-02"), r.To.Format("2006-01-02"))
+	b.WriteString("| Region | Family | Baseline | Reserved | Expiring | Buy | Offer | Upfront | Monthly savings | Break-even (months) |\n")
+	b.WriteString("|---|---|---:|---:|---:|---|---|---:|---:|---:|\n")
+	total := 0.0
+	for _, rec := range r.Recommendations {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %d x %s | %s %s %s upfront | %s | %s | %.1f |\n",
+			rec.Region, rec.Family, formatUnits(rec.BaselineUnits), formatUnits(rec.ReservedUnits),
+			formatUnits(rec.ExpiringUnits), rec.Count, rec.InstanceType, rec.Offer.Class, rec.Offer.Term,
+			rec.Offer.Payment, formatCost(rec.Upfront), formatCost(rec.MonthlySavings), rec.BreakEvenMonths)
+		total += rec.MonthlySavings
+	}
+	fmt.Fprintf(&b, "\nEstimated monthly savings: %s\n", formatCost(total))
+	if len(r.Unpriced) > 0 {
+		fmt.Fprintf(&b, "\nMissing from the price catalog: %s\n", strings.Join(r.Unpriced, ", "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write writes the recommendations in format, either "csv", "json" or "markdown"
+func (r *Recommendations) Write(w io.Writer, format string) error {
+	switch format {
+	case "csv":
+		return r.WriteCSV(w)
+	case "json":
+		return r.WriteJSON(w)
+	case "markdown", "md":
+		return r.WriteMarkdown(w)
+	}
+	return fmt.Errorf("unsupported recommendations format %q, expected csv, json or markdown", format)
+}
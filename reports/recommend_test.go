@@ -0,0 +1,83 @@
+package reports
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/pricing"
+)
+
+func TestPercentile(t *testing.T) {
+	values := []float64{16, 8, 16, 8, 8, 16, 8, 16, 8, 16}
+	for p, expected := range map[float64]float64{0: 8, 50: 8, 51: 16, 100: 16} {
+		if got := percentile(values, p); got != expected {
+			t.Errorf("p%v = %v, want %v", p, got, expected)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of no values = %v, want 0", got)
+	}
+}
+
+func TestHourlyUnits(t *testing.T) {
+	from := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	usage := hourlyUnits([]postgres.HourlyUsage{
+		{Hour: from.Add(time.Hour), Region: "us-east-1", Family: "m5", Units: 8},
+		{Hour: from.Add(5 * time.Hour), Region: "us-east-1", Family: "m5", Units: 4},
+	}, from, from.Add(2*time.Hour))
+	values := usage["us-east-1/m5"]
+	if len(values) != 3 || values[0] != 0 || values[1] != 8 || values[2] != 0 {
+		t.Errorf("hourly units = %v, want [0 8 0]", values)
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	catalog, err := pricing.ReadCatalog(strings.NewReader(`region,instance_type,on_demand,standard_1yr_no_hourly,standard_1yr_all_upfront
+us-east-1,m5.large,0.1,0.06,438
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := map[string][]float64{
+		"us-east-1/m5": {8, 8, 8, 8, 8, 16, 16, 16, 16, 16},
+		"us-east-1/c5": {4, 4},
+		"eu-west-1/m5": {2, 2},
+	}
+	types := instanceTypesOf([]postgres.InstanceUsage{
+		{Az: "us-east-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal", Units: 4, Hours: 100},
+		{Az: "us-east-1a", Family: "m5", InstanceType: "m5.xlarge", Lifecycle: "normal", Units: 8, Hours: 10},
+		{Az: "us-east-1a", Family: "m5", InstanceType: "m5.2xlarge", Lifecycle: "spot", Units: 16, Hours: 100},
+		{Az: "us-east-1b", Family: "c5", InstanceType: "c5.large", Lifecycle: "normal", Units: 4, Hours: 10},
+		{Az: "eu-west-1a", Family: "m5", InstanceType: "m5.large", Lifecycle: "normal", Units: 4, Hours: 10},
+	})
+	// the only m5 reservation expires within the horizon, so it doesn't cover the baseline
+	now := time.Now()
+	reservations := []models.Reservations{
+		{Region: "us-east-1", Family: "m5", Count: 1, Units: 4, EndDate: now.AddDate(0, 1, 0)},
+	}
+
+	recommendations, unpriced := recommend(RecommendOptions{Percentile: 50, Class: "standard", Term: "1yr"},
+		usage, types, reservations, now.AddDate(0, 3, 0), catalog)
+
+	if len(unpriced) != 1 || unpriced[0] != "us-east-1/c5.large" {
+		t.Errorf("unpriced = %v, want [us-east-1/c5.large]", unpriced)
+	}
+	if len(recommendations) != 1 {
+		t.Fatalf("recommendations = %+v, want one for us-east-1/m5", recommendations)
+	}
+	r := recommendations[0]
+	if r.InstanceType != "m5.large" || r.BaselineUnits != 8 || r.ReservedUnits != 4 || r.ExpiringUnits != 4 ||
+		r.GapUnits != 8 || r.Count != 2 {
+		t.Errorf("recommendation = %+v, want 2 m5.large covering 8 units", r)
+	}
+	if r.Offer.String() != "standard_1yr_all" || !closeTo(r.Upfront, 876) || r.Hourly != 0 {
+		t.Errorf("offer = %s, upfront %v, hourly %v, want standard_1yr_all for 876 upfront", r.Offer, r.Upfront, r.Hourly)
+	}
+	if !closeTo(r.MonthlySavings, 73) || !closeTo(r.TermSavings, 876) || !closeTo(r.BreakEvenMonths, 6) {
+		t.Errorf("savings = %v monthly, %v over the term, break even in %v months, want 73, 876 and 6",
+			r.MonthlySavings, r.TermSavings, r.BreakEvenMonths)
+	}
+}
@@ -0,0 +1,244 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/google/uuid"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// minHoldingDays reservations can be listed on the marketplace only after being held for this long
+const minHoldingDays = 30
+
+// ResaleOptions parameters of the resale advisor
+type ResaleOptions struct {
+	// Days of usage history utilization is computed from
+	Days int
+	// Threshold utilization below which reservations of a region and family are considered for resale
+	Threshold float64
+	// Percentile of the hourly usage which is kept reserved, the rest is considered for resale
+	Percentile float64
+	// Discount off the remaining value, to make listings competitive
+	Discount float64
+}
+
+// DefaultResaleOptions used unless set otherwise
+var DefaultResaleOptions = ResaleOptions{Days: 30, Threshold: 0.5, Percentile: 90}
+
+// ResaleCandidate a standard reservation suggested for listing on the marketplace
+// prices and values are in dollars per instance
+type ResaleCandidate struct {
+	ReservationID  uuid.UUID            `json:"reservation_id"`
+	Region         string               `json:"region"`
+	Family         string               `json:"family"`
+	InstanceType   string               `json:"instance_type"`
+	Count          uint16               `json:"count"`
+	CountToList    int                  `json:"count_to_list"`
+	EndDate        time.Time            `json:"end_date"`
+	MonthsLeft     int                  `json:"months_left"`
+	UpfrontPrice   float64              `json:"upfront_price"`
+	RemainingValue float64              `json:"remaining_value"`
+	Utilization    float64              `json:"utilization"`
+	PriceSchedules []*ec2.PriceSchedule `json:"price_schedules"`
+}
+
+// ResaleAdvice reservations suggested for resale, out of their utilization between From and To
+type ResaleAdvice struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Threshold  float64           `json:"threshold"`
+	Candidates []ResaleCandidate `json:"candidates"`
+}
+
+// Validate checks options are within range
+func (o ResaleOptions) Validate() error {
+	if o.Days < 1 {
+		return fmt.Errorf("days must be positive")
+	}
+	if o.Threshold <= 0 || o.Threshold > 1 {
+		return fmt.Errorf("threshold must be between 0 and 1")
+	}
+	if o.Percentile <= 0 || o.Percentile > 100 {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+	if o.Discount < 0 || o.Discount >= 1 {
+		return fmt.Errorf("discount must be between 0 and 1")
+	}
+	return nil
+}
+
+// termMonths returns the number of months in the term of a reservation
+func termMonths(durationSeconds int32) int {
+	return int(math.Round(float64(durationSeconds) / (365 * 24 * 3600) * 12))
+}
+
+// priceSchedules returns a price per month left, amortising the upfront price over the term
+func priceSchedules(upfront float64, term int, monthsLeft int, discount float64) []*ec2.PriceSchedule {
+	var schedules []*ec2.PriceSchedule
+	for month := monthsLeft; month >= 1; month-- {
+		price := math.Round(upfront*float64(month)/float64(term)*(1-discount)*100) / 100
+		schedules = append(schedules, &ec2.PriceSchedule{
+			Active:       aws.Bool(month == monthsLeft),
+			CurrencyCode: aws.String(ec2.CurrencyCodeValuesUsd),
+			Price:        aws.Float64(price),
+			Term:         aws.Int64(int64(month)),
+		})
+	}
+	return schedules
+}
+
+// GetResaleAdvice suggests standard reservations to list on the marketplace
+// utilization of every region and family is the hourly on-demand usage out of the units reserved,
+// when it is below the threshold, units reserved above the usage percentile are suggested for resale,
+// starting with the reservations having the most months left. nothing is ever written to AWS
+// its queries are cancelled along with ctx
+func GetResaleAdvice(ctx context.Context, options ResaleOptions) (*ResaleAdvice, error) {
+	now := time.Now().UTC()
+	to := now.Truncate(time.Hour)
+	from := to.AddDate(0, 0, -options.Days)
+
+	usage, err := hourlyUsage(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := postgres.SelectActiveReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching reservations: %v", err)
+	}
+	listings, err := postgres.SelectActiveListings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching listings: %v", err)
+	}
+	activeListings := map[uuid.UUID]bool{}
+	for _, l := range listings {
+		activeListings[l.ListingID] = true
+	}
+
+	advice := &ResaleAdvice{From: from, To: to, Threshold: options.Threshold}
+	advice.Candidates = resaleCandidates(options, usage, int(to.Sub(from).Hours())+1, reservations, activeListings, now)
+	return advice, nil
+}
+
+// resaleCandidates returns the reservations to list out of the usage of hours, leaving out the reservations
+// listed on activeListings
+func resaleCandidates(options ResaleOptions, usage map[string][]float64, hours int,
+	reservations []models.Reservations, activeListings map[uuid.UUID]bool, now time.Time) []ResaleCandidate {
+
+	reserved := map[string]float64{}
+	for _, r := range reservations {
+		reserved[usageKey(r.Region, r.Family)] += float64(r.Count) * float64(r.Units)
+	}
+
+	// units to sell, by region/family
+	excess := map[string]float64{}
+	utilization := map[string]float64{}
+	for key := range reserved {
+		values := usage[key]
+		if reserved[key] <= 0 {
+			continue
+		} else if values == nil {
+			values = make([]float64, hours)
+		}
+		used := 0.0
+		for _, v := range values {
+			used += math.Min(v, reserved[key])
+		}
+		utilization[key] = used / (reserved[key] * float64(hours))
+		if utilization[key] < options.Threshold {
+			excess[key] = reserved[key] - percentile(values, options.Percentile)
+		}
+	}
+
+	// reservations with the most months left first
+	sort.SliceStable(reservations, func(i, j int) bool {
+		return reservations[i].EndDate.After(reservations[j].EndDate)
+	})
+	candidates := []ResaleCandidate{}
+	for _, r := range reservations {
+		key := usageKey(r.Region, r.Family)
+		if excess[key] <= 0 || r.OfferClass != "standard" || r.UpfrontPrice == 0 || r.Units <= 0 ||
+			now.Sub(r.StartDate) < minHoldingDays*24*time.Hour {
+			continue
+		}
+		listed := false
+		for _, listingID := range r.ListedOn {
+			listed = listed || activeListings[listingID]
+		}
+		monthsLeft := int(r.EndDate.Sub(now).Hours() / hoursPerMonth)
+		term := termMonths(r.Duration)
+		if listed || monthsLeft < 1 || term < 1 {
+			continue
+		}
+		count := int(math.Min(float64(r.Count), math.Floor(excess[key]/float64(r.Units))))
+		if count < 1 {
+			continue
+		}
+		excess[key] -= float64(count) * float64(r.Units)
+
+		upfront := float64(r.UpfrontPrice) / 1e9
+		candidates = append(candidates, ResaleCandidate{
+			ReservationID:  r.ReservationID,
+			Region:         r.Region,
+			Family:         r.Family,
+			InstanceType:   r.InstanceType,
+			Count:          r.Count,
+			CountToList:    count,
+			EndDate:        r.EndDate,
+			MonthsLeft:     monthsLeft,
+			UpfrontPrice:   upfront,
+			RemainingValue: upfront * float64(monthsLeft) / float64(term),
+			Utilization:    utilization[key],
+			PriceSchedules: priceSchedules(upfront, term, monthsLeft, options.Discount),
+		})
+	}
+	return candidates
+}
+
+// WriteJSON writes the advice as JSON
+func (a *ResaleAdvice) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(a)
+}
+
+// WriteMarkdown writes the advice as a Markdown table, price schedules are listed as term:price
+func (a *ResaleAdvice) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Marketplace resale advice\n\nUtilization between %s and %s, below %.0f%%\n\n",
+		a.From.Format("2006-01-02"), a.To.Format("2006-01-02"), a.Threshold*100)
+	b.WriteString("| Reservation | Region | Instance type | List | Months left | Utilization | Remaining value | Price schedule |\n")
+	b.WriteString("|---|---|---|---:|---:|---:|---:|---|\n")
+	for _, c := range a.Candidates {
+		var schedule []string
+		for _, s := range c.PriceSchedules {
+			schedule = append(schedule, fmt.Sprintf("%d:%s", *s.Term, formatCost(*s.Price)))
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %d of %d | %d | %.0f%% | %s | %s |\n",
+			c.ReservationID, c.Region, c.InstanceType, c.CountToList, c.Count, c.MonthsLeft,
+			c.Utilization*100, formatCost(c.RemainingValue), strings.Join(schedule, " "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write writes the advice in format, either "json" or "markdown"
+func (a *ResaleAdvice) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		return a.WriteJSON(w)
+	case "markdown", "md":
+		return a.WriteMarkdown(w)
+	}
+	return fmt.Errorf("unsupported resale format %q, expected json or markdown", format)
+}
@@ -0,0 +1,87 @@
+package reports
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+)
+
+func TestResaleOptionsValidate(t *testing.T) {
+	if err := DefaultResaleOptions.Validate(); err != nil {
+		t.Errorf("default options are invalid: %v", err)
+	}
+	for _, options := range []ResaleOptions{
+		{Days: 0, Threshold: 0.5, Percentile: 90},
+		{Days: 30, Threshold: 1.5, Percentile: 90},
+		{Days: 30, Threshold: 0.5, Percentile: 0},
+		{Days: 30, Threshold: 0.5, Percentile: 90, Discount: 1},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("options %+v should be invalid", options)
+		}
+	}
+}
+
+func TestPriceSchedules(t *testing.T) {
+	schedules := priceSchedules(1200, 12, 3, 0.1)
+	expected := []float64{270, 180, 90}
+	if len(schedules) != len(expected) {
+		t.Fatalf("%d schedules, want %d", len(schedules), len(expected))
+	}
+	for i, s := range schedules {
+		if *s.Price != expected[i] || *s.Term != int64(3-i) || *s.Active != (i == 0) {
+			t.Errorf("schedule %d = %v", i, s)
+		}
+	}
+}
+
+func TestResaleCandidates(t *testing.T) {
+	now := time.Now().UTC()
+	year := int32(365 * 24 * 3600)
+	listing := uuid.New()
+	reservation := func(class string, count uint16, started time.Duration, ends time.Duration) models.Reservations {
+		return models.Reservations{ReservationID: uuid.New(), Region: "us-east-1", Family: "m5", InstanceType: "m5.large",
+			OfferClass: class, Count: count, Units: 4, Duration: year, UpfrontPrice: 1200e9,
+			StartDate: now.Add(-started), EndDate: now.Add(ends)}
+	}
+	day := 24 * time.Hour
+	candidate := reservation("standard", 8, 60*day, 200*day)
+	listed := reservation("standard", 1, 60*day, 300*day)
+	listed.ListedOn = []uuid.UUID{listing}
+	reservations := []models.Reservations{
+		reservation("convertible", 2, 60*day, 100*day),
+		candidate,
+		listed,
+		// held for less than the marketplace minimum
+		reservation("standard", 1, 10*day, 400*day),
+		{ReservationID: uuid.New(), Region: "eu-west-1", Family: "c5", OfferClass: "standard", Count: 1, Units: 4,
+			Duration: year, UpfrontPrice: 500e9, StartDate: now.Add(-60 * day), EndDate: now.Add(100 * day)},
+	}
+	usage := map[string][]float64{"us-east-1/m5": make([]float64, 10), "eu-west-1/c5": make([]float64, 10)}
+	for i := range usage["us-east-1/m5"] {
+		usage["us-east-1/m5"][i] = 20
+		usage["eu-west-1/c5"][i] = 4
+	}
+
+	// 48 units are reserved in us-east-1 for 20 used, 28 are in excess
+	candidates := resaleCandidates(ResaleOptions{Days: 1, Threshold: 0.5, Percentile: 90, Discount: 0.1},
+		usage, 10, reservations, map[uuid.UUID]bool{listing: true}, now)
+
+	if len(candidates) != 1 {
+		t.Fatalf("candidates = %+v, want the standard reservation only", candidates)
+	}
+	c := candidates[0]
+	if c.ReservationID != candidate.ReservationID || c.CountToList != 7 || c.MonthsLeft != 6 {
+		t.Errorf("candidate = %+v, want 7 of the reservation having 6 months left", c)
+	}
+	if !closeTo(c.Utilization, 200.0/480) || !closeTo(c.UpfrontPrice, 1200) || !closeTo(c.RemainingValue, 600) {
+		t.Errorf("utilization %v, upfront %v, remaining value %v, want %v, 1200 and 600",
+			c.Utilization, c.UpfrontPrice, c.RemainingValue, 200.0/480)
+	}
+	if len(c.PriceSchedules) != 6 || *c.PriceSchedules[0].Price != 540 {
+		t.Errorf("price schedules = %v, want 6 starting at 540", c.PriceSchedules)
+	}
+}
@@ -0,0 +1,100 @@
+package reports
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// hoursPerMonth average number of hours in a month
+const hoursPerMonth = 730
+
+// usageKey identifies a region and family
+func usageKey(region string, family string) string {
+	return region + "/" + family
+}
+
+// percentile returns the p percentile of values, sorting them
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	i := int(math.Ceil(p/100*float64(len(values)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return values[i]
+}
+
+// hourlyUsage returns the normalization units of on-demand instances running every hour between from
+// and to, by region/family, hours nothing was running on are zero
+func hourlyUsage(ctx context.Context, from time.Time, to time.Time) (map[string][]float64, error) {
+	hourly, err := postgres.SelectHourlyUsage(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching hourly usage: %v", err)
+	}
+	return hourlyUnits(hourly, from, to), nil
+}
+
+// hourlyUnits returns the units of every hour between from and to, by region/family
+func hourlyUnits(hourly []postgres.HourlyUsage, from time.Time, to time.Time) map[string][]float64 {
+	hours := int(to.Sub(from).Hours()) + 1
+	usage := map[string][]float64{}
+	for _, u := range hourly {
+		key := usageKey(u.Region, u.Family)
+		if _, ok := usage[key]; !ok {
+			usage[key] = make([]float64, hours)
+		}
+		if i := int(u.Hour.Sub(from).Hours()); i >= 0 && i < hours {
+			usage[key][i] = u.Units
+		}
+	}
+	return usage
+}
+
+// instanceTypes holds the on-demand instance type of every region/family which ran the most
+// unit hours, and the units of every instance type
+type instanceTypes struct {
+	top   map[string]string
+	units map[string]float64
+}
+
+// topInstanceTypes returns the on-demand instance types which ran the most between from and to
+func topInstanceTypes(ctx context.Context, from time.Time, to time.Time) (*instanceTypes, error) {
+	instances, err := postgres.SelectInstancesUsage(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching instances usage: %v", err)
+	}
+	return instanceTypesOf(instances), nil
+}
+
+// instanceTypesOf returns the on-demand instance types which ran the most unit hours out of instances
+func instanceTypesOf(instances []postgres.InstanceUsage) *instanceTypes {
+	unitHours := map[string]map[string]float64{}
+	types := &instanceTypes{top: map[string]string{}, units: map[string]float64{}}
+	for _, i := range instances {
+		if i.Lifecycle != "normal" {
+			continue
+		}
+		key := usageKey(regionOf(i.Az), i.Family)
+		if unitHours[key] == nil {
+			unitHours[key] = map[string]float64{}
+		}
+		unitHours[key][i.InstanceType] += i.Units * i.Hours
+		types.units[i.InstanceType] = i.Units
+	}
+	for key, byType := range unitHours {
+		for instanceType, hours := range byType {
+			top := types.top[key]
+			if top == "" || hours > byType[top] || (hours == byType[top] && instanceType < top) {
+				types.top[key] = instanceType
+			}
+		}
+	}
+	return types
+}
@@ -1,57 +1,174 @@
 package sqlmigrations
 
 import (
-	"fmt"
-	"strings"
-
 	"github.com/go-pg/migrations"
-	funk "github.com/thoas/go-funk"
-
-	"github.com/EladDolev/aws_audit_exporter/debug"
-	"github.com/EladDolev/aws_audit_exporter/models"
+	log "github.com/sirupsen/logrus"
 )
 
+// initialSchema the schema as first created from the models, frozen at the time it was released
+var initialSchema = []string{
+	// custom enum types
+	`CREATE TYPE instance_lifecycle AS ENUM ('normal', 'spot')`,
+	`CREATE TYPE instance_state AS ENUM ('pending', 'running', 'shutting-down', 'rebooting',
+		'terminated', 'stopping', 'stopped')`,
+	`CREATE TYPE reservation_listing_state AS ENUM ('available', 'cancelled', 'pending', 'sold')`,
+	`CREATE TYPE reservation_listing_status AS ENUM ('active', 'cancelled', 'closed', 'pending')`,
+	`CREATE TYPE reservation_offer_class AS ENUM ('convertible', 'scheduled', 'standard')`,
+	`CREATE TYPE reservation_offer_type AS ENUM ('All Upfront', 'No Upfront', 'Partial Upfront')`,
+	`CREATE TYPE reservation_scope AS ENUM ('Availability Zone', 'Region')`,
+	`CREATE TYPE reservation_state AS ENUM ('active', 'payment-failed', 'payment-pending', 'retired')`,
+	`CREATE TYPE reservation_tenancy AS ENUM ('dedicated', 'default')`,
+	`CREATE TYPE spot_product AS ENUM ('Linux/UNIX', 'Linux/UNIX (Amazon VPC)', 'Windows',
+		'Windows (Amazon VPC)', 'SUSE Linux', 'SUSE Linux (Amazon VPC)',
+		'Red Hat Enterprise Linux', 'Red Hat Enterprise Linux (Amazon VPC)')`,
+
+	// instances
+	`CREATE TABLE "instances" ("instance_id" varchar(25), "az" varchar(15) NOT NULL,
+		"created_at" timestamptz NOT NULL DEFAULT now(), "family" varchar(4) NOT NULL,
+		"instance_type" varchar(13) NOT NULL, "launch_time" timestamptz NOT NULL,
+		"lifecycle" instance_lifecycle NOT NULL, "owner_id" bigint NOT NULL,
+		"requester_id" bigint NOT NULL, "state" instance_state NOT NULL, "units" real NOT NULL,
+		"updated_at" timestamptz NOT NULL DEFAULT now(), "groups" text, "tags" hstore,
+		PRIMARY KEY ("instance_id"))`,
+	`CREATE INDEX idx_instances_az ON instances (az)`,
+	`CREATE INDEX idx_instances_family ON instances (family)`,
+	`CREATE INDEX idx_instances_instance_type ON instances (instance_type)`,
+	`CREATE INDEX idx_instances_lifecycle ON instances (lifecycle)`,
+	`CREATE INDEX idx_instances_state ON instances (state)`,
+	`CREATE INDEX idx_instances_tags ON instances USING HASH (tags)`,
+	`ALTER TABLE instances ADD CONSTRAINT check_instances_times CHECK (launch_time >= '2006-08-25'
+		AND created_at >= launch_time
+		AND updated_at >= created_at)`,
+	`ALTER TABLE instances ADD CONSTRAINT check_instances_type_match_family CHECK (
+		substring(instance_type from '(.+)\..+') = family)`,
+
+	// instances_uptime
+	`CREATE TABLE instances_uptime ("instance_id" varchar(25), "launch_time" timestamptz NOT NULL,
+		"state" instance_state, "created_at" timestamptz NOT NULL DEFAULT now(),
+		"updated_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("instance_id", "launch_time", "state"))`,
+	`CREATE INDEX idx_instances_uptime_launch_time ON instances_uptime (launch_time)`,
+	`CREATE INDEX idx_instances_uptime_updated_at ON instances_uptime (updated_at)`,
+	`ALTER TABLE instances_uptime ADD CONSTRAINT check_instances_uptime_times CHECK (
+		launch_time >= '2006-08-25'
+		AND created_at >= launch_time
+		AND updated_at >= created_at)`,
+	`ALTER TABLE instances_uptime ADD CONSTRAINT fk_instances_uptime_instance_id FOREIGN KEY (instance_id)
+		REFERENCES instances(instance_id) ON DELETE RESTRICT`,
+
+	// reservations_listings
+	`CREATE TABLE "reservations_listings" ("listing_id" uuid, "state" reservation_listing_state,
+		"az" varchar(15), "count" integer NOT NULL, "created_at" timestamptz NOT NULL DEFAULT now(),
+		"family" varchar(4) NOT NULL, "instance_type" varchar(13) NOT NULL,
+		"product" varchar(37) NOT NULL, "published_date" timestamptz NOT NULL,
+		"region" varchar(14) NOT NULL, "scope" reservation_scope NOT NULL,
+		"status" reservation_listing_status NOT NULL, "status_message" text, "units" real NOT NULL,
+		"updated_at" timestamptz NOT NULL DEFAULT now(), PRIMARY KEY ("listing_id", "state"))`,
+	`CREATE INDEX idx_reservations_listings_az ON reservations_listings (az)`,
+	`CREATE INDEX idx_reservations_listings_published_date ON reservations_listings (published_date)`,
+	`CREATE INDEX idx_reservations_listings_family ON reservations_listings (family)`,
+	`CREATE INDEX idx_reservations_listings_region ON reservations_listings (region)`,
+	`CREATE INDEX idx_reservations_listings_state ON reservations_listings (state)`,
+	`CREATE INDEX idx_reservations_listings_status ON reservations_listings (status)`,
+	`ALTER TABLE reservations_listings ADD CONSTRAINT check_reservations_listings_dates CHECK (
+		published_date >= '2009-03-12'
+		AND updated_at >= created_at
+		AND created_at >= published_date)`,
+	`ALTER TABLE reservations_listings ADD CONSTRAINT check_reservations_listings_type_match_family CHECK (
+		substring(instance_type from '(.+)\..+') = family)`,
+
+	// reservations
+	`CREATE TABLE "reservations" ("reservation_id" uuid, "az" varchar(15),
+		"canceled" boolean NOT NULL DEFAULT false, "converted" boolean NOT NULL DEFAULT false,
+		"count" integer NOT NULL, "created_at" timestamptz NOT NULL DEFAULT now(),
+		"duration" integer NOT NULL, "effective_price" bigint NOT NULL,
+		"end_date" timestamptz NOT NULL, "family" varchar(4) NOT NULL,
+		"instance_type" varchar(13) NOT NULL, "listed_on" uuid[],
+		"offer_class" reservation_offer_class NOT NULL, "offer_type" reservation_offer_type NOT NULL,
+		"original_end_date" timestamptz NOT NULL, "product" varchar(37) NOT NULL,
+		"recurring_charges" bigint NOT NULL, "region" varchar(14) NOT NULL,
+		"scope" reservation_scope NOT NULL, "sell_splitted" boolean NOT NULL DEFAULT false,
+		"sold" boolean NOT NULL DEFAULT false, "start_date" timestamptz NOT NULL,
+		"state" reservation_state NOT NULL, "tenancy" reservation_tenancy NOT NULL,
+		"units" real NOT NULL, "updated_at" timestamptz NOT NULL DEFAULT now(),
+		"upfront_price" bigint NOT NULL, PRIMARY KEY ("reservation_id"))`,
+	`CREATE INDEX idx_reservations_az ON reservations (az)`,
+	`CREATE INDEX idx_reservations_end_date ON reservations (end_date)`,
+	`CREATE INDEX idx_reservations_family ON reservations (family)`,
+	`CREATE INDEX idx_reservations_region ON reservations (region)`,
+	`CREATE INDEX idx_reservations_start_date ON reservations (start_date)`,
+	`ALTER TABLE reservations ADD CONSTRAINT check_reservations_az CHECK (az != NULL
+		OR scope = 'Region')`,
+	`ALTER TABLE reservations ADD CONSTRAINT check_reservations_dates CHECK (start_date >= '2009-03-12'
+		AND end_date <= start_date + interval '3 years'
+		AND end_date >= start_date
+		AND updated_at >= created_at
+		AND created_at >= start_date
+		AND duration <= 94608000)`,
+	`ALTER TABLE reservations ADD CONSTRAINT check_reservations_recurring_charges CHECK (
+		recurring_charges > 0
+		OR offer_type = 'All Upfront')`,
+	`ALTER TABLE reservations ADD CONSTRAINT check_reservations_type_match_family CHECK (
+		substring(instance_type from '(.+)\..+') = family)`,
+
+	// reservations_listings_terms
+	`CREATE TABLE "reservations_listings_terms" ("listing_id" uuid, "start_date" timestamptz,
+		"created_at" timestamptz NOT NULL DEFAULT now(), "end_date" timestamptz NOT NULL,
+		"updated_at" timestamptz NOT NULL DEFAULT now(), "upfront_price" bigint NOT NULL,
+		PRIMARY KEY ("listing_id", "start_date"))`,
+	`CREATE INDEX idx_reservations_listings_terms_end_date ON reservations_listings_terms (end_date)`,
+	`ALTER TABLE reservations_listings_terms ADD CONSTRAINT check_reservations_listings_terms_dates CHECK (
+		start_date >= '2012-09-12'
+		AND updated_at >= created_at
+		AND end_date > start_date
+		AND end_date <= now() + interval '3 years')`,
+	`ALTER TABLE reservations_listings_terms ADD CONSTRAINT check_reservations_listings_terms_term_length CHECK (
+		end_date <= start_date + interval '31 days')`,
+
+	// reservations_relations
+	`CREATE TABLE "reservations_relations" ("parent_id" uuid, "reservation_id" uuid,
+		"created_at" timestamptz NOT NULL DEFAULT now(), "updated_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("parent_id", "reservation_id"))`,
+	`ALTER TABLE reservations_relations ADD CONSTRAINT fk_reservations_relations_reservation_id
+		FOREIGN KEY (reservation_id) REFERENCES reservations(reservation_id) ON DELETE RESTRICT`,
+	`ALTER TABLE reservations_relations ADD CONSTRAINT fk_reservations_relations_parent_id
+		FOREIGN KEY (parent_id) REFERENCES reservations(reservation_id) ON DELETE RESTRICT`,
+
+	// reservations_sell_events
+	`CREATE TABLE "reservations_sell_events" ("reservation_id" uuid,
+		"created_at" timestamptz NOT NULL DEFAULT now(), "listing_id" uuid,
+		"sold_date" timestamptz NOT NULL, "units_sold" integer NOT NULL,
+		"updated_at" timestamptz NOT NULL DEFAULT now(), PRIMARY KEY ("reservation_id"))`,
+	`CREATE INDEX idx_reservations_sell_events_listing_id ON reservations_sell_events (listing_id)`,
+	`CREATE INDEX idx_reservations_sell_events_sold_date ON reservations_sell_events (sold_date)`,
+	`ALTER TABLE reservations_sell_events ADD CONSTRAINT check_reservations_sell_events_dates CHECK (
+		sold_date >= '2012-09-12'
+		AND created_at > sold_date
+		AND updated_at >= created_at)`,
+	`ALTER TABLE reservations_sell_events ADD CONSTRAINT check_reservations_sell_events_units_sold CHECK (
+		units_sold > 0)`,
+	`ALTER TABLE reservations_sell_events ADD CONSTRAINT fk_reservations_sell_events_reservation_id
+		FOREIGN KEY (reservation_id) REFERENCES reservations(reservation_id) ON DELETE RESTRICT`,
+
+	// spot_prices
+	`CREATE TABLE spot_prices ("az" varchar(15), "created_at" timestamptz DEFAULT now(),
+		"instance_type" varchar(13), "product" spot_product, "family" varchar(4) NOT NULL,
+		"recurring_charges" bigint NOT NULL, "updated_at" timestamptz NOT NULL DEFAULT now(),
+		"units" real NOT NULL, PRIMARY KEY ("az", "created_at", "instance_type", "product"))`,
+	`CREATE INDEX idx_spot_prices_az ON spot_prices (az)`,
+	`CREATE INDEX idx_spot_prices_instance_type ON spot_prices (instance_type)`,
+	`ALTER TABLE spot_prices ADD CONSTRAINT check_spot_prices_times CHECK (
+		date_trunc('second', updated_at) = date_trunc('second', created_at))`,
+	`ALTER TABLE spot_prices ADD CONSTRAINT check_spot_prices_type_match_family CHECK (
+		substring(instance_type from '(.+)\..+') = family)`,
+}
+
 func init() {
 	// Do not look for SQL files
 	migrations.DefaultCollection.DisableSQLAutodiscover(true)
 
 	migrations.MustRegisterTx(func(db migrations.DB) error {
-		debug.Println("creating DB schema")
-		debug.Println("creating custom enum types")
-		if err := createEnums(db); err != nil {
-			return fmt.Errorf("Failed creating enums for database: %v", err)
-		}
-		for _, model := range billingTables {
-			debug.Println("creating table", model.GetTableName())
-			if err := db.Model(model).CreateTable(nil); err != nil {
-				return fmt.Errorf("Failed creating table %s: %v", model.GetTableName(), err)
-			}
-			if err := createIndexes(db, model); err != nil {
-				return fmt.Errorf("Failed creating indexes for table %s: %v",
-					model.GetTableName(), err)
-			}
-			if err := createChecks(db, model); err != nil {
-				return fmt.Errorf("Failed creating check constraints for table %s: %v",
-					model.GetTableName(), err)
-			}
-			if err := createForeignKeys(db, model); err != nil {
-				return fmt.Errorf("Failed creating foreign key constraints for table %s: %v",
-					model.GetTableName(), err)
-			}
-		}
-		return nil
-
-	}, func(db migrations.DB) error {
-
-		debug.Println("dropping all tables")
-		tables := funk.Map(billingTables, func(model models.BillingTable) string {
-			return model.GetTableName()
-		}).([]string)
-		sqlStatement := "DROP TABLE IF EXISTS " + strings.Join(tables, ",") + " CASCADE"
-		if _, err := db.ExecOne(sqlStatement); err != nil {
-			return err
-		}
-		debug.Println("destroying all enums")
-		return destroyEnums(db)
+		log.Debugln("creating DB schema")
+		return execStatements(db, initialSchema)
 	})
 }
@@ -0,0 +1,137 @@
+package sqlmigrations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-pg/migrations"
+	"github.com/go-pg/pg"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// partitionsAhead number of future monthly partitions created by the migration
+// the exporter keeps creating them from then on
+const partitionsAhead = 3
+
+var spotPricesDailySchema = []string{
+	`CREATE TABLE spot_prices_daily ("az" varchar(15), "day" date, "instance_type" varchar(13),
+		"product" spot_product, "avg_recurring_charges" bigint NOT NULL,
+		"created_at" timestamptz NOT NULL DEFAULT now(), "family" varchar(4) NOT NULL,
+		"max_recurring_charges" bigint NOT NULL, "min_recurring_charges" bigint NOT NULL,
+		"samples" bigint NOT NULL, "units" real NOT NULL,
+		"updated_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("az", "day", "instance_type", "product"))`,
+	`CREATE INDEX idx_spot_prices_daily_day ON spot_prices_daily (day)`,
+	`CREATE INDEX idx_spot_prices_daily_instance_type ON spot_prices_daily (instance_type)`,
+	`ALTER TABLE spot_prices_daily ADD CONSTRAINT check_spot_prices_daily_charges CHECK (
+		min_recurring_charges <= avg_recurring_charges
+		AND avg_recurring_charges <= max_recurring_charges)`,
+	`ALTER TABLE spot_prices_daily ADD CONSTRAINT check_spot_prices_daily_samples CHECK (samples > 0)`,
+	`ALTER TABLE spot_prices_daily ADD CONSTRAINT check_spot_prices_daily_type_match_family CHECK (
+		substring(instance_type from '(.+)\..+') = family)`,
+}
+
+// partitionedTable holds the statements replacing a regular table with a partitioned one
+type partitionedTable struct {
+	name string
+	// create creates the partitioned table, along with its default partition if any
+	create []string
+	// constraints are created after rows were copied, and the regular table was dropped
+	constraints []string
+}
+
+var partitionedTables = []partitionedTable{
+	{
+		name: "instances_uptime",
+		create: []string{
+			`CREATE TABLE instances_uptime ("instance_id" varchar(25),
+				"launch_time" timestamptz NOT NULL, "state" instance_state,
+				"created_at" timestamptz NOT NULL DEFAULT now(),
+				"updated_at" timestamptz NOT NULL DEFAULT now(),
+				PRIMARY KEY ("instance_id", "launch_time", "state")) PARTITION BY RANGE (launch_time)`,
+			// rows which are older than the oldest partition, when first seeing an instance
+			// that was launched long ago
+			`CREATE TABLE instances_uptime_default PARTITION OF instances_uptime DEFAULT`,
+		},
+		constraints: []string{
+			`CREATE INDEX idx_instances_uptime_launch_time ON instances_uptime (launch_time)`,
+			`CREATE INDEX idx_instances_uptime_updated_at ON instances_uptime (updated_at)`,
+			`ALTER TABLE instances_uptime ADD CONSTRAINT check_instances_uptime_times CHECK (
+				launch_time >= '2006-08-25'
+				AND created_at >= launch_time
+				AND updated_at >= created_at)`,
+			`ALTER TABLE instances_uptime ADD CONSTRAINT fk_instances_uptime_instance_id
+				FOREIGN KEY (instance_id) REFERENCES instances(instance_id) ON DELETE RESTRICT`,
+		},
+	},
+	{
+		name: "spot_prices",
+		create: []string{
+			`CREATE TABLE spot_prices ("az" varchar(15), "created_at" timestamptz DEFAULT now(),
+				"instance_type" varchar(13), "product" spot_product, "family" varchar(4) NOT NULL,
+				"recurring_charges" bigint NOT NULL, "updated_at" timestamptz NOT NULL DEFAULT now(),
+				"units" real NOT NULL,
+				PRIMARY KEY ("az", "created_at", "instance_type", "product")) PARTITION BY RANGE (created_at)`,
+		},
+		constraints: []string{
+			`CREATE INDEX idx_spot_prices_az ON spot_prices (az)`,
+			`CREATE INDEX idx_spot_prices_instance_type ON spot_prices (instance_type)`,
+			`ALTER TABLE spot_prices ADD CONSTRAINT check_spot_prices_times CHECK (
+				date_trunc('second', updated_at) = date_trunc('second', created_at))`,
+			`ALTER TABLE spot_prices ADD CONSTRAINT check_spot_prices_type_match_family CHECK (
+				substring(instance_type from '(.+)\..+') = family)`,
+		},
+	},
+}
+
+// partitionTable replaces a regular table with a partitioned one holding the same rows
+func partitionTable(db migrations.DB, table partitionedTable) error {
+	column := postgres.PartitionedTables[table.name]
+	oldTable := table.name + "_unpartitioned"
+
+	log.WithFields(log.Fields{"table": table.name, "column": column}).Debug("partitioning table")
+	if err := execStatements(db, []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", table.name, oldTable),
+		fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s_pkey TO %s_pkey", oldTable, table.name, oldTable),
+	}); err != nil {
+		return fmt.Errorf("Failed renaming table %s: %v", table.name, err)
+	}
+	if err := execStatements(db, table.create); err != nil {
+		return fmt.Errorf("Failed creating partitioned table %s: %v", table.name, err)
+	}
+	var oldest time.Time
+	if _, err := db.QueryOne(pg.Scan(&oldest), fmt.Sprintf(
+		"SELECT coalesce(min(%s), now()) FROM %s", column, oldTable)); err != nil {
+		return fmt.Errorf("Failed fetching oldest row of %s: %v", oldTable, err)
+	}
+	if err := postgres.CreateMonthlyPartitions(db, table.name, oldest, partitionsAhead); err != nil {
+		return err
+	}
+	if err := execStatements(db, []string{
+		fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", table.name, oldTable),
+		fmt.Sprintf("DROP TABLE %s", oldTable),
+	}); err != nil {
+		return fmt.Errorf("Failed moving rows into %s: %v", table.name, err)
+	}
+	if err := execStatements(db, table.constraints); err != nil {
+		return fmt.Errorf("Failed creating constraints for table %s: %v", table.name, err)
+	}
+	return nil
+}
+
+func init() {
+	migrations.MustRegisterTx(func(db migrations.DB) error {
+		log.Debugln("creating table spot_prices_daily")
+		if err := execStatements(db, spotPricesDailySchema); err != nil {
+			return fmt.Errorf("Failed creating table spot_prices_daily: %v", err)
+		}
+		for _, table := range partitionedTables {
+			if err := partitionTable(db, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
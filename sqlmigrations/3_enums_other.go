@@ -0,0 +1,31 @@
+package sqlmigrations
+
+import (
+	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// enumsOtherValues adds lifecycles AWS introduced since the initial schema, and an "other"
+// value to every enum, for values AWS returns which are still unknown
+// ALTER TYPE ... ADD VALUE can not run inside a transaction block, hence not registered with MustRegisterTx
+var enumsOtherValues = []string{
+	`ALTER TYPE instance_lifecycle ADD VALUE IF NOT EXISTS 'scheduled'`,
+	`ALTER TYPE instance_lifecycle ADD VALUE IF NOT EXISTS 'capacity-block'`,
+	`ALTER TYPE instance_lifecycle ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE instance_state ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_listing_state ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_listing_status ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_offer_class ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_offer_type ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_scope ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_state ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE reservation_tenancy ADD VALUE IF NOT EXISTS 'other'`,
+	`ALTER TYPE spot_product ADD VALUE IF NOT EXISTS 'other'`,
+}
+
+func init() {
+	migrations.MustRegister(func(db migrations.DB) error {
+		log.Debugln("adding \"other\" value to enums")
+		return execStatements(db, enumsOtherValues)
+	})
+}
@@ -0,0 +1,27 @@
+package sqlmigrations
+
+import (
+	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// relationsEvent records the event that created each reservations relation
+// existing relations are inferred: reservations sharing a listing were split by a sale, and the rest
+// were modified. exchanges of convertible reservations aren't reported along with modifications
+var relationsEvent = []string{
+	`CREATE TYPE reservation_relation_event AS ENUM ('modification', 'sell-split', 'other')`,
+	`ALTER TABLE reservations_relations ADD COLUMN "event" reservation_relation_event NOT NULL DEFAULT 'other'`,
+	`UPDATE reservations_relations r SET event = CASE
+			WHEN parent.listed_on && child.listed_on THEN 'sell-split'
+			ELSE 'modification'
+		END::reservation_relation_event
+		FROM reservations parent, reservations child
+		WHERE parent.reservation_id = r.parent_id AND child.reservation_id = r.reservation_id`,
+}
+
+func init() {
+	migrations.MustRegisterTx(func(db migrations.DB) error {
+		log.Debugln("adding event to reservations_relations")
+		return execStatements(db, relationsEvent)
+	})
+}
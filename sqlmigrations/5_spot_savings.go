@@ -0,0 +1,29 @@
+package sqlmigrations
+
+import (
+	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// spotSavingsSchema holds the cumulative savings of spot instances compared to on-demand,
+// in billionths of a dollar, so the savings counter survives restarts
+var spotSavingsSchema = []string{
+	`CREATE TABLE "spot_savings" ("instance_id" varchar(25), "az" varchar(15) NOT NULL,
+		"created_at" timestamptz NOT NULL DEFAULT now(), "family" varchar(4) NOT NULL,
+		"instance_type" varchar(13) NOT NULL, "product" spot_product NOT NULL,
+		"savings" bigint NOT NULL, "tags" hstore,
+		"updated_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("instance_id"))`,
+	`CREATE INDEX idx_spot_savings_family ON spot_savings (family)`,
+	`CREATE INDEX idx_spot_savings_instance_type ON spot_savings (instance_type)`,
+	`ALTER TABLE spot_savings ADD CONSTRAINT check_spot_savings_times CHECK (updated_at >= created_at)`,
+	`ALTER TABLE spot_savings ADD CONSTRAINT check_spot_savings_type_match_family CHECK (
+		substring(instance_type from '(.+)\..+') = family)`,
+}
+
+func init() {
+	migrations.MustRegisterTx(func(db migrations.DB) error {
+		log.Debugln("creating spot_savings")
+		return execStatements(db, spotSavingsSchema)
+	})
+}
@@ -0,0 +1,20 @@
+package sqlmigrations
+
+import (
+	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// instancesProduct records the spot product of every instance, its platform as spot prices are
+// published for, so that spot instances are charged back the prices of their own product
+// rows written before are left without a product
+var instancesProduct = []string{
+	`ALTER TABLE instances ADD COLUMN "product" spot_product`,
+}
+
+func init() {
+	migrations.MustRegisterTx(func(db migrations.DB) error {
+		log.Debugln("adding product to instances")
+		return execStatements(db, instancesProduct)
+	})
+}
@@ -0,0 +1,21 @@
+package sqlmigrations
+
+import (
+	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// spotAccounts records the account spot prices and savings were collected from, as the same
+// availability zone name maps to a different zone in every account
+// rows written before, or without accounts configured, are left with an empty account
+var spotAccounts = []string{
+	`ALTER TABLE spot_prices ADD COLUMN "account" varchar(64) NOT NULL DEFAULT ''`,
+	`ALTER TABLE spot_savings ADD COLUMN "account" varchar(64) NOT NULL DEFAULT ''`,
+}
+
+func init() {
+	migrations.MustRegisterTx(func(db migrations.DB) error {
+		log.Debugln("adding account to spot_prices and spot_savings")
+		return execStatements(db, spotAccounts)
+	})
+}
@@ -0,0 +1,22 @@
+package sqlmigrations
+
+import (
+	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// spotPricesDailyAccounts records the account spot prices were rolled up for, so that the prices of
+// availability zones of the same name in different accounts are aggregated apart
+// rows rolled up before are left with an empty account
+var spotPricesDailyAccounts = []string{
+	`ALTER TABLE spot_prices_daily ADD COLUMN "account" varchar(64) NOT NULL DEFAULT ''`,
+	`ALTER TABLE spot_prices_daily DROP CONSTRAINT spot_prices_daily_pkey`,
+	`ALTER TABLE spot_prices_daily ADD PRIMARY KEY ("account", "az", "day", "instance_type", "product")`,
+}
+
+func init() {
+	migrations.MustRegisterTx(func(db migrations.DB) error {
+		log.Debugln("adding account to spot_prices_daily")
+		return execStatements(db, spotPricesDailyAccounts)
+	})
+}
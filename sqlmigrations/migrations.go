@@ -2,16 +2,18 @@ package sqlmigrations
 
 import (
 	"fmt"
-	"log"
-	"regexp"
+	"os"
 	"strings"
 
 	"github.com/go-pg/migrations"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/EladDolev/aws_audit_exporter/models"
 	"github.com/EladDolev/aws_audit_exporter/postgres"
 )
 
+// billingTables tables the models expect to find in the database
+// schema changes are made by numbered migrations, this list is only used for reporting drift
 var billingTables = []models.BillingTable{
 	&models.Instances{},
 	&models.InstancesUptime{},
@@ -21,97 +23,45 @@ var billingTables = []models.BillingTable{
 	&models.ReservationsRelations{},
 	&models.ReservationsSellEvents{},
 	&models.SpotPrices{},
+	&models.SpotPricesDaily{},
+	&models.SpotSavings{},
 }
 
-var enums = models.Enums
-
-func createEnums(db migrations.DB) error {
-	for name, values := range enums {
-		sqlStatement := fmt.Sprintf("CREATE TYPE %s AS ENUM ('%s');",
-			name, strings.Join(values, "', '"))
-		if _, err := db.ExecOne(sqlStatement); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func destroyEnums(db migrations.DB) error {
-	for name := range enums {
-		sqlStatement := fmt.Sprintf("DROP TYPE IF EXISTS %s;", name)
-		if _, err := db.ExecOne(sqlStatement); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// createIndexes creates indexes for BillingTable
-// acts on a map of index suffix to command suffix
-// index prefix: "idx_%tableName%_"
-// command prefix: "CREATE INDEX %indexName% ON %tableName% "
-func createIndexes(db migrations.DB, model models.BillingTable) error {
-	for iSuffix, cSuffix := range *model.GetTableIndexes() {
-		sqlStatement := fmt.Sprintf("CREATE INDEX idx_%s_%s ON %s %s",
-			model.GetTableName(), iSuffix, model.GetTableName(), cSuffix)
-		if _, err := db.ExecOne(sqlStatement); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// createChecks creates check constraints for BillingTable
-// acts on a map of check name to check command
-func createChecks(db migrations.DB, model models.BillingTable) error {
-	for checkName, check := range *model.GetTableChecks() {
-		tabelName := model.GetTableName()
-		constraintName := fmt.Sprintf("check_%s_%s", tabelName, checkName)
-		sqlStatement := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s CHECK (%s)",
-			tabelName, constraintName, check)
-		if _, err := db.ExecOne(sqlStatement); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// createForeignKeys creates foreign key constraints for BillingTable
-// acts on a map of source columns tuple to destination table and columns tuple
-func createForeignKeys(db migrations.DB, model models.BillingTable) error {
-	for sourceColumns, destination := range *model.GetTableForeignKeys() {
-		tabelName := model.GetTableName()
-		constraintName := fmt.Sprintf("fk_%s_%s", tabelName, regexp.MustCompile(",").ReplaceAllString(sourceColumns, "_"))
-		sqlStatement := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s;",
-			tabelName, constraintName, sourceColumns, destination)
-		if _, err := db.ExecOne(sqlStatement); err != nil {
-			return err
+// execStatements executes SQL statements one after the other
+// migrations are written as a list of statements, frozen at the time they were written
+func execStatements(db migrations.DB, statements []string) error {
+	for _, sqlStatement := range statements {
+		if _, err := db.Exec(sqlStatement); err != nil {
+			return fmt.Errorf("%v: %s", err, sqlStatement)
 		}
 	}
 	return nil
 }
 
 // RunMigrations if necessary, runs migration on the DB, and/or creates initial schema
+// migrations are forward-only, "status" reports drift between the live schema and the models
 func RunMigrations(cmd string) error {
 
 	var oldVersion int64
 	var newVersion int64
 	var err error
 
-	if cmd == "" {
-		oldVersion, newVersion, err = migrations.Run(postgres.DB)
-	} else {
-		oldVersion, newVersion, err = migrations.Run(postgres.DB, cmd)
+	switch strings.SplitN(cmd, " ", 2)[0] {
+	case "down", "reset":
+		return fmt.Errorf("migrations are forward-only, %q is not supported", cmd)
+	case "status":
+		return PrintStatus(os.Stdout)
 	}
 
+	oldVersion, newVersion, err = migrations.Run(postgres.DB, strings.Fields(cmd)...)
 	if err != nil {
 		return err
 	}
 
 	if newVersion != oldVersion {
-		log.Printf("migrated schema from version %d to %d\n", oldVersion, newVersion)
+		log.WithFields(log.Fields{"from": oldVersion, "to": newVersion}).Info("migrated schema")
 	} else {
-		log.Println("schema version is", oldVersion)
+		log.WithField("version", oldVersion).Info("schema is up to date")
 	}
 
 	return nil
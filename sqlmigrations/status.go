@@ -0,0 +1,293 @@
+package sqlmigrations
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/migrations"
+	"github.com/go-pg/pg/orm"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+)
+
+// sqlTypeAliases maps go-pg SQL types to the way postgres formats them
+var sqlTypeAliases = map[string]string{
+	"timestamptz": "timestamp with time zone",
+	"varchar":     "character varying",
+}
+
+var sqlTypeRe = regexp.MustCompile(`^([a-z]+)(.*)$`)
+
+type liveColumn struct {
+	Name    string
+	SQLType string
+	NotNull bool
+}
+
+// normalizeSQLType converts a go-pg SQL type into postgres format_type() output
+func normalizeSQLType(sqlType string) string {
+	match := sqlTypeRe.FindStringSubmatch(sqlType)
+	if match == nil {
+		return sqlType
+	}
+	if alias, ok := sqlTypeAliases[match[1]]; ok {
+		return alias + match[2]
+	}
+	return sqlType
+}
+
+// columnsDrift compares live table columns with the columns of the model
+func columnsDrift(db orm.DB, model models.BillingTable) ([]string, error) {
+	tableName := model.GetTableName()
+	var columns []liveColumn
+	if _, err := db.Query(&columns, `SELECT a.attname AS name,
+			format_type(a.atttypid, a.atttypmod) AS sql_type, a.attnotnull AS not_null
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND c.relname = ? AND a.attnum > 0 AND NOT a.attisdropped`,
+		tableName); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return []string{fmt.Sprintf("table %s: missing", tableName)}, nil
+	}
+	live := map[string]liveColumn{}
+	for _, column := range columns {
+		live[column.Name] = column
+	}
+
+	var drift []string
+	table := orm.GetTable(reflect.TypeOf(model).Elem())
+	for _, field := range table.Fields {
+		column, ok := live[field.SQLName]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("table %s: missing column %s", tableName, field.SQLName))
+			continue
+		}
+		delete(live, field.SQLName)
+		if expected := normalizeSQLType(field.SQLType); expected != column.SQLType {
+			drift = append(drift, fmt.Sprintf("table %s: column %s is %s, models expect %s",
+				tableName, field.SQLName, column.SQLType, expected))
+		}
+		notNull := field.HasFlag(orm.NotNullFlag) || field.HasFlag(orm.PrimaryKeyFlag)
+		if notNull != column.NotNull {
+			drift = append(drift, fmt.Sprintf("table %s: column %s not null is %t, models expect %t",
+				tableName, field.SQLName, column.NotNull, notNull))
+		}
+	}
+	for name := range live {
+		drift = append(drift, fmt.Sprintf("table %s: unexpected column %s", tableName, name))
+	}
+	return drift, nil
+}
+
+// namesDrift compares names of live objects with expected ones
+func namesDrift(kind string, tableName string, live []string, expected []string) []string {
+	var drift []string
+	for _, name := range expected {
+		if !contains(live, name) {
+			drift = append(drift, fmt.Sprintf("table %s: missing %s %s", tableName, kind, name))
+		}
+	}
+	for _, name := range live {
+		if !contains(expected, name) {
+			drift = append(drift, fmt.Sprintf("table %s: unexpected %s %s", tableName, kind, name))
+		}
+	}
+	return drift
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// constraintsDrift compares live indexes, checks and foreign keys with the ones of the model
+func constraintsDrift(db orm.DB, model models.BillingTable) ([]string, error) {
+	tableName := model.GetTableName()
+
+	expectedIndexes := []string{tableName + "_pkey"}
+	for suffix := range *model.GetTableIndexes() {
+		expectedIndexes = append(expectedIndexes, fmt.Sprintf("idx_%s_%s", tableName, suffix))
+	}
+	var indexes []string
+	if _, err := db.Query(&indexes, `SELECT indexname FROM pg_indexes
+		WHERE schemaname = 'public' AND tablename = ?`, tableName); err != nil {
+		return nil, err
+	}
+
+	var expectedChecks []string
+	for name := range *model.GetTableChecks() {
+		expectedChecks = append(expectedChecks, fmt.Sprintf("check_%s_%s", tableName, name))
+	}
+	var checks []string
+	if _, err := db.Query(&checks, `SELECT con.conname FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		WHERE c.relname = ? AND con.contype = 'c'`, tableName); err != nil {
+		return nil, err
+	}
+
+	var expectedForeignKeys []string
+	for columns := range *model.GetTableForeignKeys() {
+		expectedForeignKeys = append(expectedForeignKeys,
+			fmt.Sprintf("fk_%s_%s", tableName, strings.Replace(columns, ",", "_", -1)))
+	}
+	var foreignKeys []string
+	if _, err := db.Query(&foreignKeys, `SELECT con.conname FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		WHERE c.relname = ? AND con.contype = 'f'`, tableName); err != nil {
+		return nil, err
+	}
+
+	drift := namesDrift("index", tableName, indexes, expectedIndexes)
+	drift = append(drift, namesDrift("check", tableName, checks, expectedChecks)...)
+	return append(drift, namesDrift("foreign key", tableName, foreignKeys, expectedForeignKeys)...), nil
+}
+
+type liveEnumValue struct {
+	TypeName string
+	Value    string
+}
+
+// enumsDrift compares live enum types with models.Enums, returning the drift, and the values added
+// to the enum types at runtime, by --add-unknown-enum-values, which are not drift
+func enumsDrift(db orm.DB) ([]string, []string, error) {
+	var values []liveEnumValue
+	if _, err := db.Query(&values, `SELECT t.typname AS type_name, e.enumlabel AS value
+		FROM pg_type t JOIN pg_enum e ON e.enumtypid = t.oid
+		ORDER BY t.typname, e.enumsortorder`); err != nil {
+		return nil, nil, err
+	}
+	live := map[string][]string{}
+	for _, value := range values {
+		live[value.TypeName] = append(live[value.TypeName], value.Value)
+	}
+	drift, added := compareEnums(live)
+	return drift, added, nil
+}
+
+// compareEnums compares the values of live enum types with models.Enums
+// values unknown to the models are added ones, postgres can't drop values from an enum type anyway
+func compareEnums(live map[string][]string) ([]string, []string) {
+	var drift, added []string
+	for name, expected := range models.Enums {
+		liveValues, ok := live[name]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("enum %s: missing", name))
+			continue
+		}
+		for _, value := range expected {
+			if !contains(liveValues, value) {
+				drift = append(drift, fmt.Sprintf("enum %s: missing value %q", name, value))
+			}
+		}
+		for _, value := range liveValues {
+			if !contains(expected, value) {
+				added = append(added, fmt.Sprintf("enum %s: value %q was added at runtime", name, value))
+			}
+		}
+	}
+	return drift, added
+}
+
+// tablesDrift reports tables which exist in the database but are unknown to the models
+func tablesDrift(db orm.DB) ([]string, error) {
+	var tables []string
+	if _, err := db.Query(&tables, `SELECT c.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND c.relkind IN ('r', 'p') AND NOT c.relispartition
+		AND c.relname != 'gopg_migrations'`); err != nil {
+		return nil, err
+	}
+	var expected []string
+	for _, model := range billingTables {
+		expected = append(expected, model.GetTableName())
+	}
+	var drift []string
+	for _, table := range tables {
+		if !contains(expected, table) {
+			drift = append(drift, fmt.Sprintf("table %s: unexpected", table))
+		}
+	}
+	return drift, nil
+}
+
+// SchemaDrift returns the differences between the live schema and what the models expect,
+// and the enum values added at runtime, which are informational
+func SchemaDrift(db orm.DB) ([]string, []string, error) {
+	drift, added, err := enumsDrift(db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed comparing enums: %v", err)
+	}
+	tables, err := tablesDrift(db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed comparing tables: %v", err)
+	}
+	drift = append(drift, tables...)
+	for _, model := range billingTables {
+		columns, err := columnsDrift(db, model)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed comparing columns of %s: %v", model.GetTableName(), err)
+		}
+		drift = append(drift, columns...)
+		constraints, err := constraintsDrift(db, model)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed comparing constraints of %s: %v", model.GetTableName(), err)
+		}
+		drift = append(drift, constraints...)
+	}
+	sort.Strings(drift)
+	sort.Strings(added)
+	return drift, added, nil
+}
+
+// SchemaVersion returns the version of the schema, and the version of the latest migration
+func SchemaVersion(db migrations.DB) (int64, int64, error) {
+	version, err := migrations.Version(db)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed getting schema version: %v", err)
+	}
+	latest := int64(0)
+	for _, m := range migrations.RegisteredMigrations() {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return version, latest, nil
+}
+
+// PrintStatus writes the schema version, any drift from the models and the enum values added at runtime to w
+// returns an error when drift was found
+func PrintStatus(w io.Writer) error {
+	version, latest, err := SchemaVersion(postgres.DB)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "schema version is %d, latest migration is %d\n", version, latest)
+
+	drift, added, err := SchemaDrift(postgres.DB)
+	if err != nil {
+		return err
+	}
+	for _, line := range added {
+		fmt.Fprintln(w, line)
+	}
+	if len(drift) == 0 {
+		fmt.Fprintln(w, "schema matches the models")
+		return nil
+	}
+	for _, line := range drift {
+		fmt.Fprintln(w, line)
+	}
+	return fmt.Errorf("found %d differences between the schema and the models", len(drift))
+}
@@ -0,0 +1,55 @@
+package sqlmigrations
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/EladDolev/aws_audit_exporter/models"
+)
+
+func TestNormalizeSQLType(t *testing.T) {
+	for sqlType, want := range map[string]string{
+		"varchar(64)":      "character varying(64)",
+		"timestamptz":      "timestamp with time zone",
+		"bigint":           "bigint",
+		"instance_state":   "instance_state",
+		"varchar(64)[]":    "character varying(64)[]",
+		"double precision": "double precision",
+	} {
+		if got := normalizeSQLType(sqlType); got != want {
+			t.Errorf("normalizeSQLType(%q) = %q, want %q", sqlType, got, want)
+		}
+	}
+}
+
+func TestNamesDrift(t *testing.T) {
+	drift := namesDrift("index", "reservations", []string{"reservations_pkey", "reservations_az_idx"},
+		[]string{"reservations_pkey", "reservations_type_idx"})
+	want := []string{
+		"table reservations: missing index reservations_type_idx",
+		"table reservations: unexpected index reservations_az_idx",
+	}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("namesDrift() = %v, want %v", drift, want)
+	}
+	if drift := namesDrift("check", "reservations", []string{"a"}, []string{"a"}); len(drift) != 0 {
+		t.Errorf("namesDrift() = %v, want no drift", drift)
+	}
+}
+
+func TestCompareEnums(t *testing.T) {
+	live := map[string][]string{}
+	for name, values := range models.Enums {
+		live[name] = append([]string{}, values...)
+	}
+	live["instance_state"] = append(live["instance_state"], "hibernating")
+	live["instance_lifecycle"] = live["instance_lifecycle"][1:]
+
+	drift, added := compareEnums(live)
+	if len(drift) != 1 || drift[0] != `enum instance_lifecycle: missing value "normal"` {
+		t.Errorf("drift = %v, want the missing value only", drift)
+	}
+	if len(added) != 1 || added[0] != `enum instance_state: value "hibernating" was added at runtime` {
+		t.Errorf("added = %v, want the value added at runtime", added)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/EladDolev/aws_audit_exporter/config"
+	"github.com/EladDolev/aws_audit_exporter/postgres"
+	"github.com/EladDolev/aws_audit_exporter/sqlmigrations"
+)
+
+// pingTimeout time the database has to answer readiness checks
+const pingTimeout = 5 * time.Second
+
+// minWedgedAfter a cycle in flight for longer than 3 intervals, and at least this long, is wedged
+const minWedgedAfter = 15 * time.Minute
+
+// collectorState the outcome of the cycles of a collector
+type collectorState struct {
+	Name     string
+	Interval time.Duration
+	// Running start of the cycle in flight, zero when idle
+	Running      time.Time
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	LastSuccess  time.Time
+	Cycles       int
+	Failures     int
+}
+
+// wedged whether the cycle in flight has been running for too long
+func (s *collectorState) wedged(now time.Time) bool {
+	wedgedAfter := 3 * s.Interval
+	if wedgedAfter < minWedgedAfter {
+		wedgedAfter = minWedgedAfter
+	}
+	return !s.Running.IsZero() && now.Sub(s.Running) > wedgedAfter
+}
+
+// collectorStatus keeps the state of a collector, updated by its cycles and read by the HTTP handlers
+type collectorStatus struct {
+	mutex sync.Mutex
+	state collectorState
+}
+
+// newCollectorStatus creates the status of a collector which has not run yet
+func newCollectorStatus(c collector) *collectorStatus {
+	return &collectorStatus{state: collectorState{Name: c.name, Interval: c.interval}}
+}
+
+// setInterval updates the interval of a collector reloaded with a new one
+func (s *collectorStatus) setInterval(interval time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state.Interval = interval
+}
+
+// start records the start of a cycle
+func (s *collectorStatus) start(start time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state.Running = start
+}
+
+// finish records the outcome of the cycle started at start
+func (s *collectorStatus) finish(start time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state.Running = time.Time{}
+	s.state.LastRun = start
+	s.state.LastDuration = time.Since(start)
+	s.state.Cycles++
+	if err != nil {
+		s.state.LastError = err.Error()
+		s.state.Failures++
+		return
+	}
+	s.state.LastError = ""
+	s.state.LastSuccess = time.Now()
+}
+
+// get returns a copy of the state
+func (s *collectorStatus) get() collectorState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// collectorsStates returns the states of the collectors of the running exporter, in their order
+func (r *reloader) collectorsStates() []collectorState {
+	e, _ := r.current()
+	var states []collectorState
+	for _, c := range e.collectors {
+		states = append(states, e.statuses[c.name].get())
+	}
+	return states
+}
+
+// healthz reports unhealthy while a collector is wedged in a cycle
+func (r *reloader) healthz(w http.ResponseWriter, req *http.Request) {
+	var problems []string
+	now := time.Now()
+	for _, s := range r.collectorsStates() {
+		if s.wedged(now) {
+			problems = append(problems, fmt.Sprintf("collector %s has been running since %s", s.Name, s.Running.Format(time.RFC3339)))
+		}
+	}
+	writeCheck(w, problems)
+}
+
+// readyz reports ready once every collector has completed a successful cycle, and the database,
+// when configured, is reachable, until shutdown
+func (r *reloader) readyz(w http.ResponseWriter, req *http.Request) {
+	r.exporterMutex.RLock()
+	shutdown := r.shutdown
+	r.exporterMutex.RUnlock()
+	if shutdown {
+		writeCheck(w, []string{"shutting down"})
+		return
+	}
+	var problems []string
+	for _, s := range r.collectorsStates() {
+		if s.LastSuccess.IsZero() {
+			problems = append(problems, fmt.Sprintf("collector %s has not completed a successful cycle yet", s.Name))
+		}
+	}
+	if _, cfg := r.current(); len(cfg.DBURL) > 0 {
+		if err := postgres.Ping(pingTimeout); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	writeCheck(w, problems)
+}
+
+// writeCheck responds with ok, or with the problems found and 503
+func writeCheck(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// configSummary settings of the configuration shown on the status page, db_url is left out
+// as it may hold credentials
+func configSummary(cfg *config.Config) [][2]string {
+	accounts := []string{}
+	for _, account := range cfg.Accounts {
+		accounts = append(accounts, account.Name)
+	}
+	collectors := []string{}
+	for name, c := range cfg.Collectors {
+		if c.IsEnabled() {
+			collectors = append(collectors, name)
+		}
+	}
+	sort.Strings(collectors)
+	limits := []string{}
+	for operation, limit := range cfg.APIRateLimits {
+		limits = append(limits, fmt.Sprintf("%s=%g", operation, limit))
+	}
+	sort.Strings(limits)
+	database := "not configured"
+	if len(cfg.DBURL) > 0 {
+		database = "configured"
+	}
+	return [][2]string{
+		{"addr", cfg.Addr},
+		{"database", database},
+		{"regions", strings.Join(cfg.Regions, ", ")},
+		{"accounts", strings.Join(accounts, ", ")},
+		{"collectors", strings.Join(collectors, ", ")},
+		{"instance tags", strings.Join(cfg.InstanceTags, ", ")},
+		{"spot OS", strings.Join(cfg.SpotOS, ", ")},
+		{"price catalog", cfg.PriceCatalog},
+		{"labels cache TTL", cfg.LabelsCacheTTL.Duration.String()},
+		{"OTLP endpoint", cfg.OTLP.Endpoint},
+		{"API rate limits", strings.Join(limits, ", ")},
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>AWS audit exporter status</title></head>
+<body>
+<h1>AWS audit exporter status</h1>
+<p>Up since {{time .Started}}, now {{time .Now}}</p>
+<h2>Collectors</h2>
+<table border="1" cellpadding="4">
+<tr><th>Collector</th><th>Interval</th><th>Running since</th><th>Last run</th><th>Duration</th><th>Last success</th><th>Cycles</th><th>Failures</th><th>Last error</th></tr>
+{{range .Collectors}}<tr><td>{{.Name}}</td><td>{{.Interval}}</td><td>{{if .Running.IsZero}}-{{else}}{{time .Running}}{{end}}</td><td>{{time .LastRun}}</td><td>{{if .LastRun.IsZero}}-{{else}}{{duration .LastDuration}}{{end}}</td><td>{{time .LastSuccess}}</td><td>{{.Cycles}}</td><td>{{.Failures}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+<h2>Schema</h2>
+<p>{{.Schema}}</p>
+<h2>Config</h2>
+<table border="1" cellpadding="4">
+{{range .Config}}<tr><th align="left">{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// status serves a human-readable page of the collectors, the schema version and the configuration
+func (r *reloader) status(w http.ResponseWriter, req *http.Request) {
+	_, cfg := r.current()
+	schema := "no database configured"
+	if len(cfg.DBURL) > 0 {
+		if version, latest, err := sqlmigrations.SchemaVersion(postgres.DB.WithTimeout(pingTimeout)); err != nil {
+			schema = err.Error()
+		} else {
+			schema = fmt.Sprintf("schema version is %d, latest migration is %d", version, latest)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, struct {
+		Started    time.Time
+		Now        time.Time
+		Collectors []collectorState
+		Schema     string
+		Config     [][2]string
+	}{r.started, time.Now(), r.collectorsStates(), schema, configSummary(cfg)}); err != nil {
+		log.WithError(err).Warn("Failed writing status page")
+	}
+}